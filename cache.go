@@ -0,0 +1,594 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CacheConfig is off unless Enabled, targets edited outside of
+// org-manager would otherwise be served stale for up to TTL.
+type CacheConfig struct {
+	Enabled bool
+	TTL     time.Duration
+	FileDSN string
+}
+
+var DefaultCacheTTL = 5 * time.Minute
+
+// CacheStore keeps JSON encoded snapshots, Delete drops every key under prefix.
+type CacheStore interface {
+	Get(key string, value any) bool
+	Set(key string, value any, ttl time.Duration) error
+	Delete(prefix string) error
+}
+
+// memoryCacheSweepInterval is how often Set of a memory store drops the
+// expired entries, which are otherwise only skipped by Get.
+var memoryCacheSweepInterval = time.Minute
+
+type memoryCacheStore struct {
+	mu        sync.RWMutex
+	items     map[string]cacheItem
+	nextSweep time.Time
+}
+
+func NewMemoryCacheStore() CacheStore {
+	return &memoryCacheStore{items: make(map[string]cacheItem)}
+}
+
+func (s *memoryCacheStore) Get(key string, value any) bool {
+	s.mu.RLock()
+	item, ok := s.items[key]
+	s.mu.RUnlock()
+	if !ok || time.Now().After(item.ExpiresAt) {
+		return false
+	}
+	return json.Unmarshal(item.Value, value) == nil
+}
+
+func (s *memoryCacheStore) Set(key string, value any, ttl time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		for key, item := range s.items {
+			if now.After(item.ExpiresAt) {
+				delete(s.items, key)
+			}
+		}
+		s.nextSweep = now.Add(memoryCacheSweepInterval)
+	}
+	s.items[key] = cacheItem{Key: key, Value: raw, ExpiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (s *memoryCacheStore) Delete(prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.items, key)
+		}
+	}
+	return nil
+}
+
+type cacheItem struct {
+	Key       string `gorm:"primaryKey;column:cache_key"`
+	Value     []byte
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+type sqliteCacheStore struct {
+	db *gorm.DB
+}
+
+func NewSqliteCacheStore(fileDSN string) (CacheStore, error) {
+	db, err := gorm.Open(sqlite.Open(fileDSN), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.AutoMigrate(&cacheItem{}); err != nil {
+		return nil, err
+	}
+	db.Where("expires_at < ?", time.Now()).Delete(&cacheItem{})
+	return &sqliteCacheStore{db: db}, nil
+}
+
+func (s *sqliteCacheStore) Get(key string, value any) bool {
+	item := new(cacheItem)
+	rf := s.db.Where("cache_key = ? AND expires_at > ?", key, time.Now()).Limit(1).Find(item).RowsAffected
+	if rf == 0 {
+		return false
+	}
+	return json.Unmarshal(item.Value, value) == nil
+}
+
+func (s *sqliteCacheStore) Set(key string, value any, ttl time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&cacheItem{Key: key, Value: raw, ExpiresAt: time.Now().Add(ttl)}).Error
+}
+
+func (s *sqliteCacheStore) Delete(prefix string) error {
+	return s.db.Where("cache_key LIKE ?", prefix+"%").Delete(&cacheItem{}).Error
+}
+
+type userSnapshot struct {
+	ID     string
+	Name   string
+	Email  string
+	Phone  string
+	Names  []string
+	Emails []string
+	Phones []string
+	Role   *DepartmentUserRole `json:",omitempty"`
+}
+
+func snapshotOfUser(user UserableEntry) userSnapshot {
+	snapshot := userSnapshot{
+		ID:     user.GetID(),
+		Name:   user.GetName(),
+		Email:  user.GetEmail(),
+		Phone:  user.GetPhone(),
+		Names:  GetUserableNames(user),
+		Emails: GetUserableEmails(user),
+		Phones: GetUserablePhones(user),
+	}
+	if withRole, ok := user.(UserableWithRole); ok {
+		role := withRole.GetRole()
+		snapshot.Role = &role
+	}
+	return snapshot
+}
+
+type departmentSnapshot struct {
+	ID   string
+	Name string
+}
+
+type cacheTarget struct {
+	Target
+	store  CacheStore
+	ttl    time.Duration
+	logger Logger
+
+	// departments keeps the live entries behind cached departments, so
+	// walking cached children does not look each of them up again.
+	mu          sync.Mutex
+	departments map[string]liveDepartment
+}
+
+type liveDepartment struct {
+	entry     DepartmentableEntry
+	expiresAt time.Time
+}
+
+// WithCache wraps target so directory reads are served from store until
+// ttl passes, writes made through the wrapper drop the entries they touch.
+// Failures of the store are logged to logger, reads then reach target.
+func WithCache(target Target, store CacheStore, ttl time.Duration, logger Logger) Target {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &cacheTarget{
+		Target:      target,
+		store:       store,
+		ttl:         ttl,
+		logger:      logger,
+		departments: make(map[string]liveDepartment),
+	}
+}
+
+func NewCacheStore(config CacheConfig) (CacheStore, error) {
+	if config.FileDSN != "" {
+		return NewSqliteCacheStore(config.FileDSN)
+	}
+	return NewMemoryCacheStore(), nil
+}
+
+func (t *cacheTarget) Unwrap() any {
+	return t.Target
+}
+
+func (t *cacheTarget) GetTarget() Target {
+	return t
+}
+
+// key joins parts under the target. User lists are all kept under "users",
+// the one of a department under "users" and its external identity, so a
+// write on a user drops them together.
+func (t *cacheTarget) key(parts ...string) string {
+	return strings.Join(append([]string{TargetKey(t)}, parts...), "|")
+}
+
+func (t *cacheTarget) invalidate(parts ...string) {
+	if len(parts) == 0 {
+		t.mu.Lock()
+		t.departments = make(map[string]liveDepartment)
+		t.mu.Unlock()
+	}
+	if err := t.store.Delete(t.key(parts...)); err != nil {
+		t.logger.WithError(err).WithField("key", t.key(parts...)).Warn("cache invalidate failed")
+	}
+}
+
+func (t *cacheTarget) remember(department DepartmentableEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.departments[department.GetID()] = liveDepartment{entry: department, expiresAt: time.Now().Add(t.ttl)}
+}
+
+func (t *cacheTarget) recall(id string) DepartmentableEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	live, ok := t.departments[id]
+	if !ok || time.Now().After(live.expiresAt) {
+		return nil
+	}
+	return live.entry
+}
+
+func readThrough[T any](t *cacheTarget, key string, load func() (T, error)) (value T, err error) {
+	if t.store.Get(key, &value) {
+		return value, nil
+	}
+	value, err = load()
+	if err == nil {
+		if err := t.store.Set(key, value, t.ttl); err != nil {
+			t.logger.WithError(err).WithField("key", key).Warn("cache write failed")
+		}
+	}
+	return value, err
+}
+
+// cachedUserOf implements UserableWithRole only for users that had a role
+// when they were cached.
+func (t *cacheTarget) cachedUserOf(snapshot userSnapshot, live UserableEntry) UserableEntry {
+	user := &cachedUser{target: t, snapshot: snapshot, live: live}
+	if snapshot.Role != nil {
+		return &cachedUserWithRole{cachedUser: user}
+	}
+	return user
+}
+
+func (t *cacheTarget) snapshotUsers(load func() ([]UserableEntry, error), parts ...string) (users []UserableEntry, err error) {
+	live := make(map[string]UserableEntry)
+	snapshots, err := readThrough(t, t.key(parts...), func() (snapshots []userSnapshot, err error) {
+		users, err := load()
+		for _, user := range users {
+			live[user.GetID()] = user
+			snapshots = append(snapshots, snapshotOfUser(user))
+		}
+		return snapshots, err
+	})
+	for _, snapshot := range snapshots {
+		users = append(users, t.cachedUserOf(snapshot, live[snapshot.ID]))
+	}
+	return users, err
+}
+
+func (t *cacheTarget) wrapDepartment(department DepartmentableEntry, root bool) *cachedDepartment {
+	t.remember(department)
+	return &cachedDepartment{
+		target:   t,
+		snapshot: departmentSnapshot{ID: department.GetID()},
+		live:     department,
+		root:     root,
+	}
+}
+
+func (t *cacheTarget) GetRootDepartment() (DepartmentableEntry, error) {
+	department, err := t.Target.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	return t.wrapDepartment(department, true), nil
+}
+
+func (t *cacheTarget) GetAllUsers() ([]UserableEntry, error) {
+	return t.GetAllUsersContext(context.Background())
+}
+
+func (t *cacheTarget) GetAllUsersContext(ctx context.Context) ([]UserableEntry, error) {
+	return t.snapshotUsers(func() ([]UserableEntry, error) {
+		return GetAllUsersContext(ctx, t.Target)
+	}, "users")
+}
+
+func (t *cacheTarget) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	var live UserableEntry
+	snapshot, err := readThrough(t, t.key(string(internalExtID)), func() (userSnapshot, error) {
+		user, err := t.Target.LookupEntryUserByInternalExternalIdentity(internalExtID)
+		if err != nil {
+			return userSnapshot{}, err
+		}
+		live = user
+		return snapshotOfUser(user), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.cachedUserOf(snapshot, live), nil
+}
+
+func (t *cacheTarget) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	var live DepartmentableEntry
+	snapshot, err := readThrough(t, t.key(string(internalExtID)), func() (departmentSnapshot, error) {
+		department, err := t.Target.LookupEntryDepartmentByInternalExternalIdentity(internalExtID)
+		if err != nil {
+			return departmentSnapshot{}, err
+		}
+		live = department
+		return departmentSnapshot{ID: department.GetID(), Name: department.GetName()}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if live != nil {
+		t.remember(live)
+	}
+	return &cachedDepartment{target: t, snapshot: snapshot, live: live}, nil
+}
+
+// Around drops every entry after writes on optional interfaces of target,
+// a user or department may be cached under the users and children of any
+// department.
+func (t *cacheTarget) Around(call Call, fn func() error) error {
+	if call.Write {
+		defer t.invalidate()
+	}
+	return fn()
+}
+
+// Invalidate drops what the caches around v hold, for callers that learn
+// of changes made outside of them.
+func Invalidate(v any) {
+	for inner := v; ; {
+		if cache, ok := inner.(*cacheTarget); ok {
+			cache.invalidate()
+		}
+		wrapper, ok := inner.(Unwrapper)
+		if !ok {
+			return
+		}
+		inner = wrapper.Unwrap()
+	}
+}
+
+type cachedUser struct {
+	target   *cacheTarget
+	snapshot userSnapshot
+	live     UserableEntry
+}
+
+// Unwrap resolves the live entry, which costs one lookup for users
+// restored from the store.
+func (u *cachedUser) Unwrap() any {
+	if u.live == nil {
+		live, err := u.target.Target.LookupEntryUserByInternalExternalIdentity(u.extID())
+		if err != nil {
+			u.target.logger.WithError(err).WithField("extID", u.extID()).Warn("cached user lookup failed")
+			return nil
+		}
+		u.live = live
+	}
+	return u.live
+}
+
+func (u *cachedUser) extID() ExternalIdentity {
+	return ExternalIdentityOfUser(u.target, u)
+}
+
+func (u *cachedUser) GetID() string {
+	return u.snapshot.ID
+}
+
+func (u *cachedUser) GetTarget() Target {
+	return u.target
+}
+
+func (u *cachedUser) GetTargetSlug() string {
+	return u.target.GetTargetSlug()
+}
+
+func (u *cachedUser) GetPlatform() string {
+	return u.target.GetPlatform()
+}
+
+func (u *cachedUser) GetName() string {
+	return u.snapshot.Name
+}
+
+func (u *cachedUser) GetNames() []string {
+	return u.snapshot.Names
+}
+
+func (u *cachedUser) GetEmail() string {
+	return u.snapshot.Email
+}
+
+func (u *cachedUser) GetEmails() []string {
+	return u.snapshot.Emails
+}
+
+func (u *cachedUser) GetPhone() string {
+	return u.snapshot.Phone
+}
+
+func (u *cachedUser) GetPhones() []string {
+	return u.snapshot.Phones
+}
+
+type cachedUserWithRole struct {
+	*cachedUser
+}
+
+func (u *cachedUserWithRole) GetRole() DepartmentUserRole {
+	return *u.snapshot.Role
+}
+
+// Around drops the user and every user list after writes, the user may be
+// listed by any department.
+func (u *cachedUser) Around(call Call, fn func() error) error {
+	if call.Write {
+		defer u.target.invalidate(string(u.extID()))
+		defer u.target.invalidate("users")
+	}
+	return fn()
+}
+
+type cachedDepartment struct {
+	target   *cacheTarget
+	snapshot departmentSnapshot
+	live     DepartmentableEntry
+	root     bool
+}
+
+func (d *cachedDepartment) Unwrap() any {
+	if d.live == nil {
+		d.live = d.target.recall(d.snapshot.ID)
+	}
+	if d.live == nil {
+		var live DepartmentableEntry
+		var err error
+		if d.root {
+			live, err = d.target.Target.GetRootDepartment()
+		} else {
+			live, err = d.target.Target.LookupEntryDepartmentByInternalExternalIdentity(d.extID())
+		}
+		if err != nil {
+			d.target.logger.WithError(err).WithField("extID", d.extID()).Warn("cached department lookup failed")
+			return nil
+		}
+		d.live = live
+		d.target.remember(live)
+	}
+	return d.live
+}
+
+func (d *cachedDepartment) liveDepartment() (DepartmentableEntry, error) {
+	if department, ok := d.Unwrap().(DepartmentableEntry); ok && department != nil {
+		return department, nil
+	}
+	return nil, notSupported(d.target, "resolve department "+d.snapshot.ID)
+}
+
+func (d *cachedDepartment) extID() ExternalIdentity {
+	return ExternalIdentityOfDepartment(d.target, d)
+}
+
+func (d *cachedDepartment) GetID() string {
+	return d.snapshot.ID
+}
+
+func (d *cachedDepartment) GetTarget() Target {
+	return d.target
+}
+
+func (d *cachedDepartment) GetTargetSlug() string {
+	return d.target.GetTargetSlug()
+}
+
+func (d *cachedDepartment) GetPlatform() string {
+	return d.target.GetPlatform()
+}
+
+func (d *cachedDepartment) GetName() string {
+	if d.snapshot.Name != "" {
+		return d.snapshot.Name
+	}
+	name, err := readThrough(d.target, d.target.key(string(d.extID()), "name"), func() (string, error) {
+		department, err := d.liveDepartment()
+		if err != nil {
+			return "", err
+		}
+		return department.GetName(), nil
+	})
+	if err != nil {
+		d.target.logger.WithError(err).WithField("extID", d.extID()).Warn("cached department name failed")
+	}
+	d.snapshot.Name = name
+	return name
+}
+
+func (d *cachedDepartment) GetDescription() string {
+	description, err := readThrough(d.target, d.target.key(string(d.extID()), "description"), func() (string, error) {
+		department, err := d.liveDepartment()
+		if err != nil {
+			return "", err
+		}
+		return department.GetDescription(), nil
+	})
+	if err != nil {
+		d.target.logger.WithError(err).WithField("extID", d.extID()).Warn("cached department description failed")
+	}
+	return description
+}
+
+// GetChildDepartments keeps the live children next to their snapshots,
+// the children are only looked up one by one once they left memory.
+func (d *cachedDepartment) GetChildDepartments() (departments []DepartmentableEntry) {
+	snapshots, err := readThrough(d.target, d.target.key(string(d.extID()), "children"), func() (snapshots []departmentSnapshot, err error) {
+		department, err := d.liveDepartment()
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range department.GetChildDepartments() {
+			d.target.remember(child)
+			snapshots = append(snapshots, departmentSnapshot{ID: child.GetID(), Name: child.GetName()})
+		}
+		return snapshots, nil
+	})
+	if err != nil {
+		d.target.logger.WithError(err).WithField("extID", d.extID()).Warn("cached children failed")
+	}
+	for _, snapshot := range snapshots {
+		departments = append(departments, &cachedDepartment{target: d.target, snapshot: snapshot, live: d.target.recall(snapshot.ID)})
+	}
+	return departments
+}
+
+func (d *cachedDepartment) CreateChildDepartment(departmentable Departmentable) (DepartmentableEntry, error) {
+	department, err := d.liveDepartment()
+	if err != nil {
+		return nil, err
+	}
+	defer d.target.invalidate(string(d.extID()), "children")
+	child, err := department.CreateChildDepartment(departmentable)
+	if err != nil {
+		return nil, err
+	}
+	return d.target.wrapDepartment(child, false), nil
+}
+
+func (d *cachedDepartment) GetUsers() (users []UserableEntry, err error) {
+	return d.target.snapshotUsers(func() ([]UserableEntry, error) {
+		department, err := d.liveDepartment()
+		if err != nil {
+			return nil, err
+		}
+		return department.GetUsers()
+	}, "users", string(d.extID()))
+}
+
+func (d *cachedDepartment) Around(call Call, fn func() error) error {
+	if call.Write {
+		defer d.target.invalidate("users", string(d.extID()))
+	}
+	return fn()
+}
@@ -0,0 +1,89 @@
+package manager
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDecorateTargetCachesOnlyWhenEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		cached bool
+	}{
+		{`{}`, false},
+		{`{"Cache":{"TTL":60000000000}}`, false},
+		{`{"Cache":{"Enabled":true}}`, true},
+	} {
+		target, err := decorateTarget(openTestLocal(t), func(v any) error { return json.Unmarshal([]byte(tc.config), v) }, Log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, cached := target.(*cacheTarget); cached != tc.cached {
+			t.Errorf("%s: cached %v, want %v", tc.config, cached, tc.cached)
+		}
+	}
+}
+
+func TestCachedUserWriteDropsDepartmentUserLists(t *testing.T) {
+	l := openTestLocal(t)
+	eng := tree(t, l, "eng")["eng"]
+	ann, err := l.CreateUser(&User{Name: "ann", Email: "ann@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	annID := ExternalIdentityOfUser(l, ann)
+	if err := eng.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, annID); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := WithCache(l, NewMemoryCacheStore(), time.Hour, Log)
+	root, _ := cache.GetRootDepartment()
+	cachedEng := root.GetChildDepartments()[0]
+	names := func() (names []string) {
+		users, err := cachedEng.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range users {
+			names = append(names, user.GetName())
+		}
+		return names
+	}
+	if got := names(); len(got) != 1 || got[0] != "ann" {
+		t.Fatalf("got users %v", got)
+	}
+	users, _ := cachedEng.GetUsers()
+	err = Do(users[0], Call{Operation: "update_user", Write: true}, func() error {
+		_, err := l.UpdateUser(annID, &User{Name: "anne", Email: "ann@example.com"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); len(got) != 1 || got[0] != "anne" {
+		t.Errorf("got users %v after renaming ann, want anne", got)
+	}
+}
+
+func TestMemoryCacheStoreSweepsExpiredEntries(t *testing.T) {
+	defer func(interval time.Duration) { memoryCacheSweepInterval = interval }(memoryCacheSweepInterval)
+	memoryCacheSweepInterval = 0
+	store := NewMemoryCacheStore().(*memoryCacheStore)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Set(key, key, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := store.Set("d", "d", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.items) != 1 {
+		t.Errorf("kept %d entries, want only d", len(store.items))
+	}
+	var value string
+	if !store.Get("d", &value) || value != "d" {
+		t.Errorf("got %q, want d", value)
+	}
+}
@@ -0,0 +1,84 @@
+package manager
+
+import "errors"
+
+type EntryChangeType string
+
+const (
+	// EntryChangeUpsert is an entry created or updated.
+	EntryChangeUpsert       EntryChangeType = "upsert"
+	EntryChangeDelete       EntryChangeType = "delete"
+	EntryChangeMemberAdd    EntryChangeType = "member_add"
+	EntryChangeMemberRemove EntryChangeType = "member_remove"
+)
+
+// EntryChange is a change of a user or department, for membership changes
+// ExtID is the department and Member the user.
+type EntryChange struct {
+	Type   EntryChangeType  `json:"type"`
+	ExtID  ExternalIdentity `json:"extID"`
+	Name   string           `json:"name,omitempty"`
+	Member ExternalIdentity `json:"member,omitempty"`
+}
+
+// ErrChangesExpired is returned for tokens the target no longer resumes
+// from, tracking has to start over.
+var ErrChangesExpired = errors.New("change tracking token expired")
+
+// TargetWithChanges reports changes without listing every entry again.
+type TargetWithChanges interface {
+	// ChangesSince lists the changes since token and returns the token the
+	// next call resumes from. The empty token starts tracking from now and
+	// has no changes.
+	ChangesSince(token string) (changes []EntryChange, next string, err error)
+}
+
+var _ = []DeltaTokenStore{
+	&local{},
+}
+
+// DeltaTokenStore keeps the tokens of TargetWithChanges between runs.
+type DeltaTokenStore interface {
+	// GetDeltaToken returns the empty token when key has none.
+	GetDeltaToken(key string) (string, error)
+	SetDeltaToken(key, token string) error
+}
+
+// TrackChanges hands the changes of target since the token stored under key
+// to handle, the next token is only stored once handle succeeds. Every
+// consumer of the changes of target needs its own key, a consumer storing
+// its token would hide the changes from the others. Without a token, or with
+// an expired one, tracking starts over and handle gets baseline true, the
+// caller has to compare everything once.
+func TrackChanges(target Target, store DeltaTokenStore, key string, handle func(changes []EntryChange, baseline bool) error) error {
+	tracker, ok := As[TargetWithChanges](target)
+	if !ok {
+		return notSupported(target, "track changes")
+	}
+	token, err := store.GetDeltaToken(key)
+	if err != nil {
+		return err
+	}
+	var changes []EntryChange
+	var next string
+	changesSince := func() (err error) {
+		changes, next, err = tracker.ChangesSince(token)
+		return err
+	}
+	err = Do(target, Call{Operation: "changes_since"}, changesSince)
+	if errors.Is(err, ErrChangesExpired) {
+		token = ""
+		err = Do(target, Call{Operation: "changes_since"}, changesSince)
+	}
+	if err != nil {
+		return err
+	}
+	// any change makes what was cached of target stale
+	if len(changes) != 0 {
+		Invalidate(target)
+	}
+	if err := handle(changes, token == ""); err != nil {
+		return err
+	}
+	return store.SetDeltaToken(key, next)
+}
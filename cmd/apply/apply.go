@@ -0,0 +1,69 @@
+package apply
+
+import (
+	"fmt"
+
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/base"
+	"github.com/spf13/cobra"
+)
+
+var (
+	file      string
+	targetKey string
+	prune     bool
+	dryRun    bool
+)
+
+func init() {
+	Cmd.Flags().StringVarP(&file, "file", "f", "", "desired state yaml, e.g. org.yaml")
+	Cmd.Flags().StringVarP(&targetKey, "target", "t", "", "target key to apply to, e.g. main@github")
+	Cmd.Flags().BoolVar(&prune, "prune", false, "remove members not declared in the file")
+	Cmd.Flags().BoolVar(&dryRun, "dry-run", false, "only print the changes")
+	cobra.CheckErr(Cmd.MarkFlagRequired("file"))
+}
+
+var Cmd = &cobra.Command{
+	Use:   "apply",
+	Short: "apply a desired state yaml of depts and members to a target",
+	Run: func(cmd *cobra.Command, args []string) {
+		state, err := manager.LoadDesiredState(file)
+		cobra.CheckErr(err)
+		target := base.TargetByKeyOrSelect(targetKey)
+		root, err := target.GetRootDepartment()
+		cobra.CheckErr(err)
+		plan, err := manager.PlanDesiredState(root, state)
+		cobra.CheckErr(err)
+
+		var applied, skipped, failed int
+		for _, change := range plan.Changes {
+			switch {
+			case change.Action == manager.ChangeUnmanagedDepartment:
+				fmt.Println(change)
+				continue
+			case change.Action == manager.ChangeRemoveMember && !prune:
+				fmt.Println(change, "skipped, use --prune")
+				skipped++
+				continue
+			case dryRun:
+				fmt.Println(change)
+				continue
+			}
+			if err := plan.Apply(change); err != nil {
+				fmt.Println(change, "failed:", err)
+				failed++
+				continue
+			}
+			fmt.Println(change)
+			applied++
+		}
+		if dryRun {
+			fmt.Println("Dry run, nothing applied")
+			return
+		}
+		fmt.Println("Applied", applied, "Skipped", skipped, "Failed", failed)
+		if failed != 0 {
+			cobra.CheckErr(fmt.Errorf("%d changes failed", failed))
+		}
+	},
+}
@@ -26,6 +26,20 @@ func SelectTarget(exc ...string) (manager.Target, string) {
 	return manager.Targets[target], target
 }
 
+// TargetByKeyOrSelect returns the target of key, or prompts for one when
+// key is empty.
+func TargetByKeyOrSelect(key string) manager.Target {
+	if key == "" {
+		target, _ := SelectTarget()
+		return target
+	}
+	target, ok := manager.Targets[key]
+	if !ok {
+		cobra.CheckErr(fmt.Errorf("target %s not found", key))
+	}
+	return target
+}
+
 func InputStringWithHint(hint string) string {
 	fmt.Printf("%s: ", hint)
 	return InputString()
@@ -70,7 +70,7 @@ var infoCmd = &cobra.Command{
 		fmt.Println(dept.GetID(), dept.GetName())
 		fmt.Println(manager.ExternalIdentityOfDepartment(target, dept))
 
-		if entryCenter, ok := target.(manager.EntryCenter); ok {
+		if entryCenter, ok := manager.As[manager.EntryCenter](target); ok {
 			dept, err := entryCenter.LookupEntryDepartmentByExternalIdentity(extID)
 			cobra.CheckErr(err)
 			for _, extID := range dept.GetExternalIdentities() {
@@ -107,7 +107,7 @@ var linkCmd = &cobra.Command{
 		_, err = target.LookupEntryDepartmentByInternalExternalIdentity(extIDNeedLink)
 		cobra.CheckErr(err)
 
-		if entryCenter, ok := targetShouldBeEntryCenter.(manager.EntryCenter); ok {
+		if entryCenter, ok := manager.As[manager.EntryCenter](targetShouldBeEntryCenter); ok {
 			dept, err := entryCenter.LookupEntryDepartmentByExternalIdentity(extIDNeedLink)
 			if err != nil {
 				fmt.Println(err)
@@ -123,10 +123,16 @@ var linkCmd = &cobra.Command{
 
 		dept, err := targetShouldBeEntryCenter.LookupEntryDepartmentByInternalExternalIdentity(extIDLinkTo)
 		cobra.CheckErr(err)
-		deptExtIDStoreable := dept.(manager.EntryExtIDStoreable)
+		deptExtIDStoreable, ok := manager.As[manager.EntryExtIDStoreable](dept)
+		if !ok {
+			fmt.Println(targetShouldBeEntryCenter.GetPlatform(), "cannot store extIDs")
+			return
+		}
 		alreadyExtIDs := deptExtIDStoreable.GetExternalIdentities()
 		fmt.Println(alreadyExtIDs)
-		err = deptExtIDStoreable.SetExternalIdentities(append(alreadyExtIDs, extIDNeedLink))
+		err = manager.Do(dept, manager.Call{Operation: "set_external_identities", Write: true, Idempotent: true}, func() error {
+			return deptExtIDStoreable.SetExternalIdentities(append(alreadyExtIDs, extIDNeedLink))
+		})
 		cobra.CheckErr(err)
 	},
 }
@@ -0,0 +1,104 @@
+package drift
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/base"
+	"github.com/spf13/cobra"
+)
+
+// exitCodeDrift tells drift apart from errors, which exit with 1.
+const exitCodeDrift = 2
+
+var (
+	centerKeys []string
+	file       string
+	targetKey  string
+	format     string
+)
+
+func init() {
+	Cmd.Flags().StringSliceVar(&centerKeys, "center", nil, "EntryCenter target keys to check links of, all EntryCenters by default")
+	Cmd.Flags().StringVarP(&file, "file", "f", "", "desired state yaml to also check --target against")
+	Cmd.Flags().StringVarP(&targetKey, "target", "t", "", "target key the desired state file describes")
+	Cmd.Flags().StringVar(&format, "format", "json", "report format: json or text")
+}
+
+var Cmd = &cobra.Command{
+	Use:   "drift",
+	Short: "report drift of linked depts and of a desired state file",
+	Long: `Compare every dept of the EntryCenters with the depts linked to it and,
+with --file, a target against a desired state file. Exits with 2 when
+drift is found, so it can gate CI or alerting.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if format != "json" && format != "text" {
+			cobra.CheckErr(fmt.Errorf("unknown format %s", format))
+		}
+		report := report{GeneratedAt: time.Now().UTC(), Drifts: make([]manager.Drift, 0)}
+		for _, key := range selectCenters() {
+			root, err := manager.Targets[key].GetRootDepartment()
+			cobra.CheckErr(err)
+			drifts, pairs, err := manager.DetectLinkDrift(root)
+			cobra.CheckErr(err)
+			report.Centers = append(report.Centers, key)
+			report.LinkedPairs += pairs
+			report.Drifts = append(report.Drifts, drifts...)
+		}
+		if file != "" {
+			state, err := manager.LoadDesiredState(file)
+			cobra.CheckErr(err)
+			root, err := base.TargetByKeyOrSelect(targetKey).GetRootDepartment()
+			cobra.CheckErr(err)
+			plan, err := manager.PlanDesiredState(root, state)
+			cobra.CheckErr(err)
+			report.DesiredState = file
+			report.Drifts = append(report.Drifts, manager.DriftOfPlan(plan)...)
+		}
+
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			cobra.CheckErr(encoder.Encode(report))
+		} else {
+			for _, drift := range report.Drifts {
+				fmt.Println(drift)
+			}
+			fmt.Println("Linked pairs", report.LinkedPairs, "Drifts", len(report.Drifts))
+		}
+		if len(report.Drifts) != 0 {
+			os.Exit(exitCodeDrift)
+		}
+	},
+}
+
+type report struct {
+	GeneratedAt  time.Time       `json:"generatedAt"`
+	Centers      []string        `json:"centers,omitempty"`
+	LinkedPairs  int             `json:"linkedPairs"`
+	DesiredState string          `json:"desiredState,omitempty"`
+	Drifts       []manager.Drift `json:"drifts"`
+}
+
+func selectCenters() []string {
+	if len(centerKeys) != 0 {
+		for _, key := range centerKeys {
+			if _, ok := manager.As[manager.EntryCenter](manager.Targets[key]); !ok {
+				cobra.CheckErr(fmt.Errorf("target %s not found or not EntryCenter", key))
+			}
+		}
+		return centerKeys
+	}
+	var keys []string
+	for key, target := range manager.Targets {
+		if _, ok := manager.As[manager.EntryCenter](target); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/org-tools/manager"
+	"gopkg.in/yaml.v3"
+)
+
+type encoder func(w io.Writer, tree *manager.TreeDepartment) error
+
+var encoders = map[string]encoder{
+	"json":    encodeJSON,
+	"yaml":    encodeYAML,
+	"csv":     encodeCSV,
+	"dot":     encodeDOT,
+	"mermaid": encodeMermaid,
+}
+
+func encodeJSON(w io.Writer, tree *manager.TreeDepartment) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(tree)
+}
+
+func encodeYAML(w io.Writer, tree *manager.TreeDepartment) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(tree); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// encodeCSV writes a dept row for every department followed by a user row
+// for each of its members, path is the department path from the export root.
+func encodeCSV(w io.Writer, tree *manager.TreeDepartment) error {
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"type", "path", "extID", "name", "description", "email", "phone", "role"})
+	tree.Walk(func(path []string, department *manager.TreeDepartment) {
+		joined := strings.Join(path, "/")
+		_ = writer.Write([]string{"dept", joined, string(department.ExtID), department.Name, department.Description, "", "", ""})
+		for _, user := range department.Users {
+			_ = writer.Write([]string{"user", joined, string(user.ExtID), user.Name, "", user.Email, user.Phone, user.Role})
+		}
+	})
+	writer.Flush()
+	return writer.Error()
+}
+
+func encodeDOT(w io.Writer, tree *manager.TreeDepartment) error {
+	var b strings.Builder
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+	declared := make(map[manager.ExternalIdentity]bool)
+	b.WriteString("digraph org {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	tree.Walk(func(path []string, department *manager.TreeDepartment) {
+		fmt.Fprintf(&b, "\t%s [label=%s];\n", quote(string(department.ExtID)), quote(department.Name))
+		for _, child := range department.Children {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", quote(string(department.ExtID)), quote(string(child.ExtID)))
+		}
+		for _, user := range department.Users {
+			if !declared[user.ExtID] {
+				declared[user.ExtID] = true
+				fmt.Fprintf(&b, "\t%s [label=%s, shape=ellipse];\n", quote(string(user.ExtID)), quote(user.Name))
+			}
+			if user.Role != "" && user.Role != manager.DepartmentUserRoleMember.String() {
+				fmt.Fprintf(&b, "\t%s -> %s [label=%s];\n", quote(string(department.ExtID)), quote(string(user.ExtID)), quote(user.Role))
+			} else {
+				fmt.Fprintf(&b, "\t%s -> %s;\n", quote(string(department.ExtID)), quote(string(user.ExtID)))
+			}
+		}
+	})
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// encodeMermaid numbers nodes in walk order, extIDs are not valid mermaid ids.
+func encodeMermaid(w io.Writer, tree *manager.TreeDepartment) error {
+	var b strings.Builder
+	label := func(s string) string {
+		return `"` + strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s) + `"`
+	}
+	ids := make(map[manager.ExternalIdentity]string)
+	id := func(extID manager.ExternalIdentity, prefix string) (string, bool) {
+		if nodeID, ok := ids[extID]; ok {
+			return nodeID, false
+		}
+		ids[extID] = fmt.Sprintf("%s%d", prefix, len(ids))
+		return ids[extID], true
+	}
+	b.WriteString("graph LR\n")
+	tree.Walk(func(path []string, department *manager.TreeDepartment) {
+		deptID, _ := id(department.ExtID, "d")
+		fmt.Fprintf(&b, "\t%s[%s]\n", deptID, label(department.Name))
+		for _, child := range department.Children {
+			childID, _ := id(child.ExtID, "d")
+			fmt.Fprintf(&b, "\t%s --> %s\n", deptID, childID)
+		}
+		for _, user := range department.Users {
+			userID, isNew := id(user.ExtID, "u")
+			if isNew {
+				fmt.Fprintf(&b, "\t%s([%s])\n", userID, label(user.Name))
+			}
+			if user.Role != "" && user.Role != manager.DepartmentUserRoleMember.String() {
+				fmt.Fprintf(&b, "\t%s -->|%s| %s\n", deptID, user.Role, userID)
+			} else {
+				fmt.Fprintf(&b, "\t%s --> %s\n", deptID, userID)
+			}
+		}
+	})
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,111 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/org-tools/manager"
+	"gopkg.in/yaml.v3"
+)
+
+// exportTree has Ann in two departments, admin of one, and names that
+// need quoting in every format.
+func exportTree() *manager.TreeDepartment {
+	ann := manager.TreeUser{ExtID: "ei.user.1@hub.local", Name: "Ann", Email: "ann@example.com", Role: "admin"}
+	bob := manager.TreeUser{ExtID: "ei.user.2@hub.local", Name: `Bob "B"`, Phone: "+1 555 0100", Role: "member"}
+	return &manager.TreeDepartment{
+		ExtID: "ei.dept.r@hub.local",
+		Name:  "Acme",
+		Children: []*manager.TreeDepartment{
+			{ExtID: "ei.dept.e@hub.local", Name: "Eng, R&D", Description: "builds\nthings", Users: []manager.TreeUser{ann, bob}},
+			{ExtID: "ei.dept.s@hub.local", Name: "Sales", Users: []manager.TreeUser{{ExtID: ann.ExtID, Name: ann.Name, Email: ann.Email}}},
+		},
+	}
+}
+
+func encode(t *testing.T, format string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := encoders[format](&out, exportTree()); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestEncodersRoundTrip(t *testing.T) {
+	for format, unmarshal := range map[string]func([]byte, any) error{"json": json.Unmarshal, "yaml": yaml.Unmarshal} {
+		got := new(manager.TreeDepartment)
+		if err := unmarshal([]byte(encode(t, format)), got); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, exportTree()) {
+			t.Errorf("%s: decoded %+v", format, got)
+		}
+	}
+}
+
+func TestEncodeCSV(t *testing.T) {
+	want := `type,path,extID,name,description,email,phone,role
+dept,Acme,ei.dept.r@hub.local,Acme,,,,
+dept,"Acme/Eng, R&D",ei.dept.e@hub.local,"Eng, R&D","builds
+things",,,
+user,"Acme/Eng, R&D",ei.user.1@hub.local,Ann,,ann@example.com,,admin
+user,"Acme/Eng, R&D",ei.user.2@hub.local,"Bob ""B""",,,+1 555 0100,member
+dept,Acme/Sales,ei.dept.s@hub.local,Sales,,,,
+user,Acme/Sales,ei.user.1@hub.local,Ann,,ann@example.com,,
+`
+	if got := encode(t, "csv"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEncodeDOT(t *testing.T) {
+	want := `digraph org {
+	rankdir=LR;
+	node [shape=box];
+	"ei.dept.r@hub.local" [label="Acme"];
+	"ei.dept.r@hub.local" -> "ei.dept.e@hub.local";
+	"ei.dept.r@hub.local" -> "ei.dept.s@hub.local";
+	"ei.dept.e@hub.local" [label="Eng, R&D"];
+	"ei.user.1@hub.local" [label="Ann", shape=ellipse];
+	"ei.dept.e@hub.local" -> "ei.user.1@hub.local" [label="admin"];
+	"ei.user.2@hub.local" [label="Bob \"B\"", shape=ellipse];
+	"ei.dept.e@hub.local" -> "ei.user.2@hub.local";
+	"ei.dept.s@hub.local" [label="Sales"];
+	"ei.dept.s@hub.local" -> "ei.user.1@hub.local";
+}
+`
+	if got := encode(t, "dot"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEncodeMermaid(t *testing.T) {
+	want := `graph LR
+	d0["Acme"]
+	d0 --> d1
+	d0 --> d2
+	d1["Eng, R&D"]
+	u3(["Ann"])
+	d1 -->|admin| u3
+	u4(["Bob #quot;B#quot;"])
+	d1 --> u4
+	d2["Sales"]
+	d2 --> u3
+`
+	if got := encode(t, "mermaid"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEncodersCoverTheFormatFlag(t *testing.T) {
+	usage := Cmd.Flags().Lookup("format").Usage
+	for format := range encoders {
+		if !strings.Contains(usage, format) {
+			t.Errorf("--format does not mention %s", format)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/base"
+	"github.com/spf13/cobra"
+)
+
+var (
+	targetKey    string
+	format       string
+	rootExtID    string
+	output       string
+	withoutUsers bool
+)
+
+func init() {
+	Cmd.Flags().StringVarP(&targetKey, "target", "t", "", "target key to export, e.g. main@feishu")
+	Cmd.Flags().StringVarP(&format, "format", "f", "json", "output format: json, yaml, csv, dot or mermaid")
+	Cmd.Flags().StringVar(&rootExtID, "root", "", "extID of the dept to export instead of the root dept")
+	Cmd.Flags().StringVarP(&output, "output", "o", "", "file to write, stdout by default")
+	Cmd.Flags().BoolVar(&withoutUsers, "without-users", false, "only export depts")
+}
+
+var Cmd = &cobra.Command{
+	Use:   "export",
+	Short: "export org tree as json, yaml, csv, dot or mermaid",
+	Run: func(cmd *cobra.Command, args []string) {
+		encode, ok := encoders[format]
+		if !ok {
+			cobra.CheckErr(fmt.Errorf("unknown format %s", format))
+		}
+		root := exportRoot()
+		tree, err := manager.SnapshotTree(root)
+		cobra.CheckErr(err)
+		if withoutUsers {
+			tree.Walk(func(path []string, department *manager.TreeDepartment) {
+				department.Users = nil
+			})
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			cobra.CheckErr(err)
+			defer f.Close()
+			w = f
+		}
+		cobra.CheckErr(encode(w, tree))
+	},
+}
+
+func exportRoot() manager.DepartmentableEntry {
+	if rootExtID == "" {
+		root, err := base.TargetByKeyOrSelect(targetKey).GetRootDepartment()
+		cobra.CheckErr(err)
+		return root
+	}
+	extID, err := manager.ExternalIdentityParseString(rootExtID)
+	cobra.CheckErr(err)
+	if extID.GetEntryType() != manager.EntryTypeDept {
+		cobra.CheckErr(fmt.Errorf("extID %s not type dept", extID))
+	}
+	var target manager.Target
+	if targetKey != "" {
+		target = base.TargetByKeyOrSelect(targetKey)
+	} else {
+		target, err = manager.GetTargetByPlatformAndSlug(extID.GetPlatform(), extID.GetTargetSlug())
+		cobra.CheckErr(err)
+	}
+	cobra.CheckErr(extID.CheckIfInternal(target))
+	root, err := target.LookupEntryDepartmentByInternalExternalIdentity(extID)
+	cobra.CheckErr(err)
+	return root
+}
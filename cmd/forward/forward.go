@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"fmt"
+
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/base"
+	"github.com/spf13/cobra"
+)
+
+var (
+	centerKey string
+	targetKey string
+	dryRun    bool
+	maxDelete float64
+)
+
+func init() {
+	Cmd.PersistentFlags().StringVarP(&targetKey, "target", "t", "", "target key keeping the forwards, e.g. main@cloudflare")
+	reconcileCmd.Flags().StringVar(&centerKey, "center", "", "EntryCenter target key the users come from")
+	reconcileCmd.Flags().BoolVar(&dryRun, "dry-run", true, "only count the changes, --dry-run=false applies them")
+	reconcileCmd.Flags().Float64Var(&maxDelete, "max-delete-ratio", manager.DefaultMaxEmailForwardDeleteRatio, "share of the current forwards one run may delete, 1 lifts the cap")
+	Cmd.AddCommand(listCmd, reconcileCmd)
+}
+
+var Cmd = &cobra.Command{
+	Use:   "forward",
+	Short: "email forwards of enterprise addresses",
+}
+
+func forwardingTarget() (manager.Target, manager.TargetWithEmailForwarding) {
+	target := base.TargetByKeyOrSelect(targetKey)
+	forwarding, ok := manager.As[manager.TargetWithEmailForwarding](target)
+	if !ok {
+		cobra.CheckErr("target should keep email forwards")
+	}
+	return target, forwarding
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the forwards a target keeps",
+	Run: func(cmd *cobra.Command, args []string) {
+		target, forwarding := forwardingTarget()
+		var forwards []manager.EmailForward
+		err := manager.Do(target, manager.Call{Operation: "get_email_forwards"}, func() (err error) {
+			forwards, err = forwarding.GetEmailForwards()
+			return err
+		})
+		cobra.CheckErr(err)
+		for _, forward := range forwards {
+			fmt.Println(forward.Address, "->", forward.Destination, forward.Name)
+		}
+	},
+}
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "forward enterprise addresses of center users and remove forwards of offboarded ones",
+	Run: func(cmd *cobra.Command, args []string) {
+		target, _ := forwardingTarget()
+		center := base.TargetByKeyOrSelect(centerKey)
+		if _, ok := manager.As[manager.EntryCenter](center); !ok {
+			cobra.CheckErr("center should be EntryCenter")
+		}
+		result, err := manager.ReconcileEmailForwards(cmd.Context(), center, target, manager.ReconcileEmailForwardsOptions{
+			DryRun:         dryRun,
+			MaxDeleteRatio: maxDelete,
+		})
+		cobra.CheckErr(err)
+		fmt.Println("Users", result.Users, "Forwards", result.Forwards)
+		for _, err := range result.Errors {
+			fmt.Println(err)
+		}
+		if dryRun {
+			fmt.Println("Dry run, would create", result.Created, "update", result.Updated, "delete", result.Deleted)
+			fmt.Println("Run again with --dry-run=false to apply")
+			return
+		}
+		fmt.Println("Created", result.Created, "Updated", result.Updated, "Deleted", result.Deleted, "Unchanged", result.Unchanged)
+	},
+}
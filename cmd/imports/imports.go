@@ -0,0 +1,223 @@
+package imports
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/base"
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	file      string
+	sheet     string
+	targetKey string
+	mapping   map[string]string
+)
+
+func init() {
+	Cmd.PersistentFlags().StringVarP(&file, "file", "f", "", "csv or xlsx file to import")
+	Cmd.PersistentFlags().StringVar(&sheet, "sheet", "", "xlsx sheet name, the active sheet by default")
+	Cmd.PersistentFlags().StringVarP(&targetKey, "target", "t", "", "target key to import into, e.g. hub@local")
+	Cmd.PersistentFlags().StringToStringVar(&mapping, "map", nil, "column mapping as field=header, e.g. name=姓名,email=邮箱")
+	cobra.CheckErr(Cmd.MarkPersistentFlagRequired("file"))
+	Cmd.AddCommand(usersCmd, deptsCmd)
+}
+
+var Cmd = &cobra.Command{
+	Use:   "import",
+	Short: "bulk import users or depts from csv or xlsx",
+}
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "import users, columns: name, email, emails, phone, phones, departments, role",
+	Run: func(cmd *cobra.Command, args []string) {
+		target := base.TargetByKeyOrSelect(targetKey)
+		importer, ok := manager.As[manager.UserImporter](target)
+		if !ok {
+			fmt.Println(manager.TargetKey(target), "should be UserImporter")
+			return
+		}
+		t, err := readTable(file, sheet, mapping)
+		cobra.CheckErr(err)
+		if !t.hasColumn("name") {
+			cobra.CheckErr(errors.New("column name not found, map it with --map name=<header>"))
+		}
+		root, err := target.GetRootDepartment()
+		cobra.CheckErr(err)
+
+		var created, updated, failed int
+		for i, row := range t.rows {
+			user, paths, role, err := parseUserRow(t, row)
+			var isNew bool
+			if err == nil {
+				isNew, err = importUser(target, importer, root, user, paths, role)
+			}
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("row %d: %s\n", t.rowNumber(i), err)
+			case isNew:
+				created++
+			default:
+				updated++
+			}
+		}
+		fmt.Println("Created", created, "Updated", updated, "Failed", failed)
+		if failed != 0 {
+			cobra.CheckErr(fmt.Errorf("%d rows failed", failed))
+		}
+	},
+}
+
+var deptsCmd = &cobra.Command{
+	Use:   "depts",
+	Short: "import depts, columns: path, description",
+	Run: func(cmd *cobra.Command, args []string) {
+		target := base.TargetByKeyOrSelect(targetKey)
+		t, err := readTable(file, sheet, mapping)
+		cobra.CheckErr(err)
+		if !t.hasColumn("path") {
+			cobra.CheckErr(errors.New("column path not found, map it with --map path=<header>"))
+		}
+		root, err := target.GetRootDepartment()
+		cobra.CheckErr(err)
+
+		var created, existed, failed int
+		for i, row := range t.rows {
+			isNew, err := importDepartment(root, t.get(row, "path"), t.get(row, "description"))
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("row %d: %s\n", t.rowNumber(i), err)
+			case isNew:
+				created++
+			default:
+				existed++
+			}
+		}
+		fmt.Println("Created", created, "Existed", existed, "Failed", failed)
+		if failed != 0 {
+			cobra.CheckErr(fmt.Errorf("%d rows failed", failed))
+		}
+	},
+}
+
+type importUserRow struct {
+	manager.User
+	emails []string
+	phones []string
+}
+
+func (u importUserRow) GetEmails() []string {
+	return u.emails
+}
+
+func (u importUserRow) GetPhones() []string {
+	return u.phones
+}
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9][0-9 -]{4,19}$`)
+
+func splitList(value string) []string {
+	return lo.Compact(lo.Map(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ';' || r == '|' || r == '\n'
+	}), func(v string, _ int) string {
+		return strings.TrimSpace(v)
+	}))
+}
+
+func parseUserRow(t *table, row []string) (user importUserRow, paths []string, role manager.DepartmentUserRole, err error) {
+	user.Name = t.get(row, "name")
+	user.Email = t.get(row, "email")
+	user.Phone = t.get(row, "phone")
+	user.emails = splitList(t.get(row, "emails"))
+	user.phones = splitList(t.get(row, "phones"))
+	paths = splitList(t.get(row, "departments"))
+	if user.Name == "" {
+		return user, nil, role, errors.New("name is required")
+	}
+	for _, email := range append([]string{user.Email}, user.emails...) {
+		if email == "" {
+			continue
+		}
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			return user, nil, role, fmt.Errorf("invalid email %q", email)
+		}
+	}
+	for _, phone := range append([]string{user.Phone}, user.phones...) {
+		if phone != "" && !phonePattern.MatchString(phone) {
+			return user, nil, role, fmt.Errorf("invalid phone %q", phone)
+		}
+	}
+	if user.Email == "" && user.Phone == "" && len(user.emails) == 0 && len(user.phones) == 0 {
+		return user, nil, role, errors.New("email or phone is required to match existing users")
+	}
+	for _, path := range paths {
+		if len(manager.SplitDepartmentPath(path)) == 0 {
+			return user, nil, role, fmt.Errorf("invalid department path %q", path)
+		}
+	}
+	if role, err = manager.ParseDepartmentUserRole(t.get(row, "role")); err != nil {
+		return user, nil, role, err
+	}
+	return user, paths, role, nil
+}
+
+func importUser(target manager.Target, importer manager.UserImporter, root manager.DepartmentableEntry, user importUserRow, paths []string, role manager.DepartmentUserRole) (bool, error) {
+	var entry manager.UserableEntry
+	var created bool
+	err := manager.Do(target, manager.Call{Operation: "upsert_user", Write: true, Idempotent: true}, func() (err error) {
+		entry, created, err = importer.UpsertUser(user)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	extID := manager.ExternalIdentityOfEntry(entry)
+	for _, path := range paths {
+		department, err := manager.EnsureDepartmentPath(root, path)
+		if err != nil {
+			return created, fmt.Errorf("department %s: %w", path, err)
+		}
+		writer, ok := manager.As[manager.DepartmentUserWriter](department)
+		if !ok {
+			return created, fmt.Errorf("department %s cannot add users", path)
+		}
+		err = manager.Do(department, manager.Call{Operation: "add_to_department", Write: true, Idempotent: true}, func() error {
+			return writer.AddToDepartment(manager.DepartmentModifyUserOptions{Role: role}, extID)
+		})
+		if err != nil {
+			return created, fmt.Errorf("department %s: %w", path, err)
+		}
+	}
+	return created, nil
+}
+
+func importDepartment(root manager.DepartmentableEntry, path, description string) (bool, error) {
+	names := manager.SplitDepartmentPath(path)
+	if len(names) == 0 {
+		return false, fmt.Errorf("invalid department path %q", path)
+	}
+	parent, err := manager.EnsureDepartmentPath(root, strings.Join(names[:len(names)-1], "/"))
+	if err != nil {
+		return false, err
+	}
+	name := names[len(names)-1]
+	if _, found := lo.Find(parent.GetChildDepartments(), func(child manager.DepartmentableEntry) bool {
+		return child.GetName() == name
+	}); found {
+		return false, nil
+	}
+	newDepartment := manager.NewDepartment()
+	newDepartment.Name = name
+	newDepartment.Description = description
+	_, err = parent.CreateChildDepartment(newDepartment)
+	return err == nil, err
+}
@@ -0,0 +1,226 @@
+package imports
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/org-tools/manager"
+	"github.com/xuri/excelize/v2"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func writeXLSX(t *testing.T, sheets map[string][][]string, active string) string {
+	t.Helper()
+	f := excelize.NewFile()
+	for name, rows := range sheets {
+		index := f.NewSheet(name)
+		if name == active {
+			f.SetActiveSheet(index)
+		}
+		for i, row := range rows {
+			cell, _ := excelize.CoordinatesToCellName(1, i+1)
+			if err := f.SetSheetRow(name, cell, &row); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	f.DeleteSheet("Sheet1")
+	file := filepath.Join(t.TempDir(), "users.xlsx")
+	if err := f.SaveAs(file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadTableCSV(t *testing.T) {
+	file := writeFile(t, "users.CSV", "\ufeffName, E-Mail ,role\nAnn,ann@example.com\n Bob , bob@example.com ,admin,extra\n")
+	table, err := readTable(file, "", map[string]string{"email": "e-mail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.rows) != 2 || table.rowNumber(1) != 3 {
+		t.Fatalf("got rows %v", table.rows)
+	}
+	for _, tc := range []struct {
+		row   int
+		field string
+		want  string
+	}{
+		{0, "name", "Ann"},
+		{0, "email", "ann@example.com"},
+		// a short row has no cell for role
+		{0, "role", ""},
+		{1, "NAME", "Bob"},
+		{1, "email", "bob@example.com"},
+		{1, "role", "admin"},
+		{1, "phone", ""},
+	} {
+		if got := table.get(table.rows[tc.row], tc.field); got != tc.want {
+			t.Errorf("row %d %s: got %q, want %q", tc.row, tc.field, got, tc.want)
+		}
+	}
+	if !table.hasColumn("name") || !table.hasColumn("email") || table.hasColumn("phone") {
+		t.Error("hasColumn does not follow the header and the mapping")
+	}
+}
+
+func TestReadTableXLSX(t *testing.T) {
+	file := writeXLSX(t, map[string][][]string{
+		"Users": {{"姓名", "邮箱"}, {"Ann", "ann@example.com"}},
+		"Depts": {{"path"}, {"Eng/Platform"}},
+	}, "Users")
+	table, err := readTable(file, "", map[string]string{"name": "姓名", "email": "邮箱"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := table.get(table.rows[0], "email"); len(table.rows) != 1 || got != "ann@example.com" {
+		t.Errorf("active sheet: got rows %v", table.rows)
+	}
+	table, err = readTable(file, "Depts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := table.get(table.rows[0], "path"); got != "Eng/Platform" {
+		t.Errorf("Depts sheet: got path %q", got)
+	}
+	if _, err := readTable(file, "Missing", nil); err == nil {
+		t.Error("read a missing sheet")
+	}
+}
+
+func TestReadTableRejects(t *testing.T) {
+	for name, file := range map[string]string{
+		"unsupported": writeFile(t, "users.txt", "name\nAnn\n"),
+		"empty":       writeFile(t, "users.csv", ""),
+		"bad quotes":  writeFile(t, "users.csv", "name\n\"Ann\n"),
+		"missing":     filepath.Join(t.TempDir(), "users.csv"),
+	} {
+		if _, err := readTable(file, "", nil); err == nil {
+			t.Errorf("%s: read without error", name)
+		}
+	}
+}
+
+func TestParseUserRow(t *testing.T) {
+	header := []string{"name", "email", "emails", "phone", "phones", "departments", "role"}
+	table := &table{header: header}
+	for _, tc := range []struct {
+		name  string
+		row   []string
+		want  importUserRow
+		paths []string
+		role  manager.DepartmentUserRole
+		fails bool
+	}{
+		{
+			name:  "full row",
+			row:   []string{"Ann", "ann@example.com", "a@example.org; ann@example.net |", "+1 555 0100", "13800138000\n+4930123456", "Eng/Platform;Sales", "Admin"},
+			want:  importUserRow{User: manager.User{Name: "Ann", Email: "ann@example.com", Phone: "+1 555 0100"}, emails: []string{"a@example.org", "ann@example.net"}, phones: []string{"13800138000", "+4930123456"}},
+			paths: []string{"Eng/Platform", "Sales"},
+			role:  manager.DepartmentUserRoleAdmin,
+		},
+		{
+			name:  "phone only",
+			row:   []string{"Bob", "", "", "13800138000"},
+			want:  importUserRow{User: manager.User{Name: "Bob", Phone: "13800138000"}, emails: []string{}, phones: []string{}},
+			paths: []string{},
+		},
+		{
+			name:  "listed email only",
+			row:   []string{"Cid", "", "cid@example.com"},
+			want:  importUserRow{User: manager.User{Name: "Cid"}, emails: []string{"cid@example.com"}, phones: []string{}},
+			paths: []string{},
+		},
+		{name: "no name", row: []string{"", "ann@example.com"}, fails: true},
+		{name: "no contact", row: []string{"Ann"}, fails: true},
+		{name: "invalid email", row: []string{"Ann", "ann.example.com"}, fails: true},
+		{name: "email with a display name", row: []string{"Ann", "Ann <ann@example.com>"}, fails: true},
+		{name: "invalid listed email", row: []string{"Ann", "ann@example.com", "ann@"}, fails: true},
+		{name: "invalid phone", row: []string{"Ann", "", "", "call me"}, fails: true},
+		{name: "invalid department path", row: []string{"Ann", "ann@example.com", "", "", "", "/"}, fails: true},
+		{name: "invalid role", row: []string{"Ann", "ann@example.com", "", "", "", "", "owner"}, fails: true},
+	} {
+		user, paths, role, err := parseUserRow(table, tc.row)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s: parsed %+v", tc.name, user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(user, tc.want) || !reflect.DeepEqual(paths, tc.paths) || role != tc.role {
+			t.Errorf("%s: got %+v %v %v", tc.name, user, paths, role)
+		}
+	}
+}
+
+func openLocal(t *testing.T) manager.Target {
+	t.Helper()
+	dsn := t.TempDir() + "/hub.db"
+	local, err := manager.InitTarget("local", func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"local","Slug":"hub","FileDSN":"`+dsn+`"}`), v)
+	}, manager.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local
+}
+
+func TestImportRows(t *testing.T) {
+	target := openLocal(t)
+	importer, _ := manager.As[manager.UserImporter](target)
+	root, err := target.GetRootDepartment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, false} {
+		isNew, err := importDepartment(root, " Eng / Platform ", "runs things")
+		if err != nil || isNew != want {
+			t.Errorf("import %d of Eng/Platform: got %v %v, want %v", i, isNew, err, want)
+		}
+	}
+	if _, err := importDepartment(root, "//", ""); err == nil {
+		t.Error("imported an empty path")
+	}
+
+	ann := importUserRow{User: manager.User{Name: "Ann", Email: "ann@example.com"}}
+	isNew, err := importUser(target, importer, root, ann, []string{"Eng/Platform", "Sales"}, manager.DepartmentUserRoleAdmin)
+	if err != nil || !isNew {
+		t.Fatalf("got %v %v, want Ann created", isNew, err)
+	}
+	ann.Phone = "13800138000"
+	if isNew, err = importUser(target, importer, root, ann, nil, manager.DepartmentUserRoleMember); err != nil || isNew {
+		t.Errorf("got %v %v, want Ann updated", isNew, err)
+	}
+
+	eng := root.GetChildDepartments()[0]
+	platform := eng.GetChildDepartments()[0]
+	if eng.GetName() != "Eng" || platform.GetName() != "Platform" || platform.GetDescription() != "runs things" {
+		t.Fatalf("got departments %s/%s (%s)", eng.GetName(), platform.GetName(), platform.GetDescription())
+	}
+	users, err := platform.GetUsers()
+	if err != nil || len(users) != 1 || users[0].GetPhone() != "13800138000" {
+		t.Fatalf("got users %v %v of Platform", users, err)
+	}
+	if withRole, ok := users[0].(manager.UserableWithRole); !ok || withRole.GetRole() != manager.DepartmentUserRoleAdmin {
+		t.Errorf("Ann is not an admin of Platform")
+	}
+	if len(root.GetChildDepartments()) != 2 {
+		t.Errorf("Sales was not created for Ann")
+	}
+}
@@ -0,0 +1,103 @@
+package imports
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+type table struct {
+	header  []string
+	rows    [][]string
+	mapping map[string]string
+}
+
+// row numbers count the header as row 1, like spreadsheet apps do.
+func (t *table) rowNumber(index int) int {
+	return index + 2
+}
+
+// get returns the cell of field in row, field is looked up through the
+// --map flag first and matched against headers case-insensitively.
+func (t *table) get(row []string, field string) string {
+	column := field
+	if mapped, ok := t.mapping[field]; ok {
+		column = mapped
+	}
+	for i, header := range t.header {
+		if strings.EqualFold(strings.TrimSpace(header), column) && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+	}
+	return ""
+}
+
+func (t *table) hasColumn(field string) bool {
+	column := field
+	if mapped, ok := t.mapping[field]; ok {
+		column = mapped
+	}
+	for _, header := range t.header {
+		if strings.EqualFold(strings.TrimSpace(header), column) {
+			return true
+		}
+	}
+	return false
+}
+
+func readTable(file, sheet string, mapping map[string]string) (*table, error) {
+	var (
+		records [][]string
+		err     error
+	)
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		records, err = readCSV(file)
+	case ".xlsx":
+		records, err = readXLSX(file, sheet)
+	default:
+		return nil, fmt.Errorf("unsupported file %s, should be .csv or .xlsx", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("file has no header row")
+	}
+	return &table{header: records[0], rows: records[1:], mapping: mapping}, nil
+}
+
+func readCSV(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 0 && len(records[0]) != 0 {
+		records[0][0] = strings.TrimPrefix(records[0][0], "\ufeff")
+	}
+	return records, nil
+}
+
+func readXLSX(file, sheet string) ([][]string, error) {
+	f, err := excelize.OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if sheet == "" {
+		sheet = f.GetSheetName(f.GetActiveSheetIndex())
+	}
+	return f.GetRows(sheet)
+}
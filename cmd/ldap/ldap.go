@@ -0,0 +1,72 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/base"
+	"github.com/org-tools/manager/ldapserver"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	targetKey      string
+	listen         string
+	baseDN         string
+	tlsCert        string
+	tlsKey         string
+	allowAnonymous bool
+)
+
+func init() {
+	serveCmd.Flags().StringVarP(&targetKey, "target", "t", "", "target key to serve, like hub@local")
+	serveCmd.Flags().StringVar(&listen, "listen", ":3389", "address to listen on")
+	serveCmd.Flags().StringVar(&baseDN, "base-dn", "dc=example,dc=com", "suffix of the served tree")
+	serveCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "certificate file, serves LDAPS together with --tls-key")
+	serveCmd.Flags().StringVar(&tlsKey, "tls-key", "", "private key file of --tls-cert")
+	serveCmd.Flags().BoolVar(&allowAnonymous, "allow-anonymous", false, "allow searching without bind")
+	Cmd.AddCommand(serveCmd)
+}
+
+var Cmd = &cobra.Command{
+	Use:   "ldap",
+	Short: "LDAP frontend of targets",
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve a target read-only over LDAP",
+	Long: `Serve a target read-only over LDAPv3, users under ou=people and
+departments as nested groupOfNames under ou=groups. Applications bind
+with the accounts of the ldap section of org-manager.yml:
+
+  ldap:
+    accounts:
+      - dn: cn=jenkins,ou=apps,dc=example,dc=com
+        password: change-me`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var accounts []ldapserver.Account
+		cobra.CheckErr(viper.UnmarshalKey("ldap.accounts", &accounts))
+		target := base.TargetByKeyOrSelect(targetKey)
+		server, err := ldapserver.NewServer(target, ldapserver.Options{
+			BaseDN:         baseDN,
+			Accounts:       accounts,
+			AllowAnonymous: allowAnonymous,
+			Logger:         manager.Log.WithField("target", manager.TargetKey(target)),
+		})
+		cobra.CheckErr(err)
+		listener, err := net.Listen("tcp", listen)
+		cobra.CheckErr(err)
+		if tlsCert != "" || tlsKey != "" {
+			cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+			cobra.CheckErr(err)
+			listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		} else {
+			manager.Log.Warn("serving LDAP without TLS, bind passwords travel in clear text")
+		}
+		manager.Log.WithField("listen", listen).WithField("base_dn", baseDN).Info("serving LDAP")
+		cobra.CheckErr(server.Serve(listener))
+	},
+}
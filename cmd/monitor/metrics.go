@@ -0,0 +1,108 @@
+package monitor
+
+import (
+	"time"
+
+	"github.com/org-tools/manager"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	apiCalls          *prometheus.CounterVec
+	apiErrors         *prometheus.CounterVec
+	apiLatency        *prometheus.HistogramVec
+	entriesSeen       *prometheus.CounterVec
+	membershipChanges *prometheus.CounterVec
+	trackedChanges    *prometheus.CounterVec
+	syncChanges       *prometheus.CounterVec
+	syncLastRun       *prometheus.GaugeVec
+	syncLastSuccess   *prometheus.GaugeVec
+}
+
+func newMetrics(registry prometheus.Registerer) *metrics {
+	m := &metrics{
+		apiCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "org_manager_api_calls_total",
+			Help: "API calls made to a target.",
+		}, []string{"target", "operation"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "org_manager_api_errors_total",
+			Help: "API calls to a target that failed, by error type.",
+		}, []string{"target", "operation", "type"}),
+		apiLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "org_manager_api_call_duration_seconds",
+			Help:    "Latency of API calls made to a target.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"target", "operation"}),
+		entriesSeen: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "org_manager_entries_seen_total",
+			Help: "Users and departments returned by a target.",
+		}, []string{"target", "type"}),
+		membershipChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "org_manager_membership_changes_total",
+			Help: "Department membership changes applied to a target.",
+		}, []string{"target", "operation"}),
+		trackedChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "org_manager_tracked_changes_total",
+			Help: "Changes a target reported since the last run, by change type.",
+		}, []string{"target", "type"}),
+		syncChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "org_manager_sync_changes_total",
+			Help: "Users created, merged and linked by sync runs.",
+		}, []string{"source", "destination", "kind"}),
+		syncLastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "org_manager_sync_last_run",
+			Help: "Users seen, created, merged, linked and failed in the last sync run.",
+		}, []string{"source", "destination", "kind"}),
+		syncLastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "org_manager_sync_last_success_timestamp_seconds",
+			Help: "Unix time of the last sync run that finished without errors.",
+		}, []string{"source", "destination"}),
+	}
+	registry.MustRegister(m.apiCalls, m.apiErrors, m.apiLatency, m.entriesSeen,
+		m.membershipChanges, m.trackedChanges, m.syncChanges, m.syncLastRun, m.syncLastSuccess)
+	return m
+}
+
+func (m *metrics) ObserveCall(target manager.Target, operation string, duration time.Duration, err error) {
+	key := manager.TargetKey(target)
+	m.apiCalls.WithLabelValues(key, operation).Inc()
+	m.apiLatency.WithLabelValues(key, operation).Observe(duration.Seconds())
+	if err != nil {
+		m.apiErrors.WithLabelValues(key, operation, manager.ErrorType(err)).Inc()
+		return
+	}
+	switch operation {
+	case "add_to_department", "remove_from_department":
+		m.membershipChanges.WithLabelValues(key, operation).Inc()
+	}
+}
+
+func (m *metrics) ObserveEntries(target manager.Target, entryType manager.EntryType, count int) {
+	m.entriesSeen.WithLabelValues(manager.TargetKey(target), string(entryType)).Add(float64(count))
+}
+
+func (m *metrics) observeChanges(target string, changes []manager.EntryChange) {
+	for _, change := range changes {
+		m.trackedChanges.WithLabelValues(target, string(change.Type)).Inc()
+	}
+}
+
+func (m *metrics) observeSync(source, destination string, result manager.SyncResult, err error) {
+	counts := map[string]int{
+		"seen":    result.Uniq,
+		"created": result.Created,
+		"merged":  result.Merged,
+		"linked":  result.Linked,
+		"failed":  len(result.Errors),
+	}
+	for kind, count := range counts {
+		m.syncLastRun.WithLabelValues(source, destination, kind).Set(float64(count))
+		if kind != "seen" {
+			m.syncChanges.WithLabelValues(source, destination, kind).Add(float64(count))
+		}
+	}
+	if err == nil && len(result.Errors) == 0 {
+		m.syncLastSuccess.WithLabelValues(source, destination).SetToCurrentTime()
+	}
+}
@@ -1,11 +1,200 @@
 package monitor
 
-import "github.com/spf13/cobra"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/org-tools/manager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+)
+
+var (
+	listen     string
+	interval   time.Duration
+	syncs      []string
+	deltaStore string
+)
+
+func init() {
+	Cmd.Flags().StringVar(&listen, "listen", ":9100", "address serving /metrics and /healthz")
+	Cmd.Flags().DurationVar(&interval, "interval", 10*time.Minute, "time between sync runs")
+	Cmd.Flags().StringSliceVar(&syncs, "sync", nil, "user sync as source=destination target keys, e.g. main@feishu=hub@local")
+	Cmd.Flags().StringVar(&deltaStore, "delta-store", "", "local target key keeping change tracking tokens, sources tracking changes are only synced when they changed")
+}
 
 var Cmd = &cobra.Command{
 	Use:   "monitor",
 	Short: "monitor org changing and sync it",
 	Run: func(cmd *cobra.Command, args []string) {
+		jobs, err := parseSyncJobs(syncs)
+		cobra.CheckErr(err)
+		var store manager.DeltaTokenStore
+		if deltaStore != "" {
+			var ok bool
+			if store, ok = manager.As[manager.DeltaTokenStore](manager.Targets[deltaStore]); !ok {
+				cobra.CheckErr(fmt.Errorf("target %s not found or cannot keep delta tokens", deltaStore))
+			}
+		}
+
+		registry := prometheus.NewRegistry()
+		m := newMetrics(registry)
+		manager.RegisterObserver(m)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		mux.HandleFunc("/healthz", healthz)
+		// listening before the first run makes a taken address fail at once
+		listener, err := net.Listen("tcp", listen)
+		cobra.CheckErr(err)
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		served := make(chan error, 1)
+		go func() {
+			served <- server.Serve(listener)
+		}()
+		defer shutdown(server)
 
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, job := range jobs {
+				job.run(cmd.Context(), m, store)
+			}
+			select {
+			case <-cmd.Context().Done():
+				return
+			case err := <-served:
+				cobra.CheckErr(err)
+			case <-ticker.C:
+			}
+		}
 	},
 }
+
+// shutdownTimeout bounds how long scrapes in flight may finish once the
+// monitor is stopped.
+const shutdownTimeout = 5 * time.Second
+
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		manager.Log.WithError(err).Warn("metrics server shutdown failed")
+	}
+}
+
+type syncJob struct {
+	sourceKey, destinationKey string
+	source                    manager.Target
+	destination               manager.Target
+}
+
+func parseSyncJobs(specs []string) (jobs []syncJob, err error) {
+	for _, spec := range specs {
+		keys := strings.SplitN(spec, "=", 2)
+		if len(keys) != 2 {
+			return nil, fmt.Errorf("sync %s should be source=destination", spec)
+		}
+		source, ok := manager.Targets[keys[0]]
+		if !ok {
+			return nil, fmt.Errorf("target %s not found", keys[0])
+		}
+		destination, ok := manager.Targets[keys[1]]
+		if _, writeable := manager.As[manager.UserWriteable](destination); !ok || !writeable {
+			return nil, fmt.Errorf("target %s not found or not UserWriteable", keys[1])
+		}
+		jobs = append(jobs, syncJob{
+			sourceKey:      keys[0],
+			destinationKey: keys[1],
+			source:         source,
+			destination:    destination,
+		})
+	}
+	return jobs, nil
+}
+
+// run syncs sources that track changes only when they changed. Failed
+// syncs keep the token, so the same changes are seen again next run.
+func (j syncJob) run(ctx context.Context, m *metrics, store manager.DeltaTokenStore) {
+	logger := manager.Log.WithFields(map[string]any{"source": j.sourceKey, "destination": j.destinationKey})
+	if _, tracked := manager.As[manager.TargetWithChanges](j.source); !tracked || store == nil {
+		_ = j.sync(ctx, m, logger)
+		return
+	}
+	// keyed on the pair, so syncs of one source to several destinations
+	// each see the changes
+	key := j.sourceKey + "=" + j.destinationKey
+	err := manager.TrackChanges(j.source, store, key, func(changes []manager.EntryChange, baseline bool) error {
+		m.observeChanges(j.sourceKey, changes)
+		for _, change := range changes {
+			logger.WithFields(map[string]any{
+				"type":   change.Type,
+				"extID":  change.ExtID,
+				"name":   change.Name,
+				"member": change.Member,
+			}).Debug("change tracked")
+		}
+		if !baseline && len(changes) == 0 {
+			logger.Debug("no changes, sync skipped")
+			return nil
+		}
+		return j.sync(ctx, m, logger)
+	})
+	if err != nil {
+		logger.WithError(err).Error("change tracking failed")
+	}
+}
+
+func (j syncJob) sync(ctx context.Context, m *metrics, logger manager.Logger) error {
+	result, err := manager.SyncUsers(ctx, j.source, j.destination)
+	m.observeSync(j.sourceKey, j.destinationKey, result, err)
+	if err != nil {
+		logger.WithError(err).Error("sync failed")
+		return err
+	}
+	for _, err := range result.Errors {
+		logger.WithError(err).Warn("sync user failed")
+	}
+	logger.WithFields(map[string]any{
+		"users":   result.Uniq,
+		"created": result.Created,
+		"merged":  result.Merged,
+		"linked":  result.Linked,
+	}).Info("sync finished")
+	if len(result.Errors) != 0 {
+		return fmt.Errorf("%d users failed to sync", len(result.Errors))
+	}
+	return nil
+}
+
+type targetHealth struct {
+	Platform string `json:"platform"`
+	Key      string `json:"key,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	healthy := true
+	targets := make(map[string]targetHealth)
+	for name, status := range manager.TargetStatuses {
+		health := targetHealth{Platform: status.Platform, Key: status.Key, OK: status.Err == nil}
+		if status.Err != nil {
+			healthy = false
+			health.Error = status.Err.Error()
+		}
+		targets[name] = health
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": healthy, "targets": targets})
+}
@@ -1,21 +1,59 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/apply"
 	"github.com/org-tools/manager/cmd/dept"
+	"github.com/org-tools/manager/cmd/drift"
+	"github.com/org-tools/manager/cmd/export"
+	"github.com/org-tools/manager/cmd/forward"
+	"github.com/org-tools/manager/cmd/imports"
+	"github.com/org-tools/manager/cmd/ldap"
 	"github.com/org-tools/manager/cmd/monitor"
+	"github.com/org-tools/manager/cmd/scim"
 	"github.com/org-tools/manager/cmd/user"
+	_ "github.com/org-tools/manager/drivers/azuread"
+	_ "github.com/org-tools/manager/drivers/cloudflare"
+	_ "github.com/org-tools/manager/drivers/dingtalk"
+	_ "github.com/org-tools/manager/drivers/feishu"
+	_ "github.com/org-tools/manager/drivers/github"
+	_ "github.com/org-tools/manager/drivers/gitlab"
+	_ "github.com/org-tools/manager/drivers/googleworkspace"
+	_ "github.com/org-tools/manager/drivers/keycloak"
+	_ "github.com/org-tools/manager/drivers/ldap"
+	_ "github.com/org-tools/manager/drivers/okta"
+	_ "github.com/org-tools/manager/drivers/scim"
+	_ "github.com/org-tools/manager/drivers/slack"
+	_ "github.com/org-tools/manager/drivers/wecom"
 	"github.com/spf13/cobra"
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "org-manager",
 	Short: "org manager of multi-platform",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := manager.ConfigureLogging(logLevel, logFormat); err != nil {
+			return err
+		}
+		manager.InitWithTargetConfigStore(&manager.DefaultViperConfigStore{})
+		return nil
+	},
 }
 
+var (
+	logLevel  string
+	logFormat string
+)
+
 func main() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
 	if err != nil {
 		os.Exit(1)
 	}
@@ -23,5 +61,7 @@ func main() {
 
 func init() {
 	rootCmd.Flags().BoolP("target", "t", false, "Custom the target")
-	rootCmd.AddCommand(dept.Cmd, user.Cmd, monitor.Cmd)
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level: trace, debug, info, warn, error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	rootCmd.AddCommand(dept.Cmd, user.Cmd, monitor.Cmd, imports.Cmd, export.Cmd, apply.Cmd, drift.Cmd, scim.Cmd, ldap.Cmd, forward.Cmd)
 }
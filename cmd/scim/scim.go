@@ -0,0 +1,74 @@
+package scim
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/org-tools/manager"
+	"github.com/org-tools/manager/cmd/base"
+	"github.com/org-tools/manager/scim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	targetKey string
+	listen    string
+	basePath  string
+	baseURL   string
+	slug      string
+	token     string
+	noAuth    bool
+)
+
+func init() {
+	serveCmd.Flags().StringVarP(&targetKey, "target", "t", "", "target key to serve, like hub@local")
+	serveCmd.Flags().StringVar(&listen, "listen", ":8080", "address to listen on")
+	serveCmd.Flags().StringVar(&basePath, "path", "/scim/v2", "base path of the SCIM endpoints")
+	serveCmd.Flags().StringVar(&baseURL, "base-url", "", "public URL of the base path used in meta.location, the base path by default")
+	serveCmd.Flags().StringVar(&slug, "slug", "idp", "slug of the SCIM client, externalId values are linked as ei.{type}.{base64url}@{slug}.client")
+	serveCmd.Flags().StringVar(&token, "token", os.Getenv("ORG_MANAGER_SCIM_TOKEN"), "bearer token clients must send, $ORG_MANAGER_SCIM_TOKEN by default")
+	serveCmd.Flags().BoolVar(&noAuth, "insecure-no-auth", false, "serve without --token, letting anyone reaching it write the target")
+	Cmd.AddCommand(serveCmd)
+}
+
+var Cmd = &cobra.Command{
+	Use:   "scim",
+	Short: "SCIM 2.0 provisioning",
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve a target over SCIM 2.0 so IdPs can push users and groups",
+	Long: `Serve /Users and /Groups of a target over SCIM 2.0. Departments are
+groups, their parent and description live in the extension
+` + scim.SchemaGroupHierarchy + `.
+userName maps to the primary email, then the name. active=false
+deactivates users on targets which can, like local, and is refused on
+the others.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if token == "" && !noAuth {
+			cobra.CheckErr(errors.New("no --token given, pass --insecure-no-auth to serve without one"))
+		}
+		if token == "" {
+			manager.Log.Warn("--insecure-no-auth given, the SCIM server accepts anyone")
+		}
+		basePath = "/" + strings.Trim(basePath, "/")
+		if baseURL == "" {
+			baseURL = basePath
+		}
+		target := base.TargetByKeyOrSelect(targetKey)
+		server, err := scim.NewServer(target, scim.ServerOptions{
+			Slug:    slug,
+			Token:   token,
+			BaseURL: baseURL,
+			Logger:  manager.Log.WithField("target", manager.TargetKey(target)),
+		})
+		cobra.CheckErr(err)
+		mux := http.NewServeMux()
+		mux.Handle(basePath+"/", http.StripPrefix(basePath, server))
+		manager.Log.WithField("listen", listen).WithField("path", basePath).Info("serving SCIM")
+		cobra.CheckErr(http.ListenAndServe(listen, mux))
+	},
+}
@@ -34,7 +34,7 @@ var infoCmd = &cobra.Command{
 		fmt.Println(user.GetID(), user.GetName())
 		fmt.Println(manager.ExternalIdentityOfUser(target, user))
 
-		if entryCenter, ok := target.(manager.EntryCenter); ok {
+		if entryCenter, ok := manager.As[manager.EntryCenter](target); ok {
 			user, err := entryCenter.LookupEntryUserByExternalIdentity(extID)
 			cobra.CheckErr(err)
 			for _, extID := range user.GetExternalIdentities() {
@@ -71,7 +71,7 @@ var linkCmd = &cobra.Command{
 		_, err = target.LookupEntryUserByInternalExternalIdentity(extIDNeedLink)
 		cobra.CheckErr(err)
 
-		if entryCenter, ok := targetShouldBeEntryCenter.(manager.EntryCenter); ok {
+		if entryCenter, ok := manager.As[manager.EntryCenter](targetShouldBeEntryCenter); ok {
 			user, err := entryCenter.LookupEntryUserByExternalIdentity(extIDNeedLink)
 			if err != nil {
 				fmt.Println(err)
@@ -84,10 +84,16 @@ var linkCmd = &cobra.Command{
 
 		user, err := targetShouldBeEntryCenter.LookupEntryUserByInternalExternalIdentity(extIDLinkTo)
 		cobra.CheckErr(err)
-		userExtIDStoreable := user.(manager.EntryExtIDStoreable)
+		userExtIDStoreable, ok := manager.As[manager.EntryExtIDStoreable](user)
+		if !ok {
+			fmt.Println(targetShouldBeEntryCenter.GetPlatform(), "cannot store extIDs")
+			return
+		}
 		alreadyExtIDs := userExtIDStoreable.GetExternalIdentities()
 		fmt.Println(alreadyExtIDs)
-		err = userExtIDStoreable.SetExternalIdentities(append(alreadyExtIDs, extIDNeedLink))
+		err = manager.Do(user, manager.Call{Operation: "set_external_identities", Write: true, Idempotent: true}, func() error {
+			return userExtIDStoreable.SetExternalIdentities(append(alreadyExtIDs, extIDNeedLink))
+		})
 		cobra.CheckErr(err)
 	},
 }
@@ -97,7 +103,7 @@ var listCmd = &cobra.Command{
 	Short: "list users",
 	Run: func(cmd *cobra.Command, args []string) {
 		target, _ := base.SelectTarget()
-		users, err := target.GetAllUsers()
+		users, err := manager.GetAllUsersContext(cmd.Context(), target)
 		cobra.CheckErr(err)
 		for _, user := range users {
 			fmt.Println(user.GetName(), manager.ExternalIdentityOfUser(target, user))
@@ -113,7 +119,16 @@ var createCmd = &cobra.Command{
 		newUser := manager.NewUser()
 		newUser.Name = base.InputStringWithHint("Name")
 		newUser.Email = base.InputStringWithHint("Email")
-		user, err := target.(manager.UserWriteable).CreateUser(newUser)
+		userWriteable, ok := manager.As[manager.UserWriteable](target)
+		if !ok {
+			fmt.Println("target should be UserWriteable")
+			return
+		}
+		var user manager.UserableEntry
+		err := manager.Do(target, manager.Call{Operation: "create_user", Write: true}, func() (err error) {
+			user, err = userWriteable.CreateUser(newUser)
+			return err
+		})
 		cobra.CheckErr(err)
 		fmt.Println(user.GetName(), manager.ExternalIdentityOfUser(target, user))
 	},
@@ -129,35 +144,17 @@ var syncCmd = &cobra.Command{
 			fmt.Println("target is same as source")
 			return
 		}
-		userWriteable, ok := targetShouldBeUserWriteable.(manager.UserWriteable)
-		if !ok {
+		if _, ok := manager.As[manager.UserWriteable](targetShouldBeUserWriteable); !ok {
 			fmt.Println("target should be UserWriteable")
 			return
 		}
-		users, err := source.GetAllUsers()
+		result, err := manager.SyncUsers(cmd.Context(), source, targetShouldBeUserWriteable)
 		cobra.CheckErr(err)
-		fmt.Println("Total", len(users))
-		users = manager.Uniq(users)
-		fmt.Println("Uniq", len(users))
-		for _, user := range users {
-			get, err := userWriteable.LookupUser(user)
-			if err != nil {
-				fmt.Println(err)
-			}
-			if get != nil {
-				fmt.Println("merge", get.GetName(), user.GetName())
-				if mergable, ok := get.(manager.UserableCanMerge); ok {
-					err = mergable.Merge(user)
-					if err != nil {
-						fmt.Println(err)
-					}
-				}
-				continue
-			}
-			_, err = userWriteable.CreateUser(user)
-			if err != nil {
-				fmt.Println(err)
-			}
+		fmt.Println("Total", result.Users)
+		fmt.Println("Uniq", result.Uniq)
+		for _, err := range result.Errors {
+			fmt.Println(err)
 		}
+		fmt.Println("Created", result.Created, "Merged", result.Merged, "Linked", result.Linked)
 	},
 }
@@ -20,10 +20,22 @@ type TargetConfigStore interface {
 type Unmarshaler func(any) error
 
 type TargetConfig interface {
+	GetName() string
 	GetPlatform() string
 	GetUnmarshaler() Unmarshaler
 }
 
+// TargetStatus records how a configured target initialized, a failed target
+// is left out of Targets instead of stopping every command.
+type TargetStatus struct {
+	Name     string
+	Platform string
+	Key      string
+	Err      error
+}
+
+var TargetStatuses = make(map[string]TargetStatus)
+
 type DefaultViperConfigStore struct{}
 
 func (DefaultViperConfigStore) GetConfigs() (configs []TargetConfig) {
@@ -44,6 +56,10 @@ type DefaultViperConfig struct {
 	targetName string
 }
 
+func (c DefaultViperConfig) GetName() string {
+	return c.targetName
+}
+
 func (c DefaultViperConfig) GetPlatform() string {
 	return viper.GetString(fmt.Sprintf("targets.%s.platform", c.targetName))
 }
@@ -59,16 +75,45 @@ type DatabaseConfigStore struct {
 	db *gorm.DB
 }
 
-func init() {
-	InitWithTargetConfigStore(&DefaultViperConfigStore{})
-}
-
+// InitWithTargetConfigStore loads the targets of store into Targets, it runs
+// once logging is configured so init failures honour the log flags.
 func InitWithTargetConfigStore(store TargetConfigStore) {
 	for _, config := range store.GetConfigs() {
-		target, err := InitTarget(config.GetPlatform(), config.GetUnmarshaler())
+		status := TargetStatus{Name: config.GetName(), Platform: config.GetPlatform()}
+		logger := Log.WithFields(map[string]any{"target": status.Name, "platform": status.Platform})
+		target, err := InitTarget(config.GetPlatform(), config.GetUnmarshaler(), logger)
+		if err == nil {
+			target, err = decorateTarget(target, config.GetUnmarshaler(), logger)
+		}
+		if err != nil {
+			status.Err = err
+			TargetStatuses[status.Name] = status
+			logger.WithError(err).Error("target init failed")
+			continue
+		}
+		status.Key = TargetKey(target)
+		TargetStatuses[status.Name] = status
+		Targets[status.Key] = target
+	}
+}
+
+type targetDecoratorConfig struct {
+	Retry RetryConfig
+	Cache CacheConfig
+}
+
+func decorateTarget(target Target, unmarshaler Unmarshaler, logger Logger) (Target, error) {
+	config := new(targetDecoratorConfig)
+	if err := unmarshaler(config); err != nil {
+		return nil, err
+	}
+	target = WithRetry(target, config.Retry)
+	if config.Cache.Enabled {
+		store, err := NewCacheStore(config.Cache)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		Targets[TargetKey(target)] = target
+		target = WithCache(target, store, config.Cache.TTL, logger)
 	}
+	return target, nil
 }
@@ -1,5 +1,11 @@
 package manager
 
+import (
+	"strings"
+
+	"github.com/samber/lo"
+)
+
 type Departmentable interface {
 	GetName() string
 	GetDescription() string
@@ -38,3 +44,40 @@ type DepartmentUserWriter interface {
 	AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error
 	RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error
 }
+
+// DepartmentEditor renames, moves or deletes departments, parent of
+// UpdateDepartment keeps the current parent when it is empty.
+type DepartmentEditor interface {
+	UpdateDepartment(extID ExternalIdentity, department Departmentable, parent ExternalIdentity) (DepartmentableEntry, error)
+	DeleteDepartment(extID ExternalIdentity) error
+}
+
+// SplitDepartmentPath turns "Eng/Platform/Infra" into its department names.
+func SplitDepartmentPath(path string) (names []string) {
+	for _, name := range strings.Split(path, "/") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// EnsureDepartmentPath walks path from root by department name and creates
+// the departments that are missing on the way.
+func EnsureDepartmentPath(root DepartmentableEntry, path string) (department DepartmentableEntry, err error) {
+	department = root
+	for _, name := range SplitDepartmentPath(path) {
+		child, found := lo.Find(department.GetChildDepartments(), func(child DepartmentableEntry) bool {
+			return child.GetName() == name
+		})
+		if !found {
+			newDepartment := NewDepartment()
+			newDepartment.Name = name
+			if child, err = department.CreateChildDepartment(newDepartment); err != nil {
+				return nil, err
+			}
+		}
+		department = child
+	}
+	return department, nil
+}
@@ -0,0 +1,355 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// DesiredState is an org-as-code file, departments are the children of the
+// target root department and are matched to live ones by name.
+type DesiredState struct {
+	Departments []DesiredDepartment `yaml:"departments" json:"departments"`
+}
+
+// DesiredDepartment leaves the description of its live department alone
+// when Description is empty.
+type DesiredDepartment struct {
+	Name        string              `yaml:"name" json:"name"`
+	Description string              `yaml:"description,omitempty" json:"description,omitempty"`
+	Members     []DesiredMember     `yaml:"members,omitempty" json:"members,omitempty"`
+	Children    []DesiredDepartment `yaml:"children,omitempty" json:"children,omitempty"`
+}
+
+// DesiredMember names a user of the target by extID or by email.
+type DesiredMember struct {
+	ExtID ExternalIdentity `yaml:"extID,omitempty" json:"extID,omitempty"`
+	Email string           `yaml:"email,omitempty" json:"email,omitempty"`
+	Role  string           `yaml:"role,omitempty" json:"role,omitempty"`
+}
+
+func (m DesiredMember) String() string {
+	if m.ExtID != "" {
+		return string(m.ExtID)
+	}
+	return m.Email
+}
+
+func LoadDesiredState(file string) (*DesiredState, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	state := new(DesiredState)
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(state); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+	return state, state.Validate()
+}
+
+func (s *DesiredState) Validate() error {
+	return validateDesiredDepartments(nil, s.Departments)
+}
+
+func validateDesiredDepartments(parent []string, departments []DesiredDepartment) error {
+	names := make(map[string]bool, len(departments))
+	for _, department := range departments {
+		path := append(append([]string{}, parent...), department.Name)
+		if strings.TrimSpace(department.Name) == "" || strings.Contains(department.Name, "/") {
+			return fmt.Errorf("department %q under %q: name should be non-empty without /", department.Name, strings.Join(parent, "/"))
+		}
+		if names[department.Name] {
+			return fmt.Errorf("department %s is declared twice", strings.Join(path, "/"))
+		}
+		names[department.Name] = true
+		for _, member := range department.Members {
+			if (member.ExtID == "") == (member.Email == "") {
+				return fmt.Errorf("department %s: member should have one of extID or email", strings.Join(path, "/"))
+			}
+			if member.ExtID != "" && (!member.ExtID.Valid() || member.ExtID.GetEntryType() != EntryTypeUser) {
+				return fmt.Errorf("department %s: %s is not a user extID", strings.Join(path, "/"), member.ExtID)
+			}
+			if _, err := ParseDepartmentUserRole(member.Role); err != nil {
+				return fmt.Errorf("department %s: member %s: %w", strings.Join(path, "/"), member, err)
+			}
+		}
+		if err := validateDesiredDepartments(path, department.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ChangeAction string
+
+const (
+	ChangeCreateDepartment ChangeAction = "create_department"
+	ChangeUpdateDepartment ChangeAction = "update_department"
+	ChangeAddMember        ChangeAction = "add_member"
+	ChangeUpdateRole       ChangeAction = "update_role"
+	ChangeRemoveMember     ChangeAction = "remove_member"
+	// ChangeUnmanagedDepartment is only reported, departments are never deleted.
+	ChangeUnmanagedDepartment ChangeAction = "unmanaged_department"
+)
+
+// Change is one step from the live tree to the desired state, Path is the
+// department path from the target root joined by "/".
+type Change struct {
+	Action              ChangeAction     `json:"action"`
+	Path                string           `json:"path"`
+	Description         string           `json:"description,omitempty"`
+	PreviousDescription string           `json:"previousDescription,omitempty"`
+	ExtID               ExternalIdentity `json:"extID,omitempty"`
+	Role                string           `json:"role,omitempty"`
+	PreviousRole        string           `json:"previousRole,omitempty"`
+}
+
+func (c Change) String() string {
+	switch c.Action {
+	case ChangeCreateDepartment:
+		return fmt.Sprintf("+ dept %s", c.Path)
+	case ChangeUpdateDepartment:
+		return fmt.Sprintf("~ dept %s description (%q -> %q)", c.Path, c.PreviousDescription, c.Description)
+	case ChangeAddMember:
+		return fmt.Sprintf("+ member %s %s (%s)", c.Path, c.ExtID, c.Role)
+	case ChangeUpdateRole:
+		return fmt.Sprintf("~ member %s %s (%s -> %s)", c.Path, c.ExtID, c.PreviousRole, c.Role)
+	case ChangeRemoveMember:
+		return fmt.Sprintf("- member %s %s (%s)", c.Path, c.ExtID, c.Role)
+	case ChangeUnmanagedDepartment:
+		return fmt.Sprintf("? dept %s is not declared", c.Path)
+	default:
+		return fmt.Sprintf("%s %s", c.Action, c.Path)
+	}
+}
+
+// Plan is the diff of a DesiredState against a live department tree.
+type Plan struct {
+	Changes []Change
+
+	departments map[string]DepartmentableEntry
+}
+
+// PlanDesiredState reads the live tree under root and computes the changes
+// to reach state. Users given by email are looked up in GetAllUsers of the
+// target of root.
+func PlanDesiredState(root DepartmentableEntry, state *DesiredState) (*Plan, error) {
+	planner := &desiredPlanner{
+		target: root.GetTarget(),
+		plan:   &Plan{departments: map[string]DepartmentableEntry{"": root}},
+	}
+	if err := planner.department(nil, root, state.Departments); err != nil {
+		return nil, err
+	}
+	return planner.plan, nil
+}
+
+type desiredPlanner struct {
+	target       Target
+	plan         *Plan
+	usersByEmail map[string][]ExternalIdentity
+}
+
+func (p *desiredPlanner) department(path []string, live DepartmentableEntry, desired []DesiredDepartment) error {
+	var liveChildren []DepartmentableEntry
+	if live != nil {
+		liveChildren = live.GetChildDepartments()
+	}
+	for _, department := range desired {
+		childPath := append(append([]string{}, path...), department.Name)
+		joined := strings.Join(childPath, "/")
+		child, found := lo.Find(liveChildren, func(child DepartmentableEntry) bool {
+			return child.GetName() == department.Name
+		})
+		if found {
+			p.plan.departments[joined] = child
+			if previous := child.GetDescription(); department.Description != "" && department.Description != previous {
+				p.plan.Changes = append(p.plan.Changes, Change{
+					Action:              ChangeUpdateDepartment,
+					Path:                joined,
+					Description:         department.Description,
+					PreviousDescription: previous,
+				})
+			}
+		} else {
+			child = nil
+			p.plan.Changes = append(p.plan.Changes, Change{
+				Action:      ChangeCreateDepartment,
+				Path:        joined,
+				Description: department.Description,
+			})
+		}
+		if err := p.members(joined, child, department.Members); err != nil {
+			return err
+		}
+		if err := p.department(childPath, child, department.Children); err != nil {
+			return err
+		}
+	}
+	for _, child := range liveChildren {
+		if !lo.ContainsBy(desired, func(department DesiredDepartment) bool {
+			return department.Name == child.GetName()
+		}) {
+			p.plan.Changes = append(p.plan.Changes, Change{
+				Action: ChangeUnmanagedDepartment,
+				Path:   strings.Join(append(append([]string{}, path...), child.GetName()), "/"),
+			})
+		}
+	}
+	return nil
+}
+
+func (p *desiredPlanner) members(path string, live DepartmentableEntry, desired []DesiredMember) error {
+	liveRoles := make(map[ExternalIdentity]*DepartmentUserRole)
+	var liveOrder []ExternalIdentity
+	if live != nil {
+		users, err := live.GetUsers()
+		if err != nil {
+			return fmt.Errorf("department %s: %w", path, err)
+		}
+		for _, user := range Uniq(users) {
+			extID := ExternalIdentityOfEntry(user)
+			liveOrder = append(liveOrder, extID)
+			liveRoles[extID] = nil
+			if withRole, ok := user.(UserableWithRole); ok {
+				role := withRole.GetRole()
+				liveRoles[extID] = &role
+			}
+		}
+	}
+	declared := make(map[ExternalIdentity]bool, len(desired))
+	for _, member := range desired {
+		extID, err := p.resolve(member)
+		if err != nil {
+			return fmt.Errorf("department %s: %w", path, err)
+		}
+		if declared[extID] {
+			return fmt.Errorf("department %s: member %s is declared twice", path, member)
+		}
+		declared[extID] = true
+		role, _ := ParseDepartmentUserRole(member.Role)
+		liveRole, isMember := liveRoles[extID]
+		switch {
+		case !isMember:
+			p.plan.Changes = append(p.plan.Changes, Change{Action: ChangeAddMember, Path: path, ExtID: extID, Role: role.String()})
+		case liveRole != nil && *liveRole != role:
+			p.plan.Changes = append(p.plan.Changes, Change{Action: ChangeUpdateRole, Path: path, ExtID: extID, Role: role.String(), PreviousRole: liveRole.String()})
+		}
+	}
+	for _, extID := range liveOrder {
+		if declared[extID] {
+			continue
+		}
+		change := Change{Action: ChangeRemoveMember, Path: path, ExtID: extID}
+		if role := liveRoles[extID]; role != nil {
+			change.Role = role.String()
+		}
+		p.plan.Changes = append(p.plan.Changes, change)
+	}
+	return nil
+}
+
+func (p *desiredPlanner) resolve(member DesiredMember) (ExternalIdentity, error) {
+	if member.ExtID != "" {
+		return member.ExtID, member.ExtID.CheckIfInternal(p.target)
+	}
+	if p.usersByEmail == nil {
+		users, err := p.target.GetAllUsers()
+		if err != nil {
+			return InvalidExternalIdentity, err
+		}
+		p.usersByEmail = make(map[string][]ExternalIdentity)
+		for _, user := range Uniq(users) {
+			for _, email := range lo.Uniq(lo.Compact(GetUserableEmails(user))) {
+				email = strings.ToLower(email)
+				p.usersByEmail[email] = append(p.usersByEmail[email], ExternalIdentityOfEntry(user))
+			}
+		}
+	}
+	switch extIDs := p.usersByEmail[strings.ToLower(member.Email)]; len(extIDs) {
+	case 0:
+		return InvalidExternalIdentity, fmt.Errorf("no user with email %s", member.Email)
+	case 1:
+		return extIDs[0], nil
+	default:
+		return InvalidExternalIdentity, fmt.Errorf("%d users with email %s", len(extIDs), member.Email)
+	}
+}
+
+var ErrUnappliableChange = errors.New("change cannot be applied")
+
+// Apply runs a single change, changes must be applied in plan order so
+// departments are created before their members and children.
+func (p *Plan) Apply(change Change) error {
+	switch change.Action {
+	case ChangeCreateDepartment:
+		parentPath, name := "", change.Path
+		if i := strings.LastIndex(change.Path, "/"); i >= 0 {
+			parentPath, name = change.Path[:i], change.Path[i+1:]
+		}
+		parent, ok := p.departments[parentPath]
+		if !ok {
+			return fmt.Errorf("parent of %s was not created", change.Path)
+		}
+		department := NewDepartment()
+		department.Name = name
+		department.Description = change.Description
+		created, err := parent.CreateChildDepartment(department)
+		if err != nil {
+			return err
+		}
+		p.departments[change.Path] = created
+		return nil
+	case ChangeUpdateDepartment:
+		department, ok := p.departments[change.Path]
+		if !ok {
+			return fmt.Errorf("department %s was not found", change.Path)
+		}
+		target := department.GetTarget()
+		editor, ok := As[DepartmentEditor](target)
+		if !ok {
+			return notSupported(target, "department updates")
+		}
+		updated := NewDepartment()
+		updated.Name = department.GetName()
+		updated.Description = change.Description
+		return Do(target, Call{Operation: "update_department", Write: true, Idempotent: true}, func() error {
+			entry, err := editor.UpdateDepartment(ExternalIdentityOfEntry(department), updated, InvalidExternalIdentity)
+			if err == nil {
+				p.departments[change.Path] = entry
+			}
+			return err
+		})
+	case ChangeAddMember, ChangeUpdateRole, ChangeRemoveMember:
+		department, ok := p.departments[change.Path]
+		if !ok {
+			return fmt.Errorf("department %s was not created", change.Path)
+		}
+		writer, ok := As[DepartmentUserWriter](department)
+		if !ok {
+			return notSupported(department.GetTarget(), "department membership changes")
+		}
+		role, err := ParseDepartmentUserRole(change.Role)
+		if err != nil {
+			return err
+		}
+		options := DepartmentModifyUserOptions{Role: role}
+		if change.Action == ChangeRemoveMember {
+			return Do(department, Call{Operation: "remove_from_department", Write: true, Idempotent: true}, func() error {
+				return writer.RemoveFromDepartment(options, change.ExtID)
+			})
+		}
+		return Do(department, Call{Operation: "add_to_department", Write: true, Idempotent: true}, func() error {
+			return writer.AddToDepartment(options, change.ExtID)
+		})
+	default:
+		return fmt.Errorf("%w: %s", ErrUnappliableChange, change.Action)
+	}
+}
@@ -0,0 +1,68 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func describedTree(t *testing.T, l *local, descriptions map[string]string) map[string]DepartmentableEntry {
+	t.Helper()
+	root, _ := l.GetRootDepartment()
+	departments := map[string]DepartmentableEntry{"": root}
+	for _, name := range []string{"eng", "sales", "ops"} {
+		department := NewDepartment()
+		department.Name, department.Description = name, descriptions[name]
+		created, err := root.CreateChildDepartment(department)
+		if err != nil {
+			t.Fatal(err)
+		}
+		departments[name] = created
+	}
+	return departments
+}
+
+func TestPlanDesiredStateUpdatesChangedDescriptions(t *testing.T) {
+	l := openTestLocal(t)
+	describedTree(t, l, map[string]string{"eng": "builds things", "sales": "sells things", "ops": "runs things"})
+	state := &DesiredState{Departments: []DesiredDepartment{
+		{Name: "eng", Description: "builds and runs things"},
+		{Name: "sales", Description: "sells things"},
+		// no description leaves the live one alone
+		{Name: "ops"},
+		{Name: "legal", Description: "reads things"},
+	}}
+	root, _ := l.GetRootDepartment()
+	plan, err := PlanDesiredState(root, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Action: ChangeUpdateDepartment, Path: "eng", Description: "builds and runs things", PreviousDescription: "builds things"},
+		{Action: ChangeCreateDepartment, Path: "legal", Description: "reads things"},
+	}
+	if !reflect.DeepEqual(plan.Changes, want) {
+		t.Fatalf("got changes %+v, want %+v", plan.Changes, want)
+	}
+	if drifts := DriftOfPlan(plan); drifts[0].Kind != DriftDescriptionMismatch || drifts[0].Expected != "builds and runs things" || drifts[0].Actual != "builds things" {
+		t.Errorf("got drift %s", drifts[0])
+	}
+
+	for _, change := range plan.Changes {
+		if err := plan.Apply(change); err != nil {
+			t.Fatalf("%s: %v", change, err)
+		}
+	}
+	root, _ = l.GetRootDepartment()
+	again, err := PlanDesiredState(root, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Changes) != 0 {
+		t.Errorf("got changes %+v after applying the plan", again.Changes)
+	}
+	for _, child := range root.GetChildDepartments() {
+		if child.GetName() == "eng" && child.GetDescription() != "builds and runs things" {
+			t.Errorf("eng is described %q", child.GetDescription())
+		}
+	}
+}
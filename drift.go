@@ -0,0 +1,195 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+)
+
+type DriftKind string
+
+const (
+	DriftMissingMember       DriftKind = "missing_member"
+	DriftExtraMember         DriftKind = "extra_member"
+	DriftRoleMismatch        DriftKind = "role_mismatch"
+	DriftRenamedDepartment   DriftKind = "renamed_department"
+	DriftDescriptionMismatch DriftKind = "description_mismatch"
+	DriftDanglingLink        DriftKind = "dangling_link"
+	DriftMissingDepartment   DriftKind = "missing_department"
+	DriftUnmanagedDepartment DriftKind = "unmanaged_department"
+	DriftUnlinkedMember      DriftKind = "unlinked_member"
+)
+
+// Drift is one difference found between a department and what it should
+// look like, either its linked department or a desired state file.
+type Drift struct {
+	Kind DriftKind `json:"kind"`
+	// Department is the center department of a link, Path the department
+	// path of a desired state file, only one of them is set.
+	Department ExternalIdentity `json:"department,omitempty"`
+	Path       string           `json:"path,omitempty"`
+	Linked     ExternalIdentity `json:"linked,omitempty"`
+	User       ExternalIdentity `json:"user,omitempty"`
+	Expected   string           `json:"expected,omitempty"`
+	Actual     string           `json:"actual,omitempty"`
+	Detail     string           `json:"detail,omitempty"`
+}
+
+func (d Drift) String() string {
+	where := string(d.Department)
+	if d.Path != "" {
+		where = d.Path
+	}
+	if d.Linked != "" {
+		where += " -> " + string(d.Linked)
+	}
+	msg := fmt.Sprintf("%s %s", d.Kind, where)
+	if d.User != "" {
+		msg += " " + string(d.User)
+	}
+	if d.Expected != "" || d.Actual != "" {
+		msg += fmt.Sprintf(" (expected %q, actual %q)", d.Expected, d.Actual)
+	}
+	if d.Detail != "" {
+		msg += ": " + d.Detail
+	}
+	return msg
+}
+
+// DetectLinkDrift walks the tree of an EntryCenter from department and
+// compares every department with each department linked to it. Members are
+// mapped to the linked target through the extIDs stored on center users.
+func DetectLinkDrift(department DepartmentableEntry) (drifts []Drift, pairs int, err error) {
+	if storeable, ok := As[EntryExtIDStoreable](department); ok {
+		if links := storeable.GetExternalIdentities(); len(links) != 0 {
+			members, err := department.GetUsers()
+			if err != nil {
+				return nil, pairs, BranchError{Department: department, Err: err}
+			}
+			members = Uniq(members)
+			for _, link := range links {
+				if link.GetPlatform() == ClientLinkPlatform {
+					continue
+				}
+				pairs++
+				pairDrifts, err := detectPairDrift(department, members, link)
+				if err != nil {
+					return nil, pairs, BranchError{Department: department, Err: err}
+				}
+				drifts = append(drifts, pairDrifts...)
+			}
+		}
+	}
+	for _, child := range department.GetChildDepartments() {
+		childDrifts, childPairs, err := DetectLinkDrift(child)
+		pairs += childPairs
+		if err != nil {
+			return nil, pairs, err
+		}
+		drifts = append(drifts, childDrifts...)
+	}
+	return drifts, pairs, nil
+}
+
+func detectPairDrift(center DepartmentableEntry, members []UserableEntry, link ExternalIdentity) (drifts []Drift, err error) {
+	centerExtID := ExternalIdentityOfEntry(center)
+	dangling := func(err error) []Drift {
+		return []Drift{{Kind: DriftDanglingLink, Department: centerExtID, Linked: link, Detail: err.Error()}}
+	}
+	target, err := link.GetTarget()
+	if errors.Is(err, ErrNotFound) {
+		return dangling(err), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	linked, err := target.LookupEntryDepartmentByInternalExternalIdentity(link)
+	if errors.Is(err, ErrNotFound) {
+		return dangling(err), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup linked department %s: %w", link, err)
+	}
+	if linked.GetName() != center.GetName() {
+		drifts = append(drifts, Drift{Kind: DriftRenamedDepartment, Department: centerExtID, Linked: link,
+			Expected: center.GetName(), Actual: linked.GetName()})
+	}
+
+	expected := make(map[ExternalIdentity]*DepartmentUserRole)
+	var expectedOrder []ExternalIdentity
+	for _, member := range members {
+		var linkedUser ExternalIdentity
+		if storeable, ok := As[EntryExtIDStoreable](member); ok {
+			for _, extID := range storeable.GetExternalIdentities() {
+				if extID.CheckIfInternal(target) == nil {
+					linkedUser = extID
+					break
+				}
+			}
+		}
+		if linkedUser == "" {
+			drifts = append(drifts, Drift{Kind: DriftUnlinkedMember, Department: centerExtID, Linked: link,
+				User: ExternalIdentityOfEntry(member), Detail: "no linked user on the target of the link"})
+			continue
+		}
+		expected[linkedUser] = nil
+		if withRole, ok := member.(UserableWithRole); ok {
+			role := withRole.GetRole()
+			expected[linkedUser] = &role
+		}
+		expectedOrder = append(expectedOrder, linkedUser)
+	}
+
+	users, err := linked.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	actual := make(map[ExternalIdentity]bool)
+	for _, user := range Uniq(users) {
+		extID := ExternalIdentityOfEntry(user)
+		actual[extID] = true
+		role, isExpected := expected[extID]
+		if !isExpected {
+			drifts = append(drifts, Drift{Kind: DriftExtraMember, Department: centerExtID, Linked: link, User: extID})
+			continue
+		}
+		if withRole, ok := user.(UserableWithRole); ok && role != nil && withRole.GetRole() != *role {
+			drifts = append(drifts, Drift{Kind: DriftRoleMismatch, Department: centerExtID, Linked: link, User: extID,
+				Expected: role.String(), Actual: withRole.GetRole().String()})
+		}
+	}
+	for _, extID := range expectedOrder {
+		if !actual[extID] {
+			drifts = append(drifts, Drift{Kind: DriftMissingMember, Department: centerExtID, Linked: link, User: extID})
+		}
+	}
+	return drifts, nil
+}
+
+// DriftOfPlan reports the changes of a desired state plan as drifts.
+func DriftOfPlan(plan *Plan) (drifts []Drift) {
+	for _, change := range plan.Changes {
+		drift := Drift{Path: change.Path, User: change.ExtID}
+		switch change.Action {
+		case ChangeCreateDepartment:
+			drift.Kind = DriftMissingDepartment
+		case ChangeUpdateDepartment:
+			drift.Kind = DriftDescriptionMismatch
+			drift.Expected, drift.Actual = change.Description, change.PreviousDescription
+		case ChangeAddMember:
+			drift.Kind = DriftMissingMember
+			drift.Expected = change.Role
+		case ChangeRemoveMember:
+			drift.Kind = DriftExtraMember
+			drift.Actual = change.Role
+		case ChangeUpdateRole:
+			drift.Kind = DriftRoleMismatch
+			drift.Expected, drift.Actual = change.Role, change.PreviousRole
+		case ChangeUnmanagedDepartment:
+			drift.Kind = DriftUnmanagedDepartment
+		default:
+			continue
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts
+}
@@ -0,0 +1,76 @@
+package manager
+
+import (
+	"errors"
+	"testing"
+)
+
+// lookupFailingTarget fails every department lookup like a target that
+// is down.
+type lookupFailingTarget struct {
+	*local
+	err error
+}
+
+func (t lookupFailingTarget) LookupEntryDepartmentByInternalExternalIdentity(ExternalIdentity) (DepartmentableEntry, error) {
+	return nil, t.err
+}
+
+// register adds targets to Targets for the test.
+func register(t *testing.T, targets ...Target) {
+	for _, target := range targets {
+		key := TargetKey(target)
+		Targets[key] = target
+		t.Cleanup(func() { delete(Targets, key) })
+	}
+}
+
+func linkTo(t *testing.T, department DepartmentableEntry, links ...ExternalIdentity) {
+	t.Helper()
+	if err := department.(*localDepartment).SetExternalIdentities(links); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectLinkDriftReportsMissingLinkedDepartments(t *testing.T) {
+	hub, mirror := openTestLocal(t), openTestLocalAs(t, "mirror")
+	register(t, mirror)
+	gone := tree(t, mirror, "gone")["gone"]
+	goneID := ExternalIdentityOfDepartment(mirror, gone)
+	if err := mirror.DeleteDepartment(goneID); err != nil {
+		t.Fatal(err)
+	}
+	departments := tree(t, hub, "eng", "sales")
+	linkTo(t, departments["eng"], goneID)
+	linkTo(t, departments["sales"], ExternalIdentity("ei.dept.1@nowhere.local"))
+
+	root, _ := hub.GetRootDepartment()
+	drifts, pairs, err := DetectLinkDrift(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs != 2 || len(drifts) != 2 {
+		t.Fatalf("got %d pairs and drifts %v, want 2 dangling links", pairs, drifts)
+	}
+	for _, drift := range drifts {
+		if drift.Kind != DriftDanglingLink {
+			t.Errorf("got %s, want a dangling link", drift)
+		}
+	}
+}
+
+func TestDetectLinkDriftReturnsLookupFailures(t *testing.T) {
+	hub := openTestLocal(t)
+	boom := errors.New("503 service unavailable")
+	flaky := lookupFailingTarget{local: openTestLocalAs(t, "flaky"), err: boom}
+	register(t, flaky)
+	linked := tree(t, flaky.local, "eng")["eng"]
+	linkTo(t, tree(t, hub, "eng")["eng"], ExternalIdentityOfDepartment(flaky, linked))
+
+	root, _ := hub.GetRootDepartment()
+	drifts, _, err := DetectLinkDrift(root)
+	var branchErr BranchError
+	if !errors.Is(err, boom) || !errors.As(err, &branchErr) || branchErr.Department.GetName() != "eng" {
+		t.Errorf("got drifts %v and error %v, want the lookup failure of eng", drifts, err)
+	}
+}
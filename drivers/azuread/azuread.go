@@ -10,9 +10,8 @@ import (
 	azurego "github.com/microsoft/kiota-authentication-azure-go"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
 	"github.com/microsoftgraph/msgraph-sdk-go/groups"
-	"github.com/microsoftgraph/msgraph-sdk-go/groups/item/members"
-	"github.com/microsoftgraph/msgraph-sdk-go/groups/item/owners"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
 	"github.com/microsoftgraph/msgraph-sdk-go/users"
 	usersitem "github.com/microsoftgraph/msgraph-sdk-go/users/item"
 	. "github.com/org-tools/manager"
@@ -26,10 +25,15 @@ type azureAD struct {
 	client  *msgraphsdk.GraphServiceClient
 	adapter abstractions.RequestAdapter
 	config  *azureADConfig
+	logger  Logger
 }
 
 func init() {
-	RegisterPlatform("github", &azureAD{})
+	RegisterPlatform("azuread", &azureAD{})
+}
+
+func (a *azureAD) SetLogger(logger Logger) {
+	a.logger = logger
 }
 
 var defaultAzureADUserSelect = []string{
@@ -47,6 +51,12 @@ var defaultAzureADUserSelect = []string{
 	"otherMails",
 }
 
+var azureADGroupSelect = []string{
+	"id",
+	"displayName",
+	"description",
+}
+
 func (a *azureAD) GetTarget() Target {
 	return a
 }
@@ -156,7 +166,7 @@ func (d *azureAD) LookupEntryDepartmentByExternalIdentity(extID ExternalIdentity
 
 func (d *azureAD) lookupAzureADGroupByExternalIdentity(extID ExternalIdentity) (*azureADGroup, error) {
 	if extID.GetTargetSlug() == d.config.Slug && extID.GetPlatform() == d.config.Platform {
-		return d.lookupAzureADGroupByExternalIdentity(extID)
+		return d.lookupAzureADGroupByInternalExternalIdentity(extID)
 	}
 	requestParameters := &groups.GroupsRequestBuilderGetQueryParameters{
 		Search: proto.String(fmt.Sprintf(`"description:%s"`, extID)),
@@ -199,6 +209,9 @@ func (d *azureAD) LookupEntryDepartmentByInternalExternalIdentity(internalExtID
 
 func (d *azureAD) lookupAzureADGroupByInternalExternalIdentity(internalExtID ExternalIdentity) (*azureADGroup, error) {
 	group, err := d.client.GroupsById(internalExtID.GetEntryID()).Get()
+	if isODataError(err, "Request_ResourceNotFound", "") {
+		return nil, NotFound(err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -206,6 +219,19 @@ func (d *azureAD) lookupAzureADGroupByInternalExternalIdentity(internalExtID Ext
 }
 
 func (d *azureAD) CreateUser(options Userable) (UserableEntry, error) {
+	newUser, err := newAzureADUser(options)
+	if err != nil {
+		return nil, err
+	}
+	user, err := d.client.Users().Post(newUser)
+	if err != nil {
+		return nil, err
+	}
+	return &azureADUser{azureAD: d, raw: user}, err
+}
+
+// newAzureADUser builds the user CreateUser and CreateUsers post.
+func newAzureADUser(options Userable) (models.Userable, error) {
 	newUser := models.NewUser()
 	newUser.SetAccountEnabled(proto.Bool(true))
 	newUser.SetDisplayName(proto.String(options.GetName()))
@@ -227,11 +253,7 @@ func (d *azureAD) CreateUser(options Userable) (UserableEntry, error) {
 	newPasswordProfile.SetPassword(proto.String(newPassword))
 	newUser.SetPasswordProfile(newPasswordProfile)
 	// newUser.SetUserPrincipalName(proto.String(fmt.Sprintf("%s@%s", options.GetMailNickname(), d.config.EmailDomain)))
-	user, err := d.client.Users().Post(newUser)
-	if err != nil {
-		return nil, err
-	}
-	return &azureADUser{azureAD: d, raw: user}, err
+	return newUser, nil
 }
 
 type AzureADGroupRole string
@@ -248,10 +270,53 @@ func castAzureADGroupRoleFromDepartmentUserRole(role DepartmentUserRole) AzureAD
 	}[role]
 }
 
+// isODataError matches the error code Graph answers with, and part of the
+// message when the code alone is too broad.
+func isODataError(err error, code, message string) bool {
+	var odataErr *odataerrors.ODataError
+	if !errors.As(err, &odataErr) || odataErr.GetError() == nil {
+		return false
+	}
+	return lo.FromPtr(odataErr.GetError().GetCode()) == code &&
+		strings.Contains(lo.FromPtr(odataErr.GetError().GetMessage()), message)
+}
+
+// postAddToAzureADGroup adds a $ref to the owners or members of the group,
+// adding one that already exists is not an error.
 func (g *azureAD) postAddToAzureADGroup(role AzureADGroupRole, groupID, objectID string) error {
 	requestBody := models.NewReferenceCreate()
 	requestBody.SetOdataId(proto.String("https://graph.microsoft.com/v1.0/directoryObjects/" + objectID))
-	return g.client.GroupsById(groupID).Members().Ref().Post(requestBody)
+	var err error
+	switch role {
+	case AzureADGroupRoleOwner:
+		err = g.client.GroupsById(groupID).Owners().Ref().Post(requestBody)
+	case AzureADGroupRoleMember:
+		err = g.client.GroupsById(groupID).Members().Ref().Post(requestBody)
+	default:
+		return errors.New("Role Mapping not found")
+	}
+	if isODataError(err, "Request_BadRequest", "already exist") {
+		return nil
+	}
+	return err
+}
+
+// deleteFromAzureADGroup deletes the $ref of the object from the owners or
+// members of the group, deleting one that does not exist is not an error.
+func (g *azureAD) deleteFromAzureADGroup(role AzureADGroupRole, groupID, objectID string) error {
+	var err error
+	switch role {
+	case AzureADGroupRoleOwner:
+		err = g.client.GroupsById(groupID).OwnersById(objectID).Ref().Delete()
+	case AzureADGroupRoleMember:
+		err = g.client.GroupsById(groupID).MembersById(objectID).Ref().Delete()
+	default:
+		return errors.New("Role Mapping not found")
+	}
+	if isODataError(err, "Request_ResourceNotFound", "") {
+		return nil
+	}
+	return err
 }
 
 type azureADGroup struct {
@@ -268,14 +333,19 @@ func (g azureADGroup) GetName() (name string) {
 }
 
 func (g azureADGroup) GetDescription() (name string) {
-	return *g.raw.GetDescription()
+	return lo.FromPtr(g.raw.GetDescription())
 }
 
+// GetChildDepartments lists the group members with the properties of
+// azureADGroup selected, so the groups need no lookup of their own.
 func (g azureADGroup) GetChildDepartments() (departments []DepartmentableEntry) {
-	groups, _ := g.client.GroupsById(*g.raw.GetId()).Members().Get()
-	for _, v := range groups.GetValue() {
-		if *v.GetAdditionalData()["@odata.type"].(*string) == "#microsoft.graph.group" {
-			group, _ := g.client.GroupsById(*v.GetId()).Get()
+	lists, err := g.listDirectoryObjects(azureADGroupPath(*g.raw.GetId(), "members", "microsoft.graph.group", azureADGroupSelect))
+	if err != nil {
+		g.logger.WithError(err).WithField("group", *g.raw.GetId()).Error("list child groups failed")
+		return departments
+	}
+	for _, v := range lists[0] {
+		if group, isGroup := v.(models.Groupable); isGroup {
 			departments = append(departments, &azureADGroup{
 				azureAD: g.azureAD,
 				raw:     group,
@@ -305,54 +375,87 @@ func (g *azureADGroup) CreateChildDepartment(department Departmentable) (Departm
 	}, err
 }
 
+// GetUsers returns the user members and owners of the group, owners have
+// the admin role whether or not they are members too. Members and owners
+// are listed in the same batches.
 func (g *azureADGroup) GetUsers() (users []UserableEntry, err error) {
-	groups, err := g.client.GroupsById(*g.raw.GetId()).Members().
-		GetWithRequestConfigurationAndResponseHandler(&members.MembersRequestBuilderGetRequestConfiguration{
-			QueryParameters: &members.MembersRequestBuilderGetQueryParameters{
-				Select: defaultAzureADUserSelect,
-			},
-		}, nil)
+	lists, err := g.listDirectoryObjects(
+		azureADGroupPath(*g.raw.GetId(), "members", "microsoft.graph.user", defaultAzureADUserSelect),
+		azureADGroupPath(*g.raw.GetId(), "owners", "microsoft.graph.user", defaultAzureADUserSelect),
+	)
 	if err != nil {
-		return
+		return nil, err
 	}
-	for _, member := range groups.GetValue() {
-		if *member.GetAdditionalData()["@odata.type"].(*string) == "#microsoft.graph.user" {
-			user, _ := g.client.UsersById(*member.GetId()).Get()
-			users = append(users, &azureADUser{
-				azureAD: g.azureAD,
-				raw:     user,
+	admins := g.groupMembers(lists[1], DepartmentUserRoleAdmin)
+	ownerIDs := lo.Map(admins, func(admin UserableEntry, _ int) string { return admin.GetID() })
+	for _, member := range lists[0] {
+		if user, isUser := member.(models.Userable); isUser && !lo.Contains(ownerIDs, *user.GetId()) {
+			users = append(users, &azureADGroupMember{
+				azureADUser: &azureADUser{azureAD: g.azureAD, raw: user},
+				role:        DepartmentUserRoleMember,
 			})
 		}
 	}
-	return
+	return append(users, admins...), nil
 }
 
-func (g *azureADGroup) Admins() (users []UserableEntry) {
-	groups, _ := g.client.GroupsById(*g.raw.GetId()).Owners().
-		GetWithRequestConfigurationAndResponseHandler(&owners.OwnersRequestBuilderGetRequestConfiguration{
-			QueryParameters: &owners.OwnersRequestBuilderGetQueryParameters{
-				Select: defaultAzureADUserSelect,
-			},
-		}, nil)
-	for _, v := range groups.GetValue() {
-		if *v.GetAdditionalData()["@odata.type"].(*string) == "#microsoft.graph.user" {
-			user, _ := g.client.UsersById(*v.GetId()).Get()
-			users = append(users, &azureADUser{
-				azureAD: g.azureAD,
-				raw:     user,
+// Admins returns the user owners of the group.
+func (g *azureADGroup) Admins() (users []UserableEntry, err error) {
+	lists, err := g.listDirectoryObjects(azureADGroupPath(*g.raw.GetId(), "owners", "microsoft.graph.user", defaultAzureADUserSelect))
+	if err != nil {
+		return nil, err
+	}
+	return g.groupMembers(lists[0], DepartmentUserRoleAdmin), nil
+}
+
+func (g *azureADGroup) groupMembers(objects []models.DirectoryObjectable, role DepartmentUserRole) (users []UserableEntry) {
+	for _, v := range objects {
+		if user, isUser := v.(models.Userable); isUser {
+			users = append(users, &azureADGroupMember{
+				azureADUser: &azureADUser{azureAD: g.azureAD, raw: user},
+				role:        role,
 			})
 		}
 	}
 	return users
 }
 
+// AddToDepartment makes the user a member, and an owner too for the admin
+// role. Owners added as members lose ownership, so it changes roles both
+// ways.
 func (g *azureADGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(g.azureAD); err != nil {
+		return err
+	}
 	azureADGroupRole := castAzureADGroupRoleFromDepartmentUserRole(options.Role)
-	return g.postAddToAzureADGroup(azureADGroupRole, *g.raw.GetId(), extID.GetEntryID())
+	if azureADGroupRole == "" {
+		return errors.New("Role Mapping not found")
+	}
+	if err := g.postAddToAzureADGroup(AzureADGroupRoleMember, *g.raw.GetId(), extID.GetEntryID()); err != nil {
+		return err
+	}
+	if azureADGroupRole == AzureADGroupRoleOwner {
+		return g.postAddToAzureADGroup(AzureADGroupRoleOwner, *g.raw.GetId(), extID.GetEntryID())
+	}
+	admins, err := g.Admins()
+	if err != nil {
+		return err
+	}
+	if !lo.ContainsBy(admins, func(admin UserableEntry) bool { return admin.GetID() == extID.GetEntryID() }) {
+		return nil
+	}
+	return g.deleteFromAzureADGroup(AzureADGroupRoleOwner, *g.raw.GetId(), extID.GetEntryID())
 }
 
+// RemoveFromDepartment deletes both the member and the owner $ref.
 func (g *azureADGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
-	panic("not implemented") // TODO: Implement
+	if err := extID.CheckIfInternal(g.azureAD); err != nil {
+		return err
+	}
+	if err := g.deleteFromAzureADGroup(AzureADGroupRoleMember, *g.raw.GetId(), extID.GetEntryID()); err != nil {
+		return err
+	}
+	return g.deleteFromAzureADGroup(AzureADGroupRoleOwner, *g.raw.GetId(), extID.GetEntryID())
 }
 
 func (u *azureADGroup) GetExternalIdentities() ExternalIdentities {
@@ -380,6 +483,16 @@ type azureADUser struct {
 	raw models.Userable
 }
 
+// azureADGroupMember is a user as a member or owner of a group.
+type azureADGroupMember struct {
+	*azureADUser
+	role DepartmentUserRole
+}
+
+func (m azureADGroupMember) GetRole() DepartmentUserRole {
+	return m.role
+}
+
 func (u azureADUser) GetID() string {
 	return *u.raw.GetId()
 }
@@ -389,11 +502,11 @@ func (u azureADUser) GetName() string {
 }
 
 func (u azureADUser) GetEmail() string {
-	return *u.raw.GetMail()
+	return lo.FromPtr(u.raw.GetMail())
 }
 
 func (u azureADUser) GetPhone() string {
-	return *u.raw.GetMobilePhone()
+	return lo.FromPtr(u.raw.GetMobilePhone())
 }
 
 func (u azureADUser) GetExternalIdentities() ExternalIdentities {
@@ -401,6 +514,13 @@ func (u azureADUser) GetExternalIdentities() ExternalIdentities {
 }
 
 func (u azureADUser) SetExternalIdentities(extIDs ExternalIdentities) error {
+	newUser := models.NewUser()
+	newUser.SetOtherMails(u.otherMailsWith(extIDs))
+	return u.client.UsersById(*u.raw.GetId()).Patch(newUser)
+}
+
+// otherMailsWith replaces the extIDs among the otherMails of u.
+func (u azureADUser) otherMailsWith(extIDs ExternalIdentities) []string {
 	newOtherMails := make([]string, 0)
 	for _, mail := range u.raw.GetOtherMails() {
 		if _, err := ExternalIdentityParseString(mail); err != nil {
@@ -412,9 +532,7 @@ func (u azureADUser) SetExternalIdentities(extIDs ExternalIdentities) error {
 			newOtherMails = append(newOtherMails, string(extID))
 		}
 	}
-	newUser := models.NewUser()
-	newUser.SetOtherMails(newOtherMails)
-	return u.client.UsersById(*u.raw.GetId()).Patch(newUser)
+	return newOtherMails
 }
 
 func (u azureADUser) GetEmailSet() (emails []string) {
@@ -0,0 +1,488 @@
+package azuread
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/microsoft/kiota-abstractions-go/authentication"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	. "github.com/org-tools/manager"
+)
+
+// graph answers Graph requests below /v1.0 with route, including each
+// request of a $batch. Requests are logged as "METHOD path?query", batched
+// ones with their headers in batched as well.
+type graph struct {
+	route func(method, path string, query url.Values, body []byte) (status int, reply string)
+
+	mu       sync.Mutex
+	requests []string
+	batched  []azureADBatchRequest
+	batches  int
+}
+
+func (g *graph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	path := strings.TrimPrefix(r.URL.Path, "/v1.0")
+	w.Header().Set("Content-Type", "application/json")
+	if path != "/$batch" {
+		status, reply := g.answer(r.Method, path, r.URL.RawQuery, body)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(reply))
+		return
+	}
+	var batch struct {
+		Requests []azureADBatchRequest `json:"requests"`
+	}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g.mu.Lock()
+	g.batches++
+	g.batched = append(g.batched, batch.Requests...)
+	g.mu.Unlock()
+	var responses []map[string]any
+	for _, request := range batch.Requests {
+		path, query, _ := strings.Cut(request.URL, "?")
+		status, reply := g.answer(request.Method, path, query, request.Body)
+		responses = append(responses, map[string]any{"id": request.ID, "status": status, "body": json.RawMessage(reply)})
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"responses": responses})
+}
+
+func (g *graph) answer(method, path, rawQuery string, body []byte) (int, string) {
+	query, _ := url.ParseQuery(rawQuery)
+	g.mu.Lock()
+	g.requests = append(g.requests, method+" "+path+"?"+query.Encode())
+	g.mu.Unlock()
+	status, reply := g.route(method, path, query, body)
+	if reply == "" {
+		reply = "{}"
+	}
+	return status, reply
+}
+
+func odataError(code, message string) string {
+	return `{"error":{"code":"` + code + `","message":"` + message + `"}}`
+}
+
+func connectGraph(t *testing.T, g *graph) *azureAD {
+	t.Helper()
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	adapter, err := msgraphsdk.NewGraphRequestAdapterWithParseNodeFactoryAndSerializationWriterFactoryAndHttpClient(
+		&authentication.AnonymousAuthenticationProvider{}, nil, nil, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter.SetBaseUrl(server.URL + "/v1.0")
+	return &azureAD{
+		adapter: adapter,
+		client:  msgraphsdk.NewGraphServiceClient(adapter),
+		config:  &azureADConfig{Platform: "azuread", Slug: "aad", RootGroupID: "root"},
+		logger:  Log,
+	}
+}
+
+// openLocal opens the local target hub in a temporary file.
+func openLocal(t *testing.T) Target {
+	t.Helper()
+	dsn := t.TempDir() + "/hub.db"
+	local, err := InitTarget("local", func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"local","Slug":"hub","FileDSN":"`+dsn+`"}`), v)
+	}, Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local
+}
+
+func TestAzureADResolvesOwnGroupExtIDByID(t *testing.T) {
+	g := &graph{route: func(method, path string, query url.Values, body []byte) (int, string) {
+		if path == "/groups/g1" {
+			return http.StatusOK, `{"id":"g1","displayName":"Eng"}`
+		}
+		return http.StatusNotFound, odataError("Request_ResourceNotFound", "not found")
+	}}
+	a := connectGraph(t, g)
+	group, err := a.LookupEntryDepartmentByExternalIdentity("ei.dept.g1@aad.azuread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.GetID() != "g1" || group.GetName() != "Eng" {
+		t.Errorf("resolved group %s %q", group.GetID(), group.GetName())
+	}
+	if len(g.requests) != 1 || !strings.HasPrefix(g.requests[0], "GET /groups/g1?") {
+		t.Errorf("got requests %q, want one read of the group", g.requests)
+	}
+}
+
+func TestAzureADMembershipRefs(t *testing.T) {
+	g := &graph{route: func(method, path string, query url.Values, body []byte) (int, string) {
+		switch {
+		case path == "/groups/g1":
+			return http.StatusOK, `{"id":"g1","displayName":"Eng"}`
+		case method == http.MethodPost && strings.Contains(string(body), "directoryObjects/u1"):
+			return http.StatusBadRequest, odataError("Request_BadRequest", "One or more added object references already exist for the following modified properties: 'members'.")
+		case method == http.MethodPost:
+			return http.StatusNoContent, ""
+		case method == http.MethodDelete && strings.Contains(path, "/u3/"):
+			return http.StatusNotFound, odataError("Request_ResourceNotFound", "Resource 'u3' does not exist")
+		case method == http.MethodDelete:
+			return http.StatusNoContent, ""
+		case path == "/groups/g1/owners/microsoft.graph.user":
+			return http.StatusOK, `{"value":[{"@odata.type":"#microsoft.graph.user","id":"u1","displayName":"Ada"}]}`
+		}
+		return http.StatusNotFound, odataError("Request_ResourceNotFound", "not found")
+	}}
+	a := connectGraph(t, g)
+	eng, err := a.LookupEntryDepartmentByInternalExternalIdentity("ei.dept.g1@aad.azuread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := eng.(DepartmentUserWriter)
+	// u1 is an owner already a member, adding it as a member drops ownership
+	if err := writer.AddToDepartment(DepartmentModifyUserOptions{Role: DepartmentUserRoleMember}, "ei.user.u1@aad.azuread"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.AddToDepartment(DepartmentModifyUserOptions{Role: DepartmentUserRoleAdmin}, "ei.user.u2@aad.azuread"); err != nil {
+		t.Fatal(err)
+	}
+	// u3 is neither member nor owner
+	if err := writer.RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.u3@aad.azuread"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.AddToDepartment(DepartmentModifyUserOptions{Role: DepartmentUserRoleAdmin + 1}, "ei.user.u2@aad.azuread"); err == nil {
+		t.Error("added with a role that has no relation")
+	}
+	var writes []string
+	for _, request := range g.requests {
+		if !strings.HasPrefix(request, "GET ") {
+			writes = append(writes, strings.TrimSuffix(request, "?"))
+		}
+	}
+	want := []string{
+		"POST /groups/g1/members/$ref",
+		"DELETE /groups/g1/owners/u1/$ref",
+		"POST /groups/g1/members/$ref",
+		"POST /groups/g1/owners/$ref",
+		"DELETE /groups/g1/members/u3/$ref",
+		"DELETE /groups/g1/owners/u3/$ref",
+	}
+	if strings.Join(writes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got writes\n%s\nwant\n%s", strings.Join(writes, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// deltaRounds serves users/delta and groups/delta from pages keyed by
+// their delta or skip token, {base} in a page is the URL it was read from.
+func deltaRounds(base *string, users, groups map[string]string) func(method, path string, query url.Values, body []byte) (int, string) {
+	serve := func(rounds map[string]string, path string, query url.Values) (int, string) {
+		page, ok := rounds[query.Get("$deltatoken")+query.Get("$skiptoken")]
+		if !ok {
+			return http.StatusGone, odataError("syncStateNotFound", "sync state expired")
+		}
+		return http.StatusOK, strings.ReplaceAll(page, "{base}", *base+path)
+	}
+	return func(method, path string, query url.Values, body []byte) (int, string) {
+		if path == "/users/delta" {
+			return serve(users, path, query)
+		}
+		return serve(groups, path, query)
+	}
+}
+
+func TestAzureADChangesSinceFollowsNextLinks(t *testing.T) {
+	var base string
+	g := &graph{route: deltaRounds(&base, map[string]string{
+		"latest": `{"value":[],"@odata.deltaLink":"{base}?$deltatoken=u1"}`,
+		"u1":     `{"value":[{"id":"a","displayName":"Ada"}],"@odata.nextLink":"{base}?$skiptoken=u1p2"}`,
+		"u1p2":   `{"value":[{"id":"b","@removed":{"reason":"deleted"}}],"@odata.deltaLink":"{base}?$deltatoken=u2"}`,
+	}, map[string]string{
+		"latest": `{"value":[],"@odata.deltaLink":"{base}?$deltatoken=g1"}`,
+		"g1": `{"value":[
+			{"id":"eng","displayName":"Eng"},
+			{"id":"ops","members@delta":[
+				{"@odata.type":"#microsoft.graph.user","id":"a"},
+				{"@odata.type":"#microsoft.graph.user","id":"b","@removed":{"reason":"deleted"}},
+				{"@odata.type":"#microsoft.graph.group","id":"eng"}]},
+			{"id":"old","@removed":{"reason":"changed"}}],
+			"@odata.deltaLink":"{base}?$deltatoken=g2"}`,
+	})}
+	a := connectGraph(t, g)
+	base = a.adapter.GetBaseUrl()
+	changes, token, err := a.ChangesSince("")
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("first round returned %v, %v, want no changes", changes, err)
+	}
+	changes, token, err = a.ChangesSince(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(changes))
+	for _, change := range changes {
+		got = append(got, strings.TrimSpace(string(change.Type)+" "+string(change.ExtID)+" "+change.Name+" "+string(change.Member)))
+	}
+	want := []string{
+		"upsert ei.user.a@aad.azuread Ada",
+		"delete ei.user.b@aad.azuread",
+		"upsert ei.dept.eng@aad.azuread Eng",
+		"member_add ei.dept.ops@aad.azuread  ei.user.a@aad.azuread",
+		"member_remove ei.dept.ops@aad.azuread  ei.user.b@aad.azuread",
+		"delete ei.dept.old@aad.azuread",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got changes\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	var links azureADDeltaToken
+	if err := json.Unmarshal([]byte(token), &links); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(links.Users, "$deltatoken=u2") || !strings.HasSuffix(links.Groups, "$deltatoken=g2") {
+		t.Errorf("next token is %s, want the delta links of the last pages", token)
+	}
+	if _, _, err := a.ChangesSince(token); !errors.Is(err, ErrChangesExpired) {
+		t.Errorf("a link without sync state returned %v, want ErrChangesExpired", err)
+	}
+	if _, _, err := a.ChangesSince("not json"); !errors.Is(err, ErrChangesExpired) {
+		t.Errorf("a malformed token returned %v, want ErrChangesExpired", err)
+	}
+}
+
+func TestAzureADTrackChangesStoresTokenAfterHandling(t *testing.T) {
+	var base string
+	g := &graph{route: deltaRounds(&base, map[string]string{
+		"latest": `{"value":[],"@odata.deltaLink":"{base}?$deltatoken=u1"}`,
+		"u1":     `{"value":[{"id":"a","displayName":"Ada"}],"@odata.deltaLink":"{base}?$deltatoken=u2"}`,
+	}, map[string]string{
+		"latest": `{"value":[],"@odata.deltaLink":"{base}?$deltatoken=g1"}`,
+		"g1":     `{"value":[],"@odata.deltaLink":"{base}?$deltatoken=g2"}`,
+	})}
+	a := connectGraph(t, g)
+	base = a.adapter.GetBaseUrl()
+	store := openLocal(t).(DeltaTokenStore)
+	track := func(fail error) (got []EntryChange, baseline bool, err error) {
+		err = TrackChanges(a, store, "aad>hub", func(changes []EntryChange, isBaseline bool) error {
+			got, baseline = changes, isBaseline
+			return fail
+		})
+		return got, baseline, err
+	}
+	if _, baseline, err := track(nil); err != nil || !baseline {
+		t.Fatalf("first run returned baseline %v, %v", baseline, err)
+	}
+	failed := errors.New("handler failed")
+	if changes, _, err := track(failed); !errors.Is(err, failed) || len(changes) != 1 {
+		t.Fatalf("failing run handed %v and returned %v", changes, err)
+	}
+	// the failed run kept the token, so the change is handed again
+	changes, baseline, err := track(nil)
+	if err != nil || baseline || len(changes) != 1 || changes[0].ExtID != "ei.user.a@aad.azuread" {
+		t.Fatalf("retried run handed %v, baseline %v, %v", changes, baseline, err)
+	}
+	// u2 has no sync state, tracking starts over from latest
+	if _, baseline, err := track(nil); err != nil || !baseline {
+		t.Errorf("run after expiry returned baseline %v, %v, want a new baseline", baseline, err)
+	}
+	if token, _ := store.GetDeltaToken("other>hub"); token != "" {
+		t.Errorf("another consumer sees token %s", token)
+	}
+}
+
+// usersOf builds users of a with an email and a stale extID in otherMails.
+func usersOf(a *azureAD, ids ...string) (users []UserableEntry) {
+	for _, id := range ids {
+		id := id
+		user := models.NewUser()
+		user.SetId(&id)
+		user.SetOtherMails([]string{id + "@example.com", "ei.user.old@hr.feishu"})
+		users = append(users, &azureADUser{azureAD: a, raw: user})
+	}
+	return users
+}
+
+func TestAzureADSetExternalIdentitiesOfFailedBatch(t *testing.T) {
+	g := &graph{route: func(method, path string, query url.Values, body []byte) (int, string) {
+		return http.StatusNoContent, ""
+	}}
+	a := connectGraph(t, g)
+	users := usersOf(a, "u1", "u2")
+	extIDs := []ExternalIdentities{{"ei.user.1@hr.feishu"}, {"ei.user.2@hr.feishu"}}
+	if errs := a.SetExternalIdentitiesOf(users, extIDs); errs[0] != nil || errs[1] != nil {
+		t.Fatalf("patches returned %v", errs)
+	}
+	if len(g.batched) != 2 || g.batched[1].URL != "/users/u2" {
+		t.Fatalf("batched %v, want a patch of each user", g.batched)
+	}
+	patch := string(g.batched[0].Body)
+	if !strings.Contains(patch, `"u1@example.com"`) || !strings.Contains(patch, `"ei.user.1@hr.feishu"`) || strings.Contains(patch, "ei.user.old") {
+		t.Errorf("patched otherMails with %s, want the email kept and the extID replaced", patch)
+	}
+	// the whole batch failing fails every user instead of reading responses
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(odataError("serviceNotAvailable", "try later")))
+	}))
+	defer down.Close()
+	a.adapter.SetBaseUrl(down.URL + "/v1.0")
+	if errs := a.SetExternalIdentitiesOf(users, extIDs); len(errs) != 2 || errs[0] == nil || errs[1] == nil {
+		t.Errorf("failed batch returned %v, want an error for every user", errs)
+	}
+}
+
+func TestAzureADLookupUsersFallsBackToPhonesAndLinks(t *testing.T) {
+	local := openLocal(t)
+	grace, err := local.(UserWriteable).CreateUser(User{Name: "grace", Phone: "+1 555 0100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked := string(ExternalIdentityOfUser(local, grace))
+	g := &graph{route: func(method, path string, query url.Values, body []byte) (int, string) {
+		filter := query.Get("$filter")
+		switch {
+		case strings.Contains(filter, "'ada@example.com'"):
+			// the alias of ada and the phone of someone else match as well
+			return http.StatusOK, `{"value":[
+				{"id":"u9","mail":"ada.l@example.com","otherMails":["ADA@example.com"]},
+				{"id":"u8","mobilePhone":"+1 555 0199"}]}`
+		case strings.Contains(filter, "'"+linked+"'"):
+			return http.StatusOK, `{"value":[
+				{"id":"u2","mobilePhone":"+1 555 0100"},
+				{"id":"u3","mobilePhone":"+1 555 0100","otherMails":["` + linked + `"]}]}`
+		case strings.Contains(filter, "'+1 555 0199'"):
+			return http.StatusOK, `{"value":[{"id":"u5"},{"id":"u6"}]}`
+		}
+		return http.StatusOK, `{"value":[]}`
+	}}
+	a := connectGraph(t, g)
+	users := []Userable{
+		User{Email: "ada@example.com", Phone: "+1 555 0199"},
+		grace,
+		User{Phone: "+1 555 0199"},
+		User{Email: "nobody@example.com"},
+		User{Name: "nothing to match"},
+	}
+	found, errs := a.LookupUsers(users)
+	var got []string
+	for i := range users {
+		switch {
+		case errs[i] != nil:
+			got = append(got, "error")
+		case found[i] == nil:
+			got = append(got, "none")
+		default:
+			got = append(got, found[i].GetID())
+		}
+	}
+	// the linked user wins over the one sharing the phone, two users with
+	// nothing but the phone are ambiguous
+	if strings.Join(got, " ") != "u9 u3 error none none" {
+		t.Errorf("found %v", got)
+	}
+	if g.batches != 1 || len(g.batched) != 4 {
+		t.Fatalf("sent %d batches of %d lookups, want the users with anything to match in one", g.batches, len(g.batched))
+	}
+	for _, request := range g.batched {
+		query, _ := url.ParseQuery(strings.SplitN(request.URL, "?", 2)[1])
+		if query.Get("$count") != "true" || request.Headers["ConsistencyLevel"] != "eventual" {
+			t.Errorf("looked up with %s %v, want $count with eventual consistency", request.URL, request.Headers)
+		}
+	}
+	filter := func(i int) string {
+		query, _ := url.ParseQuery(strings.SplitN(g.batched[i].URL, "?", 2)[1])
+		return query.Get("$filter")
+	}
+	want := "mobilePhone eq '+1 555 0100' or businessPhones/any(p:p eq '+1 555 0100') or otherMails/any(m:m eq '" + linked + "')"
+	if filter(1) != want {
+		t.Errorf("looked grace up with %s, want %s", filter(1), want)
+	}
+}
+
+func TestAzureADBatchesInTwentiesAndResendsThrottled(t *testing.T) {
+	var attempts sync.Map
+	g := &graph{route: func(method, path string, query url.Values, body []byte) (int, string) {
+		var user struct {
+			DisplayName string `json:"displayName"`
+		}
+		_ = json.Unmarshal(body, &user)
+		// the first post of user7 is throttled
+		if n, _ := attempts.LoadOrStore(user.DisplayName, 0); user.DisplayName == "user7" && n == 0 {
+			attempts.Store(user.DisplayName, 1)
+			return http.StatusTooManyRequests, odataError("TooManyRequests", "slow down")
+		}
+		if user.DisplayName == "user13" {
+			return http.StatusBadRequest, odataError("Request_BadRequest", "property conflict")
+		}
+		return http.StatusCreated, `{"id":"id-` + user.DisplayName + `","displayName":"` + user.DisplayName + `"}`
+	}}
+	a := connectGraph(t, g)
+	var users []Userable
+	for i := 0; i < 21; i++ {
+		users = append(users, User{Name: "user" + strconv.Itoa(i), Phone: "+1 555 01" + strconv.Itoa(10+i)})
+	}
+	created, errs := a.CreateUsers(users)
+	for i := range users {
+		switch {
+		case i == 13:
+			var httpErr *HTTPError
+			if !errors.As(errs[i], &httpErr) || httpErr.Status != http.StatusBadRequest {
+				t.Errorf("user13 failed with %v, want the 400 of its response", errs[i])
+			}
+		case errs[i] != nil || created[i] == nil || created[i].GetID() != "id-user"+strconv.Itoa(i):
+			t.Errorf("user%d created %v, %v", i, created[i], errs[i])
+		}
+	}
+	if g.batches != 3 || len(g.batched) != 22 {
+		t.Errorf("sent %d batches of %d requests, want 20 and 1 then the throttled one again", g.batches, len(g.batched))
+	}
+}
+
+func TestAzureADGroupUsersPageMembersAndOwnersTogether(t *testing.T) {
+	var base string
+	g := &graph{route: func(method, path string, query url.Values, body []byte) (int, string) {
+		switch {
+		case path == "/groups/g1":
+			return http.StatusOK, `{"id":"g1","displayName":"Eng"}`
+		case path == "/groups/g1/members/microsoft.graph.user" && query.Get("$skiptoken") == "":
+			return http.StatusOK, `{"value":[{"@odata.type":"#microsoft.graph.user","id":"u1","displayName":"Ada"}],
+				"@odata.nextLink":"` + base + `/groups/g1/members/microsoft.graph.user?$skiptoken=p2"}`
+		case path == "/groups/g1/members/microsoft.graph.user":
+			return http.StatusOK, `{"value":[{"@odata.type":"#microsoft.graph.user","id":"u2","displayName":"Grace"}]}`
+		case path == "/groups/g1/owners/microsoft.graph.user":
+			return http.StatusOK, `{"value":[{"@odata.type":"#microsoft.graph.user","id":"u2","displayName":"Grace"}]}`
+		}
+		return http.StatusNotFound, odataError("Request_ResourceNotFound", "not found")
+	}}
+	a := connectGraph(t, g)
+	base = a.adapter.GetBaseUrl()
+	eng, err := a.LookupEntryDepartmentByInternalExternalIdentity("ei.dept.g1@aad.azuread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := eng.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, user := range users {
+		got = append(got, user.GetName()+":"+user.(UserableWithRole).GetRole().String())
+	}
+	// owners are admins whether or not they are members too
+	if want := "Ada:" + DepartmentUserRoleMember.String() + " Grace:" + DepartmentUserRoleAdmin.String(); strings.Join(got, " ") != want {
+		t.Errorf("got users %v, want %s", got, want)
+	}
+	if g.batches != 2 || len(g.batched) != 3 || g.batched[2].URL != "/groups/g1/members/microsoft.graph.user?$skiptoken=p2" {
+		t.Errorf("sent %d batches of %v, want members and owners together then the next page of members", g.batches, g.batched)
+	}
+}
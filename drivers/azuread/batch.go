@@ -0,0 +1,399 @@
+package azuread
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoft/kiota-abstractions-go/serialization"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	// azureADBatchSize is the most requests Graph takes in one $batch.
+	azureADBatchSize = 20
+	// azureADBatchAttempts bounds how often throttled requests of a batch
+	// are sent again.
+	azureADBatchAttempts = 3
+	azureADPageSize      = 999
+)
+
+type azureADBatchRequest struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type azureADBatchResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+func (r azureADBatchResponse) header() http.Header {
+	header := make(http.Header)
+	for key, value := range r.Headers {
+		header.Set(key, value)
+	}
+	return header
+}
+
+// err is the error of a failed response, an HTTPError so the retry
+// decorator classifies it like any other.
+func (r azureADBatchResponse) err() error {
+	if r.Status < http.StatusBadRequest {
+		return nil
+	}
+	return &HTTPError{Status: r.Status, Header: r.header(), Body: string(r.Body)}
+}
+
+// sendRaw sends a request to a full Graph URL through the adapter, so it
+// carries the same credentials as the SDK calls.
+func (a *azureAD) sendRaw(method abstractions.HttpMethod, rawURL string, content []byte) ([]byte, error) {
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	info := abstractions.NewRequestInformation()
+	info.Method = method
+	info.Headers["Accept"] = "application/json"
+	if content != nil {
+		info.Headers["Content-Type"] = "application/json"
+		info.Content = content
+	}
+	info.SetUri(*uri)
+	body, err := a.adapter.SendPrimitiveAsync(info, "[]byte", nil, abstractions.ErrorMappings{
+		"4XX": odataerrors.CreateODataErrorFromDiscriminatorValue,
+		"5XX": odataerrors.CreateODataErrorFromDiscriminatorValue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	bytes, _ := body.([]byte)
+	return bytes, nil
+}
+
+// batch sends requests through $batch, 20 at a time, and lines the
+// responses up with them. Throttled requests are sent again after the
+// longest wait Graph asked for.
+func (a *azureAD) batch(requests []azureADBatchRequest) ([]azureADBatchResponse, error) {
+	responses := make([]azureADBatchResponse, len(requests))
+	pending := lo.Range(len(requests))
+	for attempt := 1; len(pending) != 0; attempt++ {
+		var throttled []int
+		var wait time.Duration
+		for _, chunk := range lo.Chunk(pending, azureADBatchSize) {
+			var body struct {
+				Requests []azureADBatchRequest `json:"requests"`
+			}
+			for _, i := range chunk {
+				request := requests[i]
+				request.ID = strconv.Itoa(i)
+				body.Requests = append(body.Requests, request)
+			}
+			content, err := json.Marshal(body)
+			if err != nil {
+				return nil, err
+			}
+			raw, err := a.sendRaw(abstractions.POST, a.adapter.GetBaseUrl()+"/$batch", content)
+			if err != nil {
+				return nil, err
+			}
+			var got struct {
+				Responses []azureADBatchResponse `json:"responses"`
+			}
+			if err := json.Unmarshal(raw, &got); err != nil {
+				return nil, err
+			}
+			for _, response := range got.Responses {
+				i, err := strconv.Atoi(response.ID)
+				if err != nil || i < 0 || i >= len(requests) {
+					return nil, fmt.Errorf("unexpected batch response id %q", response.ID)
+				}
+				responses[i] = response
+				if response.Status == http.StatusTooManyRequests && attempt < azureADBatchAttempts {
+					throttled = append(throttled, i)
+					wait = lo.Max([]time.Duration{wait, RetryAfterFromHeader(response.header()), time.Second})
+				}
+			}
+		}
+		time.Sleep(lo.Ternary(len(throttled) != 0, wait, 0))
+		pending = throttled
+	}
+	return responses, nil
+}
+
+func parseAzureADBody[T any](body []byte, factory serialization.ParsableFactory) (t T, err error) {
+	node, err := serialization.DefaultParseNodeFactoryInstance.GetRootParseNode("application/json", body)
+	if err != nil {
+		return t, err
+	}
+	parsable, err := node.GetObjectValue(factory)
+	if err != nil {
+		return t, err
+	}
+	t, _ = parsable.(T)
+	return t, nil
+}
+
+func serializeAzureADBody(value serialization.Parsable) ([]byte, error) {
+	writer, err := serialization.DefaultSerializationWriterFactoryInstance.GetSerializationWriter("application/json")
+	if err != nil {
+		return nil, err
+	}
+	if err := writer.WriteObjectValue("", value); err != nil {
+		return nil, err
+	}
+	return writer.GetSerializedContent()
+}
+
+// listDirectoryObjects lists the collections at paths, the first pages of
+// all paths share batches and so do the pages after.
+func (a *azureAD) listDirectoryObjects(paths ...string) ([][]models.DirectoryObjectable, error) {
+	lists := make([][]models.DirectoryObjectable, len(paths))
+	pending := lo.Range(len(paths))
+	for len(pending) != 0 {
+		requests := lo.Map(pending, func(i int, _ int) azureADBatchRequest {
+			return azureADBatchRequest{Method: http.MethodGet, URL: paths[i]}
+		})
+		responses, err := a.batch(requests)
+		if err != nil {
+			return nil, err
+		}
+		var next []int
+		for j, i := range pending {
+			if err := responses[j].err(); err != nil {
+				return nil, err
+			}
+			page, err := parseAzureADBody[models.DirectoryObjectCollectionResponseable](responses[j].Body, models.CreateDirectoryObjectCollectionResponseFromDiscriminatorValue)
+			if err != nil {
+				return nil, err
+			}
+			lists[i] = append(lists[i], page.GetValue()...)
+			if link := lo.FromPtr(page.GetOdataNextLink()); link != "" {
+				paths[i] = strings.TrimPrefix(link, a.adapter.GetBaseUrl())
+				next = append(next, i)
+			}
+		}
+		pending = next
+	}
+	return lists, nil
+}
+
+func azureADGroupPath(groupID, relation, cast string, selects []string) string {
+	return fmt.Sprintf("/groups/%s/%s/%s?$select=%s&$top=%d", groupID, relation, cast, strings.Join(selects, ","), azureADPageSize)
+}
+
+func azureADFilterValue(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// lookupFilter matches the emails of user against mail, userPrincipalName
+// and otherMails, its phones against mobilePhone and businessPhones, and
+// for entries of another target the extID linked in otherMails. It is empty
+// for users with none of them.
+func lookupFilter(user Userable) string {
+	var clauses []string
+	for _, email := range lo.Compact(GetUserableEmails(user)) {
+		value := azureADFilterValue(email)
+		clauses = append(clauses,
+			"mail eq "+value,
+			"userPrincipalName eq "+value,
+			"otherMails/any(m:m eq "+value+")")
+	}
+	for _, phone := range lo.Compact(GetUserablePhones(user)) {
+		value := azureADFilterValue(phone)
+		clauses = append(clauses,
+			"mobilePhone eq "+value,
+			"businessPhones/any(p:p eq "+value+")")
+	}
+	if extID, ok := linkedExtID(user); ok {
+		clauses = append(clauses, "otherMails/any(m:m eq "+azureADFilterValue(string(extID))+")")
+	}
+	return strings.Join(clauses, " or ")
+}
+
+// linkedExtID is the extID a user of another target leaves in the
+// otherMails of the users it was synced to.
+func linkedExtID(user Userable) (ExternalIdentity, bool) {
+	entry, ok := user.(UserableEntry)
+	if !ok || entry.GetTarget() == nil {
+		return "", false
+	}
+	return ExternalIdentityOfUser(entry.GetTarget(), entry), true
+}
+
+// pickLookupMatch picks among the users lookupFilter matched the one linked
+// to user, then the only one matching an email, then the only one matching
+// a phone.
+func pickLookupMatch(user Userable, matched []models.Userable) (models.Userable, error) {
+	switch len(matched) {
+	case 0:
+		return nil, nil
+	case 1:
+		return matched[0], nil
+	}
+	if extID, ok := linkedExtID(user); ok {
+		if linked, ok := lo.Find(matched, func(u models.Userable) bool { return lo.Contains(u.GetOtherMails(), string(extID)) }); ok {
+			return linked, nil
+		}
+	}
+	emails := lo.Compact(GetUserableEmails(user))
+	byEmail := lo.Filter(matched, func(u models.Userable, _ int) bool {
+		return anyEqualFold(emails, append([]string{lo.FromPtr(u.GetMail()), lo.FromPtr(u.GetUserPrincipalName())}, u.GetOtherMails()...))
+	})
+	if len(byEmail) == 1 {
+		return byEmail[0], nil
+	}
+	if len(byEmail) == 0 {
+		phones := lo.Compact(GetUserablePhones(user))
+		byPhone := lo.Filter(matched, func(u models.Userable, _ int) bool {
+			return anyEqualFold(phones, append([]string{lo.FromPtr(u.GetMobilePhone())}, u.GetBusinessPhones()...))
+		})
+		if len(byPhone) == 1 {
+			return byPhone[0], nil
+		}
+	}
+	return nil, fmt.Errorf("found %d users for %s", len(matched), user.GetEmail())
+}
+
+func anyEqualFold(values, candidates []string) bool {
+	return lo.SomeBy(candidates, func(candidate string) bool {
+		return lo.ContainsBy(values, func(value string) bool { return strings.EqualFold(value, candidate) })
+	})
+}
+
+func (a *azureAD) LookupUser(user Userable) (UserableEntry, error) {
+	found, errs := a.LookupUsers([]Userable{user})
+	return found[0], errs[0]
+}
+
+// LookupUsers filters users as lookupFilter does, 20 users a request.
+func (a *azureAD) LookupUsers(users []Userable) (found []UserableEntry, errs []error) {
+	found, errs = make([]UserableEntry, len(users)), make([]error, len(users))
+	var requests []azureADBatchRequest
+	var indexes []int
+	for i, user := range users {
+		filter := lookupFilter(user)
+		if filter == "" {
+			continue
+		}
+		// lambda and phone filters are advanced queries, which need $count
+		// with eventual consistency
+		query := url.Values{"$filter": {filter}, "$select": {strings.Join(defaultAzureADUserSelect, ",")}, "$count": {"true"}}
+		requests = append(requests, azureADBatchRequest{
+			Method:  http.MethodGet,
+			URL:     "/users?" + query.Encode(),
+			Headers: map[string]string{"ConsistencyLevel": "eventual"},
+		})
+		indexes = append(indexes, i)
+	}
+	responses, err := a.batch(requests)
+	for j, i := range indexes {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if errs[i] = responses[j].err(); errs[i] != nil {
+			continue
+		}
+		page, err := parseAzureADBody[models.UserCollectionResponseable](responses[j].Body, models.CreateUserCollectionResponseFromDiscriminatorValue)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		match, err := pickLookupMatch(users[i], page.GetValue())
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if match != nil {
+			found[i] = &azureADUser{azureAD: a, raw: match}
+		}
+	}
+	return found, errs
+}
+
+// CreateUsers posts the users in batches, the users are built as by
+// CreateUser.
+func (a *azureAD) CreateUsers(users []Userable) (created []UserableEntry, errs []error) {
+	created, errs = make([]UserableEntry, len(users)), make([]error, len(users))
+	requests := make([]azureADBatchRequest, len(users))
+	for i, user := range users {
+		newUser, err := newAzureADUser(user)
+		if err != nil {
+			return created, lo.Map(errs, func(error, int) error { return err })
+		}
+		if requests[i].Body, err = serializeAzureADBody(newUser); err != nil {
+			return created, lo.Map(errs, func(error, int) error { return err })
+		}
+		requests[i].Method = http.MethodPost
+		requests[i].URL = "/users"
+		requests[i].Headers = map[string]string{"Content-Type": "application/json"}
+	}
+	responses, err := a.batch(requests)
+	if err != nil {
+		return created, lo.Map(errs, func(error, int) error { return err })
+	}
+	for i, response := range responses {
+		if errs[i] = response.err(); errs[i] != nil {
+			continue
+		}
+		user, err := parseAzureADBody[models.Userable](response.Body, models.CreateUserFromDiscriminatorValue)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		created[i] = &azureADUser{azureAD: a, raw: user}
+	}
+	return created, errs
+}
+
+// SetExternalIdentitiesOf patches the otherMails of users in batches, as
+// SetExternalIdentities does for one.
+func (a *azureAD) SetExternalIdentitiesOf(users []UserableEntry, extIDs []ExternalIdentities) (errs []error) {
+	errs = make([]error, len(users))
+	var requests []azureADBatchRequest
+	var indexes []int
+	for i, user := range users {
+		azureUser, ok := As[*azureADUser](user)
+		if !ok {
+			errs[i] = fmt.Errorf("user %s is not of %s", user.GetID(), TargetKey(a))
+			continue
+		}
+		patch := models.NewUser()
+		patch.SetOtherMails(azureUser.otherMailsWith(extIDs[i]))
+		body, err := serializeAzureADBody(patch)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		requests = append(requests, azureADBatchRequest{
+			Method:  http.MethodPatch,
+			URL:     "/users/" + azureUser.GetID(),
+			Headers: map[string]string{"Content-Type": "application/json"},
+			Body:    body,
+		})
+		indexes = append(indexes, i)
+	}
+	responses, err := a.batch(requests)
+	for j, i := range indexes {
+		if err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = responses[j].err()
+		}
+	}
+	return errs
+}
@@ -0,0 +1,140 @@
+package azuread
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	azureADDeltaUserSelect  = "id,displayName"
+	azureADDeltaGroupSelect = "id,displayName,description,members"
+)
+
+// azureADDeltaExpiredCodes are answered for delta links Graph no longer
+// keeps the sync state of.
+var azureADDeltaExpiredCodes = []string{"syncStateNotFound", "syncStateInvalid", "resyncRequired"}
+
+// azureADDeltaToken holds the delta links of users and groups, it is the
+// token of ChangesSince as JSON.
+type azureADDeltaToken struct {
+	Users  string `json:"users"`
+	Groups string `json:"groups"`
+}
+
+type azureADDeltaObject struct {
+	ID           string               `json:"id"`
+	OdataType    string               `json:"@odata.type"`
+	DisplayName  string               `json:"displayName"`
+	Removed      *json.RawMessage     `json:"@removed"`
+	MembersDelta []azureADDeltaObject `json:"members@delta"`
+}
+
+type azureADDeltaPage struct {
+	Value     []azureADDeltaObject `json:"value"`
+	NextLink  string               `json:"@odata.nextLink"`
+	DeltaLink string               `json:"@odata.deltaLink"`
+}
+
+// getRaw follows a delta link, links whose sync state is gone are
+// ErrChangesExpired.
+func (a *azureAD) getRaw(rawURL string) ([]byte, error) {
+	body, err := a.sendRaw(abstractions.GET, rawURL, nil)
+	var odataErr *odataerrors.ODataError
+	if errors.As(err, &odataErr) && odataErr.GetError() != nil &&
+		lo.Contains(azureADDeltaExpiredCodes, lo.FromPtr(odataErr.GetError().GetCode())) {
+		return nil, fmt.Errorf("%w: %s", ErrChangesExpired, err)
+	}
+	return body, err
+}
+
+// delta follows the next links of a delta round and returns the delta link
+// the next round starts from.
+func (a *azureAD) delta(link string) (objects []azureADDeltaObject, deltaLink string, err error) {
+	for link != "" {
+		body, err := a.getRaw(link)
+		if err != nil {
+			return nil, "", err
+		}
+		var page azureADDeltaPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, "", err
+		}
+		objects = append(objects, page.Value...)
+		link, deltaLink = page.NextLink, page.DeltaLink
+	}
+	return objects, deltaLink, nil
+}
+
+func (a *azureAD) userExtID(id string) ExternalIdentity {
+	user := models.NewUser()
+	user.SetId(&id)
+	return ExternalIdentityOfUser(a, &azureADUser{azureAD: a, raw: user})
+}
+
+func (a *azureAD) groupExtID(id string) ExternalIdentity {
+	group := models.NewGroup()
+	group.SetId(&id)
+	return ExternalIdentityOfDepartment(a, &azureADGroup{azureAD: a, raw: group})
+}
+
+// ChangesSince runs a round of users/delta and groups/delta. Groups are
+// every group of the tenant, not only those under RootGroupID, and only
+// user members are reported.
+func (a *azureAD) ChangesSince(token string) (changes []EntryChange, next string, err error) {
+	links := azureADDeltaToken{
+		Users:  a.adapter.GetBaseUrl() + "/users/delta?$deltatoken=latest&$select=" + azureADDeltaUserSelect,
+		Groups: a.adapter.GetBaseUrl() + "/groups/delta?$deltatoken=latest&$select=" + azureADDeltaGroupSelect,
+	}
+	if token != "" {
+		if err := json.Unmarshal([]byte(token), &links); err != nil {
+			return nil, "", fmt.Errorf("%w: %s", ErrChangesExpired, err)
+		}
+	}
+	users, usersLink, err := a.delta(links.Users)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, user := range users {
+		changes = append(changes, EntryChange{
+			Type:  lo.Ternary(user.Removed != nil, EntryChangeDelete, EntryChangeUpsert),
+			ExtID: a.userExtID(user.ID),
+			Name:  user.DisplayName,
+		})
+	}
+	groups, groupsLink, err := a.delta(links.Groups)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, group := range groups {
+		extID := a.groupExtID(group.ID)
+		if group.Removed != nil {
+			changes = append(changes, EntryChange{Type: EntryChangeDelete, ExtID: extID, Name: group.DisplayName})
+			continue
+		}
+		// groups whose members alone changed come back without their other
+		// properties
+		if group.DisplayName != "" || len(group.MembersDelta) == 0 {
+			changes = append(changes, EntryChange{Type: EntryChangeUpsert, ExtID: extID, Name: group.DisplayName})
+		}
+		for _, member := range group.MembersDelta {
+			if member.OdataType != "#microsoft.graph.user" {
+				continue
+			}
+			changes = append(changes, EntryChange{
+				Type:   lo.Ternary(member.Removed != nil, EntryChangeMemberRemove, EntryChangeMemberAdd),
+				ExtID:  extID,
+				Name:   group.DisplayName,
+				Member: a.userExtID(member.ID),
+			})
+		}
+	}
+	nextToken, err := json.Marshal(azureADDeltaToken{Users: usersLink, Groups: groupsLink})
+	return changes, string(nextToken), err
+}
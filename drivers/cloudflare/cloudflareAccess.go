@@ -0,0 +1,283 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	// cloudflareAccessUserPrefix marks ids of people only known by the email
+	// of an Access include rule, the email is encoded as ids cannot hold
+	// dots or @.
+	cloudflareAccessUserPrefix = "email-"
+	// cloudflareAccessPlaceholderDomain keeps groups without members valid,
+	// Access requires an include rule and nobody has an email under the
+	// reserved .invalid TLD.
+	cloudflareAccessPlaceholderDomain = "org-manager.invalid"
+)
+
+func accessUserID(email string) string {
+	return cloudflareAccessUserPrefix + base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(email)))
+}
+
+func accessUserEmail(id string) (string, bool) {
+	if !strings.HasPrefix(id, cloudflareAccessUserPrefix) {
+		return "", false
+	}
+	email, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(id, cloudflareAccessUserPrefix))
+	return string(email), err == nil
+}
+
+// isAccessGroupID tells Access group ids, which are UUIDs, from account
+// ids, which are 32 hex digits.
+func isAccessGroupID(id string) bool {
+	return strings.Contains(id, "-")
+}
+
+// cloudflareAccessUser is someone an Access group includes by email who
+// is not a member of the account.
+type cloudflareAccessUser struct {
+	*cloudflareDNS
+	email string
+}
+
+func (u *cloudflareAccessUser) GetTarget() Target {
+	return u.cloudflareDNS
+}
+
+func (u cloudflareAccessUser) GetID() string {
+	return accessUserID(u.email)
+}
+
+func (u cloudflareAccessUser) GetName() string {
+	return u.email
+}
+
+func (u cloudflareAccessUser) GetEmail() string {
+	return u.email
+}
+
+func (u cloudflareAccessUser) GetPhone() string {
+	return ""
+}
+
+func (c *cloudflareDNS) listAccessGroups(accountID string) (groups []cloudflare.AccessGroup, err error) {
+	options := cloudflare.PaginationOptions{PerPage: cloudflarePerPage}
+	for options.Page = 1; ; options.Page++ {
+		page, info, err := c.api.AccessGroups(context.Background(), accountID, options)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, page...)
+		if options.Page >= info.TotalPages {
+			return groups, nil
+		}
+	}
+}
+
+// lookupAccessGroup finds the account of an Access group by trying each
+// account, the id alone does not say which one it belongs to.
+func (c *cloudflareDNS) lookupAccessGroup(groupID string) (*cloudflareAccessGroup, error) {
+	accounts, err := c.listAccounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		group, err := c.api.AccessGroup(context.Background(), account.ID, groupID)
+		var notFound *cloudflare.NotFoundError
+		if errors.As(err, &notFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &cloudflareAccessGroup{cloudflareDNS: c, accountID: account.ID, raw: group}, nil
+	}
+	return nil, NotFound(fmt.Errorf("cloudflare access group %s not found", groupID))
+}
+
+// cloudflareAccessGroup is a Zero Trust Access group of an account, its
+// members are the email include rules.
+type cloudflareAccessGroup struct {
+	*cloudflareDNS
+	accountID string
+	raw       cloudflare.AccessGroup
+}
+
+func (g *cloudflareAccessGroup) GetTarget() Target {
+	return g.cloudflareDNS
+}
+
+func (g cloudflareAccessGroup) GetID() string {
+	return g.raw.ID
+}
+
+func (g cloudflareAccessGroup) GetName() string {
+	return g.raw.Name
+}
+
+func (g cloudflareAccessGroup) GetDescription() string {
+	return ""
+}
+
+func (g cloudflareAccessGroup) GetChildDepartments() (departments []DepartmentableEntry) {
+	return departments
+}
+
+func (g cloudflareAccessGroup) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	return nil, fmt.Errorf("%w: cloudflare access groups are flat, create %s under the account", ErrNotSupported, department.GetName())
+}
+
+// includedEmails returns the emails of the email include rules.
+func includedEmails(rules []interface{}) (emails []string) {
+	for _, rule := range rules {
+		if email, ok := includeRuleEmail(rule); ok {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+func includeRuleEmail(rule interface{}) (string, bool) {
+	switch rule := rule.(type) {
+	case cloudflare.AccessGroupEmail:
+		return strings.ToLower(rule.Email.Email), true
+	case map[string]interface{}:
+		if inner, ok := rule["email"].(map[string]interface{}); ok {
+			email, ok := inner["email"].(string)
+			return strings.ToLower(email), ok
+		}
+	}
+	return "", false
+}
+
+func isPlaceholderRule(rule interface{}) bool {
+	switch rule := rule.(type) {
+	case cloudflare.AccessGroupEmailDomain:
+		return rule.EmailDomain.Domain == cloudflareAccessPlaceholderDomain
+	case map[string]interface{}:
+		if inner, ok := rule["email_domain"].(map[string]interface{}); ok {
+			return inner["domain"] == cloudflareAccessPlaceholderDomain
+		}
+	}
+	return false
+}
+
+func placeholderRule() cloudflare.AccessGroupEmailDomain {
+	rule := cloudflare.AccessGroupEmailDomain{}
+	rule.EmailDomain.Domain = cloudflareAccessPlaceholderDomain
+	return rule
+}
+
+// includeRules rewrites the email include rules of rules to emails, other
+// rules are kept and the placeholder is only used when nothing is left.
+func includeRules(rules []interface{}, emails []string) (include []interface{}) {
+	for _, rule := range rules {
+		if _, isEmail := includeRuleEmail(rule); !isEmail && !isPlaceholderRule(rule) {
+			include = append(include, rule)
+		}
+	}
+	for _, email := range emails {
+		rule := cloudflare.AccessGroupEmail{}
+		rule.Email.Email = email
+		include = append(include, rule)
+	}
+	if len(include) == 0 {
+		include = append(include, placeholderRule())
+	}
+	return include
+}
+
+// GetUsers returns the emails the group includes, as the account member
+// with that email when there is one so a person has a single id.
+func (g cloudflareAccessGroup) GetUsers() (users []UserableEntry, err error) {
+	emails := includedEmails(g.raw.Include)
+	if len(emails) == 0 {
+		return nil, nil
+	}
+	members, err := g.listMembers(g.accountID)
+	if err != nil {
+		return nil, err
+	}
+	membersByEmail := lo.KeyBy(members, func(member cloudflare.AccountMember) string { return strings.ToLower(member.User.Email) })
+	for _, email := range lo.Uniq(emails) {
+		if member, ok := membersByEmail[email]; ok {
+			users = append(users, &cloudflareAccountMember{cloudflareDNS: g.cloudflareDNS, member: member})
+			continue
+		}
+		users = append(users, &cloudflareAccessUser{cloudflareDNS: g.cloudflareDNS, email: email})
+	}
+	return users, nil
+}
+
+// AddToDepartment adds an email include rule for the user, the role is
+// ignored as Access groups have none.
+func (g cloudflareAccessGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return g.updateEmails(extID, func(emails []string, email string) []string {
+		return lo.Uniq(append(emails, email))
+	})
+}
+
+func (g cloudflareAccessGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return g.updateEmails(extID, func(emails []string, email string) []string {
+		return lo.Without(emails, email)
+	})
+}
+
+func (g cloudflareAccessGroup) updateEmails(extID ExternalIdentity, update func(emails []string, email string) []string) error {
+	if err := extID.CheckIfInternal(g.cloudflareDNS); err != nil {
+		return err
+	}
+	user, err := g.LookupEntryUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return fmt.Errorf("error finding user %s: %s", extID, err)
+	}
+	if user.GetEmail() == "" {
+		return fmt.Errorf("cloudflare user %s has no email to include", extID)
+	}
+	current, err := g.api.AccessGroup(context.Background(), g.accountID, g.raw.ID)
+	if err != nil {
+		return err
+	}
+	before := includedEmails(current.Include)
+	emails := update(before, strings.ToLower(user.GetEmail()))
+	if len(emails) == len(before) && len(lo.Intersect(emails, before)) == len(emails) {
+		return nil
+	}
+	current.Include = includeRules(current.Include, emails)
+	_, err = g.api.UpdateAccessGroup(context.Background(), g.accountID, current)
+	return err
+}
+
+func (z cloudflareAccount) createAccessGroup(department Departmentable) (DepartmentableEntry, error) {
+	group, err := z.api.CreateAccessGroup(context.Background(), z.account.ID, cloudflare.AccessGroup{
+		Name:    department.GetName(),
+		Include: includeRules(nil, nil),
+		Exclude: []interface{}{},
+		Require: []interface{}{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cloudflareAccessGroup{cloudflareDNS: z.cloudflareDNS, accountID: z.account.ID, raw: group}, nil
+}
+
+func (z cloudflareAccount) accessGroups() (departments []DepartmentableEntry) {
+	groups, err := z.listAccessGroups(z.account.ID)
+	if err != nil {
+		// accounts without Zero Trust answer with an error
+		z.logger.WithError(err).WithField("account", z.account.ID).Warn("list cloudflare access groups failed")
+		return departments
+	}
+	for _, group := range groups {
+		departments = append(departments, &cloudflareAccessGroup{cloudflareDNS: z.cloudflareDNS, accountID: z.account.ID, raw: group})
+	}
+	return departments
+}
@@ -1,58 +1,123 @@
-package orgmanager
+package cloudflare
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/cloudflare/cloudflare-go"
 	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	// cloudflareRootID is the synthetic root department, accounts are its
+	// children and their Access groups are theirs.
+	cloudflareRootID            = "root"
+	cloudflareDefaultMemberRole = "Administrator Read Only"
+	cloudflareDefaultAdminRole  = "Super Administrator - All Privileges"
+	cloudflarePerPage           = 50
 )
 
 type cloudflareDNS struct {
 	api    *cloudflare.API
 	config *cloudflareConfig
+	logger Logger
+}
+
+func init() {
+	RegisterPlatform("cloudflare", &cloudflareDNS{})
 }
 
 type cloudflareConfig struct {
-	Platform  string
-	Slug      string
-	ApiKey    string
-	ApiEmail  string
-	ApiToken  string
+	Platform string
+	Slug     string
+	ApiKey   string
+	ApiEmail string
+	ApiToken string
+	// Account or AccountID limits the target to one account, every account
+	// the credentials can see is used otherwise.
 	Account   string
 	AccountID string
+	// MemberRole and AdminRole name the account roles members and admins
+	// of a department get.
+	MemberRole string
+	AdminRole  string
+	// EmailDomains are zones with Email Routing whose addresses forward to
+	// the primary email of their users.
+	EmailDomains []string
+	// BaseURL replaces https://api.cloudflare.com/client/v4, for a
+	// stand-in in tests.
+	BaseURL string
 }
 
+func (c *cloudflareDNS) SetLogger(logger Logger) {
+	c.logger = logger
+}
+
+// InitFormUnmarshaler keeps the retries of cloudflare-go, it retries rate
+// limits and server errors itself and only returns opaque errors after.
 func (c *cloudflareDNS) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
 	err := unmarshaler(&c.config)
 	if err != nil {
 		return nil, err
 	}
+	if c.config.MemberRole == "" {
+		c.config.MemberRole = cloudflareDefaultMemberRole
+	}
+	if c.config.AdminRole == "" {
+		c.config.AdminRole = cloudflareDefaultAdminRole
+	}
+	var options []cloudflare.Option
+	if c.config.BaseURL != "" {
+		options = append(options, cloudflare.BaseURL(strings.TrimRight(c.config.BaseURL, "/")))
+	}
 	switch {
 	case c.config.ApiToken != "":
-		c.api, err = cloudflare.NewWithAPIToken(c.config.ApiToken)
+		c.api, err = cloudflare.NewWithAPIToken(c.config.ApiToken, options...)
 	case c.config.ApiKey != "" && c.config.ApiEmail != "":
-		c.api, err = cloudflare.New(c.config.ApiKey, c.config.ApiEmail)
+		c.api, err = cloudflare.New(c.config.ApiKey, c.config.ApiEmail, options...)
 	default:
 		return nil, errors.New("should have api-token or api-key with api-email")
 	}
 	return c, err
 }
 
+// LookupEntryUserByInternalExternalIdentity also answers the ids of
+// people only included by Access groups, they carry their email.
 func (c *cloudflareDNS) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
-	if c.config.AccountID != "" {
-		c.GetRootDepartment()
+	if email, ok := accessUserEmail(internalExtID.GetEntryID()); ok {
+		return &cloudflareAccessUser{cloudflareDNS: c, email: email}, nil
 	}
-	member, err := c.api.AccountMember(context.Background(), c.config.AccountID, internalExtID.GetEntryID())
+	accounts, err := c.listAccounts()
 	if err != nil {
 		return nil, err
 	}
-	return &cloudflareAccountMember{cloudflareDNS: c, member: member}, nil
+	for _, account := range accounts {
+		member, err := c.findMember(account.ID, internalExtID.GetEntryID())
+		if err != nil {
+			return nil, err
+		}
+		if member != nil {
+			return &cloudflareAccountMember{cloudflareDNS: c, member: *member}, nil
+		}
+	}
+	return nil, fmt.Errorf("cloudflare member %s not found", internalExtID.GetEntryID())
 }
 
 func (c *cloudflareDNS) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	if internalExtID.GetEntryID() == cloudflareRootID {
+		return c.GetRootDepartment()
+	}
+	if isAccessGroupID(internalExtID.GetEntryID()) {
+		return c.lookupAccessGroup(internalExtID.GetEntryID())
+	}
 	account, _, err := c.api.Account(context.Background(), (internalExtID.GetEntryID()))
+	var notFound *cloudflare.NotFoundError
+	if errors.As(err, &notFound) {
+		return nil, NotFound(err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -72,28 +137,214 @@ func (c cloudflareDNS) GetPlatform() string {
 }
 
 func (c *cloudflareDNS) GetRootDepartment() (DepartmentableEntry, error) {
-	if c.config.AccountID == "" {
-		params := cloudflare.AccountsListParams{}
-		accounts, _, _ := c.api.Accounts(context.Background(), params)
-		for _, account := range accounts {
-			if account.Name == c.config.Account {
-				c.config.AccountID = account.ID
-				return &cloudflareAccount{cloudflareDNS: c, account: account}, nil
-			}
+	return &cloudflareAccount{cloudflareDNS: c}, nil
+}
+
+// listAccounts pages through the accounts of the credentials, keeping the
+// configured one when Account or AccountID is set.
+func (c *cloudflareDNS) listAccounts() (accounts []cloudflare.Account, err error) {
+	if c.config.AccountID != "" {
+		account, _, err := c.api.Account(context.Background(), c.config.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		return []cloudflare.Account{account}, nil
+	}
+	params := cloudflare.AccountsListParams{Name: c.config.Account}
+	params.PerPage = cloudflarePerPage
+	for params.Page = 1; ; params.Page++ {
+		page, info, err := c.api.Accounts(context.Background(), params)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, page...)
+		if params.Page >= info.TotalPages {
+			break
+		}
+	}
+	if c.config.Account != "" {
+		// the name filter of the API is not documented as an exact match
+		accounts = lo.Filter(accounts, func(account cloudflare.Account, _ int) bool { return account.Name == c.config.Account })
+		if len(accounts) == 0 {
+			return nil, fmt.Errorf("cloudflare account '%s' not found", c.config.Account)
 		}
-		return nil, fmt.Errorf("cloudflare account '%s' not found", c.config.Account)
 	}
+	return accounts, nil
+}
 
-	account, _, _ := c.api.Account(context.Background(), c.config.AccountID)
-	return &cloudflareAccount{cloudflareDNS: c, account: account}, nil
+func (c *cloudflareDNS) listMembers(accountID string) (members []cloudflare.AccountMember, err error) {
+	options := cloudflare.PaginationOptions{PerPage: cloudflarePerPage}
+	for options.Page = 1; ; options.Page++ {
+		page, info, err := c.api.AccountMembers(context.Background(), accountID, options)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if options.Page >= info.TotalPages {
+			return members, nil
+		}
+	}
+}
+
+// findMember finds the membership of a user in an account by the user id
+// members are identified with, it returns nil when there is none.
+func (c *cloudflareDNS) findMember(accountID, id string) (*cloudflare.AccountMember, error) {
+	members, err := c.listMembers(accountID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		if memberID(members[i]) == id {
+			return &members[i], nil
+		}
+	}
+	return nil, nil
 }
 
-func (c cloudflareDNS) GetAllUsers() (users []UserableEntry, err error) {
+// memberID is the user id, the same in every account, falling back to the
+// membership id for invitations not yet tied to a user.
+func memberID(member cloudflare.AccountMember) string {
+	return lo.Ternary(member.User.ID != "", member.User.ID, member.ID)
+}
+
+// defaultAccount is where CreateUser invites to, the configured account or
+// the only one the credentials can see.
+func (c *cloudflareDNS) defaultAccount() (*cloudflare.Account, error) {
+	accounts, err := c.listAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) != 1 {
+		return nil, fmt.Errorf("cloudflare credentials see %d accounts, set account or accountid to invite users", len(accounts))
+	}
+	return &accounts[0], nil
+}
+
+// roleIDs resolves account role names to their ids, role ids differ
+// between accounts.
+func (c *cloudflareDNS) roleIDs(accountID string, names ...string) (ids []string, err error) {
+	roles, err := c.api.AccountRoles(context.Background(), accountID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		role, ok := lo.Find(roles, func(role cloudflare.AccountRole) bool { return role.Name == name })
+		if !ok {
+			return nil, fmt.Errorf("cloudflare account %s has no role '%s'", accountID, name)
+		}
+		ids = append(ids, role.ID)
+	}
+	return ids, nil
+}
+
+func (c *cloudflareDNS) roleNameOf(role DepartmentUserRole) (string, error) {
+	name, ok := map[DepartmentUserRole]string{
+		DepartmentUserRoleMember: c.config.MemberRole,
+		DepartmentUserRoleAdmin:  c.config.AdminRole,
+	}[role]
+	if !ok {
+		return "", errors.New("Role Mapping not found")
+	}
+	return name, nil
+}
+
+func (c *cloudflareDNS) GetAllUsers() (users []UserableEntry, err error) {
 	department, err := c.GetRootDepartment()
 	if err != nil {
 		return users, err
 	}
-	return department.GetUsers()
+	users, err = RecursionGetAllUsersIncludeChildDepartments(department)
+	if err != nil {
+		return nil, err
+	}
+	return uniqByEmail(users), nil
+}
+
+// uniqByEmail keeps one user per email where it first shows up, as the one
+// ranked best: a member, then an invitation, then an Access user. An Access
+// group of one account includes by email people who are members of
+// another, and an invitation has its own id until it is accepted.
+func uniqByEmail(users []UserableEntry) (uniq []UserableEntry) {
+	rank := func(user UserableEntry) int {
+		switch user := user.(type) {
+		case *cloudflareAccountMember:
+			return lo.Ternary(user.member.User.ID != "", 0, 1)
+		default:
+			return 2
+		}
+	}
+	index := make(map[string]int, len(users))
+	for _, user := range users {
+		key := strings.ToLower(user.GetEmail())
+		if key == "" {
+			key = user.GetID()
+		}
+		i, seen := index[key]
+		switch {
+		case !seen:
+			index[key] = len(uniq)
+			uniq = append(uniq, user)
+		case rank(user) < rank(uniq[i]):
+			uniq[i] = user
+		}
+	}
+	return uniq
+}
+
+// CreateUser invites user by email with the member role, the member stays
+// pending until the invitation is accepted.
+func (c *cloudflareDNS) CreateUser(user Userable) (UserableEntry, error) {
+	if user.GetEmail() == "" {
+		return nil, errors.New("cloudflare members are invited by email")
+	}
+	account, err := c.defaultAccount()
+	if err != nil {
+		return nil, err
+	}
+	return c.invite(account.ID, user.GetEmail(), DepartmentUserRoleMember)
+}
+
+func (c *cloudflareDNS) invite(accountID, email string, role DepartmentUserRole) (*cloudflareAccountMember, error) {
+	roleName, err := c.roleNameOf(role)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := c.roleIDs(accountID, roleName)
+	if err != nil {
+		return nil, err
+	}
+	member, err := c.api.CreateAccountMember(context.Background(), accountID, email, roles)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudflareAccountMember{cloudflareDNS: c, member: member}, nil
+}
+
+// LookupUser matches the email of user against the members of every
+// account, it returns nil without error when nobody matches. People only
+// Access groups include are not members, they are reached by the email-
+// ids of LookupEntryUserByInternalExternalIdentity instead.
+func (c *cloudflareDNS) LookupUser(user Userable) (UserableEntry, error) {
+	emails := lo.Compact(GetUserableEmails(user))
+	if len(emails) == 0 {
+		return nil, nil
+	}
+	accounts, err := c.listAccounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		members, err := c.listMembers(account.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if lo.ContainsBy(emails, func(email string) bool { return strings.EqualFold(email, member.User.Email) }) {
+				return &cloudflareAccountMember{cloudflareDNS: c, member: member}, nil
+			}
+		}
+	}
+	return nil, nil
 }
 
 type cloudflareAccountMember struct {
@@ -101,12 +352,19 @@ type cloudflareAccountMember struct {
 	member cloudflare.AccountMember
 }
 
+func (m *cloudflareAccountMember) GetTarget() Target {
+	return m.cloudflareDNS
+}
+
 func (m cloudflareAccountMember) GetID() string {
-	return m.member.ID
+	return memberID(m.member)
 }
 
 func (m cloudflareAccountMember) GetName() string {
-	return fmt.Sprint(m.member.User.FirstName, m.member.User.LastName)
+	if name := strings.TrimSpace(m.member.User.FirstName + " " + m.member.User.LastName); name != "" {
+		return name
+	}
+	return m.member.User.Email
 }
 
 func (m cloudflareAccountMember) GetEmail() (email string) {
@@ -117,16 +375,37 @@ func (m cloudflareAccountMember) GetPhone() (phone string) {
 	return ""
 }
 
+// GetRole is admin for members holding the admin role in the account.
+func (m cloudflareAccountMember) GetRole() DepartmentUserRole {
+	for _, role := range m.member.Roles {
+		if role.Name == m.config.AdminRole {
+			return DepartmentUserRoleAdmin
+		}
+	}
+	return DepartmentUserRoleMember
+}
+
+// cloudflareAccount is an account, the zero account is the synthetic root.
 type cloudflareAccount struct {
 	*cloudflareDNS
 	account cloudflare.Account
 }
 
+func (a *cloudflareAccount) GetTarget() Target {
+	return a.cloudflareDNS
+}
+
 func (a cloudflareAccount) GetID() string {
+	if a.account.ID == "" {
+		return cloudflareRootID
+	}
 	return a.account.ID
 }
 
 func (a cloudflareAccount) GetName() string {
+	if a.account.ID == "" {
+		return a.config.Slug
+	}
 	return a.account.Name
 }
 
@@ -134,17 +413,37 @@ func (a cloudflareAccount) GetDescription() string {
 	return ""
 }
 
+// GetChildDepartments lists the accounts under the root and the Access
+// groups under an account.
 func (z cloudflareAccount) GetChildDepartments() (departments []DepartmentableEntry) {
+	if z.account.ID != "" {
+		return z.accessGroups()
+	}
+	accounts, err := z.listAccounts()
+	if err != nil {
+		z.logger.WithError(err).Error("list cloudflare accounts failed")
+		return departments
+	}
+	for _, account := range accounts {
+		departments = append(departments, &cloudflareAccount{cloudflareDNS: z.cloudflareDNS, account: account})
+	}
 	return departments
 }
 
+// CreateChildDepartment creates an Access group under an account, accounts
+// themselves cannot be created.
 func (z cloudflareAccount) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
-	panic("not implemented") // TODO: Implement
+	if z.account.ID != "" {
+		return z.createAccessGroup(department)
+	}
+	return nil, fmt.Errorf("%w: cloudflare accounts cannot be created from the api, create %s in the dashboard", ErrNotSupported, department.GetName())
 }
 
 func (z *cloudflareAccount) GetUsers() (users []UserableEntry, err error) {
-	opts := cloudflare.PaginationOptions{}
-	members, _, err := z.api.AccountMembers(context.Background(), z.account.ID, opts)
+	if z.account.ID == "" {
+		return nil, nil
+	}
+	members, err := z.listMembers(z.account.ID)
 	if err != nil {
 		return
 	}
@@ -156,3 +455,63 @@ func (z *cloudflareAccount) GetUsers() (users []UserableEntry, err error) {
 	}
 	return
 }
+
+// AddToDepartment gives the member the role options maps to, inviting the
+// user by email first when it is not a member yet. Roles other than the
+// member and admin ones are kept.
+func (z cloudflareAccount) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if z.account.ID == "" {
+		return errors.New("cannot add user to the cloudflare root")
+	}
+	if err := extID.CheckIfInternal(z.cloudflareDNS); err != nil {
+		return err
+	}
+	roleName, err := z.roleNameOf(options.Role)
+	if err != nil {
+		return err
+	}
+	member, err := z.findMember(z.account.ID, extID.GetEntryID())
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		user, err := z.LookupEntryUserByInternalExternalIdentity(extID)
+		if err != nil {
+			return fmt.Errorf("error finding user %s: %s", extID, err)
+		}
+		_, err = z.invite(z.account.ID, user.GetEmail(), options.Role)
+		return err
+	}
+	var names []string
+	for _, role := range member.Roles {
+		if role.Name != z.config.MemberRole && role.Name != z.config.AdminRole {
+			names = append(names, role.Name)
+		}
+	}
+	roles, err := z.roleIDs(z.account.ID, append(names, roleName)...)
+	if err != nil {
+		return err
+	}
+	current := lo.Map(member.Roles, func(role cloudflare.AccountRole, _ int) string { return role.ID })
+	if len(current) == len(roles) && len(lo.Intersect(current, roles)) == len(roles) {
+		return nil
+	}
+	updated := *member
+	updated.Roles = lo.Map(roles, func(id string, _ int) cloudflare.AccountRole { return cloudflare.AccountRole{ID: id} })
+	_, err = z.api.UpdateAccountMember(context.Background(), z.account.ID, member.ID, updated)
+	return err
+}
+
+func (z cloudflareAccount) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if z.account.ID == "" {
+		return errors.New("cannot remove user from the cloudflare root")
+	}
+	if err := extID.CheckIfInternal(z.cloudflareDNS); err != nil {
+		return err
+	}
+	member, err := z.findMember(z.account.ID, extID.GetEntryID())
+	if err != nil || member == nil {
+		return err
+	}
+	return z.api.DeleteAccountMember(context.Background(), z.account.ID, member.ID)
+}
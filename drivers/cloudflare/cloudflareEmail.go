@@ -0,0 +1,294 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+// cloudflareEmailRulePrefix names the routing rules of forwards, rules
+// without it were made by hand and are left alone.
+const cloudflareEmailRulePrefix = "org-manager: "
+
+// cloudflare-go has no Email Routing calls yet, they go through Raw.
+type emailRoutingRule struct {
+	Tag      string                   `json:"tag,omitempty"`
+	Name     string                   `json:"name"`
+	Enabled  bool                     `json:"enabled"`
+	Priority int                      `json:"priority,omitempty"`
+	Matchers []emailRoutingRuleMatch  `json:"matchers"`
+	Actions  []emailRoutingRuleAction `json:"actions"`
+}
+
+type emailRoutingRuleMatch struct {
+	Type  string `json:"type"`
+	Field string `json:"field,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+type emailRoutingRuleAction struct {
+	Type  string   `json:"type"`
+	Value []string `json:"value,omitempty"`
+}
+
+type emailRoutingAddress struct {
+	Email string `json:"email"`
+}
+
+func newEmailRoutingRule(forward EmailForward) emailRoutingRule {
+	return emailRoutingRule{
+		Name:     cloudflareEmailRulePrefix + forward.Name,
+		Enabled:  true,
+		Matchers: []emailRoutingRuleMatch{{Type: "literal", Field: "to", Value: forward.Address}},
+		Actions:  []emailRoutingRuleAction{{Type: "forward", Value: []string{forward.Destination}}},
+	}
+}
+
+// address is the recipient a rule matches, empty for catch-all and other
+// non literal rules.
+func (r emailRoutingRule) address() string {
+	if len(r.Matchers) != 1 || r.Matchers[0].Type != "literal" || r.Matchers[0].Field != "to" {
+		return ""
+	}
+	return strings.ToLower(r.Matchers[0].Value)
+}
+
+func (r emailRoutingRule) managed() bool {
+	return strings.HasPrefix(r.Name, cloudflareEmailRulePrefix)
+}
+
+func (r emailRoutingRule) forward() EmailForward {
+	forward := EmailForward{Address: r.address(), Name: strings.TrimPrefix(r.Name, cloudflareEmailRulePrefix)}
+	for _, action := range r.Actions {
+		if action.Type == "forward" && len(action.Value) != 0 {
+			forward.Destination = action.Value[0]
+		}
+	}
+	return forward
+}
+
+// GetEnterpriseEmailDomains is the zones of EmailDomains, forwards are only
+// kept for addresses under them.
+func (c *cloudflareDNS) GetEnterpriseEmailDomains() []string {
+	return c.config.EmailDomains
+}
+
+// rawList pages a list endpoint with Raw, which drops result_info, so a
+// short page is the last one.
+func rawList[T any](c *cloudflareDNS, endpoint string) (items []T, err error) {
+	for page := 1; ; page++ {
+		raw, err := c.api.Raw(http.MethodGet, fmt.Sprintf("%s?page=%d&per_page=%d", endpoint, page, cloudflarePerPage), nil)
+		if err != nil {
+			return nil, err
+		}
+		var got []T
+		if err := json.Unmarshal(raw, &got); err != nil {
+			return nil, err
+		}
+		items = append(items, got...)
+		if len(got) < cloudflarePerPage {
+			return items, nil
+		}
+	}
+}
+
+// emailZone finds the zone of the domain of address, it has to be one of
+// EmailDomains.
+func (c *cloudflareDNS) emailZone(address string) (zone cloudflare.Zone, err error) {
+	_, domain, _ := strings.Cut(address, "@")
+	if !lo.ContainsBy(c.config.EmailDomains, func(d string) bool { return strings.EqualFold(d, domain) }) {
+		return zone, fmt.Errorf("%s is not under the email domains of %s", address, TargetKey(c))
+	}
+	return c.zoneByName(domain)
+}
+
+func (c *cloudflareDNS) zoneByName(domain string) (zone cloudflare.Zone, err error) {
+	zones, err := c.api.ListZonesContext(context.Background(), cloudflare.WithZoneFilters(domain, c.config.AccountID, ""))
+	if err != nil {
+		return zone, err
+	}
+	if len(zones.Result) != 1 {
+		return zone, fmt.Errorf("found %d cloudflare zones named %s", len(zones.Result), domain)
+	}
+	return zones.Result[0], nil
+}
+
+func (c *cloudflareDNS) listEmailRules(zoneID string) ([]emailRoutingRule, error) {
+	return rawList[emailRoutingRule](c, "/zones/"+zoneID+"/email/routing/rules")
+}
+
+// GetEmailForwards lists the forwards of every zone of EmailDomains.
+func (c *cloudflareDNS) GetEmailForwards() (forwards []EmailForward, err error) {
+	for _, domain := range c.config.EmailDomains {
+		zone, err := c.zoneByName(domain)
+		if err != nil {
+			return nil, err
+		}
+		rules, err := c.listEmailRules(zone.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if rule.managed() && rule.address() != "" {
+				forwards = append(forwards, rule.forward())
+			}
+		}
+	}
+	return forwards, nil
+}
+
+// emailRouting holds the zones, rules and destinations that writes check,
+// each listed once for all the forwards set or deleted through it and kept
+// up to date with what those writes change.
+type emailRouting struct {
+	*cloudflareDNS
+	zones        map[string]cloudflare.Zone
+	rules        map[string][]emailRoutingRule
+	destinations map[string][]emailRoutingAddress
+}
+
+func (c *cloudflareDNS) newEmailRouting() *emailRouting {
+	return &emailRouting{
+		cloudflareDNS: c,
+		zones:         make(map[string]cloudflare.Zone),
+		rules:         make(map[string][]emailRoutingRule),
+		destinations:  make(map[string][]emailRoutingAddress),
+	}
+}
+
+func (r *emailRouting) zone(address string) (cloudflare.Zone, error) {
+	_, domain, _ := strings.Cut(strings.ToLower(address), "@")
+	if zone, ok := r.zones[domain]; ok {
+		return zone, nil
+	}
+	zone, err := r.emailZone(address)
+	if err == nil {
+		r.zones[domain] = zone
+	}
+	return zone, err
+}
+
+// rule returns the index of the rule of the zone matching address, -1 when
+// there is none.
+func (r *emailRouting) rule(zoneID, address string) (int, error) {
+	if _, ok := r.rules[zoneID]; !ok {
+		rules, err := r.listEmailRules(zoneID)
+		if err != nil {
+			return -1, err
+		}
+		r.rules[zoneID] = rules
+	}
+	for i, rule := range r.rules[zoneID] {
+		if rule.address() == strings.ToLower(address) {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// SetEmailForward refuses to take over rules made by hand. Destinations
+// new to the account are added too, Cloudflare mails them to verify and
+// only forwards once that is done.
+func (c *cloudflareDNS) SetEmailForward(forward EmailForward) error {
+	return c.newEmailRouting().set(forward)
+}
+
+// SetEmailForwards is SetEmailForward listing the rules of each zone and
+// the destinations of each account once.
+func (c *cloudflareDNS) SetEmailForwards(forwards []EmailForward) []error {
+	routing := c.newEmailRouting()
+	return lo.Map(forwards, func(forward EmailForward, _ int) error { return routing.set(forward) })
+}
+
+func (r *emailRouting) set(forward EmailForward) error {
+	zone, err := r.zone(forward.Address)
+	if err != nil {
+		return err
+	}
+	i, err := r.rule(zone.ID, forward.Address)
+	if err != nil {
+		return err
+	}
+	rules := r.rules[zone.ID]
+	if i >= 0 && !rules[i].managed() {
+		return fmt.Errorf("routing rule %q of %s was not made by org-manager", rules[i].Name, forward.Address)
+	}
+	if err := r.ensureDestination(zone.Account.ID, forward.Destination); err != nil {
+		return err
+	}
+	updated := newEmailRoutingRule(forward)
+	if i < 0 {
+		raw, err := r.api.Raw(http.MethodPost, "/zones/"+zone.ID+"/email/routing/rules", updated)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &updated); err != nil {
+			return err
+		}
+		r.rules[zone.ID] = append(rules, updated)
+		return nil
+	}
+	if current := rules[i].forward(); current.Name == forward.Name && strings.EqualFold(current.Destination, forward.Destination) && rules[i].Enabled {
+		return nil
+	}
+	updated.Tag, updated.Priority = rules[i].Tag, rules[i].Priority
+	if _, err = r.api.Raw(http.MethodPut, "/zones/"+zone.ID+"/email/routing/rules/"+rules[i].Tag, updated); err != nil {
+		return err
+	}
+	rules[i] = updated
+	return nil
+}
+
+func (r *emailRouting) ensureDestination(accountID, email string) error {
+	endpoint := "/accounts/" + accountID + "/email/routing/addresses"
+	if _, ok := r.destinations[accountID]; !ok {
+		addresses, err := rawList[emailRoutingAddress](r.cloudflareDNS, endpoint)
+		if err != nil {
+			return err
+		}
+		r.destinations[accountID] = addresses
+	}
+	if lo.ContainsBy(r.destinations[accountID], func(address emailRoutingAddress) bool { return strings.EqualFold(address.Email, email) }) {
+		return nil
+	}
+	if _, err := r.api.Raw(http.MethodPost, endpoint, emailRoutingAddress{Email: email}); err != nil {
+		return err
+	}
+	r.destinations[accountID] = append(r.destinations[accountID], emailRoutingAddress{Email: email})
+	r.logger.WithField("email", email).Warn("cloudflare email destination added, forwarding starts once it is verified")
+	return nil
+}
+
+func (c *cloudflareDNS) DeleteEmailForward(address string) error {
+	return c.newEmailRouting().delete(address)
+}
+
+// DeleteEmailForwards is DeleteEmailForward listing the rules of each zone
+// once.
+func (c *cloudflareDNS) DeleteEmailForwards(addresses []string) []error {
+	routing := c.newEmailRouting()
+	return lo.Map(addresses, func(address string, _ int) error { return routing.delete(address) })
+}
+
+func (r *emailRouting) delete(address string) error {
+	zone, err := r.zone(address)
+	if err != nil {
+		return err
+	}
+	i, err := r.rule(zone.ID, address)
+	if err != nil || i < 0 || !r.rules[zone.ID][i].managed() {
+		return err
+	}
+	rules := r.rules[zone.ID]
+	if _, err = r.api.Raw(http.MethodDelete, "/zones/"+zone.ID+"/email/routing/rules/"+rules[i].Tag, nil); err != nil {
+		return err
+	}
+	r.rules[zone.ID] = append(rules[:i:i], rules[i+1:]...)
+	return nil
+}
@@ -0,0 +1,763 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+// dashboard is an in-memory Cloudflare API serving what the driver calls,
+// lists in pages of per_page. Requests are logged as "METHOD path".
+type dashboard struct {
+	mu       sync.Mutex
+	accounts []cloudflare.Account
+	roles    []cloudflare.AccountRole
+	members  map[string][]cloudflare.AccountMember
+	// groups are the Access groups by account, accounts without an entry
+	// have no Zero Trust
+	groups map[string][]cloudflare.AccessGroup
+	zones  []cloudflare.Zone
+	// rules are the Email Routing rules by zone, destinations the
+	// addresses by account
+	rules        map[string][]emailRoutingRule
+	destinations map[string][]emailRoutingAddress
+	requests     []string
+	nextID       int
+}
+
+func newDashboard(accounts ...string) *dashboard {
+	d := &dashboard{
+		members:      make(map[string][]cloudflare.AccountMember),
+		groups:       make(map[string][]cloudflare.AccessGroup),
+		rules:        make(map[string][]emailRoutingRule),
+		destinations: make(map[string][]emailRoutingAddress),
+	}
+	for _, name := range accounts {
+		d.accounts = append(d.accounts, cloudflare.Account{ID: fmt.Sprintf("%032x", len(d.accounts)+1), Name: name})
+	}
+	for _, name := range []string{cloudflareDefaultMemberRole, cloudflareDefaultAdminRole, "DNS"} {
+		d.roles = append(d.roles, cloudflare.AccountRole{ID: "role-" + strings.Fields(name)[0], Name: name})
+	}
+	return d
+}
+
+func (d *dashboard) id(prefix string) string {
+	d.nextID++
+	return fmt.Sprintf("%s%d", prefix, d.nextID)
+}
+
+func (d *dashboard) role(name string) cloudflare.AccountRole {
+	role, _ := lo.Find(d.roles, func(role cloudflare.AccountRole) bool { return role.Name == name })
+	return role
+}
+
+// member adds a member to the account, pending invitations have no user id.
+func (d *dashboard) member(account int, userID, email string, roles ...string) {
+	accountID := d.accounts[account].ID
+	member := cloudflare.AccountMember{ID: d.id("m"), User: cloudflare.AccountMemberUserDetails{ID: userID, Email: email}, Status: "accepted"}
+	if userID == "" {
+		member.Status = "pending"
+	}
+	for _, name := range roles {
+		member.Roles = append(member.Roles, d.role(name))
+	}
+	d.members[accountID] = append(d.members[accountID], member)
+}
+
+// group adds an Access group to the account including the emails, rules
+// of other kinds are passed as they are.
+func (d *dashboard) group(account int, name string, include ...any) string {
+	accountID := d.accounts[account].ID
+	group := cloudflare.AccessGroup{ID: fmt.Sprintf("%08d-0000-0000-0000-000000000000", len(d.groups[accountID])+100*account+1), Name: name}
+	for _, rule := range include {
+		if email, ok := rule.(string); ok {
+			rule = map[string]any{"email": map[string]any{"email": email}}
+		}
+		group.Include = append(group.Include, rule)
+	}
+	d.groups[accountID] = append(d.groups[accountID], group)
+	return group.ID
+}
+
+// zone adds a zone with Email Routing to the account.
+func (d *dashboard) zone(account int, name string) string {
+	zone := cloudflare.Zone{ID: fmt.Sprintf("z%031x", len(d.zones)+1), Name: name}
+	zone.Account.ID = d.accounts[account].ID
+	d.zones = append(d.zones, zone)
+	d.rules[zone.ID] = []emailRoutingRule{}
+	return zone.ID
+}
+
+// rule adds a routing rule to the zone, named without the prefix of
+// forwards when made by hand.
+func (d *dashboard) rule(zoneID string, rule emailRoutingRule) {
+	rule.Tag = d.id("r")
+	d.rules[zoneID] = append(d.rules[zoneID], rule)
+}
+
+// count is how many requests were "METHOD path".
+func (d *dashboard) count(request string) int {
+	return len(lo.Filter(d.requests, func(r string, _ int) bool { return r == request }))
+}
+
+// includes decodes the include rules of the group as the API serves them.
+func (d *dashboard) includes(account int, groupID string) (rules []string) {
+	group, _ := lo.Find(d.groups[d.accounts[account].ID], func(group cloudflare.AccessGroup) bool { return group.ID == groupID })
+	for _, rule := range group.Include {
+		raw, _ := json.Marshal(rule)
+		rules = append(rules, string(raw))
+	}
+	return rules
+}
+
+func (d *dashboard) writes() []string {
+	return lo.Reject(d.requests, func(request string, _ int) bool { return strings.HasPrefix(request, "GET ") })
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = append(d.requests, r.Method+" "+r.URL.Path)
+	body, _ := io.ReadAll(r.Body)
+	status, result := d.route(r.Method, strings.Split(strings.Trim(r.URL.Path, "/"), "/"), r.URL.Query(), body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status >= http.StatusBadRequest {
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": false, "errors": []any{map[string]any{"code": status, "message": result}}})
+		return
+	}
+	response := map[string]any{"success": true, "errors": []any{}, "messages": []any{}, "result": result}
+	if page, ok := result.(page); ok {
+		response["result"], response["result_info"] = page.items, page.info
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+type page struct {
+	items any
+	info  cloudflare.ResultInfo
+}
+
+func paged[T any](items []T, query map[string][]string) page {
+	number, _ := strconv.Atoi(first(query["page"]))
+	perPage, _ := strconv.Atoi(first(query["per_page"]))
+	if number < 1 {
+		number = 1
+	}
+	if perPage < 1 {
+		perPage = 20
+	}
+	chunks := lo.Chunk(items, perPage)
+	info := cloudflare.ResultInfo{Page: number, PerPage: perPage, TotalPages: len(chunks), Total: len(items)}
+	if number > len(chunks) {
+		return page{items: []T{}, info: info}
+	}
+	info.Count = len(chunks[number-1])
+	return page{items: chunks[number-1], info: info}
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (d *dashboard) route(method string, path []string, query map[string][]string, body []byte) (int, any) {
+	if len(path) != 0 && path[0] == "zones" {
+		return d.routeZones(method, path[1:], query, body)
+	}
+	if len(path) == 0 || path[0] != "accounts" {
+		return http.StatusNotFound, "not found"
+	}
+	if len(path) == 1 {
+		accounts := lo.Filter(d.accounts, func(account cloudflare.Account, _ int) bool {
+			return first(query["name"]) == "" || strings.Contains(account.Name, first(query["name"]))
+		})
+		return http.StatusOK, paged(accounts, query)
+	}
+	account, ok := lo.Find(d.accounts, func(account cloudflare.Account) bool { return account.ID == path[1] })
+	if !ok {
+		return http.StatusNotFound, "account not found"
+	}
+	switch resource := strings.Join(path[2:], "/"); {
+	case resource == "" && method == http.MethodGet:
+		return http.StatusOK, account
+	case resource == "roles":
+		return http.StatusOK, paged(d.roles, map[string][]string{"per_page": {"50"}})
+	case resource == "members" && method == http.MethodGet:
+		return http.StatusOK, paged(d.members[account.ID], query)
+	case resource == "members" && method == http.MethodPost:
+		var invitation cloudflare.AccountMemberInvitation
+		_ = json.Unmarshal(body, &invitation)
+		member := cloudflare.AccountMember{ID: d.id("m"), User: cloudflare.AccountMemberUserDetails{Email: invitation.Email}, Status: "pending"}
+		for _, id := range invitation.Roles {
+			role, _ := lo.Find(d.roles, func(role cloudflare.AccountRole) bool { return role.ID == id })
+			member.Roles = append(member.Roles, role)
+		}
+		d.members[account.ID] = append(d.members[account.ID], member)
+		return http.StatusOK, member
+	case resource == "email/routing/addresses" && method == http.MethodGet:
+		return http.StatusOK, paged(d.destinations[account.ID], query)
+	case resource == "email/routing/addresses" && method == http.MethodPost:
+		var address emailRoutingAddress
+		_ = json.Unmarshal(body, &address)
+		d.destinations[account.ID] = append(d.destinations[account.ID], address)
+		return http.StatusOK, address
+	case strings.HasPrefix(resource, "access/groups"):
+		return d.routeAccessGroups(method, account.ID, path[4:], query, body)
+	case len(path) == 4 && path[2] == "members":
+		members := d.members[account.ID]
+		i := lo.IndexOf(lo.Map(members, func(member cloudflare.AccountMember, _ int) string { return member.ID }), path[3])
+		if i < 0 {
+			return http.StatusNotFound, "member not found"
+		}
+		switch method {
+		case http.MethodPut:
+			var updated cloudflare.AccountMember
+			_ = json.Unmarshal(body, &updated)
+			members[i].Roles = lo.Map(updated.Roles, func(role cloudflare.AccountRole, _ int) cloudflare.AccountRole {
+				found, _ := lo.Find(d.roles, func(r cloudflare.AccountRole) bool { return r.ID == role.ID })
+				return found
+			})
+			return http.StatusOK, members[i]
+		case http.MethodDelete:
+			d.members[account.ID] = append(members[:i:i], members[i+1:]...)
+			return http.StatusOK, map[string]string{"id": path[3]}
+		}
+	}
+	return http.StatusNotFound, "not found"
+}
+
+func (d *dashboard) routeAccessGroups(method, accountID string, path []string, query map[string][]string, body []byte) (int, any) {
+	groups, ok := d.groups[accountID]
+	if !ok {
+		return http.StatusForbidden, "access is not enabled"
+	}
+	if len(path) == 0 {
+		switch method {
+		case http.MethodGet:
+			return http.StatusOK, paged(groups, query)
+		case http.MethodPost:
+			var group cloudflare.AccessGroup
+			_ = json.Unmarshal(body, &group)
+			group.ID = fmt.Sprintf("%08d-0000-0000-0000-000000000000", 900+len(groups))
+			d.groups[accountID] = append(groups, group)
+			return http.StatusOK, group
+		}
+	}
+	i := lo.IndexOf(lo.Map(groups, func(group cloudflare.AccessGroup, _ int) string { return group.ID }), path[0])
+	if i < 0 {
+		return http.StatusNotFound, "access group not found"
+	}
+	switch method {
+	case http.MethodGet:
+		return http.StatusOK, groups[i]
+	case http.MethodPut:
+		var group cloudflare.AccessGroup
+		_ = json.Unmarshal(body, &group)
+		// rules are served back decoded into maps like the real API would
+		raw, _ := json.Marshal(group)
+		group = cloudflare.AccessGroup{}
+		_ = json.Unmarshal(raw, &group)
+		groups[i] = group
+		return http.StatusOK, group
+	}
+	return http.StatusNotFound, "not found"
+}
+
+func (d *dashboard) routeZones(method string, path []string, query map[string][]string, body []byte) (int, any) {
+	if len(path) == 0 {
+		zones := lo.Filter(d.zones, func(zone cloudflare.Zone, _ int) bool {
+			return (first(query["name"]) == "" || zone.Name == first(query["name"])) &&
+				(first(query["account.id"]) == "" || zone.Account.ID == first(query["account.id"]))
+		})
+		return http.StatusOK, paged(zones, query)
+	}
+	rules, ok := d.rules[path[0]]
+	if !ok || len(path) < 4 || strings.Join(path[1:4], "/") != "email/routing/rules" {
+		return http.StatusNotFound, "not found"
+	}
+	if len(path) == 4 {
+		switch method {
+		case http.MethodGet:
+			return http.StatusOK, paged(rules, query)
+		case http.MethodPost:
+			var rule emailRoutingRule
+			_ = json.Unmarshal(body, &rule)
+			d.rule(path[0], rule)
+			return http.StatusOK, d.rules[path[0]][len(rules)]
+		}
+	}
+	i := lo.IndexOf(lo.Map(rules, func(rule emailRoutingRule, _ int) string { return rule.Tag }), path[4])
+	if i < 0 {
+		return http.StatusNotFound, "rule not found"
+	}
+	switch method {
+	case http.MethodPut:
+		var rule emailRoutingRule
+		_ = json.Unmarshal(body, &rule)
+		rule.Tag = rules[i].Tag
+		rules[i] = rule
+		return http.StatusOK, rule
+	case http.MethodDelete:
+		d.rules[path[0]] = append(rules[:i:i], rules[i+1:]...)
+		return http.StatusOK, map[string]string{"tag": path[4]}
+	}
+	return http.StatusNotFound, "not found"
+}
+
+func named(name string) Departmentable {
+	department := NewDepartment()
+	department.Name = name
+	return department
+}
+
+func connectDashboard(t *testing.T, d *dashboard, config string) *cloudflareDNS {
+	t.Helper()
+	server := httptest.NewServer(d)
+	t.Cleanup(server.Close)
+	c := new(cloudflareDNS)
+	c.SetLogger(Log)
+	_, err := c.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"cloudflare","Slug":"cf","ApiToken":"token","BaseURL":"`+server.URL+`"`+config+`}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client allows 4 requests a second by default
+	if err := cloudflare.UsingRateLimit(1e6)(c.api); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCloudflareListsMembersOfEveryAccountInPages(t *testing.T) {
+	d := newDashboard("Prod", "Staging")
+	for i := 0; i < cloudflarePerPage+5; i++ {
+		d.member(0, fmt.Sprintf("u%02d", i), fmt.Sprintf("user%02d@example.com", i), cloudflareDefaultMemberRole)
+	}
+	d.member(1, "u00", "user00@example.com", cloudflareDefaultAdminRole)
+	d.member(1, "staging", "staging@example.com", cloudflareDefaultMemberRole)
+	c := connectDashboard(t, d, "")
+
+	root, _ := c.GetRootDepartment()
+	accounts := root.GetChildDepartments()
+	if names := lo.Map(accounts, func(a DepartmentableEntry, _ int) string { return a.GetName() }); strings.Join(names, ",") != "Prod,Staging" {
+		t.Fatalf("accounts %v", names)
+	}
+	prod, err := accounts[0].GetUsers()
+	if err != nil || len(prod) != cloudflarePerPage+5 {
+		t.Fatalf("%d members of Prod, %v", len(prod), err)
+	}
+	staging, _ := accounts[1].GetUsers()
+	if role := staging[0].(UserableWithRole).GetRole(); role != DepartmentUserRoleAdmin {
+		t.Errorf("admin role read as %s", role)
+	}
+	users, err := c.GetAllUsers()
+	if err != nil || len(users) != cloudflarePerPage+6 {
+		t.Errorf("%d users, %v", len(users), err)
+	}
+
+	if _, err := c.LookupEntryUserByInternalExternalIdentity("ei.user.staging@cf.cloudflare"); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.LookupEntryUserByInternalExternalIdentity("ei.user.nobody@cf.cloudflare"); err == nil {
+		t.Error("found a user who is not a member")
+	}
+}
+
+func TestCloudflareAccountOrAccountIDLimitsTheAccounts(t *testing.T) {
+	d := newDashboard("Prod", "Prod Legacy")
+	for config, want := range map[string]string{
+		`,"Account":"Prod"`:                       "Prod",
+		`,"AccountID":"` + d.accounts[1].ID + `"`: "Prod Legacy",
+	} {
+		c := connectDashboard(t, d, config)
+		accounts, err := c.listAccounts()
+		if err != nil || len(accounts) != 1 || accounts[0].Name != want {
+			t.Errorf("%s: %v %v", config, accounts, err)
+		}
+	}
+	if _, err := connectDashboard(t, d, `,"Account":"Dev"`).listAccounts(); err == nil {
+		t.Error("found an account which does not exist")
+	}
+}
+
+func TestCloudflareGetAllUsersIsUniqByEmail(t *testing.T) {
+	users := []UserableEntry{
+		&cloudflareAccessUser{email: "ann@example.com"},
+		&cloudflareAccountMember{member: cloudflare.AccountMember{ID: "m1", User: cloudflare.AccountMemberUserDetails{Email: "Bob@example.com"}}},
+		&cloudflareAccountMember{member: cloudflare.AccountMember{ID: "m2", User: cloudflare.AccountMemberUserDetails{ID: "ann", Email: "ANN@example.com"}}},
+		&cloudflareAccessUser{email: "bob@example.com"},
+		&cloudflareAccountMember{member: cloudflare.AccountMember{ID: "m3", User: cloudflare.AccountMemberUserDetails{ID: "bob", Email: "bob@example.com"}}},
+		&cloudflareAccountMember{member: cloudflare.AccountMember{ID: "m4", User: cloudflare.AccountMemberUserDetails{ID: "bob", Email: "bob@example.com"}}},
+		&cloudflareAccessUser{email: "cid@example.com"},
+	}
+	got := lo.Map(uniqByEmail(users), func(user UserableEntry, _ int) string { return user.GetID() })
+	if want := []string{"ann", "bob", accessUserID("cid@example.com")}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCloudflareInvitesAndUpdatesRoles(t *testing.T) {
+	d := newDashboard("Prod")
+	d.member(0, "ann", "ann@example.com", cloudflareDefaultMemberRole, "DNS")
+	c := connectDashboard(t, d, "")
+	root, _ := c.GetRootDepartment()
+	prod := root.GetChildDepartments()[0].(DepartmentUserWriter)
+
+	invited, err := c.CreateUser(User{Name: "Bob", Email: "bob@example.com"})
+	if err != nil || invited.GetEmail() != "bob@example.com" {
+		t.Fatalf("%v %v", invited, err)
+	}
+	if _, err := c.CreateUser(User{Name: "No Email"}); err == nil {
+		t.Error("invited a user without email")
+	}
+
+	// promoting keeps the roles the driver does not manage
+	admin := DepartmentModifyUserOptions{Role: DepartmentUserRoleAdmin}
+	if err := prod.AddToDepartment(admin, "ei.user.ann@cf.cloudflare"); err != nil {
+		t.Fatal(err)
+	}
+	roles := lo.Map(d.members[d.accounts[0].ID][0].Roles, func(role cloudflare.AccountRole, _ int) string { return role.Name })
+	sort.Strings(roles)
+	if strings.Join(roles, ",") != "DNS,"+cloudflareDefaultAdminRole {
+		t.Errorf("roles of ann %v", roles)
+	}
+	before := len(d.writes())
+	if err := prod.AddToDepartment(admin, "ei.user.ann@cf.cloudflare"); err != nil || len(d.writes()) != before {
+		t.Errorf("adding again wrote %v, %v", d.writes()[before:], err)
+	}
+	if err := prod.AddToDepartment(admin, "ei.user.ann@other.cloudflare"); err == nil {
+		t.Error("added an extID of another target")
+	}
+	if err := prod.RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.ann@cf.cloudflare"); err != nil {
+		t.Fatal(err)
+	}
+	if err := prod.RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.ann@cf.cloudflare"); err != nil {
+		t.Errorf("removing a non member: %v", err)
+	}
+	if members := d.members[d.accounts[0].ID]; len(members) != 1 || members[0].User.Email != "bob@example.com" {
+		t.Errorf("members left %v", members)
+	}
+}
+
+func TestCloudflareAccessGroupsIncludeMembersAndAccessUsers(t *testing.T) {
+	d := newDashboard("Prod", "Staging")
+	d.member(0, "ann", "ann@example.com", cloudflareDefaultMemberRole)
+	d.member(1, "bob", "bob@example.com", cloudflareDefaultMemberRole)
+	// bob is a member of Staging only, cid of no account
+	engID := d.group(0, "Eng", "ANN@example.com", "bob@example.com", "cid@example.com",
+		map[string]any{"email_domain": map[string]any{"domain": "example.org"}})
+	d.group(0, "Empty", placeholderRule())
+	c := connectDashboard(t, d, "")
+
+	root, _ := c.GetRootDepartment()
+	prod, staging := root.GetChildDepartments()[0], root.GetChildDepartments()[1]
+	groups := prod.GetChildDepartments()
+	if len(groups) != 2 || groups[0].GetName() != "Eng" || groups[0].GetID() != engID {
+		t.Fatalf("groups of Prod %v", groups)
+	}
+	if len(staging.GetChildDepartments()) != 0 {
+		t.Error("an account without Zero Trust has groups")
+	}
+	eng, err := groups[0].GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ann", accessUserID("bob@example.com"), accessUserID("cid@example.com")}
+	if got := lo.Map(eng, func(user UserableEntry, _ int) string { return user.GetID() }); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("users of Eng %v, want %v", got, want)
+	}
+	if empty, _ := groups[1].GetUsers(); len(empty) != 0 {
+		t.Errorf("the placeholder included %v", empty)
+	}
+
+	// bob is the Staging member everywhere, cid stays an Access user
+	users, err := c.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"ann", "bob", accessUserID("cid@example.com")}
+	if got := lo.Map(users, func(user UserableEntry, _ int) string { return user.GetID() }); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("all users %v, want %v", got, want)
+	}
+
+	group, err := c.LookupEntryDepartmentByInternalExternalIdentity(ExternalIdentity("ei.dept." + engID + "@cf.cloudflare"))
+	if err != nil || group.GetName() != "Eng" {
+		t.Errorf("%v %v", group, err)
+	}
+	if _, err := c.LookupEntryDepartmentByInternalExternalIdentity("ei.dept.00000000-0000-0000-0000-000000000009@cf.cloudflare"); err == nil {
+		t.Error("found an Access group which does not exist")
+	}
+	user, err := c.LookupEntryUserByInternalExternalIdentity(ExternalIdentity("ei.user." + accessUserID("cid@example.com") + "@cf.cloudflare"))
+	if err != nil || user.GetEmail() != "cid@example.com" {
+		t.Errorf("%v %v", user, err)
+	}
+}
+
+func TestCloudflareAccessGroupMembershipRewritesEmailRules(t *testing.T) {
+	d := newDashboard("Prod")
+	d.member(0, "ann", "ann@example.com", cloudflareDefaultMemberRole)
+	domain := map[string]any{"email_domain": map[string]any{"domain": "example.org"}}
+	engID := d.group(0, "Eng", "bob@example.com", domain)
+	c := connectDashboard(t, d, "")
+	root, _ := c.GetRootDepartment()
+	prod := root.GetChildDepartments()[0]
+	eng := prod.GetChildDepartments()[0].(DepartmentUserWriter)
+	cid := ExternalIdentity("ei.user." + accessUserID("Cid@Example.com") + "@cf.cloudflare")
+	member := DepartmentModifyUserOptions{Role: DepartmentUserRoleMember}
+
+	for _, extID := range []ExternalIdentity{"ei.user.ann@cf.cloudflare", cid} {
+		if err := eng.AddToDepartment(member, extID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{`{"email_domain":{"domain":"example.org"}}`,
+		`{"email":{"email":"bob@example.com"}}`, `{"email":{"email":"ann@example.com"}}`, `{"email":{"email":"cid@example.com"}}`}
+	if got := d.includes(0, engID); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("include %v, want %v", got, want)
+	}
+	before := len(d.writes())
+	if err := eng.AddToDepartment(member, cid); err != nil || len(d.writes()) != before {
+		t.Errorf("adding again wrote %v, %v", d.writes()[before:], err)
+	}
+	if err := eng.AddToDepartment(member, "ei.user.nobody@cf.cloudflare"); err == nil {
+		t.Error("added someone who is neither a member nor an Access user")
+	}
+	if err := eng.AddToDepartment(member, cid+"x"); err == nil {
+		t.Error("added an extID of another target")
+	}
+
+	// the invitation path is never taken for Access groups
+	if lo.SomeBy(d.writes(), func(request string) bool { return strings.HasSuffix(request, "/members") }) {
+		t.Errorf("invited to the account: %v", d.writes())
+	}
+
+	created, err := prod.CreateChildDepartment(named("Ops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := created.(DepartmentUserWriter)
+	if got := d.includes(0, created.GetID()); len(got) != 1 || !strings.Contains(got[0], cloudflareAccessPlaceholderDomain) {
+		t.Errorf("new group includes %v", got)
+	}
+	if err := ops.AddToDepartment(member, cid); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.includes(0, created.GetID()); strings.Join(got, " ") != `{"email":{"email":"cid@example.com"}}` {
+		t.Errorf("the placeholder was kept: %v", got)
+	}
+	// removing the last email brings the placeholder back, Access needs a rule
+	if err := ops.RemoveFromDepartment(member, cid); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.includes(0, created.GetID()); len(got) != 1 || !strings.Contains(got[0], cloudflareAccessPlaceholderDomain) {
+		t.Errorf("emptied group includes %v", got)
+	}
+	if _, err := created.CreateChildDepartment(named("Nested")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("nested group: %v", err)
+	}
+	if _, err := root.CreateChildDepartment(named("Account")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("account: %v", err)
+	}
+}
+
+type withEmails struct {
+	User
+	emails []string
+}
+
+func (u withEmails) GetEmails() []string {
+	return u.emails
+}
+
+func TestCloudflareLookupUserOnlyFindsMembers(t *testing.T) {
+	d := newDashboard("Prod", "Staging")
+	d.member(1, "ann", "ann@example.com", cloudflareDefaultMemberRole)
+	d.group(0, "Eng", "cid@example.com")
+	c := connectDashboard(t, d, "")
+	for _, tc := range []struct {
+		user Userable
+		want string
+	}{
+		{User{Email: "ANN@example.com"}, "ann"},
+		{withEmails{User{Email: "other@example.com"}, []string{"ann@example.com"}}, "ann"},
+		{User{Email: "cid@example.com"}, ""},
+		{User{Email: "nobody@example.com"}, ""},
+		{User{Name: "No Email"}, ""},
+	} {
+		got, err := c.LookupUser(tc.user)
+		if err != nil {
+			t.Errorf("%v: %v", tc.user, err)
+			continue
+		}
+		switch {
+		case got == nil && tc.want != "":
+			t.Errorf("%v found nobody, want %s", tc.user, tc.want)
+		case got != nil && got.GetID() != tc.want:
+			t.Errorf("%v found %s, want %q", tc.user, got.GetID(), tc.want)
+		}
+	}
+}
+
+// forwardsOf lists the rules of the zone as forwards, hand-made ones with
+// their full name.
+func (d *dashboard) forwardsOf(zoneID string) []EmailForward {
+	return lo.Map(d.rules[zoneID], func(rule emailRoutingRule, _ int) EmailForward {
+		forward := rule.forward()
+		if !rule.managed() {
+			forward.Name = rule.Name
+		}
+		return forward
+	})
+}
+
+func TestCloudflareGetEmailForwardsListsManagedRules(t *testing.T) {
+	d := newDashboard("Acme")
+	zone := d.zone(0, "example.com")
+	d.zone(0, "other.com")
+	d.rule(zone, newEmailRoutingRule(EmailForward{Address: "Ann@example.com", Destination: "ann@gmail.com", Name: "Ann"}))
+	d.rule(zone, emailRoutingRule{Name: "sales", Matchers: []emailRoutingRuleMatch{{Type: "literal", Field: "to", Value: "sales@example.com"}}})
+	d.rule(zone, emailRoutingRule{Name: cloudflareEmailRulePrefix + "catch-all", Matchers: []emailRoutingRuleMatch{{Type: "all"}}})
+	for i := 0; i < cloudflarePerPage; i++ {
+		d.rule(zone, newEmailRoutingRule(EmailForward{Address: fmt.Sprintf("u%d@example.com", i), Destination: "x@gmail.com"}))
+	}
+	c := connectDashboard(t, d, `,"EmailDomains":["example.com"]`)
+
+	forwards, err := c.GetEmailForwards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwards) != cloudflarePerPage+1 {
+		t.Fatalf("got %d forwards, want %d", len(forwards), cloudflarePerPage+1)
+	}
+	if want := (EmailForward{Address: "ann@example.com", Destination: "ann@gmail.com", Name: "Ann"}); forwards[0] != want {
+		t.Errorf("got %+v, want %+v", forwards[0], want)
+	}
+	if got := d.count("GET /zones/" + zone + "/email/routing/rules"); got != 2 {
+		t.Errorf("listed the rules in %d pages, want 2", got)
+	}
+}
+
+func TestCloudflareSetEmailForward(t *testing.T) {
+	d := newDashboard("Acme")
+	zone := d.zone(0, "example.com")
+	account := d.accounts[0].ID
+	d.destinations[account] = []emailRoutingAddress{{Email: "ann@gmail.com"}, {Email: "bob@gmail.com"}}
+	d.rule(zone, newEmailRoutingRule(EmailForward{Address: "bob@example.com", Destination: "bob@gmail.com", Name: "Bob"}))
+	d.rule(zone, emailRoutingRule{Name: "sales", Matchers: []emailRoutingRuleMatch{{Type: "literal", Field: "to", Value: "sales@example.com"}}})
+	c := connectDashboard(t, d, `,"EmailDomains":["example.com"]`)
+
+	if err := c.SetEmailForward(EmailForward{Address: "ann@example.com", Destination: "ANN@gmail.com", Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetEmailForward(EmailForward{Address: "Bob@example.com", Destination: "bob@gmail.com", Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.writes(); len(got) != 1 || got[0] != "POST /zones/"+zone+"/email/routing/rules" {
+		t.Errorf("creating ann and keeping bob wrote %v", got)
+	}
+
+	if err := c.SetEmailForward(EmailForward{Address: "bob@example.com", Destination: "robert@gmail.com", Name: "Robert"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.destinations[account]; len(got) != 3 || got[2].Email != "robert@gmail.com" {
+		t.Errorf("got destinations %v, want robert@gmail.com added", got)
+	}
+	if err := c.SetEmailForward(EmailForward{Address: "sales@example.com", Destination: "ann@gmail.com"}); err == nil {
+		t.Error("took over a rule made by hand")
+	}
+	if err := c.SetEmailForward(EmailForward{Address: "ann@elsewhere.com", Destination: "ann@gmail.com"}); err == nil {
+		t.Error("set a forward outside the email domains")
+	}
+	want := []EmailForward{
+		{Address: "bob@example.com", Destination: "robert@gmail.com", Name: "Robert"},
+		{Address: "sales@example.com", Name: "sales"},
+		{Address: "ann@example.com", Destination: "ANN@gmail.com", Name: "Ann"},
+	}
+	if got := d.forwardsOf(zone); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rules %+v, want %+v", got, want)
+	}
+}
+
+func TestCloudflareDeleteEmailForward(t *testing.T) {
+	d := newDashboard("Acme")
+	zone := d.zone(0, "example.com")
+	d.rule(zone, newEmailRoutingRule(EmailForward{Address: "bob@example.com", Destination: "bob@gmail.com"}))
+	d.rule(zone, emailRoutingRule{Name: "sales", Matchers: []emailRoutingRuleMatch{{Type: "literal", Field: "to", Value: "sales@example.com"}}})
+	c := connectDashboard(t, d, `,"EmailDomains":["example.com"]`)
+
+	for _, address := range []string{"bob@example.com", "sales@example.com", "nobody@example.com"} {
+		if err := c.DeleteEmailForward(address); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+	if got := d.forwardsOf(zone); len(got) != 1 || got[0].Name != "sales" {
+		t.Errorf("got rules %+v, want only the hand-made one", got)
+	}
+}
+
+func isNil(err error) bool { return err == nil }
+
+func TestCloudflareBulkEmailForwardsListOnce(t *testing.T) {
+	d := newDashboard("Acme", "Beta")
+	zones := []string{d.zone(0, "example.com"), d.zone(0, "example.org"), d.zone(1, "beta.com")}
+	d.rule(zones[0], newEmailRoutingRule(EmailForward{Address: "old@example.com", Destination: "old@gmail.com"}))
+	d.rule(zones[0], newEmailRoutingRule(EmailForward{Address: "keep@example.com", Destination: "keep@gmail.com"}))
+	c := connectDashboard(t, d, `,"EmailDomains":["example.com","example.org","beta.com"]`)
+	var _ TargetWithEmailForwardingBulk = c
+
+	var forwards []EmailForward
+	for _, domain := range []string{"example.com", "example.org", "beta.com"} {
+		for i := 0; i < 5; i++ {
+			forwards = append(forwards, EmailForward{Address: fmt.Sprintf("u%d@%s", i, domain), Destination: fmt.Sprintf("u%d@gmail.com", i%2)})
+		}
+	}
+	// set twice in one call, the second sees the rule the first created
+	forwards = append(forwards, forwards[0], EmailForward{Address: "u0@elsewhere.com", Destination: "u0@gmail.com"})
+	errs := c.SetEmailForwards(forwards)
+	if len(errs) != len(forwards) || lo.CountBy(errs, isNil) != len(forwards)-1 || errs[len(errs)-1] == nil {
+		t.Fatalf("got errors %v, want one for elsewhere.com", errs)
+	}
+	errs = c.DeleteEmailForwards([]string{"old@example.com", "u1@example.org", "u1@example.org"})
+	if lo.CountBy(errs, isNil) != len(errs) {
+		t.Fatalf("got errors %v", errs)
+	}
+
+	// beta.com has nothing to delete, its rules are only listed to set
+	lists, rules := []int{2, 2, 1}, []int{6, 4, 5}
+	for i, zone := range zones {
+		if got := d.count("GET /zones/" + zone + "/email/routing/rules"); got != lists[i] {
+			t.Errorf("listed the rules of zone %d in %d calls, want %d", i, got, lists[i])
+		}
+		if got := len(d.rules[zone]); got != rules[i] {
+			t.Errorf("zone %d has %d rules, want %d", i, got, rules[i])
+		}
+	}
+	for i, account := range d.accounts {
+		if got := d.count("GET /accounts/" + account.ID + "/email/routing/addresses"); got != 1 {
+			t.Errorf("listed the destinations of account %d in %d calls, want 1", i, got)
+		}
+		if got := d.count("POST /accounts/" + account.ID + "/email/routing/addresses"); got != 2 {
+			t.Errorf("added %d destinations to account %d, want 2", got, i)
+		}
+	}
+	if got := d.count("GET /zones"); got != 5 {
+		t.Errorf("looked zones up %d times, want once per zone of each call", got)
+	}
+}
@@ -1,11 +1,13 @@
 package dingtalk
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	. "github.com/org-tools/manager"
-	"github.com/samber/lo"
 	"github.com/zhaoyunxing92/dingtalk/v2"
 	"github.com/zhaoyunxing92/dingtalk/v2/request"
 	"github.com/zhaoyunxing92/dingtalk/v2/response"
@@ -33,11 +35,12 @@ func (d dingTalk) GetPlatform() string {
 }
 
 type dingTalkConfig struct {
-	Platform   string
-	Slug       string
-	AppKey     string
-	AppSecret  string
-	RootDeptID int
+	Platform        string
+	Slug            string
+	AppKey          string
+	AppSecret       string
+	RootDeptID      int
+	TraverseWorkers int
 }
 
 func (d *dingTalk) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
@@ -52,6 +55,22 @@ func (d *dingTalk) InitFormUnmarshaler(unmarshaler func(any) error) (Target, err
 	return d, nil
 }
 
+// dingtalk sdk only surfaces "code:%d,msg:%s" strings, these codes mean
+// the app or corp QPS limit was hit or the server was busy.
+var dingTalkThrottledErrPrefixes = []string{"code:-1,", "code:88,", "code:90002,", "code:90018,", "code:90019,"}
+
+func (d *dingTalk) ClassifyError(err error) (bool, time.Duration) {
+	if err == nil {
+		return false, 0
+	}
+	for _, prefix := range dingTalkThrottledErrPrefixes {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true, time.Second
+		}
+	}
+	return ClassifyError(err)
+}
+
 func (d *dingTalk) GetRootDepartment() (DepartmentableEntry, error) {
 	return &dingTalkDept{
 		dingTalk: d,
@@ -60,7 +79,19 @@ func (d *dingTalk) GetRootDepartment() (DepartmentableEntry, error) {
 }
 
 func (d *dingTalk) GetAllUsers() (users []UserableEntry, err error) {
-	return RecursionGetAllUsersIncludeChildDepartments(lo.Must(d.GetRootDepartment()))
+	return d.GetAllUsersContext(context.Background())
+}
+
+func (d *dingTalk) GetAllUsersContext(ctx context.Context) (users []UserableEntry, err error) {
+	rootDepartment, err := d.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	return ConcurrentGetAllUsersIncludeChildDepartments(ctx, rootDepartment, d.GetTraverseOptions())
+}
+
+func (d *dingTalk) GetTraverseOptions() TraverseOptions {
+	return TraverseOptions{Workers: d.config.TraverseWorkers}
 }
 
 func (d *dingTalk) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
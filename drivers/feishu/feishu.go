@@ -2,8 +2,11 @@ package feishu
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/larksuite/oapi-sdk-go/api/core/response"
 	"github.com/larksuite/oapi-sdk-go/core"
 	"github.com/larksuite/oapi-sdk-go/core/config"
 	contact "github.com/larksuite/oapi-sdk-go/service/contact/v3"
@@ -14,18 +17,24 @@ import (
 const (
 	feishuDefaultUserIdType       = "user_id"
 	feishuDefaultDepartmentIdType = "open_department_id"
+	feishuErrCodeRateLimited      = 99991400
 )
 
 type feishu struct {
 	oapiConfig     *config.Config
 	contactService *contact.Service
 	config         *feishuConfig
+	logger         Logger
 }
 
 func init() {
 	RegisterPlatform("feishu", &feishu{})
 }
 
+func (f *feishu) SetLogger(logger Logger) {
+	f.logger = logger
+}
+
 func (d *feishu) GetTarget() Target {
 	return d
 }
@@ -71,10 +80,11 @@ func (f *feishu) LookupEntryDepartmentByInternalExternalIdentity(internalExtID E
 }
 
 type feishuConfig struct {
-	Platform  string
-	Slug      string
-	AppID     string
-	AppSecret string
+	Platform        string
+	Slug            string
+	AppID           string
+	AppSecret       string
+	TraverseWorkers int
 }
 
 func (f feishu) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
@@ -90,6 +100,17 @@ func (f feishu) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error)
 	return &f, nil
 }
 
+func (f *feishu) ClassifyError(err error) (bool, time.Duration) {
+	var respErr *response.Error
+	if errors.As(err, &respErr) {
+		if respErr.Code == feishuErrCodeRateLimited {
+			return true, time.Second
+		}
+		return respErr.Retryable(), 0
+	}
+	return ClassifyError(err)
+}
+
 func (f *feishu) GetRootDepartment() (DepartmentableEntry, error) {
 	contactService := contact.NewService(f.oapiConfig)
 	coreCtx := core.WrapContext(context.Background())
@@ -103,7 +124,19 @@ func (f *feishu) GetRootDepartment() (DepartmentableEntry, error) {
 }
 
 func (f *feishu) GetAllUsers() (users []UserableEntry, err error) {
-	return RecursionGetAllUsersIncludeChildDepartments(lo.Must(f.GetRootDepartment()))
+	return f.GetAllUsersContext(context.Background())
+}
+
+func (f *feishu) GetAllUsersContext(ctx context.Context) (users []UserableEntry, err error) {
+	rootDepartment, err := f.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	return ConcurrentGetAllUsersIncludeChildDepartments(ctx, rootDepartment, f.GetTraverseOptions())
+}
+
+func (f *feishu) GetTraverseOptions() TraverseOptions {
+	return TraverseOptions{Workers: f.config.TraverseWorkers}
 }
 
 type feishuDepartment struct {
@@ -169,7 +202,8 @@ func (d feishuDepartment) GetChildDepartments() (departments []DepartmentableEnt
 	req.SetDepartmentIdType(feishuDefaultDepartmentIdType)
 	resp, err := req.Do()
 	if err != nil {
-		fmt.Println(err)
+		d.logger.WithError(err).WithField("department", d.raw.OpenDepartmentId).Error("list child departments failed")
+		return departments
 	}
 	for _, v := range resp.Items {
 		departments = append(departments, &feishuDepartment{
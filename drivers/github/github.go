@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/google/go-github/v44/github"
@@ -15,12 +16,17 @@ import (
 type gitHub struct {
 	client *github.Client
 	config *githubConfig
+	logger Logger
 }
 
 func init() {
 	RegisterPlatform("github", &gitHub{})
 }
 
+func (g *gitHub) SetLogger(logger Logger) {
+	g.logger = logger
+}
+
 func (g *gitHub) GetTarget() Target {
 	return g
 }
@@ -60,11 +66,27 @@ func (g *gitHub) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error
 			return nil, err
 		}
 		g.config.OrgID = *org.ID
-		fmt.Println(g.config.OrgID)
+		g.logger.WithField("org_id", g.config.OrgID).Debug("resolved github org id")
 	}
 	return g, nil
 }
 
+func (g *gitHub) ClassifyError(err error) (bool, time.Duration) {
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return true, time.Until(rateLimitErr.Rate.Reset.Time)
+	}
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		return true, abuseErr.GetRetryAfter()
+	}
+	var respErr *github.ErrorResponse
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		return IsRetryableStatus(respErr.Response.StatusCode), RetryAfterFromHeader(respErr.Response.Header)
+	}
+	return ClassifyError(err)
+}
+
 func (g *gitHub) GetRootDepartment() (DepartmentableEntry, error) {
 	return &githubTeam{gitHub: g}, nil
 }
@@ -89,7 +111,7 @@ FETCH:
 			raw:    v,
 		})
 	}
-	if resp.LastPage != listOptions.Page {
+	if resp.NextPage != 0 {
 		listOptions.Page = resp.NextPage
 		goto FETCH
 	}
@@ -101,7 +123,10 @@ func (g *gitHub) LookupEntryDepartmentByInternalExternalIdentity(internalExtID E
 	if err != nil {
 		return nil, err
 	}
-	team, _, err := g.client.Teams.GetTeamByID(context.Background(), g.config.OrgID, teamID)
+	team, resp, err := g.client.Teams.GetTeamByID(context.Background(), g.config.OrgID, teamID)
+	if err != nil && resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, NotFound(err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -133,6 +158,16 @@ func (u *githubUser) GetTarget() Target {
 	return u.gitHub
 }
 
+// githubMember is a user listed by a team, maintainers have the admin role.
+type githubMember struct {
+	*githubUser
+	role DepartmentUserRole
+}
+
+func (m *githubMember) GetRole() DepartmentUserRole {
+	return m.role
+}
+
 type githubTeam struct {
 	*gitHub
 	raw *github.Team
@@ -153,8 +188,11 @@ func (t *githubTeam) GetTarget() Target {
 func (t githubTeam) GetName() string {
 	//handle root dept as org
 	if t.raw == nil {
-		org, _, _ := t.client.Organizations.Get(context.Background(), t.config.Org)
-		return *org.Name
+		org, _, err := t.client.Organizations.Get(context.Background(), t.config.Org)
+		if err != nil || org.GetName() == "" {
+			return t.config.Org
+		}
+		return org.GetName()
 	}
 	return *t.raw.Name
 }
@@ -180,8 +218,11 @@ func (o *githubTeamAddUserOptions) FromUnion(opts DepartmentModifyUserOptions) e
 }
 
 func (t githubTeam) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
-	if extID.GetTargetSlug() != t.gitHub.config.Slug && extID.GetPlatform() != t.gitHub.GetPlatform() {
-		return errors.New("cannot add external user")
+	if t.raw == nil {
+		return errors.New("cannot add user to the org root")
+	}
+	if err := extID.CheckIfInternal(t.gitHub); err != nil {
+		return err
 	}
 	user, err := t.gitHub.lookupGitHubUserByInternalExternalIdentity(extID)
 	if err != nil {
@@ -196,32 +237,39 @@ func (t githubTeam) AddToDepartment(options DepartmentModifyUserOptions, extID E
 	return err
 }
 
-func (t githubTeam) DeleteFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
-	if extID.GetTargetSlug() != t.gitHub.config.Slug && extID.GetPlatform() != t.gitHub.GetPlatform() {
-		return errors.New("cannot delete external user")
+func (t githubTeam) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if t.raw == nil {
+		return errors.New("cannot remove user from the org root")
+	}
+	if err := extID.CheckIfInternal(t.gitHub); err != nil {
+		return err
 	}
 	user, err := t.gitHub.lookupGitHubUserByInternalExternalIdentity(extID)
 	if err != nil {
 		return fmt.Errorf("error finding user %s: %s", extID, err)
 	}
-	opts := new(githubTeamAddUserOptions)
-	if err := opts.FromUnion(options); err != nil {
-		return err
-	}
 	_, err = t.gitHub.client.Teams.RemoveTeamMembershipBySlug(context.Background(), t.gitHub.config.Org, *t.raw.Slug,
 		*user.raw.Login)
 	return err
 }
 
 func (t githubTeam) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
-	team, _, err := t.gitHub.client.Teams.CreateTeam(context.Background(), t.gitHub.config.Org, github.NewTeam{
-		Name:         department.GetName(),
-		ParentTeamID: t.raw.ID,
-	})
+	newTeam := github.NewTeam{
+		Name:        department.GetName(),
+		Description: github.String(department.GetDescription()),
+	}
+	//root dept is the org, teams created there have no parent
+	if t.raw != nil {
+		newTeam.ParentTeamID = t.raw.ID
+	}
+	team, _, err := t.gitHub.client.Teams.CreateTeam(context.Background(), t.gitHub.config.Org, newTeam)
+	if err != nil {
+		return nil, err
+	}
 	return &githubTeam{
 		gitHub: t.gitHub,
 		raw:    team,
-	}, err
+	}, nil
 }
 
 func (t githubTeam) GetChildDepartments() (departments []DepartmentableEntry) {
@@ -232,10 +280,11 @@ func (t githubTeam) GetChildDepartments() (departments []DepartmentableEntry) {
 	var (
 		teams []*github.Team
 		resp  *github.Response
+		err   error
 	)
 FETCH_TEAMS:
 	if t.raw == nil {
-		teams, resp, _ = t.gitHub.client.Teams.ListTeams(context.Background(), t.gitHub.config.Org, opts)
+		teams, resp, err = t.gitHub.client.Teams.ListTeams(context.Background(), t.gitHub.config.Org, opts)
 		firstDepthTeams := make([]*github.Team, 0)
 		for _, team := range teams {
 			if team.Parent == nil {
@@ -244,7 +293,11 @@ FETCH_TEAMS:
 		}
 		teams = firstDepthTeams
 	} else {
-		teams, resp, _ = t.gitHub.client.Teams.ListChildTeamsByParentSlug(context.Background(), t.gitHub.config.Org, *t.raw.Slug, opts)
+		teams, resp, err = t.gitHub.client.Teams.ListChildTeamsByParentSlug(context.Background(), t.gitHub.config.Org, *t.raw.Slug, opts)
+	}
+	if err != nil {
+		t.gitHub.logger.WithError(err).Error("list teams failed")
+		return departments
 	}
 	for _, team := range teams {
 		departments = append(departments, &githubTeam{
@@ -253,7 +306,7 @@ FETCH_TEAMS:
 		})
 	}
 
-	if resp.NextPage != resp.LastPage {
+	if resp.NextPage != 0 {
 		opts.Page = resp.NextPage
 		goto FETCH_TEAMS
 	}
@@ -264,7 +317,34 @@ func (t githubTeam) GetUsers() (users []UserableEntry, err error) {
 	if t.raw == nil {
 		return
 	}
+	maintainers, err := t.listMembers("maintainer")
+	if err != nil {
+		return nil, err
+	}
+	maintainerIDs := make(map[int64]bool, len(maintainers))
+	for _, maintainer := range maintainers {
+		maintainerIDs[maintainer.GetID()] = true
+	}
+	members, err := t.listMembers("all")
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range members {
+		role := DepartmentUserRoleMember
+		if maintainerIDs[user.GetID()] {
+			role = DepartmentUserRoleAdmin
+		}
+		users = append(users, &githubMember{
+			githubUser: &githubUser{gitHub: t.gitHub, raw: user},
+			role:       role,
+		})
+	}
+	return users, nil
+}
+
+func (t githubTeam) listMembers(role string) (members []*github.User, err error) {
 	opts := &github.TeamListTeamMembersOptions{
+		Role: role,
 		ListOptions: github.ListOptions{
 			Page:    0,
 			PerPage: 100,
@@ -273,19 +353,14 @@ func (t githubTeam) GetUsers() (users []UserableEntry, err error) {
 FETCH_USERS:
 	githubUsers, resp, err := t.gitHub.client.Teams.ListTeamMembersBySlug(context.Background(), t.gitHub.config.Org, *t.raw.Slug, opts)
 	if err != nil {
-		return
-	}
-	for _, user := range githubUsers {
-		users = append(users, &githubUser{
-			gitHub: t.gitHub,
-			raw:    user,
-		})
+		return nil, err
 	}
-	if resp.NextPage != resp.LastPage {
+	members = append(members, githubUsers...)
+	if resp.NextPage != 0 {
 		opts.ListOptions.Page = resp.NextPage
 		goto FETCH_USERS
 	}
-	return
+	return members, nil
 }
 
 func (u githubUser) GetID() (userId string) {
@@ -304,9 +379,9 @@ func (u githubUser) GetPhone() string {
 }
 
 func (u githubUser) GetEmail() string {
-	return *u.raw.Email
+	return u.raw.GetEmail()
 }
 
 func (u githubUser) GetEmails() []string {
-	return []string{*u.raw.Email}
+	return []string{u.raw.GetEmail()}
 }
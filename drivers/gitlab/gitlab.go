@@ -0,0 +1,427 @@
+package gitlab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/xanzy/go-gitlab"
+)
+
+const gitlabPerPage = 100
+
+type gitLab struct {
+	client *gitlab.Client
+	config *gitlabConfig
+	logger Logger
+	// root is the configured top group, nil when the whole instance is
+	// the root.
+	root *gitlab.Group
+}
+
+func init() {
+	RegisterPlatform("gitlab", &gitLab{})
+}
+
+func (g *gitLab) SetLogger(logger Logger) {
+	g.logger = logger
+}
+
+func (g *gitLab) GetTarget() Target {
+	return g
+}
+
+func (g gitLab) GetTargetSlug() string {
+	return g.config.Slug
+}
+
+func (g gitLab) GetPlatform() string {
+	return g.config.Platform
+}
+
+type gitlabConfig struct {
+	Platform string
+	Slug     string
+	// BaseURL is the API root of self-hosted instances, like
+	// https://gitlab.example.com/api/v4, gitlab.com when empty.
+	BaseURL string
+	Token   string
+	// Group is the full path or ID of the group used as the root, all
+	// top-level groups of the instance are children of the root when empty.
+	Group string
+	// TraverseWorkers bounds the subgroups of Group walked at once.
+	TraverseWorkers int
+}
+
+func (g *gitLab) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	err := unmarshaler(&g.config)
+	if err != nil {
+		return nil, err
+	}
+	if g.config.Token == "" {
+		return nil, errors.New("gitlab token is required")
+	}
+	// retries are left to the retry decorator
+	options := []gitlab.ClientOptionFunc{gitlab.WithoutRetries()}
+	if g.config.BaseURL != "" {
+		options = append(options, gitlab.WithBaseURL(g.config.BaseURL))
+	}
+	g.client, err = gitlab.NewClient(g.config.Token, options...)
+	if err != nil {
+		return nil, err
+	}
+	if g.config.Group != "" {
+		g.root, _, err = g.client.Groups.GetGroup(g.config.Group, &gitlab.GetGroupOptions{WithProjects: gitlab.Bool(false)})
+		if err != nil {
+			return nil, err
+		}
+		g.logger.WithField("group_id", g.root.ID).Debug("resolved gitlab root group")
+	}
+	return g, nil
+}
+
+// SetHTTPClient replaces the client talking to BaseURL.
+func (g *gitLab) SetHTTPClient(client *http.Client) error {
+	options := []gitlab.ClientOptionFunc{gitlab.WithoutRetries(), gitlab.WithHTTPClient(client)}
+	if g.config.BaseURL != "" {
+		options = append(options, gitlab.WithBaseURL(g.config.BaseURL))
+	}
+	gitlabClient, err := gitlab.NewClient(g.config.Token, options...)
+	if err != nil {
+		return err
+	}
+	g.client = gitlabClient
+	return nil
+}
+
+func (g *gitLab) ClassifyError(err error) (bool, time.Duration) {
+	var respErr *gitlab.ErrorResponse
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		return IsRetryableStatus(respErr.Response.StatusCode), RetryAfterFromHeader(respErr.Response.Header)
+	}
+	return ClassifyError(err)
+}
+
+func (g *gitLab) GetRootDepartment() (DepartmentableEntry, error) {
+	return &gitlabGroup{gitLab: g, raw: g.root}, nil
+}
+
+func (g *gitLab) GetAllUsers() (users []UserableEntry, err error) {
+	return g.GetAllUsersContext(context.Background())
+}
+
+// GetAllUsersContext lists the members of the root group and its subgroups,
+// or every active user of the instance without a root group.
+func (g *gitLab) GetAllUsersContext(ctx context.Context) (users []UserableEntry, err error) {
+	if g.root != nil {
+		root, err := g.GetRootDepartment()
+		if err != nil {
+			return nil, err
+		}
+		return ConcurrentGetAllUsersIncludeChildDepartments(ctx, root, TraverseOptions{Workers: g.config.TraverseWorkers})
+	}
+	opts := &gitlab.ListUsersOptions{
+		ListOptions:     gitlab.ListOptions{Page: 1, PerPage: gitlabPerPage},
+		Active:          gitlab.Bool(true),
+		ExcludeInternal: gitlab.Bool(true),
+	}
+FETCH:
+	gitlabUsers, resp, err := g.client.Users.ListUsers(opts, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range gitlabUsers {
+		if v.Bot {
+			continue
+		}
+		users = append(users, &gitlabUser{gitLab: g, raw: v})
+	}
+	if resp.NextPage != 0 {
+		opts.Page = resp.NextPage
+		goto FETCH
+	}
+	return users, nil
+}
+
+func (g *gitLab) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	groupID, err := strconv.Atoi(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	if groupID == 0 && g.root == nil {
+		return g.GetRootDepartment()
+	}
+	group, resp, err := g.client.Groups.GetGroup(groupID, &gitlab.GetGroupOptions{WithProjects: gitlab.Bool(false)})
+	if err != nil && resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, NotFound(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gitlabGroup{gitLab: g, raw: group}, nil
+}
+
+func (g *gitLab) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	return g.lookupGitLabUserByInternalExternalIdentity(internalExtID)
+}
+
+func (g *gitLab) lookupGitLabUserByInternalExternalIdentity(internalExtID ExternalIdentity) (*gitlabUser, error) {
+	userID, err := strconv.Atoi(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	user, _, err := g.client.Users.GetUser(userID, gitlab.GetUsersOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &gitlabUser{gitLab: g, raw: user}, nil
+}
+
+type gitlabUser struct {
+	*gitLab
+	raw *gitlab.User
+}
+
+func (u *gitlabUser) GetTarget() Target {
+	return u.gitLab
+}
+
+func (u gitlabUser) GetID() string {
+	return strconv.Itoa(u.raw.ID)
+}
+
+func (u gitlabUser) GetName() string {
+	if u.raw.Name != "" {
+		return u.raw.Name
+	}
+	return u.raw.Username
+}
+
+func (u gitlabUser) GetPhone() string {
+	return ""
+}
+
+// GetEmail is the private email when the token can see it, admins and
+// group SAML, or the public one.
+func (u gitlabUser) GetEmail() string {
+	if u.raw.Email != "" {
+		return u.raw.Email
+	}
+	return u.raw.PublicEmail
+}
+
+func (u gitlabUser) GetEmails() []string {
+	return []string{u.GetEmail()}
+}
+
+// gitlabMember is a user listed by a group, maintainers and owners have the
+// admin role.
+type gitlabMember struct {
+	*gitlabUser
+	role DepartmentUserRole
+}
+
+func (m *gitlabMember) GetRole() DepartmentUserRole {
+	return m.role
+}
+
+func roleOfAccessLevel(level gitlab.AccessLevelValue) DepartmentUserRole {
+	if level >= gitlab.MaintainerPermissions {
+		return DepartmentUserRoleAdmin
+	}
+	return DepartmentUserRoleMember
+}
+
+func accessLevelOfRole(role DepartmentUserRole) (gitlab.AccessLevelValue, error) {
+	level, ok := map[DepartmentUserRole]gitlab.AccessLevelValue{
+		DepartmentUserRoleMember: gitlab.DeveloperPermissions,
+		DepartmentUserRoleAdmin:  gitlab.MaintainerPermissions,
+	}[role]
+	if !ok {
+		return 0, errors.New("Role Mapping not found")
+	}
+	return level, nil
+}
+
+type gitlabGroup struct {
+	*gitLab
+	raw *gitlab.Group
+}
+
+func (t gitlabGroup) GetID() string {
+	//handle instance root id as 0
+	if t.raw == nil {
+		return "0"
+	}
+	return strconv.Itoa(t.raw.ID)
+}
+
+func (t *gitlabGroup) GetTarget() Target {
+	return t.gitLab
+}
+
+func (t gitlabGroup) GetName() string {
+	if t.raw == nil {
+		return t.config.Slug
+	}
+	return t.raw.Name
+}
+
+func (t gitlabGroup) GetDescription() string {
+	if t.raw == nil {
+		return ""
+	}
+	return t.raw.Description
+}
+
+func (t gitlabGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if t.raw == nil {
+		return errors.New("cannot add user to the instance root")
+	}
+	if err := extID.CheckIfInternal(t.gitLab); err != nil {
+		return err
+	}
+	user, err := t.gitLab.lookupGitLabUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return fmt.Errorf("error finding user %s: %s", extID, err)
+	}
+	level, err := accessLevelOfRole(options.Role)
+	if err != nil {
+		return err
+	}
+	_, resp, err := t.gitLab.client.GroupMembers.AddGroupMember(t.raw.ID, &gitlab.AddGroupMemberOptions{
+		UserID:      gitlab.Int(user.raw.ID),
+		AccessLevel: gitlab.AccessLevel(level),
+	})
+	// already a member, apply the role like github does for maintainers
+	if resp != nil && resp.StatusCode == http.StatusConflict {
+		_, _, err = t.gitLab.client.GroupMembers.EditGroupMember(t.raw.ID, user.raw.ID, &gitlab.EditGroupMemberOptions{
+			AccessLevel: gitlab.AccessLevel(level),
+		})
+	}
+	return err
+}
+
+func (t gitlabGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if t.raw == nil {
+		return errors.New("cannot remove user from the instance root")
+	}
+	if err := extID.CheckIfInternal(t.gitLab); err != nil {
+		return err
+	}
+	userID, err := strconv.Atoi(extID.GetEntryID())
+	if err != nil {
+		return err
+	}
+	_, err = t.gitLab.client.GroupMembers.RemoveGroupMember(t.raw.ID, userID, &gitlab.RemoveGroupMemberOptions{})
+	return err
+}
+
+var groupPathInvalid = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// groupPath derives the URL path of a new group from its name, GitLab
+// requires one and only takes letters, digits, _, - and . in it.
+func groupPath(name string) string {
+	path := strings.Trim(groupPathInvalid.ReplaceAllString(strings.ToLower(name), "-"), "-_.")
+	if path == "" {
+		path = "group-" + strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	return path
+}
+
+func (t gitlabGroup) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	newGroup := &gitlab.CreateGroupOptions{
+		Name:        gitlab.String(department.GetName()),
+		Path:        gitlab.String(groupPath(department.GetName())),
+		Description: gitlab.String(department.GetDescription()),
+	}
+	//instance root has no group, groups created there are top-level
+	if t.raw != nil {
+		newGroup.ParentID = gitlab.Int(t.raw.ID)
+	}
+	group, _, err := t.gitLab.client.Groups.CreateGroup(newGroup)
+	if err != nil {
+		return nil, err
+	}
+	return &gitlabGroup{
+		gitLab: t.gitLab,
+		raw:    group,
+	}, nil
+}
+
+func (t gitlabGroup) GetChildDepartments() (departments []DepartmentableEntry) {
+	opts := &gitlab.ListGroupsOptions{
+		ListOptions: gitlab.ListOptions{Page: 1, PerPage: gitlabPerPage},
+	}
+	var (
+		groups []*gitlab.Group
+		resp   *gitlab.Response
+		err    error
+	)
+FETCH_GROUPS:
+	if t.raw == nil {
+		opts.TopLevelOnly = gitlab.Bool(true)
+		opts.AllAvailable = gitlab.Bool(true)
+		groups, resp, err = t.gitLab.client.Groups.ListGroups(opts)
+	} else {
+		groups, resp, err = t.gitLab.client.Groups.ListSubGroups(t.raw.ID, (*gitlab.ListSubGroupsOptions)(opts))
+	}
+	if err != nil {
+		t.gitLab.logger.WithError(err).Error("list groups failed")
+		return departments
+	}
+	for _, group := range groups {
+		departments = append(departments, &gitlabGroup{
+			gitLab: t.gitLab,
+			raw:    group,
+		})
+	}
+	if resp.NextPage != 0 {
+		opts.Page = resp.NextPage
+		goto FETCH_GROUPS
+	}
+	return departments
+}
+
+// GetUsers lists direct members, those inherited from parent groups are
+// members of the parent already.
+func (t gitlabGroup) GetUsers() (users []UserableEntry, err error) {
+	if t.raw == nil {
+		return
+	}
+	opts := &gitlab.ListGroupMembersOptions{
+		ListOptions: gitlab.ListOptions{Page: 1, PerPage: gitlabPerPage},
+	}
+FETCH_USERS:
+	members, resp, err := t.gitLab.client.Groups.ListGroupMembers(t.raw.ID, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		if member.State != "" && member.State != "active" {
+			continue
+		}
+		users = append(users, &gitlabMember{
+			gitlabUser: &gitlabUser{gitLab: t.gitLab, raw: &gitlab.User{
+				ID:       member.ID,
+				Username: member.Username,
+				Name:     member.Name,
+				State:    member.State,
+				Email:    member.Email,
+				WebURL:   member.WebURL,
+			}},
+			role: roleOfAccessLevel(member.AccessLevel),
+		})
+	}
+	if resp.NextPage != 0 {
+		opts.Page = resp.NextPage
+		goto FETCH_USERS
+	}
+	return users, nil
+}
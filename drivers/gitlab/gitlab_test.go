@@ -0,0 +1,238 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+// gitlabRoutes is the part of the v4 API a test needs, by path below
+// /api/v4. Requests are logged as "METHOD escaped path?query".
+type gitlabRoutes map[string]func(w http.ResponseWriter, r *http.Request)
+
+type gitlabServer struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func serveGitLab(t *testing.T, routes gitlabRoutes, group string) (*gitLab, *gitlabServer) {
+	t.Helper()
+	logged := new(gitlabServer)
+	mux := http.NewServeMux()
+	for path, handler := range routes {
+		handler := handler
+		mux.HandleFunc("/api/v4"+path, func(w http.ResponseWriter, r *http.Request) {
+			logged.mu.Lock()
+			logged.requests = append(logged.requests, r.Method+" "+strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4")+"?"+r.URL.RawQuery)
+			logged.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			handler(w, r)
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	g := &gitLab{logger: Log}
+	_, err := g.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"gitlab","Slug":"lab","Token":"glpat-test","BaseURL":"`+server.URL+`/api/v4","Group":"`+group+`"}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, logged
+}
+
+func jsonReply(body string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func TestGitLabFollowsXNextPage(t *testing.T) {
+	g, logged := serveGitLab(t, gitlabRoutes{
+		"/users": func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Query().Get("page") {
+			case "1":
+				w.Header().Set("X-Next-Page", "2")
+				_, _ = w.Write([]byte(`[{"id":1,"username":"ada","name":"Ada Lovelace","email":"ada@example.com"},{"id":7,"username":"project_7_bot","bot":true}]`))
+			case "2":
+				// the last page has an empty X-Next-Page
+				w.Header().Set("X-Next-Page", "")
+				_, _ = w.Write([]byte(`[{"id":2,"username":"grace","public_email":"grace@example.com"}]`))
+			}
+		},
+	}, "")
+	users, err := g.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := lo.Map(users, func(user UserableEntry, _ int) string { return user.GetName() + " <" + user.GetEmail() + ">" })
+	if strings.Join(got, ", ") != "Ada Lovelace <ada@example.com>, grace <grace@example.com>" {
+		t.Errorf("got users %v", got)
+	}
+	if len(logged.requests) != 2 || !strings.Contains(logged.requests[0], "active=true") || !strings.Contains(logged.requests[0], "exclude_internal=true") {
+		t.Errorf("got requests %q, want two pages of active non-internal users", logged.requests)
+	}
+}
+
+func TestGitLabInstanceRootListsTopLevelGroups(t *testing.T) {
+	g, logged := serveGitLab(t, gitlabRoutes{
+		"/groups": jsonReply(`[{"id":3,"name":"Acme","full_path":"acme"}]`),
+	}, "")
+	root, _ := g.GetRootDepartment()
+	if root.GetID() != "0" || root.GetName() != "lab" {
+		t.Errorf("instance root is %s %q, want 0 named after the slug", root.GetID(), root.GetName())
+	}
+	children := root.GetChildDepartments()
+	if len(children) != 1 || children[0].GetName() != "Acme" {
+		t.Fatalf("got top level groups %v", children)
+	}
+	if query := logged.requests[0]; !strings.Contains(query, "top_level_only=true") || !strings.Contains(query, "all_available=true") {
+		t.Errorf("listed %s, want every top level group", query)
+	}
+	found, err := g.LookupEntryDepartmentByInternalExternalIdentity("ei.dept.0@lab.gitlab")
+	if err != nil || found.GetID() != "0" {
+		t.Errorf("group 0 resolved to %v, %v, want the instance root", found, err)
+	}
+	if err := root.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.1@lab.gitlab"); err == nil {
+		t.Error("added a user to the instance root")
+	}
+}
+
+func TestGitLabResolvesRootGroupByEscapedPath(t *testing.T) {
+	g, logged := serveGitLab(t, gitlabRoutes{
+		"/groups/acme/platform": jsonReply(`{"id":9,"name":"Platform","full_path":"acme/platform"}`),
+	}, "acme/platform")
+	root, _ := g.GetRootDepartment()
+	if root.GetID() != "9" {
+		t.Errorf("root is group %s, want 9", root.GetID())
+	}
+	if logged.requests[0] != "GET /groups/acme%2Fplatform?with_projects=false" {
+		t.Errorf("resolved the root with %s", logged.requests[0])
+	}
+}
+
+func TestGitLabMembersSkipBlockedAndMapRoles(t *testing.T) {
+	g, _ := serveGitLab(t, gitlabRoutes{
+		"/groups/9": jsonReply(`{"id":9,"name":"Platform"}`),
+		"/groups/9/members": jsonReply(`[
+			{"id":1,"username":"ada","state":"active","access_level":30},
+			{"id":2,"username":"grace","state":"active","access_level":40},
+			{"id":3,"username":"alan","access_level":50},
+			{"id":4,"username":"edsger","state":"blocked","access_level":50},
+			{"id":5,"username":"barbara","state":"awaiting","access_level":30}]`),
+	}, "9")
+	root, _ := g.GetRootDepartment()
+	members, err := root.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := lo.Map(members, func(member UserableEntry, _ int) string {
+		return member.GetName() + ":" + member.(UserableWithRole).GetRole().String()
+	})
+	want := []string{"ada:" + DepartmentUserRoleMember.String(), "grace:" + DepartmentUserRoleAdmin.String(), "alan:" + DepartmentUserRoleAdmin.String()}
+	if strings.Join(roles, " ") != strings.Join(want, " ") {
+		t.Errorf("got members %v, want %v", roles, want)
+	}
+}
+
+func TestGitLabAddExistingMemberEditsItsRole(t *testing.T) {
+	g, logged := serveGitLab(t, gitlabRoutes{
+		"/groups/9": jsonReply(`{"id":9,"name":"Platform"}`),
+		"/users/2":  jsonReply(`{"id":2,"username":"grace"}`),
+		"/groups/9/members": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"message":"Member already exists"}`))
+		},
+		"/groups/9/members/2": jsonReply(`{"id":2,"access_level":40}`),
+	}, "9")
+	root, _ := g.GetRootDepartment()
+	err := root.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{Role: DepartmentUserRoleAdmin}, "ei.user.2@lab.gitlab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := lo.Reject(logged.requests, func(request string, _ int) bool { return strings.HasPrefix(request, "GET ") })
+	if strings.Join(writes, ", ") != "POST /groups/9/members?, PUT /groups/9/members/2?" {
+		t.Errorf("got writes %q, want the add then the role edit", writes)
+	}
+	if err := root.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{Role: DepartmentUserRoleAdmin + 1}, "ei.user.2@lab.gitlab"); err == nil {
+		t.Error("added with a role that has no access level")
+	}
+}
+
+func TestGitLabRetriesAfterRetryAfter(t *testing.T) {
+	g, _ := serveGitLab(t, gitlabRoutes{
+		"/users/1": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "12")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message":"Retry later"}`))
+		},
+		"/users/2": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"404 User Not Found"}`))
+		},
+	}, "")
+	_, err := g.LookupEntryUserByInternalExternalIdentity("ei.user.1@lab.gitlab")
+	if retry, after := g.ClassifyError(err); !retry || after != 12*time.Second {
+		t.Errorf("classified %v as retry %v after %v, want a retry after 12s", err, retry, after)
+	}
+	_, err = g.LookupEntryUserByInternalExternalIdentity("ei.user.2@lab.gitlab")
+	if retry, _ := g.ClassifyError(err); retry || err == nil {
+		t.Errorf("classified %v as retryable", err)
+	}
+}
+
+func TestGitLabGroupPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"Platform":       "platform",
+		"R&D / Platform": "r-d-platform",
+		"_infra.v2_":     "infra.v2",
+		"Ops & On-call!": "ops-on-call",
+	} {
+		if got := groupPath(name); got != want {
+			t.Errorf("groupPath(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := groupPath("研发"); !strings.HasPrefix(got, "group-") {
+		t.Errorf("groupPath of a name without path characters is %q", got)
+	}
+}
+
+func TestGitLabWalksSubgroupsOfRootGroup(t *testing.T) {
+	g, logged := serveGitLab(t, gitlabRoutes{
+		"/groups/9":            jsonReply(`{"id":9,"name":"Platform"}`),
+		"/groups/9/subgroups":  jsonReply(`[{"id":10,"name":"SRE"},{"id":11,"name":"Data"}]`),
+		"/groups/10/subgroups": jsonReply(`[]`),
+		"/groups/11/subgroups": jsonReply(`[]`),
+		"/groups/9/members":    jsonReply(`[{"id":1,"username":"ada","access_level":50}]`),
+		"/groups/10/members":   jsonReply(`[{"id":2,"username":"grace","access_level":30},{"id":1,"username":"ada","access_level":30}]`),
+		"/groups/11/members":   jsonReply(`[{"id":3,"username":"alan","access_level":30}]`),
+	}, "9")
+	users, err := g.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// inherited members are listed once, in the order of the tree
+	if names := lo.Map(users, func(user UserableEntry, _ int) string { return user.GetName() }); strings.Join(names, ",") != "ada,grace,alan" {
+		t.Errorf("got users %v", names)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := len(logged.requests)
+	_, err = g.GetAllUsersContext(ctx)
+	var branches TraverseError
+	if !errors.As(err, &branches) || len(branches) != 1 || !errors.Is(branches[0], context.Canceled) {
+		t.Errorf("canceled walk returned %v, want the root canceled", err)
+	}
+	if len(logged.requests) != before {
+		t.Errorf("canceled walk sent %q", logged.requests[before:])
+	}
+}
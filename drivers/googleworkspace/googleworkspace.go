@@ -0,0 +1,908 @@
+package googleworkspace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+const (
+	googleDefaultCustomer = "my_customer"
+	googleDefaultSchema   = "OrgManager"
+	googleExtIDsField     = "extIDs"
+	// googleRootID is the customer root org unit, whose id we cannot read,
+	// or the synthetic root when departments are groups.
+	googleRootID = "root"
+
+	googleDepartmentsOrgUnits = "orgunits"
+	googleDepartmentsGroups   = "groups"
+)
+
+// googleWorkspace reads and writes the Admin SDK directory, impersonating
+// Subject through domain-wide delegation. Departments are org units, a user
+// is in exactly one of them, or groups, nested through GROUP members.
+type googleWorkspace struct {
+	service *admin.Service
+	config  *googleWorkspaceConfig
+	logger  Logger
+}
+
+func init() {
+	RegisterPlatform("googleworkspace", &googleWorkspace{})
+}
+
+func (g *googleWorkspace) SetLogger(logger Logger) {
+	g.logger = logger
+}
+
+func (g *googleWorkspace) GetTarget() Target {
+	return g
+}
+
+func (g googleWorkspace) GetTargetSlug() string {
+	return g.config.Slug
+}
+
+func (g googleWorkspace) GetPlatform() string {
+	return g.config.Platform
+}
+
+type googleWorkspaceConfig struct {
+	Platform string
+	Slug     string
+	// Credentials is the service account key JSON, CredentialsFile a path
+	// to it.
+	Credentials     string
+	CredentialsFile string
+	// Subject is the admin the service account acts as.
+	Subject  string
+	Customer string
+	// Domain receives created groups and is the enterprise email domain.
+	Domain string
+	// Departments is orgunits or groups.
+	Departments     string
+	RootOrgUnitPath string
+	// Schema is the custom user schema holding extIDs in its multi-valued,
+	// indexed string field extIDs.
+	Schema string
+	// BaseURL overrides the API endpoint.
+	BaseURL string
+}
+
+func (g *googleWorkspace) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	err := unmarshaler(&g.config)
+	if err != nil {
+		return nil, err
+	}
+	if g.config.Customer == "" {
+		g.config.Customer = googleDefaultCustomer
+	}
+	if g.config.Schema == "" {
+		g.config.Schema = googleDefaultSchema
+	}
+	if g.config.RootOrgUnitPath == "" {
+		g.config.RootOrgUnitPath = "/"
+	}
+	switch g.config.Departments {
+	case "":
+		g.config.Departments = googleDepartmentsOrgUnits
+	case googleDepartmentsOrgUnits, googleDepartmentsGroups:
+	default:
+		return nil, fmt.Errorf("googleworkspace departments should be orgunits or groups, got %s", g.config.Departments)
+	}
+	credentials := []byte(g.config.Credentials)
+	if g.config.CredentialsFile != "" {
+		if credentials, err = os.ReadFile(g.config.CredentialsFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(credentials) == 0 || g.config.Subject == "" {
+		return nil, errors.New("googleworkspace credentials and subject are required")
+	}
+	jwtConfig, err := google.JWTConfigFromJSON(credentials,
+		admin.AdminDirectoryUserScope,
+		admin.AdminDirectoryOrgunitScope,
+		admin.AdminDirectoryGroupScope,
+		admin.AdminDirectoryGroupMemberScope,
+	)
+	if err != nil {
+		return nil, err
+	}
+	jwtConfig.Subject = g.config.Subject
+	if err := g.SetHTTPClient(jwtConfig.Client(context.Background())); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// SetHTTPClient replaces the client talking to the directory API, it has
+// to authorize requests itself.
+func (g *googleWorkspace) SetHTTPClient(client *http.Client) (err error) {
+	options := []option.ClientOption{option.WithHTTPClient(client)}
+	if g.config.BaseURL != "" {
+		options = append(options, option.WithEndpoint(g.config.BaseURL))
+	}
+	g.service, err = admin.NewService(context.Background(), options...)
+	return err
+}
+
+func (g *googleWorkspace) GetEnterpriseEmailDomains() []string {
+	if g.config.Domain == "" {
+		return nil
+	}
+	return []string{g.config.Domain}
+}
+
+var googleRateLimitReasons = []string{"rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded", "backendError"}
+
+func (g *googleWorkspace) ClassifyError(err error) (bool, time.Duration) {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		for _, item := range apiErr.Errors {
+			if lo.Contains(googleRateLimitReasons, item.Reason) {
+				return true, RetryAfterFromHeader(apiErr.Header)
+			}
+		}
+		return IsRetryableStatus(apiErr.Code), RetryAfterFromHeader(apiErr.Header)
+	}
+	return ClassifyError(err)
+}
+
+func isGoogleNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func isGoogleConflict(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict
+}
+
+func (g *googleWorkspace) GetRootDepartment() (DepartmentableEntry, error) {
+	if g.config.Departments == googleDepartmentsGroups {
+		return &googleGroup{googleWorkspace: g, walk: new(googleWalk)}, nil
+	}
+	if g.config.RootOrgUnitPath == "/" {
+		return &googleOrgUnit{googleWorkspace: g, raw: &admin.OrgUnit{Name: g.config.Slug, OrgUnitPath: "/"}}, nil
+	}
+	orgUnit, err := g.service.Orgunits.Get(g.config.Customer, strings.TrimPrefix(g.config.RootOrgUnitPath, "/")).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &googleOrgUnit{googleWorkspace: g, raw: orgUnit}, nil
+}
+
+// listUsers lists the users of the customer matching query, see
+// https://developers.google.com/admin-sdk/directory/v1/guides/search-users.
+func (g *googleWorkspace) listUsers(query string) (users []*admin.User, err error) {
+	call := g.service.Users.List().Customer(g.config.Customer).Projection("full").MaxResults(500)
+	if query != "" {
+		call = call.Query(query)
+	}
+	err = call.Pages(context.Background(), func(page *admin.Users) error {
+		users = append(users, page.Users...)
+		return nil
+	})
+	return users, err
+}
+
+func (g *googleWorkspace) GetAllUsers() (users []UserableEntry, err error) {
+	query := ""
+	if g.config.Departments == googleDepartmentsOrgUnits && g.config.RootOrgUnitPath != "/" {
+		query = fmt.Sprintf("orgUnitPath='%s'", g.config.RootOrgUnitPath)
+	}
+	googleUsers, err := g.listUsers(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range googleUsers {
+		users = append(users, &googleUser{googleWorkspace: g, raw: user})
+	}
+	return users, nil
+}
+
+func (g *googleWorkspace) getUser(userKey string) (*googleUser, error) {
+	user, err := g.service.Users.Get(userKey).Projection("full").Do()
+	if err != nil {
+		return nil, err
+	}
+	return &googleUser{googleWorkspace: g, raw: user}, nil
+}
+
+func (g *googleWorkspace) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	return g.getUser(internalExtID.GetEntryID())
+}
+
+func (g *googleWorkspace) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	id := internalExtID.GetEntryID()
+	if g.config.Departments == googleDepartmentsGroups {
+		if id == googleRootID {
+			return g.GetRootDepartment()
+		}
+		group, err := g.service.Groups.Get(id).Do()
+		if isGoogleNotFound(err) {
+			return nil, NotFound(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &googleGroup{googleWorkspace: g, raw: group, walk: new(googleWalk)}, nil
+	}
+	root, err := g.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	if root.GetID() == id {
+		return root, nil
+	}
+	orgUnit, err := g.service.Orgunits.Get(g.config.Customer, id).Do()
+	if isGoogleNotFound(err) {
+		return nil, NotFound(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &googleOrgUnit{googleWorkspace: g, raw: orgUnit}, nil
+}
+
+// LookupUser matches the emails of user against primary emails and
+// aliases, nil without error when nobody matches.
+func (g *googleWorkspace) LookupUser(user Userable) (UserableEntry, error) {
+	for _, email := range GetUserableEmails(user) {
+		if email == "" {
+			continue
+		}
+		found, err := g.getUser(email)
+		if isGoogleNotFound(err) {
+			continue
+		}
+		return found, err
+	}
+	return nil, nil
+}
+
+// CreateUser creates the user with a random password to be changed at the
+// first login, the email of user becomes the primary email.
+func (g *googleWorkspace) CreateUser(user Userable) (UserableEntry, error) {
+	if user.GetEmail() == "" {
+		return nil, errors.New("googleworkspace users need an email")
+	}
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	givenName, familyName := splitName(user.GetName())
+	newUser := &admin.User{
+		PrimaryEmail:              user.GetEmail(),
+		Name:                      &admin.UserName{GivenName: givenName, FamilyName: familyName},
+		Password:                  password,
+		ChangePasswordAtNextLogin: true,
+		OrgUnitPath:               g.config.RootOrgUnitPath,
+	}
+	if phone := user.GetPhone(); phone != "" {
+		newUser.Phones = []map[string]any{{"value": phone, "type": "work", "primary": true}}
+	}
+	created, err := g.service.Users.Insert(newUser).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &googleUser{googleWorkspace: g, raw: created}, nil
+}
+
+func randomPassword() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// splitName takes the last word as the family name, both are required and
+// a single word fills both.
+func splitName(name string) (givenName, familyName string) {
+	name = strings.TrimSpace(name)
+	if i := strings.LastIndex(name, " "); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, name
+}
+
+func (g *googleWorkspace) LookupEntryByExternalIdentity(extID ExternalIdentity) (Entry, error) {
+	if extID.GetEntryType() == EntryTypeDept {
+		return g.LookupEntryDepartmentByExternalIdentity(extID)
+	}
+	return g.LookupEntryUserByExternalIdentity(extID)
+}
+
+// LookupEntryUserByExternalIdentity searches the extIDs field of the custom
+// schema, or gets the user itself when extID is internal.
+func (g *googleWorkspace) LookupEntryUserByExternalIdentity(extID ExternalIdentity) (UserEntryExtIDStoreable, error) {
+	if extID.CheckIfInternal(g) == nil {
+		return g.getUser(extID.GetEntryID())
+	}
+	users, err := g.listUsers(fmt.Sprintf("%s.%s='%s'", g.config.Schema, googleExtIDsField, extID))
+	if err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, fmt.Errorf("no user linked to %s", extID)
+	case 1:
+		return &googleUser{googleWorkspace: g, raw: users[0]}, nil
+	default:
+		return nil, fmt.Errorf("%d users linked to %s", len(users), extID)
+	}
+}
+
+// LookupEntryDepartmentByExternalIdentity only finds departments by their
+// own extIDs, org units and groups have no custom schema to link them.
+func (g *googleWorkspace) LookupEntryDepartmentByExternalIdentity(extID ExternalIdentity) (DepartmentEntryExtIDStoreable, error) {
+	if extID.CheckIfInternal(g) != nil {
+		return nil, fmt.Errorf("%w: googleworkspace departments cannot store extIDs", ErrNotSupported)
+	}
+	department, err := g.LookupEntryDepartmentByInternalExternalIdentity(extID)
+	if err != nil {
+		return nil, err
+	}
+	return department.(DepartmentEntryExtIDStoreable), nil
+}
+
+type googleUser struct {
+	*googleWorkspace
+	raw *admin.User
+}
+
+func (u *googleUser) GetTarget() Target {
+	return u.googleWorkspace
+}
+
+func (u googleUser) GetID() string {
+	return u.raw.Id
+}
+
+func (u googleUser) GetName() string {
+	if u.raw.Name != nil && u.raw.Name.FullName != "" {
+		return u.raw.Name.FullName
+	}
+	return u.raw.PrimaryEmail
+}
+
+func (u googleUser) GetEmail() string {
+	return u.raw.PrimaryEmail
+}
+
+// GetEmails has the primary email, the other addresses and the aliases.
+func (u googleUser) GetEmails() []string {
+	emails := []string{u.raw.PrimaryEmail}
+	for _, email := range multiValued(u.raw.Emails) {
+		emails = append(emails, fmt.Sprint(email["address"]))
+	}
+	emails = append(emails, u.raw.Aliases...)
+	emails = append(emails, u.raw.NonEditableAliases...)
+	return lo.Uniq(emails)
+}
+
+func (u googleUser) GetPhone() string {
+	phones := multiValued(u.raw.Phones)
+	for _, phone := range phones {
+		if primary, _ := phone["primary"].(bool); primary {
+			return fmt.Sprint(phone["value"])
+		}
+	}
+	if len(phones) != 0 {
+		return fmt.Sprint(phones[0]["value"])
+	}
+	return ""
+}
+
+func (u googleUser) GetPhones() (phones []string) {
+	for _, phone := range multiValued(u.raw.Phones) {
+		phones = append(phones, fmt.Sprint(phone["value"]))
+	}
+	return phones
+}
+
+// multiValued reads the untyped emails and phones of a user, lists of
+// objects in the API.
+func multiValued(raw any) (values []map[string]any) {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	_ = json.Unmarshal(encoded, &values)
+	return values
+}
+
+type googleExtIDsSchema struct {
+	ExtIDs []googleExtIDValue `json:"extIDs"`
+}
+
+type googleExtIDValue struct {
+	Value string `json:"value"`
+}
+
+func (u googleUser) GetExternalIdentities() (extIDs ExternalIdentities) {
+	var schema googleExtIDsSchema
+	if raw, ok := u.raw.CustomSchemas[u.config.Schema]; ok {
+		_ = json.Unmarshal(raw, &schema)
+	}
+	for _, value := range schema.ExtIDs {
+		extIDs = append(extIDs, ExternalIdentity(value.Value))
+	}
+	return extIDs
+}
+
+func (u *googleUser) SetExternalIdentities(extIDs ExternalIdentities) error {
+	schema := googleExtIDsSchema{ExtIDs: []googleExtIDValue{}}
+	for _, extID := range extIDs {
+		schema.ExtIDs = append(schema.ExtIDs, googleExtIDValue{Value: string(extID)})
+	}
+	raw, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	_, err = u.service.Users.Patch(u.raw.Id, &admin.User{
+		CustomSchemas: map[string]googleapi.RawMessage{u.config.Schema: raw},
+	}).Do()
+	if err != nil {
+		return err
+	}
+	if u.raw.CustomSchemas == nil {
+		u.raw.CustomSchemas = make(map[string]googleapi.RawMessage)
+	}
+	u.raw.CustomSchemas[u.config.Schema] = raw
+	return nil
+}
+
+// googleMember is a user listed by a group, managers and owners have the
+// admin role.
+type googleMember struct {
+	*googleUser
+	role DepartmentUserRole
+}
+
+func (m *googleMember) GetRole() DepartmentUserRole {
+	return m.role
+}
+
+type googleOrgUnit struct {
+	*googleWorkspace
+	raw *admin.OrgUnit
+}
+
+func (o *googleOrgUnit) GetTarget() Target {
+	return o.googleWorkspace
+}
+
+func (o googleOrgUnit) GetID() string {
+	if o.raw.OrgUnitId == "" {
+		return googleRootID
+	}
+	return o.raw.OrgUnitId
+}
+
+func (o googleOrgUnit) GetName() string {
+	return o.raw.Name
+}
+
+func (o googleOrgUnit) GetDescription() string {
+	return o.raw.Description
+}
+
+func (o googleOrgUnit) GetChildDepartments() (departments []DepartmentableEntry) {
+	resp, err := o.service.Orgunits.List(o.config.Customer).OrgUnitPath(o.raw.OrgUnitPath).Type("children").Do()
+	if err != nil {
+		o.logger.WithError(err).Error("list org units failed")
+		return departments
+	}
+	for _, orgUnit := range resp.OrganizationUnits {
+		departments = append(departments, &googleOrgUnit{googleWorkspace: o.googleWorkspace, raw: orgUnit})
+	}
+	return departments
+}
+
+func (o googleOrgUnit) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	orgUnit, err := o.service.Orgunits.Insert(o.config.Customer, &admin.OrgUnit{
+		Name:              department.GetName(),
+		Description:       department.GetDescription(),
+		ParentOrgUnitPath: o.raw.OrgUnitPath,
+	}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &googleOrgUnit{googleWorkspace: o.googleWorkspace, raw: orgUnit}, nil
+}
+
+// GetUsers lists the users directly in the org unit, the orgUnitPath query
+// matches the users of sub org units too.
+func (o googleOrgUnit) GetUsers() (users []UserableEntry, err error) {
+	googleUsers, err := o.listUsers(fmt.Sprintf("orgUnitPath='%s'", o.raw.OrgUnitPath))
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range googleUsers {
+		if strings.EqualFold(user.OrgUnitPath, o.raw.OrgUnitPath) {
+			users = append(users, &googleUser{googleWorkspace: o.googleWorkspace, raw: user})
+		}
+	}
+	return users, nil
+}
+
+// AddToDepartment moves the user into the org unit, out of the one it was
+// in as users are in exactly one org unit.
+func (o googleOrgUnit) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return o.moveUser(extID, o.raw.OrgUnitPath)
+}
+
+// RemoveFromDepartment moves the user back to the root org unit.
+func (o googleOrgUnit) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if o.raw.OrgUnitPath == o.config.RootOrgUnitPath {
+		return errors.New("cannot remove user from the root org unit")
+	}
+	return o.moveUser(extID, o.config.RootOrgUnitPath)
+}
+
+func (o googleOrgUnit) moveUser(extID ExternalIdentity, orgUnitPath string) error {
+	if err := extID.CheckIfInternal(o.googleWorkspace); err != nil {
+		return err
+	}
+	_, err := o.service.Users.Patch(extID.GetEntryID(), &admin.User{OrgUnitPath: orgUnitPath}).Do()
+	return err
+}
+
+func (o googleOrgUnit) GetExternalIdentities() ExternalIdentities {
+	return nil
+}
+
+func (o *googleOrgUnit) SetExternalIdentities(extIDs ExternalIdentities) error {
+	return fmt.Errorf("%w: googleworkspace org units cannot store extIDs", ErrNotSupported)
+}
+
+// googleGroup is a group, raw is nil for the synthetic root holding the
+// groups no other group has as a member. Groups reached from one root share
+// its walk.
+type googleGroup struct {
+	*googleWorkspace
+	raw  *admin.Group
+	walk *googleWalk
+}
+
+func (t *googleGroup) GetTarget() Target {
+	return t.googleWorkspace
+}
+
+func (t googleGroup) GetID() string {
+	if t.raw == nil {
+		return googleRootID
+	}
+	return t.raw.Id
+}
+
+func (t googleGroup) GetName() string {
+	if t.raw == nil {
+		return t.config.Slug
+	}
+	return t.raw.Name
+}
+
+func (t googleGroup) GetDescription() string {
+	if t.raw == nil {
+		return ""
+	}
+	return t.raw.Description
+}
+
+func (g *googleWorkspace) listGroups() (groups []*admin.Group, err error) {
+	call := g.service.Groups.List().Customer(g.config.Customer).MaxResults(200)
+	if g.config.Domain != "" {
+		call = g.service.Groups.List().Domain(g.config.Domain).MaxResults(200)
+	}
+	err = call.Pages(context.Background(), func(page *admin.Groups) error {
+		groups = append(groups, page.Groups...)
+		return nil
+	})
+	return groups, err
+}
+
+func (g *googleWorkspace) listMembers(groupKey string) (members []*admin.Member, err error) {
+	err = g.service.Members.List(groupKey).MaxResults(200).Pages(context.Background(), func(page *admin.Members) error {
+		members = append(members, page.Members...)
+		return nil
+	})
+	return members, err
+}
+
+// googleWalk lists the groups, their members and the users once for all
+// groups reached from one root, the root needs the members of every group
+// to find the groups nobody nests. Listings that failed are tried again by
+// the next caller.
+type googleWalk struct {
+	mu      sync.Mutex
+	groups  map[string]*admin.Group
+	members map[string][]*admin.Member
+	users   map[string]*admin.User
+}
+
+// listGroups lists the groups with the members of those having any.
+func (w *googleWalk) listGroups(g *googleWorkspace) (map[string]*admin.Group, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.groups != nil {
+		return w.groups, nil
+	}
+	groups, err := g.listGroups()
+	if err != nil {
+		return nil, err
+	}
+	if w.members == nil {
+		w.members = make(map[string][]*admin.Member)
+	}
+	for _, group := range groups {
+		if _, ok := w.members[group.Id]; ok {
+			continue
+		}
+		if group.DirectMembersCount == 0 {
+			w.members[group.Id] = nil
+			continue
+		}
+		members, err := g.listMembers(group.Id)
+		if err != nil {
+			return nil, err
+		}
+		w.members[group.Id] = members
+	}
+	w.groups = lo.KeyBy(groups, func(group *admin.Group) string { return group.Id })
+	return w.groups, nil
+}
+
+// listMembers lists the members of one group unless the walk has them.
+func (w *googleWalk) listMembers(g *googleWorkspace, groupKey string) ([]*admin.Member, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if members, ok := w.members[groupKey]; ok {
+		return members, nil
+	}
+	members, err := g.listMembers(groupKey)
+	if err != nil {
+		return nil, err
+	}
+	if w.members == nil {
+		w.members = make(map[string][]*admin.Member)
+	}
+	w.members[groupKey] = members
+	return members, nil
+}
+
+// forget drops the members of a group after they changed.
+func (w *googleWalk) forget(groupKey string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.members, groupKey)
+}
+
+// addGroup keeps groups created during the walk in its listing.
+func (w *googleWalk) addGroup(group *admin.Group) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.groups != nil {
+		w.groups[group.Id] = group
+	}
+}
+
+func (w *googleWalk) listUsers(g *googleWorkspace) (map[string]*admin.User, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.users == nil {
+		users, err := g.listUsers("")
+		if err != nil {
+			return nil, err
+		}
+		w.users = lo.KeyBy(users, func(user *admin.User) string { return user.Id })
+	}
+	return w.users, nil
+}
+
+func (t googleGroup) GetChildDepartments() (departments []DepartmentableEntry) {
+	groups, err := t.childGroups()
+	if err != nil {
+		t.logger.WithError(err).Error("list groups failed")
+		return departments
+	}
+	for _, group := range groups {
+		departments = append(departments, &googleGroup{googleWorkspace: t.googleWorkspace, raw: group, walk: t.walk})
+	}
+	return departments
+}
+
+// childGroups picks the children out of the groups of the walk, the groups
+// root has those no listed group has as a member.
+func (t googleGroup) childGroups() (children []*admin.Group, err error) {
+	if t.raw != nil {
+		members, err := t.walk.listMembers(t.googleWorkspace, t.raw.Id)
+		if err != nil {
+			return nil, err
+		}
+		groups, err := t.walk.listGroups(t.googleWorkspace)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if member.Type != "GROUP" {
+				continue
+			}
+			group, ok := groups[member.Id]
+			if !ok {
+				// nested from outside Domain
+				if group, err = t.service.Groups.Get(member.Id).Do(); err != nil {
+					return nil, err
+				}
+			}
+			children = append(children, group)
+		}
+		return children, nil
+	}
+	groups, err := t.walk.listGroups(t.googleWorkspace)
+	if err != nil {
+		return nil, err
+	}
+	nested := make(map[string]bool)
+	for id := range groups {
+		members, err := t.walk.listMembers(t.googleWorkspace, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if member.Type == "GROUP" {
+				nested[member.Id] = true
+			}
+		}
+	}
+	for _, group := range groups {
+		if !nested[group.Id] {
+			children = append(children, group)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Email < children[j].Email })
+	return children, nil
+}
+
+var googleGroupEmailInvalid = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// CreateChildDepartment creates a group in Domain named after department,
+// and adds it to the parent group unless the parent is the root.
+func (t googleGroup) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	if t.config.Domain == "" {
+		return nil, errors.New("googleworkspace domain is required to create groups")
+	}
+	local := strings.Trim(googleGroupEmailInvalid.ReplaceAllString(strings.ToLower(department.GetName()), "-"), "-.")
+	if local == "" {
+		return nil, fmt.Errorf("cannot derive a group email from %q", department.GetName())
+	}
+	group, err := t.service.Groups.Insert(&admin.Group{
+		Email:       local + "@" + t.config.Domain,
+		Name:        department.GetName(),
+		Description: department.GetDescription(),
+	}).Do()
+	if err != nil {
+		return nil, err
+	}
+	if t.raw != nil {
+		if _, err := t.service.Members.Insert(t.raw.Id, &admin.Member{Id: group.Id, Role: "MEMBER"}).Do(); err != nil {
+			return nil, err
+		}
+		t.walk.forget(t.raw.Id)
+	}
+	t.walk.addGroup(group)
+	return &googleGroup{googleWorkspace: t.googleWorkspace, raw: group, walk: t.walk}, nil
+}
+
+// GetUsers resolves the members of the group against the users of the
+// walk, users created after the walk listed them are read one by one.
+func (t googleGroup) GetUsers() (users []UserableEntry, err error) {
+	if t.raw == nil {
+		return nil, nil
+	}
+	members, err := t.walk.listMembers(t.googleWorkspace, t.raw.Id)
+	if err != nil {
+		return nil, err
+	}
+	members = lo.Filter(members, func(member *admin.Member, _ int) bool { return member.Type == "USER" })
+	if len(members) == 0 {
+		return nil, nil
+	}
+	byID, err := t.walk.listUsers(t.googleWorkspace)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		role := DepartmentUserRoleMember
+		if member.Role == "OWNER" || member.Role == "MANAGER" {
+			role = DepartmentUserRoleAdmin
+		}
+		user, ok := byID[member.Id]
+		if !ok {
+			found, err := t.getUser(member.Id)
+			if isGoogleNotFound(err) {
+				// a member from outside the customer
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			user = found.raw
+		}
+		users = append(users, &googleMember{
+			googleUser: &googleUser{googleWorkspace: t.googleWorkspace, raw: user},
+			role:       role,
+		})
+	}
+	return users, nil
+}
+
+func groupRoleOf(role DepartmentUserRole) (string, error) {
+	googleRole, ok := map[DepartmentUserRole]string{
+		DepartmentUserRoleMember: "MEMBER",
+		DepartmentUserRoleAdmin:  "MANAGER",
+	}[role]
+	if !ok {
+		return "", errors.New("Role Mapping not found")
+	}
+	return googleRole, nil
+}
+
+func (t googleGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if t.raw == nil {
+		return errors.New("cannot add user to the groups root")
+	}
+	if err := extID.CheckIfInternal(t.googleWorkspace); err != nil {
+		return err
+	}
+	role, err := groupRoleOf(options.Role)
+	if err != nil {
+		return err
+	}
+	_, err = t.service.Members.Insert(t.raw.Id, &admin.Member{Id: extID.GetEntryID(), Role: role}).Do()
+	// already a member, apply the role
+	if isGoogleConflict(err) {
+		_, err = t.service.Members.Patch(t.raw.Id, extID.GetEntryID(), &admin.Member{Role: role}).Do()
+	}
+	t.walk.forget(t.raw.Id)
+	return err
+}
+
+func (t googleGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if t.raw == nil {
+		return errors.New("cannot remove user from the groups root")
+	}
+	if err := extID.CheckIfInternal(t.googleWorkspace); err != nil {
+		return err
+	}
+	err := t.service.Members.Delete(t.raw.Id, extID.GetEntryID()).Do()
+	t.walk.forget(t.raw.Id)
+	return err
+}
+
+func (t googleGroup) GetExternalIdentities() ExternalIdentities {
+	return nil
+}
+
+func (t *googleGroup) SetExternalIdentities(extIDs ExternalIdentities) error {
+	return fmt.Errorf("%w: googleworkspace groups cannot store extIDs", ErrNotSupported)
+}
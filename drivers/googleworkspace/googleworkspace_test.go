@@ -0,0 +1,299 @@
+package googleworkspace
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// directory answers the Admin SDK with route, which gets the method and
+// the path below /admin/directory/v1/. Requests are logged as "METHOD path
+// body" for writes and "GET path?query" for reads.
+type directory struct {
+	mu       sync.Mutex
+	route    func(method, path string, r *http.Request) (status int, body any)
+	requests []string
+}
+
+func (d *directory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/admin/directory/v1/")
+	if r.Method == http.MethodGet {
+		d.requests = append(d.requests, "GET "+path+"?"+r.URL.Query().Encode())
+	} else {
+		raw, _ := io.ReadAll(r.Body)
+		d.requests = append(d.requests, r.Method+" "+path+" "+strings.TrimSpace(string(raw)))
+	}
+	status, body := d.route(r.Method, path, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (d *directory) writes() []string {
+	return lo.Reject(d.requests, func(request string, _ int) bool { return strings.HasPrefix(request, "GET ") })
+}
+
+func apiError(code int, reason string) map[string]any {
+	return map[string]any{"error": map[string]any{"code": code, "message": reason, "errors": []any{map[string]any{"reason": reason}}}}
+}
+
+func connectDirectory(t *testing.T, d *directory, departments string) *googleWorkspace {
+	t.Helper()
+	server := httptest.NewServer(d)
+	t.Cleanup(server.Close)
+	// the key is never used, the client of the test server authorizes nothing
+	g := &googleWorkspace{logger: Log, config: &googleWorkspaceConfig{
+		Platform: "googleworkspace", Slug: "gw", Customer: googleDefaultCustomer, Schema: googleDefaultSchema,
+		Departments: departments, RootOrgUnitPath: "/", Domain: "example.com", BaseURL: server.URL + "/",
+	}}
+	if err := g.SetHTTPClient(server.Client()); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGoogleWorkspaceOrgUnitKeepsItsDirectUsers(t *testing.T) {
+	d := &directory{route: func(method, path string, r *http.Request) (int, any) {
+		switch path {
+		case "customer/my_customer/orgunits":
+			return http.StatusOK, admin.OrgUnits{OrganizationUnits: []*admin.OrgUnit{{OrgUnitId: "id:eng", Name: "Eng", OrgUnitPath: "/Eng"}}}
+		case "users":
+			// the orgUnitPath query matches sub org units too, in pages
+			if r.URL.Query().Get("pageToken") == "" {
+				return http.StatusOK, admin.Users{NextPageToken: "next", Users: []*admin.User{{Id: "u1", PrimaryEmail: "ada@example.com", OrgUnitPath: "/Eng"}}}
+			}
+			return http.StatusOK, admin.Users{Users: []*admin.User{{Id: "u2", OrgUnitPath: "/Eng/SRE"}, {Id: "u3", OrgUnitPath: "/eng"}}}
+		}
+		return http.StatusNotFound, apiError(http.StatusNotFound, "notFound")
+	}}
+	g := connectDirectory(t, d, googleDepartmentsOrgUnits)
+	root, _ := g.GetRootDepartment()
+	if root.GetID() != googleRootID || root.GetName() != "gw" {
+		t.Errorf("root org unit is %s %q", root.GetID(), root.GetName())
+	}
+	eng := root.GetChildDepartments()[0]
+	users, err := eng.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := lo.Map(users, func(user UserableEntry, _ int) string { return user.GetID() }); strings.Join(ids, ",") != "u1,u3" {
+		t.Errorf("Eng has %v, want u1 and u3 without SRE's u2", ids)
+	}
+	want := []string{
+		"GET customer/my_customer/orgunits?alt=json&orgUnitPath=%2F&prettyPrint=false&type=children",
+		"GET users?alt=json&customer=my_customer&maxResults=500&prettyPrint=false&projection=full&query=orgUnitPath%3D%27%2FEng%27",
+		"GET users?alt=json&customer=my_customer&maxResults=500&pageToken=next&prettyPrint=false&projection=full&query=orgUnitPath%3D%27%2FEng%27",
+	}
+	if strings.Join(d.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests\n%s\nwant\n%s", strings.Join(d.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGoogleWorkspaceOrgUnitMembershipMovesUsers(t *testing.T) {
+	d := &directory{route: func(method, path string, r *http.Request) (int, any) {
+		if path == "customer/my_customer/orgunits" {
+			return http.StatusOK, admin.OrgUnits{OrganizationUnits: []*admin.OrgUnit{{OrgUnitId: "id:eng", Name: "Eng", OrgUnitPath: "/Eng"}}}
+		}
+		return http.StatusOK, admin.User{Id: strings.TrimPrefix(path, "users/")}
+	}}
+	g := connectDirectory(t, d, googleDepartmentsOrgUnits)
+	root, _ := g.GetRootDepartment()
+	eng := root.GetChildDepartments()[0].(DepartmentUserWriter)
+	if err := eng.AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.u1@gw.googleworkspace"); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.u1@gw.googleworkspace"); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.(DepartmentUserWriter).RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.u1@gw.googleworkspace"); err == nil {
+		t.Error("removed a user from the root org unit")
+	}
+	if err := eng.AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.42@hr.feishu"); err == nil {
+		t.Error("moved the user of another target")
+	}
+	want := []string{`PATCH users/u1 {"orgUnitPath":"/Eng"}`, `PATCH users/u1 {"orgUnitPath":"/"}`}
+	if got := d.writes(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got writes %q, want %q", got, want)
+	}
+}
+
+func TestGoogleWorkspaceLinksThroughCustomSchema(t *testing.T) {
+	d := &directory{route: func(method, path string, r *http.Request) (int, any) {
+		if path == "users" && r.URL.Query().Get("query") == "OrgManager.extIDs='ei.user.42@hr.feishu'" {
+			return http.StatusOK, admin.Users{Users: []*admin.User{{Id: "u1", CustomSchemas: map[string]googleapi.RawMessage{
+				"OrgManager": googleapi.RawMessage(`{"extIDs":[{"value":"ei.user.42@hr.feishu"}]}`),
+			}}}}
+		}
+		if path == "users" {
+			return http.StatusOK, admin.Users{}
+		}
+		return http.StatusOK, admin.User{Id: "u1"}
+	}}
+	g := connectDirectory(t, d, googleDepartmentsOrgUnits)
+	user, err := g.LookupEntryUserByExternalIdentity("ei.user.42@hr.feishu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extIDs := user.GetExternalIdentities(); len(extIDs) != 1 || extIDs[0] != "ei.user.42@hr.feishu" {
+		t.Errorf("u1 is linked to %v", extIDs)
+	}
+	if err := user.SetExternalIdentities(ExternalIdentities{"ei.user.42@hr.feishu", "ei.user.7@ding.dingtalk"}); err != nil {
+		t.Fatal(err)
+	}
+	if extIDs := user.GetExternalIdentities(); len(extIDs) != 2 {
+		t.Errorf("u1 is linked to %v after the write, want both", extIDs)
+	}
+	want := `PATCH users/u1 {"customSchemas":{"OrgManager":{"extIDs":[{"value":"ei.user.42@hr.feishu"},{"value":"ei.user.7@ding.dingtalk"}]}}}`
+	if got := d.writes(); len(got) != 1 || got[0] != want {
+		t.Errorf("got writes %q, want %s", got, want)
+	}
+	if _, err := g.LookupEntryUserByExternalIdentity("ei.user.43@hr.feishu"); err == nil {
+		t.Error("found a user for an extID nobody stores")
+	}
+	if _, err := g.LookupEntryDepartmentByExternalIdentity("ei.dept.1@hr.feishu"); err == nil {
+		t.Error("found an org unit by an extID it cannot store")
+	}
+}
+
+type aliasedUser struct {
+	User
+	emails []string
+}
+
+func (u aliasedUser) GetEmails() []string {
+	return u.emails
+}
+
+func TestGoogleWorkspaceLookupUserTriesEveryEmail(t *testing.T) {
+	d := &directory{route: func(method, path string, r *http.Request) (int, any) {
+		switch path {
+		case "users/grace@example.com":
+			return http.StatusOK, admin.User{Id: "u2", PrimaryEmail: "grace.hopper@example.com", Aliases: []string{"grace@example.com"}}
+		case "users/broken@example.com":
+			return http.StatusForbidden, apiError(http.StatusForbidden, "forbidden")
+		}
+		return http.StatusNotFound, apiError(http.StatusNotFound, "notFound")
+	}}
+	g := connectDirectory(t, d, googleDepartmentsOrgUnits)
+	found, err := g.LookupUser(aliasedUser{User{Email: "ghopper@example.com"}, []string{"grace@example.com"}})
+	if err != nil || found == nil || found.GetID() != "u2" {
+		t.Fatalf("lookup found %v, %v, want u2 by its alias", found, err)
+	}
+	if missing, err := g.LookupUser(User{Email: "nobody@example.com"}); missing != nil || err != nil {
+		t.Errorf("lookup of an unknown email found %v, %v, want nothing", missing, err)
+	}
+	if _, err := g.LookupUser(User{Email: "broken@example.com"}); err == nil {
+		t.Error("lookup swallowed a 403")
+	}
+}
+
+func TestGoogleWorkspaceRetriesRateLimitReasons(t *testing.T) {
+	d := &directory{route: func(method, path string, r *http.Request) (int, any) {
+		if path == "users/u1" {
+			return http.StatusForbidden, apiError(http.StatusForbidden, "userRateLimitExceeded")
+		}
+		return http.StatusForbidden, apiError(http.StatusForbidden, "forbidden")
+	}}
+	g := connectDirectory(t, d, googleDepartmentsOrgUnits)
+	for id, want := range map[string]bool{"u1": true, "u2": false} {
+		_, err := g.LookupEntryUserByInternalExternalIdentity(ExternalIdentity("ei.user." + id + "@gw.googleworkspace"))
+		if retry, _ := g.ClassifyError(err); retry != want {
+			t.Errorf("classified %v as retry %v, want %v", err, retry, want)
+		}
+	}
+}
+
+func TestGoogleWorkspaceAddExistingMemberPatchesItsRole(t *testing.T) {
+	d := &directory{route: func(method, path string, r *http.Request) (int, any) {
+		switch {
+		case path == "groups/eng":
+			return http.StatusOK, admin.Group{Id: "eng", Email: "eng@example.com"}
+		case method == http.MethodPost:
+			return http.StatusConflict, apiError(http.StatusConflict, "duplicate")
+		}
+		return http.StatusOK, admin.Member{Id: "u1", Role: "MANAGER"}
+	}}
+	g := connectDirectory(t, d, googleDepartmentsGroups)
+	eng, err := g.LookupEntryDepartmentByInternalExternalIdentity("ei.dept.eng@gw.googleworkspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{Role: DepartmentUserRoleAdmin}, "ei.user.u1@gw.googleworkspace"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`POST groups/eng/members {"id":"u1","role":"MANAGER"}`, `PATCH groups/eng/members/u1 {"role":"MANAGER"}`}
+	if got := d.writes(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got writes %q, want %q", got, want)
+	}
+}
+
+func TestGoogleWorkspaceWalkListsGroupsOnce(t *testing.T) {
+	d := &directory{route: func(method, path string, r *http.Request) (int, any) {
+		switch path {
+		case "groups":
+			return http.StatusOK, admin.Groups{Groups: []*admin.Group{
+				{Id: "eng", Email: "eng@example.com", DirectMembersCount: 2},
+				{Id: "sre", Email: "sre@example.com", DirectMembersCount: 3},
+				{Id: "alumni", Email: "alumni@example.com"},
+			}}
+		case "groups/eng/members":
+			return http.StatusOK, admin.Members{Members: []*admin.Member{{Id: "sre", Type: "GROUP"}, {Id: "u1", Type: "USER", Role: "OWNER"}}}
+		case "groups/sre/members":
+			return http.StatusOK, admin.Members{Members: []*admin.Member{{Id: "u2", Type: "USER", Role: "MEMBER"}, {Id: "u9", Type: "USER"}, {Id: "outsider", Type: "USER"}}}
+		case "users":
+			return http.StatusOK, admin.Users{Users: []*admin.User{{Id: "u1"}, {Id: "u2"}}}
+		case "users/u9":
+			return http.StatusOK, admin.User{Id: "u9"}
+		}
+		return http.StatusNotFound, apiError(http.StatusNotFound, "notFound")
+	}}
+	g := connectDirectory(t, d, googleDepartmentsGroups)
+	root, _ := g.GetRootDepartment()
+	var walked []string
+	var walk func(department DepartmentableEntry)
+	walk = func(department DepartmentableEntry) {
+		users, err := department.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range users {
+			walked = append(walked, department.GetID()+"="+user.GetID()+":"+user.(UserableWithRole).GetRole().String())
+		}
+		for _, child := range department.GetChildDepartments() {
+			walk(child)
+		}
+	}
+	walk(root)
+	// alumni has nobody, sre is nested in eng so the root does not hold it
+	want := []string{
+		"eng=u1:" + DepartmentUserRoleAdmin.String(),
+		"sre=u2:" + DepartmentUserRoleMember.String(),
+		"sre=u9:" + DepartmentUserRoleMember.String(),
+	}
+	if strings.Join(walked, " ") != strings.Join(want, " ") {
+		t.Errorf("walked %v, want %v", walked, want)
+	}
+	count := make(map[string]int)
+	for _, request := range d.requests {
+		count[strings.SplitN(request, "?", 2)[0]]++
+	}
+	for _, read := range []string{"GET groups", "GET groups/eng/members", "GET groups/sre/members", "GET users", "GET users/u9", "GET users/outsider"} {
+		if count[read] != 1 {
+			t.Errorf("sent %s %d times, want once", read, count[read])
+		}
+	}
+	if count["GET groups/alumni/members"] != 0 {
+		t.Error("listed the members of a group without any")
+	}
+}
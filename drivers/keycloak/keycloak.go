@@ -0,0 +1,770 @@
+package keycloak
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	keycloakDefaultPageSize       = 100
+	keycloakDefaultTimeout        = 30 * time.Second
+	keycloakDefaultClientID       = "admin-cli"
+	keycloakDefaultExtIDAttribute = "extIDs"
+	keycloakDefaultPhoneAttribute = "phoneNumber"
+	// keycloakRootID is the synthetic root department, the realm itself,
+	// used when no RootGroup is configured.
+	keycloakRootID = "root"
+)
+
+// keycloak manages the users and groups of one realm through the admin
+// REST API, groups and subgroups are departments.
+type keycloak struct {
+	client *http.Client
+	config *keycloakConfig
+	logger Logger
+
+	tokenMu        sync.Mutex
+	token          string
+	tokenExpiresAt time.Time
+}
+
+func init() {
+	RegisterPlatform("keycloak", &keycloak{})
+}
+
+type keycloakConfig struct {
+	Platform string
+	Slug     string
+	// BaseURL is the server root, like https://sso.example.com, with the
+	// /auth prefix for Keycloak 16 and older.
+	BaseURL string
+	Realm   string
+	// AuthRealm is the realm the credentials belong to, Realm when empty.
+	AuthRealm string
+	// ClientID and ClientSecret use the client credentials grant, without
+	// a secret Username and Password are used with the password grant.
+	ClientID     string
+	ClientSecret string
+	Username     string
+	Password     string
+	// RootGroup is the path of the group used as root department, the
+	// whole realm when empty.
+	RootGroup string
+	// ExtIDAttribute and PhoneAttribute name the user and group attributes
+	// holding extIDs and phone numbers. With the declarative user profile
+	// of Keycloak 24 and later they must be declared or unmanaged
+	// attributes enabled.
+	ExtIDAttribute     string
+	PhoneAttribute     string
+	PageSize           int
+	TraverseWorkers    int
+	Timeout            time.Duration
+	InsecureSkipVerify bool
+}
+
+func (k *keycloak) SetLogger(logger Logger) {
+	k.logger = logger
+}
+
+// SetHTTPClient replaces the client built from the config, for proxies,
+// custom transports or a stand-in server in tests.
+func (k *keycloak) SetHTTPClient(client *http.Client) {
+	k.client = client
+}
+
+func (k *keycloak) GetTarget() Target {
+	return k
+}
+
+func (k *keycloak) GetTargetSlug() string {
+	return k.config.Slug
+}
+
+func (k *keycloak) GetPlatform() string {
+	return k.config.Platform
+}
+
+func (k *keycloak) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	if err := unmarshaler(&k.config); err != nil {
+		return nil, err
+	}
+	if k.config.BaseURL == "" || k.config.Realm == "" {
+		return nil, errors.New("keycloak baseurl and realm are required")
+	}
+	k.config.BaseURL = strings.TrimRight(k.config.BaseURL, "/")
+	if k.config.AuthRealm == "" {
+		k.config.AuthRealm = k.config.Realm
+	}
+	if k.config.ClientID == "" {
+		k.config.ClientID = keycloakDefaultClientID
+	}
+	if k.config.ClientSecret == "" && k.config.Username == "" {
+		return nil, errors.New("keycloak clientsecret or username is required")
+	}
+	if k.config.ExtIDAttribute == "" {
+		k.config.ExtIDAttribute = keycloakDefaultExtIDAttribute
+	}
+	if k.config.PhoneAttribute == "" {
+		k.config.PhoneAttribute = keycloakDefaultPhoneAttribute
+	}
+	if k.config.PageSize <= 0 {
+		k.config.PageSize = keycloakDefaultPageSize
+	}
+	if k.config.Timeout <= 0 {
+		k.config.Timeout = keycloakDefaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if k.config.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		k.logger.Warn("keycloak tls verification disabled")
+	}
+	k.client = &http.Client{Transport: transport, Timeout: k.config.Timeout}
+	return k, nil
+}
+
+// keycloakError carries the message Keycloak puts in errorMessage or
+// error_description, the status is kept for the retry decorator.
+type keycloakError struct {
+	ErrorMessage     string `json:"errorMessage"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (e keycloakError) message() string {
+	return lo.Ternary(e.ErrorMessage != "", e.ErrorMessage, lo.Ternary(e.ErrorDescription != "", e.ErrorDescription, e.Error))
+}
+
+func isKeycloakStatus(err error, status int) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode() == status
+}
+
+// accessToken returns the cached token, fetched again shortly before it
+// expires as admin tokens only live for a minute by default.
+func (k *keycloak) accessToken() (string, error) {
+	k.tokenMu.Lock()
+	defer k.tokenMu.Unlock()
+	if k.token != "" && time.Now().Before(k.tokenExpiresAt) {
+		return k.token, nil
+	}
+	form := url.Values{"client_id": {k.config.ClientID}}
+	if k.config.ClientSecret != "" {
+		form.Set("client_secret", k.config.ClientSecret)
+	}
+	if k.config.Username != "" {
+		form.Set("grant_type", "password")
+		form.Set("username", k.config.Username)
+		form.Set("password", k.config.Password)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	endpoint := fmt.Sprintf("%s/realms/%s/protocol/openid-connect/token", k.config.BaseURL, url.PathEscape(k.config.AuthRealm))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if _, err := k.send(req, &resp); err != nil {
+		return "", err
+	}
+	k.token = resp.AccessToken
+	k.tokenExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - 10*time.Second)
+	return k.token, nil
+}
+
+func (k *keycloak) invalidateToken(token string) {
+	k.tokenMu.Lock()
+	defer k.tokenMu.Unlock()
+	if k.token == token {
+		k.token = ""
+	}
+}
+
+// call sends an admin API request below /admin/realms/{realm}, renewing
+// the token once when it is rejected. It returns the Location header,
+// which is how Keycloak reports the id of created resources.
+func (k *keycloak) call(method, apiPath string, query url.Values, body, out any) (string, error) {
+	endpoint := fmt.Sprintf("%s/admin/realms/%s%s", k.config.BaseURL, url.PathEscape(k.config.Realm), apiPath)
+	if len(query) != 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var raw []byte
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return "", err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := k.accessToken()
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest(method, endpoint, bytes.NewReader(raw))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		location, err := k.send(req, out)
+		if attempt == 0 && isKeycloakStatus(err, http.StatusUnauthorized) {
+			k.invalidateToken(token)
+			continue
+		}
+		return location, err
+	}
+}
+
+func (k *keycloak) send(req *http.Request, out any) (string, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	k.logger.WithField("method", req.Method).WithField("path", req.URL.Path).WithField("status", resp.StatusCode).Debug("keycloak call")
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		httpErr := NewHTTPError(resp, raw)
+		var kcErr keycloakError
+		if json.Unmarshal(raw, &kcErr) == nil && kcErr.message() != "" {
+			httpErr.Body = kcErr.message()
+		}
+		return "", httpErr
+	}
+	location := resp.Header.Get("Location")
+	if out == nil || len(raw) == 0 {
+		return location, nil
+	}
+	return location, json.Unmarshal(raw, out)
+}
+
+// listAll pages through a list endpoint with first and max.
+func listAll[T any](k *keycloak, apiPath string, query url.Values) (items []T, err error) {
+	if query == nil {
+		query = make(url.Values)
+	}
+	query.Set("max", strconv.Itoa(k.config.PageSize))
+	for first := 0; ; first += k.config.PageSize {
+		query.Set("first", strconv.Itoa(first))
+		var page []T
+		if _, err := k.call(http.MethodGet, apiPath, query, nil, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		if len(page) < k.config.PageSize {
+			return items, nil
+		}
+	}
+}
+
+func resourcePath(resource, id string, sub ...string) string {
+	return "/" + path.Join(append([]string{resource, url.PathEscape(id)}, sub...)...)
+}
+
+// createdID takes the id from the Location header of a 201.
+func createdID(location string) (string, error) {
+	if location == "" {
+		return "", errors.New("keycloak did not return the location of the created resource")
+	}
+	return path.Base(location), nil
+}
+
+type keycloakUserRepresentation struct {
+	ID            string              `json:"id,omitempty"`
+	Username      string              `json:"username,omitempty"`
+	Email         string              `json:"email,omitempty"`
+	EmailVerified bool                `json:"emailVerified"`
+	FirstName     string              `json:"firstName,omitempty"`
+	LastName      string              `json:"lastName,omitempty"`
+	Enabled       bool                `json:"enabled"`
+	Attributes    map[string][]string `json:"attributes,omitempty"`
+}
+
+type keycloakGroupRepresentation struct {
+	ID            string                        `json:"id,omitempty"`
+	Name          string                        `json:"name"`
+	Path          string                        `json:"path,omitempty"`
+	ParentID      string                        `json:"parentId,omitempty"`
+	SubGroupCount int                           `json:"subGroupCount,omitempty"`
+	SubGroups     []keycloakGroupRepresentation `json:"subGroups,omitempty"`
+	Attributes    map[string][]string           `json:"attributes,omitempty"`
+}
+
+func (k *keycloak) GetRootDepartment() (DepartmentableEntry, error) {
+	if k.config.RootGroup == "" {
+		return &keycloakGroup{keycloak: k}, nil
+	}
+	group := new(keycloakGroupRepresentation)
+	groupPath := "/" + strings.Trim(k.config.RootGroup, "/")
+	if _, err := k.call(http.MethodGet, "/group-by-path"+groupPath, nil, nil, group); err != nil {
+		return nil, err
+	}
+	return &keycloakGroup{keycloak: k, raw: group}, nil
+}
+
+// GetAllUsers walks the root group when RootGroup is set, the whole realm
+// is listed otherwise so users in no group are included.
+func (k *keycloak) GetAllUsers() (users []UserableEntry, err error) {
+	if k.config.RootGroup != "" {
+		rootDepartment, err := k.GetRootDepartment()
+		if err != nil {
+			return nil, err
+		}
+		users, err = RecursionGetAllUsersIncludeChildDepartments(rootDepartment)
+		if err != nil {
+			return nil, err
+		}
+		return lo.UniqBy(users, func(user UserableEntry) string { return user.GetID() }), nil
+	}
+	return k.listUsers(nil)
+}
+
+func (k *keycloak) listUsers(query url.Values) (users []UserableEntry, err error) {
+	if query == nil {
+		query = make(url.Values)
+	}
+	query.Set("briefRepresentation", "false")
+	raws, err := listAll[keycloakUserRepresentation](k, "/users", query)
+	if err != nil {
+		return nil, err
+	}
+	for i := range raws {
+		users = append(users, &keycloakUser{keycloak: k, raw: &raws[i]})
+	}
+	return users, nil
+}
+
+func (k *keycloak) getUser(id string) (*keycloakUser, error) {
+	user := new(keycloakUserRepresentation)
+	if _, err := k.call(http.MethodGet, resourcePath("users", id), nil, nil, user); err != nil {
+		return nil, err
+	}
+	return &keycloakUser{keycloak: k, raw: user}, nil
+}
+
+func (k *keycloak) getGroup(id string) (*keycloakGroup, error) {
+	group := new(keycloakGroupRepresentation)
+	if _, err := k.call(http.MethodGet, resourcePath("groups", id), nil, nil, group); err != nil {
+		return nil, err
+	}
+	return &keycloakGroup{keycloak: k, raw: group}, nil
+}
+
+func (k *keycloak) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	return k.getUser(internalExtID.GetEntryID())
+}
+
+func (k *keycloak) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	if internalExtID.GetEntryID() == keycloakRootID {
+		return k.GetRootDepartment()
+	}
+	group, err := k.getGroup(internalExtID.GetEntryID())
+	if isKeycloakStatus(err, http.StatusNotFound) {
+		return nil, NotFound(err)
+	}
+	return group, err
+}
+
+// LookupUser matches the email of user exactly, then the username, it
+// returns nil without error when nobody matches.
+func (k *keycloak) LookupUser(user Userable) (UserableEntry, error) {
+	email := user.GetEmail()
+	if email == "" {
+		return nil, nil
+	}
+	for _, field := range []string{"email", "username"} {
+		users, err := k.listUsers(url.Values{field: {email}, "exact": {"true"}})
+		if err != nil {
+			return nil, err
+		}
+		switch len(users) {
+		case 0:
+			continue
+		case 1:
+			return users[0], nil
+		default:
+			return nil, fmt.Errorf("%d keycloak users matched %s %s", len(users), field, email)
+		}
+	}
+	return nil, nil
+}
+
+// CreateUser uses the email as username and keeps the extID of user in
+// the extID attribute when it comes from another target.
+func (k *keycloak) CreateUser(user Userable) (UserableEntry, error) {
+	firstName, lastName := splitName(user.GetName())
+	raw := keycloakUserRepresentation{
+		Username:   lo.Ternary(user.GetEmail() != "", user.GetEmail(), user.GetName()),
+		Email:      user.GetEmail(),
+		FirstName:  firstName,
+		LastName:   lastName,
+		Enabled:    true,
+		Attributes: make(map[string][]string),
+	}
+	if phones := lo.Compact(GetUserablePhones(user)); len(phones) != 0 {
+		raw.Attributes[k.config.PhoneAttribute] = phones
+	}
+	if entry, ok := user.(UserableEntry); ok {
+		if extID := ExternalIdentityOfEntry(entry); extID.CheckIfInternal(k) != nil {
+			raw.Attributes[k.config.ExtIDAttribute] = []string{string(extID)}
+		}
+	}
+	location, err := k.call(http.MethodPost, "/users", nil, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	id, err := createdID(location)
+	if err != nil {
+		return nil, err
+	}
+	return k.getUser(id)
+}
+
+func splitName(name string) (firstName, lastName string) {
+	name = strings.TrimSpace(name)
+	if i := strings.LastIndex(name, " "); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+func (k *keycloak) UpdateUser(extID ExternalIdentity, user Userable) (UserableEntry, error) {
+	if err := extID.CheckIfInternal(k); err != nil {
+		return nil, err
+	}
+	current, err := k.getUser(extID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	raw := *current.raw
+	if name := user.GetName(); name != "" {
+		raw.FirstName, raw.LastName = splitName(name)
+	}
+	if email := user.GetEmail(); email != "" {
+		raw.Email = email
+	}
+	raw.Attributes = copyAttributes(raw.Attributes)
+	if phones := lo.Compact(GetUserablePhones(user)); len(phones) != 0 {
+		raw.Attributes[k.config.PhoneAttribute] = phones
+	}
+	if _, err := k.call(http.MethodPut, resourcePath("users", raw.ID), nil, raw, nil); err != nil {
+		return nil, err
+	}
+	return &keycloakUser{keycloak: k, raw: &raw}, nil
+}
+
+func (k *keycloak) DeleteUser(extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(k); err != nil {
+		return err
+	}
+	_, err := k.call(http.MethodDelete, resourcePath("users", extID.GetEntryID()), nil, nil, nil)
+	return err
+}
+
+func copyAttributes(attributes map[string][]string) map[string][]string {
+	copied := make(map[string][]string, len(attributes)+1)
+	for name, values := range attributes {
+		copied[name] = values
+	}
+	return copied
+}
+
+func (k *keycloak) LookupEntryByExternalIdentity(extID ExternalIdentity) (Entry, error) {
+	switch extID.GetEntryType() {
+	case EntryTypeUser:
+		return k.LookupEntryUserByExternalIdentity(extID)
+	case EntryTypeDept:
+		return k.LookupEntryDepartmentByExternalIdentity(extID)
+	default:
+		return nil, errors.New("unsupported entry type")
+	}
+}
+
+// LookupEntryUserByExternalIdentity searches the extID attribute with an
+// attribute query, internal extIDs are looked up by id.
+func (k *keycloak) LookupEntryUserByExternalIdentity(extID ExternalIdentity) (UserEntryExtIDStoreable, error) {
+	if extID.CheckIfInternal(k) == nil {
+		return k.getUser(extID.GetEntryID())
+	}
+	users, err := k.listUsers(url.Values{"q": {k.config.ExtIDAttribute + ":" + string(extID)}, "exact": {"true"}})
+	if err != nil {
+		return nil, err
+	}
+	// older servers match attribute values by substring
+	users = lo.Filter(users, func(user UserableEntry, _ int) bool {
+		return lo.Contains(user.(*keycloakUser).GetExternalIdentities(), extID)
+	})
+	if len(users) != 1 {
+		return nil, fmt.Errorf("%d keycloak users linked to %s", len(users), extID)
+	}
+	return users[0].(*keycloakUser), nil
+}
+
+// LookupEntryDepartmentByExternalIdentity searches the extID attribute of
+// groups. Keycloak answers with the matching groups inside their top level
+// ancestors, so the result is walked for the group holding extID.
+func (k *keycloak) LookupEntryDepartmentByExternalIdentity(extID ExternalIdentity) (DepartmentEntryExtIDStoreable, error) {
+	if extID.CheckIfInternal(k) == nil {
+		if extID.GetEntryID() == keycloakRootID {
+			return nil, fmt.Errorf("%w: keycloak root department cannot store extIDs", ErrNotSupported)
+		}
+		return k.getGroup(extID.GetEntryID())
+	}
+	query := url.Values{
+		"q":                   {k.config.ExtIDAttribute + ":" + string(extID)},
+		"exact":               {"true"},
+		"briefRepresentation": {"false"},
+		"populateHierarchy":   {"true"},
+	}
+	tops, err := listAll[keycloakGroupRepresentation](k, "/groups", query)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*keycloakGroupRepresentation
+	var walk func(groups []keycloakGroupRepresentation)
+	walk = func(groups []keycloakGroupRepresentation) {
+		for i := range groups {
+			if lo.Contains(groups[i].Attributes[k.config.ExtIDAttribute], string(extID)) {
+				matched = append(matched, &groups[i])
+			}
+			walk(groups[i].SubGroups)
+		}
+	}
+	walk(tops)
+	if len(matched) != 1 {
+		return nil, fmt.Errorf("%d keycloak groups linked to %s", len(matched), extID)
+	}
+	return &keycloakGroup{keycloak: k, raw: matched[0]}, nil
+}
+
+type keycloakUser struct {
+	*keycloak
+	raw *keycloakUserRepresentation
+}
+
+func (u *keycloakUser) GetTarget() Target {
+	return u.keycloak
+}
+
+func (u keycloakUser) GetID() string {
+	return u.raw.ID
+}
+
+func (u keycloakUser) GetName() string {
+	if name := strings.TrimSpace(u.raw.FirstName + " " + u.raw.LastName); name != "" {
+		return name
+	}
+	return u.raw.Username
+}
+
+func (u keycloakUser) GetEmail() string {
+	return u.raw.Email
+}
+
+func (u keycloakUser) GetPhone() string {
+	if phones := u.GetPhones(); len(phones) != 0 {
+		return phones[0]
+	}
+	return ""
+}
+
+func (u keycloakUser) GetPhones() []string {
+	return u.raw.Attributes[u.config.PhoneAttribute]
+}
+
+// GetAttributes exposes the custom attributes of the user, the extID and
+// phone attributes included.
+func (u keycloakUser) GetAttributes() map[string][]string {
+	return u.raw.Attributes
+}
+
+func (u keycloakUser) GetExternalIdentities() ExternalIdentities {
+	return ExternalIdentitiesFromStringList(u.raw.Attributes[u.config.ExtIDAttribute])
+}
+
+// SetExternalIdentities writes the whole representation back, as a PUT
+// with only attributes would drop the attributes of other keys on some
+// versions.
+func (u *keycloakUser) SetExternalIdentities(extIDs ExternalIdentities) error {
+	raw := *u.raw
+	raw.Attributes = copyAttributes(raw.Attributes)
+	raw.Attributes[u.config.ExtIDAttribute] = lo.Uniq(extIDs.StringList())
+	if _, err := u.call(http.MethodPut, resourcePath("users", raw.ID), nil, raw, nil); err != nil {
+		return err
+	}
+	u.raw = &raw
+	return nil
+}
+
+// keycloakGroup is a realm group, raw is nil for the synthetic root.
+type keycloakGroup struct {
+	*keycloak
+	raw *keycloakGroupRepresentation
+}
+
+func (g *keycloakGroup) GetTarget() Target {
+	return g.keycloak
+}
+
+func (g keycloakGroup) GetID() string {
+	if g.raw == nil {
+		return keycloakRootID
+	}
+	return g.raw.ID
+}
+
+func (g keycloakGroup) GetName() string {
+	if g.raw == nil {
+		return g.config.Realm
+	}
+	return g.raw.Name
+}
+
+func (g keycloakGroup) GetDescription() string {
+	if g.raw == nil {
+		return ""
+	}
+	if description := g.raw.Attributes["description"]; len(description) != 0 {
+		return description[0]
+	}
+	return ""
+}
+
+// GetChildDepartments lists the children endpoint of Keycloak 23 and
+// later, falling back to the subGroups older servers embed in the group.
+func (g keycloakGroup) GetChildDepartments() (departments []DepartmentableEntry) {
+	var children []keycloakGroupRepresentation
+	var err error
+	if g.raw == nil {
+		children, err = listAll[keycloakGroupRepresentation](g.keycloak, "/groups", url.Values{"briefRepresentation": {"false"}})
+	} else {
+		children, err = listAll[keycloakGroupRepresentation](g.keycloak, resourcePath("groups", g.raw.ID, "children"), url.Values{"briefRepresentation": {"false"}})
+		if isKeycloakStatus(err, http.StatusNotFound) || isKeycloakStatus(err, http.StatusMethodNotAllowed) {
+			var group *keycloakGroup
+			if group, err = g.getGroup(g.raw.ID); err == nil {
+				children = group.raw.SubGroups
+			}
+		}
+	}
+	if err != nil {
+		g.logger.WithError(err).WithField("group", g.GetID()).Error("list keycloak child groups failed")
+		return departments
+	}
+	for i := range children {
+		departments = append(departments, &keycloakGroup{keycloak: g.keycloak, raw: &children[i]})
+	}
+	return departments
+}
+
+func (g keycloakGroup) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	raw := keycloakGroupRepresentation{Name: department.GetName()}
+	if description := department.GetDescription(); description != "" {
+		raw.Attributes = map[string][]string{"description": {description}}
+	}
+	if entry, ok := department.(DepartmentableEntry); ok {
+		if extID := ExternalIdentityOfEntry(entry); extID.CheckIfInternal(g.keycloak) != nil {
+			if raw.Attributes == nil {
+				raw.Attributes = make(map[string][]string)
+			}
+			raw.Attributes[g.config.ExtIDAttribute] = []string{string(extID)}
+		}
+	}
+	apiPath := "/groups"
+	if g.raw != nil {
+		apiPath = resourcePath("groups", g.raw.ID, "children")
+	}
+	created := new(keycloakGroupRepresentation)
+	location, err := g.call(http.MethodPost, apiPath, nil, raw, created)
+	if err != nil {
+		return nil, err
+	}
+	// subgroups come back in the body, top level groups only in Location
+	if created.ID == "" {
+		if created.ID, err = createdID(location); err != nil {
+			return nil, err
+		}
+	}
+	return g.getGroup(created.ID)
+}
+
+// GetUsers returns the direct members of the group, the synthetic root
+// has none of its own.
+func (g keycloakGroup) GetUsers() (users []UserableEntry, err error) {
+	if g.raw == nil {
+		return nil, nil
+	}
+	raws, err := listAll[keycloakUserRepresentation](g.keycloak, resourcePath("groups", g.raw.ID, "members"), url.Values{"briefRepresentation": {"false"}})
+	if err != nil {
+		return nil, err
+	}
+	for i := range raws {
+		users = append(users, &keycloakUser{keycloak: g.keycloak, raw: &raws[i]})
+	}
+	return users, nil
+}
+
+// AddToDepartment ignores the role, Keycloak group members have none.
+func (g keycloakGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return g.membership(http.MethodPut, extID)
+}
+
+func (g keycloakGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return g.membership(http.MethodDelete, extID)
+}
+
+func (g keycloakGroup) membership(method string, extID ExternalIdentity) error {
+	if g.raw == nil {
+		return fmt.Errorf("%w: keycloak realm root has no members", ErrNotSupported)
+	}
+	if err := extID.CheckIfInternal(g.keycloak); err != nil {
+		return err
+	}
+	_, err := g.call(method, resourcePath("users", extID.GetEntryID(), "groups", g.raw.ID), nil, nil, nil)
+	return err
+}
+
+func (g keycloakGroup) GetExternalIdentities() ExternalIdentities {
+	if g.raw == nil {
+		return nil
+	}
+	return ExternalIdentitiesFromStringList(g.raw.Attributes[g.config.ExtIDAttribute])
+}
+
+func (g *keycloakGroup) SetExternalIdentities(extIDs ExternalIdentities) error {
+	if g.raw == nil {
+		return fmt.Errorf("%w: keycloak root department cannot store extIDs", ErrNotSupported)
+	}
+	raw := *g.raw
+	raw.SubGroups = nil
+	raw.Attributes = copyAttributes(raw.Attributes)
+	raw.Attributes[g.config.ExtIDAttribute] = lo.Uniq(extIDs.StringList())
+	if _, err := g.call(http.MethodPut, resourcePath("groups", raw.ID), nil, raw, nil); err != nil {
+		return err
+	}
+	g.raw.Attributes = raw.Attributes
+	return nil
+}
@@ -0,0 +1,249 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+// keycloakStub is a realm "test" with four users and the groups
+// eng/sre. It hands out numbered tokens and accepts only the latest one,
+// requests to the admin API are logged as "METHOD path?query".
+type keycloakStub struct {
+	mu        sync.Mutex
+	tokens    int
+	expiresIn int
+	requests  []string
+	// oldServer answers 404 on the children endpoint of Keycloak 23.
+	oldServer bool
+	users     []keycloakUserRepresentation
+	updates   []keycloakUserRepresentation
+}
+
+func newKeycloakStub() *keycloakStub {
+	stub := &keycloakStub{expiresIn: 300}
+	for i, name := range []string{"ada", "grace", "alan", "edsger"} {
+		stub.users = append(stub.users, keycloakUserRepresentation{
+			ID: fmt.Sprint("u", i+1), Username: name, Email: name + "@example.com", FirstName: strings.Title(name), LastName: "Test", Enabled: true,
+			Attributes: map[string][]string{keycloakDefaultPhoneAttribute: {fmt.Sprint("+1 555 010", i+1)}},
+		})
+	}
+	return stub
+}
+
+var (
+	stubSRE = keycloakGroupRepresentation{ID: "sre", Name: "sre", Path: "/eng/sre", ParentID: "eng",
+		Attributes: map[string][]string{keycloakDefaultExtIDAttribute: {"ei.dept.42@hr.feishu"}}}
+	stubEng = keycloakGroupRepresentation{ID: "eng", Name: "eng", Path: "/eng", SubGroupCount: 1}
+)
+
+func (s *keycloakStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/realms/test/protocol/openid-connect/token" {
+		if r.PostFormValue("client_secret") != "secret" || r.PostFormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"unauthorized_client","error_description":"Invalid client secret"}`))
+			return
+		}
+		s.tokens++
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": fmt.Sprint("t", s.tokens), "expires_in": s.expiresIn})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/admin/realms/test")
+	s.requests = append(s.requests, r.Method+" "+path+lo.Ternary(r.URL.RawQuery != "", "?"+r.URL.RawQuery, ""))
+	if r.Header.Get("Authorization") != fmt.Sprint("Bearer t", s.tokens) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"HTTP 401 Unauthorized"}`))
+		return
+	}
+	first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+	max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+	var reply any
+	switch {
+	case path == "/users":
+		reply = lo.Subset(s.users, first, uint(max))
+	case path == "/groups" && r.URL.Query().Get("q") != "":
+		// attribute searches answer with the top level ancestors
+		eng := stubEng
+		eng.SubGroups = []keycloakGroupRepresentation{stubSRE}
+		reply = lo.Subset([]keycloakGroupRepresentation{eng}, first, uint(max))
+	case path == "/groups":
+		reply = lo.Subset([]keycloakGroupRepresentation{stubEng}, first, uint(max))
+	case path == "/groups/eng/children" && s.oldServer:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"HTTP 404 Not Found"}`))
+		return
+	case path == "/groups/eng/children":
+		reply = lo.Subset([]keycloakGroupRepresentation{stubSRE}, first, uint(max))
+	case path == "/groups/eng":
+		eng := stubEng
+		eng.SubGroups = []keycloakGroupRepresentation{stubSRE}
+		reply = eng
+	case path == "/groups/sre/children":
+		reply = []keycloakGroupRepresentation{}
+	case path == "/groups/eng/members":
+		reply = lo.Subset(s.users[:3], first, uint(max))
+	case path == "/groups/sre/members":
+		reply = lo.Subset(s.users[:1], first, uint(max))
+	case strings.HasPrefix(path, "/users/") && r.Method == http.MethodGet:
+		reply, _ = lo.Find(s.users, func(user keycloakUserRepresentation) bool { return user.ID == strings.TrimPrefix(path, "/users/") })
+	case strings.HasPrefix(path, "/users/") && r.Method == http.MethodPut:
+		var user keycloakUserRepresentation
+		_ = json.NewDecoder(r.Body).Decode(&user)
+		s.updates = append(s.updates, user)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+func newStubbedKeycloak(t *testing.T, stub *keycloakStub) *keycloak {
+	t.Helper()
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	k := &keycloak{logger: Log}
+	_, err := k.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"keycloak","Slug":"sso","BaseURL":"`+server.URL+`","Realm":"test","ClientSecret":"secret","PageSize":2}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeycloakRenewsRejectedToken(t *testing.T) {
+	stub := newKeycloakStub()
+	k := newStubbedKeycloak(t, stub)
+	if _, err := k.getUser("u1"); err != nil {
+		t.Fatal(err)
+	}
+	// a token revoked or expired on the server before its expires_in
+	stub.tokens++
+	user, err := k.getUser("u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.GetName() != "Grace Test" || user.GetPhone() != "+1 555 0102" {
+		t.Errorf("u2 is %s with phone %q", user.GetName(), user.GetPhone())
+	}
+	if stub.tokens != 3 || len(stub.requests) != 3 {
+		t.Errorf("fetched up to token t%d in %d requests, want t3 after one retry", stub.tokens, len(stub.requests))
+	}
+	if _, err := k.getUser("u3"); err != nil || stub.tokens != 3 {
+		t.Errorf("fetched token t%d for the next call (%v), want t3 kept", stub.tokens, err)
+	}
+}
+
+func TestKeycloakRefetchesTokenCloseToExpiry(t *testing.T) {
+	stub := newKeycloakStub()
+	stub.expiresIn = 5
+	k := newStubbedKeycloak(t, stub)
+	for _, id := range []string{"u1", "u2"} {
+		if _, err := k.getUser(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.tokens != 2 {
+		t.Errorf("fetched %d tokens, want one per call for tokens living under the margin", stub.tokens)
+	}
+}
+
+func TestKeycloakPagesUntilShortPage(t *testing.T) {
+	stub := newKeycloakStub()
+	k := newStubbedKeycloak(t, stub)
+	users, err := k.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 4 {
+		t.Errorf("got %d users, want 4", len(users))
+	}
+	want := []string{
+		"GET /users?briefRepresentation=false&first=0&max=2",
+		"GET /users?briefRepresentation=false&first=2&max=2",
+		"GET /users?briefRepresentation=false&first=4&max=2",
+	}
+	if strings.Join(stub.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests %q, want %q", stub.requests, want)
+	}
+}
+
+func TestKeycloakFallsBackToEmbeddedSubGroups(t *testing.T) {
+	for _, oldServer := range []bool{false, true} {
+		stub := newKeycloakStub()
+		stub.oldServer = oldServer
+		k := newStubbedKeycloak(t, stub)
+		root, _ := k.GetRootDepartment()
+		all, err := RecursionGetAllUsersIncludeChildDepartments(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := lo.Map(all, func(user UserableEntry, _ int) string { return user.GetID() })
+		if strings.Join(ids, ",") != "u1,u2,u3,u1" {
+			t.Errorf("old server %v: walk found %v, want eng then sre", oldServer, ids)
+		}
+	}
+}
+
+func TestKeycloakFindsLinkedGroupInsideItsAncestor(t *testing.T) {
+	k := newStubbedKeycloak(t, newKeycloakStub())
+	group, err := k.LookupEntryDepartmentByExternalIdentity("ei.dept.42@hr.feishu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.GetID() != "sre" {
+		t.Errorf("found %s, want the nested sre", group.GetID())
+	}
+	if _, err := k.LookupEntryDepartmentByExternalIdentity("ei.dept.43@hr.feishu"); err == nil {
+		t.Error("found a group for an extID nobody stores")
+	}
+}
+
+func TestKeycloakMembershipWrites(t *testing.T) {
+	stub := newKeycloakStub()
+	k := newStubbedKeycloak(t, stub)
+	root, _ := k.GetRootDepartment()
+	sre := root.GetChildDepartments()[0].GetChildDepartments()[0].(DepartmentUserWriter)
+	if err := sre.AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.u4@sso.keycloak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sre.RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.u1@sso.keycloak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.u4@sso.keycloak"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("adding to the realm root returned %v, want ErrNotSupported", err)
+	}
+	writes := lo.Reject(stub.requests, func(request string, _ int) bool { return strings.HasPrefix(request, "GET ") })
+	if want := "PUT /users/u4/groups/sre, DELETE /users/u1/groups/sre"; strings.Join(writes, ", ") != want {
+		t.Errorf("got writes %v, want %s", writes, want)
+	}
+}
+
+func TestKeycloakUpdateUserKeepsUnsetFields(t *testing.T) {
+	stub := newKeycloakStub()
+	k := newStubbedKeycloak(t, stub)
+	if _, err := k.UpdateUser("ei.user.u2@sso.keycloak", User{Email: "grace.hopper@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.updates) != 1 {
+		t.Fatalf("sent %d updates, want 1", len(stub.updates))
+	}
+	sent := stub.updates[0]
+	if sent.FirstName != "Grace" || sent.LastName != "Test" || sent.Email != "grace.hopper@example.com" {
+		t.Errorf("sent %s %s <%s>, want the name kept and the email changed", sent.FirstName, sent.LastName, sent.Email)
+	}
+}
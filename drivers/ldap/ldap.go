@@ -0,0 +1,687 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+	. "github.com/org-tools/manager"
+)
+
+const (
+	ldapDefaultPageSize = 500
+	// ldapRootID is the synthetic root when departments are nested through
+	// member, there is no single entry above them then.
+	ldapRootID = "root"
+
+	ldapNestingDN     = "dn"
+	ldapNestingMember = "member"
+)
+
+// ldapTarget reads persons and departments from LDAP or Active Directory.
+// Departments are entries matching DepartmentFilter, nested either by their
+// DN (OUs) or by the member attribute (nested groups), and users belong to a
+// department by living under it or by being one of its members.
+type ldapTarget struct {
+	config *ldapConfig
+	logger Logger
+
+	mu   sync.Mutex
+	conn *goldap.Conn
+}
+
+func init() {
+	RegisterPlatform("ldap", &ldapTarget{})
+}
+
+type ldapAttributes struct {
+	// ID is entryUUID by default, objectGUID on Active Directory.
+	ID     string
+	Name   string
+	Email  string
+	Phone  string
+	Member string
+	// DepartmentName is read before cn, ou is used when both are empty.
+	DepartmentName string
+}
+
+type ldapConfig struct {
+	Platform string
+	Slug     string
+	// URL is ldap://host:389 or ldaps://host:636.
+	URL                string
+	BindDN             string
+	BindPassword       string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+	PageSize           uint32
+
+	UserBaseDN       string
+	UserFilter       string
+	DepartmentBaseDN string
+	DepartmentFilter string
+	// Nesting is dn when departments are nested by DN like OUs, member when
+	// nested groups list their children as members.
+	Nesting string
+	// Membership is dn when users live under their department, member when
+	// departments list users as members.
+	Membership string
+	Attributes ldapAttributes
+
+	// Writable enables CreateUser, CreateChildDepartment and membership
+	// writes, the target is read-only otherwise.
+	Writable                bool
+	UserRDN                 string
+	UserObjectClasses       []string
+	DepartmentRDN           string
+	DepartmentObjectClasses []string
+}
+
+func (l *ldapTarget) SetLogger(logger Logger) {
+	l.logger = logger
+}
+
+func (l *ldapTarget) GetTarget() Target {
+	return l
+}
+
+func (l *ldapTarget) GetTargetSlug() string {
+	return l.config.Slug
+}
+
+func (l *ldapTarget) GetPlatform() string {
+	return l.config.Platform
+}
+
+func (l *ldapTarget) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	if err := unmarshaler(&l.config); err != nil {
+		return nil, err
+	}
+	c := l.config
+	if c.URL == "" || c.UserBaseDN == "" {
+		return nil, errors.New("ldap url and userbasedn are required")
+	}
+	if c.DepartmentBaseDN == "" {
+		c.DepartmentBaseDN = c.UserBaseDN
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = "(|(objectClass=inetOrgPerson)(&(objectCategory=person)(objectClass=user)))"
+	}
+	if c.DepartmentFilter == "" {
+		c.DepartmentFilter = "(objectClass=organizationalUnit)"
+	}
+	if c.Nesting == "" {
+		c.Nesting = ldapNestingDN
+	}
+	if c.Membership == "" {
+		c.Membership = ldapNestingDN
+	}
+	for _, mode := range []string{c.Nesting, c.Membership} {
+		if mode != ldapNestingDN && mode != ldapNestingMember {
+			return nil, fmt.Errorf("ldap nesting and membership are dn or member, got %s", mode)
+		}
+	}
+	setDefault(&c.Attributes.ID, "entryUUID")
+	setDefault(&c.Attributes.Name, "cn")
+	setDefault(&c.Attributes.Email, "mail")
+	setDefault(&c.Attributes.Phone, "telephoneNumber")
+	setDefault(&c.Attributes.Member, "member")
+	setDefault(&c.Attributes.DepartmentName, "cn")
+	setDefault(&c.UserRDN, "cn")
+	setDefault(&c.DepartmentRDN, "ou")
+	if len(c.UserObjectClasses) == 0 {
+		c.UserObjectClasses = []string{"top", "person", "organizationalPerson", "inetOrgPerson"}
+	}
+	if len(c.DepartmentObjectClasses) == 0 {
+		c.DepartmentObjectClasses = []string{"top", "organizationalUnit"}
+	}
+	if c.PageSize == 0 {
+		c.PageSize = ldapDefaultPageSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+	if _, err := l.connection(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func setDefault(value *string, fallback string) {
+	if *value == "" {
+		*value = fallback
+	}
+}
+
+// connection returns the bound connection, dialing again once it dropped.
+func (l *ldapTarget) connection() (*goldap.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil && !l.conn.IsClosing() {
+		return l.conn, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: l.config.InsecureSkipVerify}
+	conn, err := goldap.DialURL(l.config.URL, goldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(l.config.Timeout)
+	if l.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if l.config.BindDN != "" {
+		if err := conn.Bind(l.config.BindDN, l.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	l.conn = conn
+	return conn, nil
+}
+
+func (l *ldapTarget) ClassifyError(err error) (bool, time.Duration) {
+	if goldap.IsErrorAnyOf(err, goldap.LDAPResultBusy, goldap.LDAPResultUnavailable, goldap.ErrorNetwork,
+		goldap.LDAPResultServerDown, goldap.LDAPResultTimeout) {
+		return true, 0
+	}
+	return ClassifyError(err)
+}
+
+func (l *ldapTarget) search(baseDN string, scope int, filter string, attributes []string) ([]*goldap.Entry, error) {
+	conn, err := l.connection()
+	if err != nil {
+		return nil, err
+	}
+	req := goldap.NewSearchRequest(baseDN, scope, goldap.NeverDerefAliases, 0, 0, false, filter, attributes, nil)
+	result, err := conn.SearchWithPaging(req, l.config.PageSize)
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+func (l *ldapTarget) userAttributes() []string {
+	a := l.config.Attributes
+	return []string{a.ID, a.Name, "displayName", "cn", a.Email, a.Phone}
+}
+
+func (l *ldapTarget) departmentAttributes() []string {
+	a := l.config.Attributes
+	return []string{a.ID, a.DepartmentName, "ou", "cn", "description", a.Member}
+}
+
+// idFilter matches the ID attribute, objectGUID is binary and compared as
+// escaped bytes.
+func (l *ldapTarget) idFilter(id string) (string, error) {
+	if !strings.EqualFold(l.config.Attributes.ID, "objectGUID") {
+		return fmt.Sprintf("(%s=%s)", l.config.Attributes.ID, goldap.EscapeFilter(id)), nil
+	}
+	guid, err := uuid.Parse(id)
+	if err != nil {
+		return "", err
+	}
+	raw := guidBytes(guid)
+	var escaped strings.Builder
+	for _, b := range raw {
+		fmt.Fprintf(&escaped, `\%02x`, b)
+	}
+	return fmt.Sprintf("(objectGUID=%s)", escaped.String()), nil
+}
+
+// guidBytes converts between the string form and the byte order AD
+// stores, the first three groups are little endian.
+func guidBytes(guid uuid.UUID) []byte {
+	b := guid[:]
+	return []byte{b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6],
+		b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15]}
+}
+
+func (l *ldapTarget) entryID(entry *goldap.Entry) string {
+	if strings.EqualFold(l.config.Attributes.ID, "objectGUID") {
+		raw := entry.GetRawAttributeValue("objectGUID")
+		if len(raw) != 16 {
+			return ""
+		}
+		var guid uuid.UUID
+		copy(guid[:], raw)
+		swapped, _ := uuid.FromBytes(guidBytes(guid))
+		return swapped.String()
+	}
+	return entry.GetAttributeValue(l.config.Attributes.ID)
+}
+
+func (l *ldapTarget) GetRootDepartment() (DepartmentableEntry, error) {
+	if l.config.Nesting == ldapNestingMember {
+		return &ldapDepartment{ldapTarget: l, root: true}, nil
+	}
+	entries, err := l.search(l.config.DepartmentBaseDN, goldap.ScopeBaseObject, "(objectClass=*)", l.departmentAttributes())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("department base %s not found", l.config.DepartmentBaseDN)
+	}
+	return &ldapDepartment{ldapTarget: l, raw: entries[0], root: true}, nil
+}
+
+func (l *ldapTarget) GetAllUsers() (users []UserableEntry, err error) {
+	entries, err := l.search(l.config.UserBaseDN, goldap.ScopeWholeSubtree, l.config.UserFilter, l.userAttributes())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		users = append(users, &ldapUser{ldapTarget: l, raw: entry})
+	}
+	return users, nil
+}
+
+func (l *ldapTarget) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	return l.lookupLDAPUserByInternalExternalIdentity(internalExtID)
+}
+
+func (l *ldapTarget) lookupLDAPUserByInternalExternalIdentity(internalExtID ExternalIdentity) (*ldapUser, error) {
+	filter, err := l.idFilter(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	entries, err := l.search(l.config.UserBaseDN, goldap.ScopeWholeSubtree,
+		fmt.Sprintf("(&%s%s)", l.config.UserFilter, filter), l.userAttributes())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("user %s not found", internalExtID)
+	}
+	return &ldapUser{ldapTarget: l, raw: entries[0]}, nil
+}
+
+func (l *ldapTarget) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	return l.lookupLDAPDepartmentByInternalExternalIdentity(internalExtID)
+}
+
+func (l *ldapTarget) lookupLDAPDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (*ldapDepartment, error) {
+	root, err := l.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	if root.GetID() == internalExtID.GetEntryID() {
+		return root.(*ldapDepartment), nil
+	}
+	filter, err := l.idFilter(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	entries, err := l.search(l.config.DepartmentBaseDN, goldap.ScopeWholeSubtree,
+		fmt.Sprintf("(&%s%s)", l.config.DepartmentFilter, filter), l.departmentAttributes())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, NotFound(fmt.Errorf("department %s not found", internalExtID))
+	}
+	return &ldapDepartment{ldapTarget: l, raw: entries[0]}, nil
+}
+
+func (l *ldapTarget) checkWritable() error {
+	if !l.config.Writable {
+		return fmt.Errorf("%w: ldap target %s is read-only", ErrNotSupported, TargetKey(l))
+	}
+	return nil
+}
+
+// add creates an entry and reads it back for the ID the server assigned.
+func (l *ldapTarget) add(dn string, attributes map[string][]string, readAttributes []string) (*goldap.Entry, error) {
+	conn, err := l.connection()
+	if err != nil {
+		return nil, err
+	}
+	req := goldap.NewAddRequest(dn, nil)
+	for name, values := range attributes {
+		if len(values) != 0 {
+			req.Attribute(name, values)
+		}
+	}
+	if err := conn.Add(req); err != nil {
+		return nil, err
+	}
+	entries, err := l.search(dn, goldap.ScopeBaseObject, "(objectClass=*)", readAttributes)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("created entry %s not found", dn)
+	}
+	return entries[0], nil
+}
+
+// CreateUser adds the user under UserBaseDN, named by UserRDN.
+func (l *ldapTarget) CreateUser(user Userable) (UserableEntry, error) {
+	if err := l.checkWritable(); err != nil {
+		return nil, err
+	}
+	a := l.config.Attributes
+	attributes := map[string][]string{
+		"objectClass":    l.config.UserObjectClasses,
+		"sn":             {user.GetName()},
+		"displayName":    {user.GetName()},
+		l.config.UserRDN: {user.GetName()},
+		a.Email:          compact(GetUserableEmails(user)),
+		a.Phone:          compact(GetUserablePhones(user)),
+	}
+	if a.Name != l.config.UserRDN {
+		attributes[a.Name] = []string{user.GetName()}
+	}
+	dn := fmt.Sprintf("%s=%s,%s", l.config.UserRDN, goldap.EscapeDN(user.GetName()), l.config.UserBaseDN)
+	entry, err := l.add(dn, attributes, l.userAttributes())
+	if err != nil {
+		return nil, err
+	}
+	return &ldapUser{ldapTarget: l, raw: entry}, nil
+}
+
+// LookupUser matches the email, then the name, nil without error when
+// nobody matches.
+func (l *ldapTarget) LookupUser(user Userable) (UserableEntry, error) {
+	a := l.config.Attributes
+	var filters []string
+	if email := user.GetEmail(); email != "" {
+		filters = append(filters, fmt.Sprintf("(%s=%s)", a.Email, goldap.EscapeFilter(email)))
+	}
+	if name := user.GetName(); name != "" {
+		filters = append(filters, fmt.Sprintf("(%s=%s)", a.Name, goldap.EscapeFilter(name)))
+	}
+	for _, filter := range filters {
+		entries, err := l.search(l.config.UserBaseDN, goldap.ScopeWholeSubtree,
+			fmt.Sprintf("(&%s%s)", l.config.UserFilter, filter), l.userAttributes())
+		if err != nil {
+			return nil, err
+		}
+		switch len(entries) {
+		case 0:
+			continue
+		case 1:
+			return &ldapUser{ldapTarget: l, raw: entries[0]}, nil
+		default:
+			return nil, fmt.Errorf("%d users matched %s", len(entries), filter)
+		}
+	}
+	return nil, nil
+}
+
+func compact(values []string) (compacted []string) {
+	for _, value := range values {
+		if value != "" {
+			compacted = append(compacted, value)
+		}
+	}
+	return compacted
+}
+
+type ldapUser struct {
+	*ldapTarget
+	raw *goldap.Entry
+}
+
+func (u *ldapUser) GetTarget() Target {
+	return u.ldapTarget
+}
+
+func (u ldapUser) GetID() string {
+	return u.entryID(u.raw)
+}
+
+func (u ldapUser) GetName() string {
+	for _, attribute := range []string{u.config.Attributes.Name, "displayName", "cn"} {
+		if name := u.raw.GetAttributeValue(attribute); name != "" {
+			return name
+		}
+	}
+	return u.raw.DN
+}
+
+func (u ldapUser) GetEmail() string {
+	return u.raw.GetAttributeValue(u.config.Attributes.Email)
+}
+
+func (u ldapUser) GetEmails() []string {
+	return u.raw.GetAttributeValues(u.config.Attributes.Email)
+}
+
+func (u ldapUser) GetPhone() string {
+	return u.raw.GetAttributeValue(u.config.Attributes.Phone)
+}
+
+func (u ldapUser) GetPhones() []string {
+	return u.raw.GetAttributeValues(u.config.Attributes.Phone)
+}
+
+// ldapDepartment is a department entry, raw is nil for the synthetic root
+// of member nesting.
+type ldapDepartment struct {
+	*ldapTarget
+	raw  *goldap.Entry
+	root bool
+}
+
+func (d *ldapDepartment) GetTarget() Target {
+	return d.ldapTarget
+}
+
+func (d ldapDepartment) GetID() string {
+	if d.raw == nil {
+		return ldapRootID
+	}
+	// the base entry may be a plain container without the ID attribute
+	if id := d.entryID(d.raw); id != "" || !d.root {
+		return id
+	}
+	return ldapRootID
+}
+
+func (d ldapDepartment) GetName() string {
+	if d.raw == nil {
+		return d.config.Slug
+	}
+	for _, attribute := range []string{d.config.Attributes.DepartmentName, "ou", "cn"} {
+		if name := d.raw.GetAttributeValue(attribute); name != "" {
+			return name
+		}
+	}
+	return d.raw.DN
+}
+
+func (d ldapDepartment) GetDescription() string {
+	if d.raw == nil {
+		return ""
+	}
+	return d.raw.GetAttributeValue("description")
+}
+
+func (d ldapDepartment) dn() string {
+	if d.raw == nil {
+		return d.config.DepartmentBaseDN
+	}
+	return d.raw.DN
+}
+
+func (d ldapDepartment) GetChildDepartments() (departments []DepartmentableEntry) {
+	children, err := d.childEntries()
+	if err != nil {
+		d.logger.WithError(err).Error("list ldap departments failed")
+		return departments
+	}
+	for _, child := range children {
+		departments = append(departments, &ldapDepartment{ldapTarget: d.ldapTarget, raw: child})
+	}
+	return departments
+}
+
+// childEntries follows Nesting, with member nesting the root holds the
+// departments no other department lists as a member.
+func (d ldapDepartment) childEntries() ([]*goldap.Entry, error) {
+	if d.config.Nesting == ldapNestingDN {
+		return d.search(d.dn(), goldap.ScopeSingleLevel, d.config.DepartmentFilter, d.departmentAttributes())
+	}
+	all, err := d.search(d.config.DepartmentBaseDN, goldap.ScopeWholeSubtree, d.config.DepartmentFilter, d.departmentAttributes())
+	if err != nil {
+		return nil, err
+	}
+	nested := make(map[string]bool)
+	for _, entry := range all {
+		for _, member := range entry.GetAttributeValues(d.config.Attributes.Member) {
+			nested[normalizeDN(member)] = true
+		}
+	}
+	var children []*goldap.Entry
+	if d.raw == nil {
+		for _, entry := range all {
+			if !nested[normalizeDN(entry.DN)] {
+				children = append(children, entry)
+			}
+		}
+		return children, nil
+	}
+	members := make(map[string]bool)
+	for _, member := range d.raw.GetAttributeValues(d.config.Attributes.Member) {
+		members[normalizeDN(member)] = true
+	}
+	for _, entry := range all {
+		if members[normalizeDN(entry.DN)] {
+			children = append(children, entry)
+		}
+	}
+	return children, nil
+}
+
+func normalizeDN(dn string) string {
+	if parsed, err := goldap.ParseDN(dn); err == nil {
+		return strings.ToLower(parsed.String())
+	}
+	return strings.ToLower(dn)
+}
+
+func (d ldapDepartment) GetUsers() (users []UserableEntry, err error) {
+	if d.config.Membership == ldapNestingDN {
+		if d.raw == nil {
+			return nil, nil
+		}
+		entries, err := d.search(d.raw.DN, goldap.ScopeSingleLevel, d.config.UserFilter, d.userAttributes())
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			users = append(users, &ldapUser{ldapTarget: d.ldapTarget, raw: entry})
+		}
+		return users, nil
+	}
+	if d.raw == nil {
+		return nil, nil
+	}
+	members := d.raw.GetAttributeValues(d.config.Attributes.Member)
+	if len(members) == 0 {
+		return nil, nil
+	}
+	memberDNs := make(map[string]bool, len(members))
+	for _, member := range members {
+		memberDNs[normalizeDN(member)] = true
+	}
+	entries, err := d.search(d.config.UserBaseDN, goldap.ScopeWholeSubtree, d.config.UserFilter, d.userAttributes())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if memberDNs[normalizeDN(entry.DN)] {
+			users = append(users, &ldapUser{ldapTarget: d.ldapTarget, raw: entry})
+		}
+	}
+	return users, nil
+}
+
+// CreateChildDepartment adds an entry named by DepartmentRDN, under the
+// parent with dn nesting or under DepartmentBaseDN and listed as a member of
+// the parent with member nesting.
+func (d ldapDepartment) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	parentDN := d.dn()
+	if d.config.Nesting == ldapNestingMember {
+		parentDN = d.config.DepartmentBaseDN
+	}
+	attributes := map[string][]string{
+		"objectClass":          d.config.DepartmentObjectClasses,
+		d.config.DepartmentRDN: {department.GetName()},
+	}
+	if description := department.GetDescription(); description != "" {
+		attributes["description"] = []string{description}
+	}
+	dn := fmt.Sprintf("%s=%s,%s", d.config.DepartmentRDN, goldap.EscapeDN(department.GetName()), parentDN)
+	entry, err := d.add(dn, attributes, d.departmentAttributes())
+	if err != nil {
+		return nil, err
+	}
+	if d.config.Nesting == ldapNestingMember && d.raw != nil {
+		if err := d.modifyMember("add", entry.DN); err != nil {
+			return nil, err
+		}
+	}
+	return &ldapDepartment{ldapTarget: d.ldapTarget, raw: entry}, nil
+}
+
+// AddToDepartment ignores the role, LDAP groups have none, and needs
+// member membership as moving users between OUs is not supported.
+func (d ldapDepartment) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return d.writeMember("add", extID)
+}
+
+func (d ldapDepartment) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return d.writeMember("delete", extID)
+}
+
+func (d ldapDepartment) writeMember(op string, extID ExternalIdentity) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if d.config.Membership != ldapNestingMember || d.raw == nil {
+		return fmt.Errorf("%w: ldap membership of %s is not a member attribute", ErrNotSupported, d.GetName())
+	}
+	if err := extID.CheckIfInternal(d.ldapTarget); err != nil {
+		return err
+	}
+	user, err := d.lookupLDAPUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return err
+	}
+	return d.modifyMember(op, user.raw.DN)
+}
+
+func (d ldapDepartment) modifyMember(op, memberDN string) error {
+	conn, err := d.connection()
+	if err != nil {
+		return err
+	}
+	req := goldap.NewModifyRequest(d.raw.DN, nil)
+	if op == "add" {
+		req.Add(d.config.Attributes.Member, []string{memberDN})
+	} else {
+		req.Delete(d.config.Attributes.Member, []string{memberDN})
+	}
+	err = conn.Modify(req)
+	// adding a present member or removing an absent one is already done
+	if goldap.IsErrorAnyOf(err, goldap.LDAPResultAttributeOrValueExists, goldap.LDAPResultNoSuchAttribute) {
+		return nil
+	}
+	return err
+}
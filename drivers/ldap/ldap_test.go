@@ -0,0 +1,414 @@
+package ldap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	. "github.com/org-tools/manager"
+	"github.com/org-tools/manager/ldapserver"
+	"github.com/samber/lo"
+)
+
+const testBaseDN = "dc=example,dc=com"
+
+// relay sits between the driver and the read-only ldapserver of this repo.
+// It logs searches as "base filter", cuts searches with the paged results
+// control into pages, and answers writes itself with writeResult, logging
+// them as "op attribute value on dn".
+type relay struct {
+	upstream    string
+	writeResult uint16
+
+	mu       sync.Mutex
+	searches []string
+	writes   []string
+	pages    int
+	rest     map[string][]*ber.Packet
+}
+
+func (r *relay) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.relay(conn)
+	}
+}
+
+func (r *relay) relay(client net.Conn) {
+	defer client.Close()
+	upstream, err := net.Dial("tcp", r.upstream)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	for {
+		request, err := ber.ReadPacket(client)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		var responses []*ber.Packet
+		switch op := request.Children[1]; op.Tag {
+		case goldap.ApplicationUnbindRequest:
+			return
+		case goldap.ApplicationModifyRequest:
+			responses = []*ber.Packet{r.write(request, op)}
+		case goldap.ApplicationAddRequest:
+			r.mu.Lock()
+			r.writes = append(r.writes, "add "+op.Children[0].Value.(string))
+			r.mu.Unlock()
+			responses = []*ber.Packet{reply(request, goldap.ApplicationAddResponse, r.writeResult)}
+		case goldap.ApplicationSearchRequest:
+			if responses, err = r.search(request, upstream); err != nil {
+				return
+			}
+		default:
+			if responses, err = roundTrip(request, upstream); err != nil {
+				return
+			}
+		}
+		for _, response := range responses {
+			if _, err := client.Write(response.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply answers request with a bare LDAPResult of code.
+func reply(request *ber.Packet, tag ber.Tag, code uint16) *ber.Packet {
+	response := ber.NewSequence("LDAP Message")
+	response.AppendChild(request.Children[0])
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	response.AppendChild(result)
+	return response
+}
+
+func (r *relay) write(request, op *ber.Packet) *ber.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dn := op.Children[0].Value.(string)
+	for _, change := range op.Children[1].Children {
+		kind := map[int64]string{0: "add", 1: "delete", 2: "replace"}[change.Children[0].Value.(int64)]
+		attribute := change.Children[1]
+		for _, value := range attribute.Children[1].Children {
+			r.writes = append(r.writes, fmt.Sprintf("%s %s %s on %s", kind, attribute.Children[0].Value, value.Value, dn))
+		}
+	}
+	return reply(request, goldap.ApplicationModifyResponse, r.writeResult)
+}
+
+// roundTrip forwards request and reads the responses up to its last one.
+func roundTrip(request *ber.Packet, upstream net.Conn) (responses []*ber.Packet, err error) {
+	if _, err := upstream.Write(request.Bytes()); err != nil {
+		return nil, err
+	}
+	for {
+		response, err := ber.ReadPacket(upstream)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+		if request.Children[1].Tag != goldap.ApplicationSearchRequest || response.Children[1].Tag == goldap.ApplicationSearchResultDone {
+			return responses, nil
+		}
+	}
+}
+
+func (r *relay) search(request *ber.Packet, upstream net.Conn) ([]*ber.Packet, error) {
+	op := request.Children[1]
+	filter, err := goldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		return nil, err
+	}
+	var paging *goldap.ControlPaging
+	if len(request.Children) > 2 {
+		for _, child := range request.Children[2].Children {
+			if control, err := goldap.DecodeControl(child); err == nil {
+				paging, _ = control.(*goldap.ControlPaging)
+			}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if paging == nil || len(paging.Cookie) == 0 {
+		r.searches = append(r.searches, op.Children[0].Value.(string)+" "+filter)
+	}
+	if paging == nil {
+		return roundTrip(request, upstream)
+	}
+	responses, ok := r.rest[string(paging.Cookie)]
+	if !ok {
+		if responses, err = roundTrip(request, upstream); err != nil {
+			return nil, err
+		}
+	}
+	delete(r.rest, string(paging.Cookie))
+	r.pages++
+	entries, done := responses[:len(responses)-1], responses[len(responses)-1]
+	page := lo.Subset(entries, 0, uint(paging.PagingSize))
+	next := goldap.NewControlPaging(paging.PagingSize)
+	if rest := entries[len(page):]; len(rest) != 0 {
+		cookie := strconv.Itoa(r.pages)
+		r.rest[cookie] = append(append([]*ber.Packet(nil), rest...), done)
+		next.SetCookie([]byte(cookie))
+	}
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	controls.AppendChild(next.Encode())
+	// later pages answer the message ID of their own request
+	responses = nil
+	for _, entry := range page {
+		response := ber.NewSequence("LDAP Message")
+		response.AppendChild(request.Children[0])
+		response.AppendChild(entry.Children[1])
+		responses = append(responses, response)
+	}
+	last := ber.NewSequence("LDAP Message")
+	last.AppendChild(request.Children[0])
+	last.AppendChild(done.Children[1])
+	last.AppendChild(controls)
+	return append(responses, last), nil
+}
+
+// serveDirectory serves the local target hub through ldapserver and the
+// relay, and connects the driver with the settings in config to it.
+func serveDirectory(t *testing.T, config string) (*ldapTarget, Target, *relay) {
+	t.Helper()
+	dsn := t.TempDir() + "/hub.db"
+	local, err := InitTarget("local", func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"local","Slug":"hub","FileDSN":"`+dsn+`"}`), v)
+	}, Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ldapserver.NewServer(local, ldapserver.Options{BaseDN: testBaseDN, AllowAnonymous: true, Logger: Log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := func() net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		return listener
+	}
+	upstream, front := listen(), listen()
+	go server.Serve(upstream)
+	r := &relay{upstream: upstream.Addr().String(), rest: make(map[string][]*ber.Packet)}
+	go r.accept(front)
+
+	l := &ldapTarget{logger: Log}
+	_, err = l.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"ldap","Slug":"dir","URL":"ldap://`+front.Addr().String()+`",
+			"UserBaseDN":"ou=people,`+testBaseDN+`","DepartmentBaseDN":"ou=groups,`+testBaseDN+`",
+			"DepartmentFilter":"(objectClass=groupOfNames)","Membership":"member",`+config+`}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if l.conn != nil {
+			l.conn.Close()
+		}
+	})
+	return l, local, r
+}
+
+// hire creates a user in local for each name, with the name as mail
+// local part, and adds each to department.
+func hire(t *testing.T, local Target, department DepartmentableEntry, names ...string) (users []UserableEntry) {
+	t.Helper()
+	for _, name := range names {
+		user, err := local.(UserWriteable).CreateUser(User{Name: name, Email: strings.Fields(name)[0] + "@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := department.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, ExternalIdentityOfUser(local, user)); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+func createDepartment(t *testing.T, parent DepartmentableEntry, name string) DepartmentableEntry {
+	t.Helper()
+	department := NewDepartment()
+	department.Name = name
+	created, err := parent.CreateChildDepartment(department)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+// members walks the driver from its root, listing "department: users"
+// with the users sorted.
+func members(t *testing.T, root DepartmentableEntry) (walked []string) {
+	t.Helper()
+	var walk func(department DepartmentableEntry)
+	walk = func(department DepartmentableEntry) {
+		users, err := department.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := lo.Map(users, func(user UserableEntry, _ int) string { return user.GetName() })
+		sort.Strings(names)
+		walked = append(walked, department.GetName()+": "+strings.Join(names, ", "))
+		for _, child := range department.GetChildDepartments() {
+			walk(child)
+		}
+	}
+	walk(root)
+	sort.Strings(walked)
+	return walked
+}
+
+func TestLDAPWalkMatchesMembersByEscapedDN(t *testing.T) {
+	l, local, r := serveDirectory(t, `"PageSize":2`)
+	localRoot, _ := local.GetRootDepartment()
+	rnd := createDepartment(t, localRoot, "R&D, Platform")
+	hire(t, local, rnd, "ada", "grace", "alan")
+	hire(t, local, createDepartment(t, rnd, "a+b=c"), "edsger")
+	root, err := l.GetRootDepartment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := members(t, root)
+	want := []string{"R&D, Platform: ada, alan, grace", "a+b=c: edsger", "groups: ", "root: "}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("walked\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if r.pages < 2 {
+		t.Errorf("read the walk in %d pages, want the users paged by two", r.pages)
+	}
+	nested := lo.Filter(r.searches, func(search string, _ int) bool { return strings.HasPrefix(search, `cn=a\+b=c,`) })
+	if len(nested) == 0 || !strings.Contains(nested[0], `cn=R&D\, Platform`) {
+		t.Errorf("searched %q, want the nested department by its escaped DN", r.searches)
+	}
+}
+
+func TestLDAPNormalizeDN(t *testing.T) {
+	for _, same := range [][2]string{
+		{`CN=R&D\, Platform,OU=Groups,DC=example,DC=com`, `cn=r&d\2c platform,ou=groups,dc=example,dc=com`},
+		{`cn=a\+b,ou=groups`, `cn=a\2bb, ou=groups`},
+		{`uid=42,ou=people`, `UID=42,OU=People`},
+	} {
+		if normalizeDN(same[0]) != normalizeDN(same[1]) {
+			t.Errorf("%s normalized to %s and %s to %s", same[0], normalizeDN(same[0]), same[1], normalizeDN(same[1]))
+		}
+	}
+	if normalizeDN(`cn=a\,b,ou=groups`) == normalizeDN(`cn=a,cn=b,ou=groups`) {
+		t.Error("an escaped comma normalized like a separator")
+	}
+}
+
+func TestLDAPLookupUserEscapesFilter(t *testing.T) {
+	l, local, r := serveDirectory(t, `"PageSize":50`)
+	localRoot, _ := local.GetRootDepartment()
+	hire(t, local, localRoot, "ada (admin)", "grace")
+	found, err := l.LookupUser(User{Email: "*", Name: "ada (admin)"})
+	if err != nil || found == nil || found.GetName() != "ada (admin)" {
+		t.Fatalf("lookup found %v, %v, want ada by name", found, err)
+	}
+	want := []string{`(mail=\2a)`, `(cn=ada \28admin\29)`}
+	for i, search := range r.searches {
+		if i < len(want) && !strings.HasSuffix(search, want[i]+")") {
+			t.Errorf("search %d is %s, want it to end with %s", i, search, want[i])
+		}
+	}
+	if missing, err := l.LookupUser(User{Email: "nobody@example.com"}); missing != nil || err != nil {
+		t.Errorf("lookup of an unknown email found %v, %v, want nothing", missing, err)
+	}
+}
+
+func TestLDAPObjectGUID(t *testing.T) {
+	l := &ldapTarget{config: &ldapConfig{Attributes: ldapAttributes{ID: "objectGUID"}}}
+	filter, err := l.idFilter("04030201-0605-0807-090a-0b0c0d0e0f10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first three groups are stored little endian
+	if want := `(objectGUID=\01\02\03\04\05\06\07\08\09\0a\0b\0c\0d\0e\0f\10)`; filter != want {
+		t.Errorf("got filter %s, want %s", filter, want)
+	}
+	entry := &goldap.Entry{Attributes: []*goldap.EntryAttribute{{
+		Name:       "objectGUID",
+		ByteValues: [][]byte{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}},
+	}}}
+	if id := l.entryID(entry); id != "04030201-0605-0807-090a-0b0c0d0e0f10" {
+		t.Errorf("read objectGUID as %s", id)
+	}
+	if _, err := l.idFilter("*)(uid=*"); err == nil {
+		t.Error("built an objectGUID filter from an ID that is no GUID")
+	}
+	l.config.Attributes.ID = "entryUUID"
+	if filter, _ := l.idFilter("*)(uid=*"); filter != `(entryUUID=\2a\29\28uid=\2a)` {
+		t.Errorf("got filter %s for an ID with filter characters", filter)
+	}
+}
+
+func TestLDAPMemberWritesTreatDoneAsSuccess(t *testing.T) {
+	l, local, r := serveDirectory(t, `"PageSize":50,"Writable":true`)
+	localRoot, _ := local.GetRootDepartment()
+	ops := createDepartment(t, localRoot, "ops")
+	ada := hire(t, local, ops, "ada")[0]
+	department, err := l.LookupEntryDepartmentByInternalExternalIdentity(ExternalIdentity("ei.dept." + ops.GetID() + "@dir.ldap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := department.(DepartmentUserWriter)
+	extID := ExternalIdentity("ei.user." + ada.GetID() + "@dir.ldap")
+	for code, wantErr := range map[uint16]bool{
+		goldap.LDAPResultAttributeOrValueExists:   false,
+		goldap.LDAPResultNoSuchAttribute:          false,
+		goldap.LDAPResultInsufficientAccessRights: true,
+	} {
+		r.writeResult = code
+		if err := writer.AddToDepartment(DepartmentModifyUserOptions{}, extID); (err != nil) != wantErr {
+			t.Errorf("add answered with %s returned %v", goldap.LDAPResultCodeMap[code], err)
+		}
+	}
+	want := fmt.Sprintf("add member uid=%s,ou=people,%s on cn=ops,cn=root,ou=groups,%s", ada.GetID(), testBaseDN, testBaseDN)
+	if len(r.writes) != 3 || r.writes[0] != want {
+		t.Errorf("got writes %q, want three of %s", r.writes, want)
+	}
+	if err := writer.AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.42@hr.feishu"); err == nil {
+		t.Error("added the user of another target")
+	}
+}
+
+func TestLDAPReadOnlyTargetRefusesWrites(t *testing.T) {
+	l, local, r := serveDirectory(t, `"PageSize":50`)
+	localRoot, _ := local.GetRootDepartment()
+	ops := createDepartment(t, localRoot, "ops")
+	department, err := l.LookupEntryDepartmentByInternalExternalIdentity(ExternalIdentity("ei.dept." + ops.GetID() + "@dir.ldap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, createUser := l.CreateUser(User{Name: "ada"})
+	_, createDepartment := department.CreateChildDepartment(NewDepartment())
+	addMember := department.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.1@dir.ldap")
+	for name, err := range map[string]error{"create user": createUser, "create department": createDepartment, "add member": addMember} {
+		if !errors.Is(err, ErrNotSupported) {
+			t.Errorf("%s on a read-only target returned %v, want ErrNotSupported", name, err)
+		}
+	}
+	if len(r.writes) != 0 {
+		t.Errorf("read-only target sent %q", r.writes)
+	}
+}
@@ -0,0 +1,812 @@
+package okta
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	oktaDefaultPageSize       = 200
+	oktaDefaultTimeout        = 30 * time.Second
+	oktaDefaultExtIDAttribute = "orgManagerExtIDs"
+	// oktaRootID is the synthetic root department, Okta groups are flat
+	// and all hang under it.
+	oktaRootID = "root"
+
+	oktaStatusActive        = "ACTIVE"
+	oktaStatusSuspended     = "SUSPENDED"
+	oktaStatusDeprovisioned = "DEPROVISIONED"
+	oktaGroupTypeOkta       = "OKTA_GROUP"
+)
+
+// okta manages the users and groups of an Okta org with the management
+// API, groups are departments under a synthetic root.
+type okta struct {
+	client *http.Client
+	config *oktaConfig
+	logger Logger
+
+	rateLimitMu sync.Mutex
+	rateLimits  map[string]oktaRateLimit
+}
+
+func init() {
+	RegisterPlatform("okta", &okta{})
+}
+
+type oktaConfig struct {
+	Platform string
+	Slug     string
+	// OrgURL is the org address, like https://example.okta.com.
+	OrgURL string
+	// Token is an API token, sent as SSWS.
+	Token string
+	// ExtIDAttribute is a custom string array attribute, it must be added
+	// to the user and group profile schemas for Okta to store extIDs.
+	ExtIDAttribute string
+	// CreateStaged leaves created users STAGED instead of activating them.
+	CreateStaged bool
+	// RateLimitReserve is how many calls of a rate limit bucket are left
+	// to other clients, calls wait for the reset below it.
+	RateLimitReserve int
+	PageSize         int
+	Timeout          time.Duration
+}
+
+type oktaRateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+func (o *okta) SetLogger(logger Logger) {
+	o.logger = logger
+}
+
+// SetHTTPClient replaces the client built from the config, for proxies,
+// custom transports or a stand-in server in tests.
+func (o *okta) SetHTTPClient(client *http.Client) {
+	o.client = client
+}
+
+func (o *okta) GetTarget() Target {
+	return o
+}
+
+func (o *okta) GetTargetSlug() string {
+	return o.config.Slug
+}
+
+func (o *okta) GetPlatform() string {
+	return o.config.Platform
+}
+
+func (o *okta) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	if err := unmarshaler(&o.config); err != nil {
+		return nil, err
+	}
+	if o.config.OrgURL == "" || o.config.Token == "" {
+		return nil, errors.New("okta orgurl and token are required")
+	}
+	o.config.OrgURL = strings.TrimRight(o.config.OrgURL, "/")
+	if o.config.ExtIDAttribute == "" {
+		o.config.ExtIDAttribute = oktaDefaultExtIDAttribute
+	}
+	if o.config.PageSize <= 0 {
+		o.config.PageSize = oktaDefaultPageSize
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = oktaDefaultTimeout
+	}
+	o.client = &http.Client{Timeout: o.config.Timeout}
+	o.rateLimits = make(map[string]oktaRateLimit)
+	return o, nil
+}
+
+// oktaError is the error body of the management API.
+type oktaError struct {
+	ErrorCode    string `json:"errorCode"`
+	ErrorSummary string `json:"errorSummary"`
+	ErrorCauses  []struct {
+		ErrorSummary string `json:"errorSummary"`
+	} `json:"errorCauses"`
+}
+
+func (e oktaError) message() string {
+	message := e.ErrorSummary
+	for _, cause := range e.ErrorCauses {
+		message += ": " + cause.ErrorSummary
+	}
+	if e.ErrorCode != "" {
+		message = e.ErrorCode + " " + message
+	}
+	return message
+}
+
+func isOktaStatus(err error, status int) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode() == status
+}
+
+// rateLimitBucket approximates the Okta rate limit buckets, which are per
+// endpoint family, by the first path segments below /api/v1.
+func rateLimitBucket(method, apiPath string) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(apiPath, "/api/v1/"), "/"), "/")
+	if len(segments) > 2 {
+		segments = segments[:2]
+	}
+	if len(segments) == 2 && segments[1] != "rules" {
+		segments[1] = "{id}"
+	}
+	return method + " " + strings.Join(segments, "/")
+}
+
+// waitRateLimit sleeps until the bucket resets when the last response
+// said it is about to run out, rather than spend a call on a 429.
+func (o *okta) waitRateLimit(bucket string) {
+	o.rateLimitMu.Lock()
+	limit, ok := o.rateLimits[bucket]
+	o.rateLimitMu.Unlock()
+	if !ok || limit.remaining > o.config.RateLimitReserve {
+		return
+	}
+	if wait := time.Until(limit.reset); wait > 0 {
+		o.logger.WithField("bucket", bucket).WithField("wait", wait).Warn("okta rate limit nearly spent, waiting for reset")
+		time.Sleep(wait)
+	}
+}
+
+func (o *okta) recordRateLimit(bucket string, header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-Rate-Limit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("X-Rate-Limit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	o.rateLimitMu.Lock()
+	defer o.rateLimitMu.Unlock()
+	o.rateLimits[bucket] = oktaRateLimit{remaining: remaining, reset: time.Unix(reset, 0)}
+}
+
+// call sends a management API request, apiPath may also be the absolute
+// next link of a page. It returns the next link when there is one.
+func (o *okta) call(method, apiPath string, query url.Values, body, out any) (next string, err error) {
+	endpoint := apiPath
+	if !strings.HasPrefix(apiPath, "http") {
+		endpoint = o.config.OrgURL + apiPath
+	}
+	if len(query) != 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "SSWS "+o.config.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	bucket := rateLimitBucket(method, req.URL.Path)
+	o.waitRateLimit(bucket)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	o.recordRateLimit(bucket, resp.Header)
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	o.logger.WithField("method", method).WithField("path", req.URL.Path).WithField("status", resp.StatusCode).Debug("okta call")
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		httpErr := NewHTTPError(resp, raw)
+		var oktaErr oktaError
+		if json.Unmarshal(raw, &oktaErr) == nil && oktaErr.ErrorSummary != "" {
+			httpErr.Body = oktaErr.message()
+		}
+		return "", httpErr
+	}
+	next = nextLink(resp.Header)
+	if out == nil || len(raw) == 0 {
+		return next, nil
+	}
+	return next, json.Unmarshal(raw, out)
+}
+
+// nextLink finds the rel="next" entry of the Link headers.
+func nextLink(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			if len(parts) < 2 {
+				continue
+			}
+			for _, param := range parts[1:] {
+				if strings.ReplaceAll(strings.TrimSpace(param), " ", "") == `rel="next"` {
+					return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// listAll follows the next links of a list endpoint.
+func listAll[T any](o *okta, apiPath string, query url.Values) (items []T, err error) {
+	if query == nil {
+		query = make(url.Values)
+	}
+	query.Set("limit", strconv.Itoa(o.config.PageSize))
+	for apiPath != "" {
+		var page []T
+		if apiPath, err = o.call(http.MethodGet, apiPath, query, nil, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		// the next link carries the query and cursor itself
+		query = nil
+	}
+	return items, nil
+}
+
+func searchString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+type oktaUserRaw struct {
+	ID      string         `json:"id,omitempty"`
+	Status  string         `json:"status,omitempty"`
+	Profile map[string]any `json:"profile"`
+}
+
+type oktaGroupRaw struct {
+	ID      string         `json:"id,omitempty"`
+	Type    string         `json:"type,omitempty"`
+	Profile map[string]any `json:"profile"`
+}
+
+type oktaGroupRule struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Conditions struct {
+		Expression struct {
+			Value string `json:"value"`
+		} `json:"expression"`
+	} `json:"conditions"`
+	Actions struct {
+		AssignUserToGroups struct {
+			GroupIDs []string `json:"groupIds"`
+		} `json:"assignUserToGroups"`
+	} `json:"actions"`
+}
+
+func profileString(profile map[string]any, key string) string {
+	value, _ := profile[key].(string)
+	return value
+}
+
+func profileStrings(profile map[string]any, key string) (values []string) {
+	switch value := profile[key].(type) {
+	case []any:
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+	case []string:
+		values = value
+	}
+	return values
+}
+
+func copyProfile(profile map[string]any) map[string]any {
+	copied := make(map[string]any, len(profile)+1)
+	for key, value := range profile {
+		copied[key] = value
+	}
+	return copied
+}
+
+func (o *okta) GetRootDepartment() (DepartmentableEntry, error) {
+	return &oktaGroup{okta: o}, nil
+}
+
+// GetAllUsers lists every user that is not deprovisioned.
+func (o *okta) GetAllUsers() (users []UserableEntry, err error) {
+	return o.listUsers(nil)
+}
+
+func (o *okta) listUsers(query url.Values) (users []UserableEntry, err error) {
+	raws, err := listAll[oktaUserRaw](o, "/api/v1/users", query)
+	if err != nil {
+		return nil, err
+	}
+	for i := range raws {
+		users = append(users, &oktaUser{okta: o, raw: &raws[i]})
+	}
+	return users, nil
+}
+
+func (o *okta) getUser(id string) (*oktaUser, error) {
+	raw := new(oktaUserRaw)
+	if _, err := o.call(http.MethodGet, "/api/v1/users/"+url.PathEscape(id), nil, nil, raw); err != nil {
+		return nil, err
+	}
+	return &oktaUser{okta: o, raw: raw}, nil
+}
+
+func (o *okta) getGroup(id string) (*oktaGroup, error) {
+	raw := new(oktaGroupRaw)
+	if _, err := o.call(http.MethodGet, "/api/v1/groups/"+url.PathEscape(id), nil, nil, raw); err != nil {
+		return nil, err
+	}
+	return &oktaGroup{okta: o, raw: raw}, nil
+}
+
+func (o *okta) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	return o.getUser(internalExtID.GetEntryID())
+}
+
+func (o *okta) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	if internalExtID.GetEntryID() == oktaRootID {
+		return o.GetRootDepartment()
+	}
+	group, err := o.getGroup(internalExtID.GetEntryID())
+	if isOktaStatus(err, http.StatusNotFound) {
+		return nil, NotFound(err)
+	}
+	return group, err
+}
+
+// groupRules lists the group rules, they are only read to keep rule
+// managed memberships out of reach of the manager.
+func (o *okta) groupRules() ([]oktaGroupRule, error) {
+	return listAll[oktaGroupRule](o, "/api/v1/groups/rules", nil)
+}
+
+// activeRulesOf returns the names of the active rules assigning to group.
+func (o *okta) activeRulesOf(groupID string) (names []string, err error) {
+	rules, err := o.groupRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Status == oktaStatusActive && lo.Contains(rule.Actions.AssignUserToGroups.GroupIDs, groupID) {
+			names = append(names, rule.Name)
+		}
+	}
+	return names, nil
+}
+
+// LookupUser matches the email or login of user, it returns nil without
+// error when nobody matches.
+func (o *okta) LookupUser(user Userable) (UserableEntry, error) {
+	email := user.GetEmail()
+	if email == "" {
+		return nil, nil
+	}
+	search := fmt.Sprintf("profile.email eq %s or profile.login eq %s", searchString(email), searchString(email))
+	users, err := o.listUsers(url.Values{"search": {search}})
+	if err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, nil
+	case 1:
+		return users[0], nil
+	default:
+		return nil, fmt.Errorf("%d okta users matched %s", len(users), email)
+	}
+}
+
+// CreateUser uses the email as login and keeps the extID of user in the
+// extID attribute when it comes from another target.
+func (o *okta) CreateUser(user Userable) (UserableEntry, error) {
+	if user.GetEmail() == "" {
+		return nil, errors.New("okta users need an email as login")
+	}
+	firstName, lastName := splitName(user.GetName())
+	profile := map[string]any{
+		"login":     user.GetEmail(),
+		"email":     user.GetEmail(),
+		"firstName": firstName,
+		"lastName":  lastName,
+	}
+	if phone := user.GetPhone(); phone != "" {
+		profile["mobilePhone"] = phone
+	}
+	if entry, ok := user.(UserableEntry); ok {
+		if extID := ExternalIdentityOfEntry(entry); extID.CheckIfInternal(o) != nil {
+			profile[o.config.ExtIDAttribute] = []string{string(extID)}
+		}
+	}
+	query := url.Values{"activate": {strconv.FormatBool(!o.config.CreateStaged)}}
+	created := new(oktaUserRaw)
+	if _, err := o.call(http.MethodPost, "/api/v1/users", query, oktaUserRaw{Profile: profile}, created); err != nil {
+		return nil, err
+	}
+	return &oktaUser{okta: o, raw: created}, nil
+}
+
+// splitName puts single word names in both firstName and lastName, which
+// the default Okta profile requires.
+func splitName(name string) (firstName, lastName string) {
+	name = strings.TrimSpace(name)
+	if i := strings.LastIndex(name, " "); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, name
+}
+
+// UpdateUser partially updates the profile, empty fields of user are left
+// as they are.
+func (o *okta) UpdateUser(extID ExternalIdentity, user Userable) (UserableEntry, error) {
+	if err := extID.CheckIfInternal(o); err != nil {
+		return nil, err
+	}
+	profile := make(map[string]any)
+	if name := user.GetName(); name != "" {
+		profile["firstName"], profile["lastName"] = splitName(name)
+	}
+	if email := user.GetEmail(); email != "" {
+		profile["email"] = email
+	}
+	if phone := user.GetPhone(); phone != "" {
+		profile["mobilePhone"] = phone
+	}
+	updated := new(oktaUserRaw)
+	if _, err := o.call(http.MethodPost, "/api/v1/users/"+url.PathEscape(extID.GetEntryID()), nil, oktaUserRaw{Profile: profile}, updated); err != nil {
+		return nil, err
+	}
+	return &oktaUser{okta: o, raw: updated}, nil
+}
+
+// DeleteUser deactivates the user first, Okta only deletes deprovisioned
+// users.
+func (o *okta) DeleteUser(extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(o); err != nil {
+		return err
+	}
+	user, err := o.getUser(extID.GetEntryID())
+	if err != nil {
+		return err
+	}
+	if user.raw.Status != oktaStatusDeprovisioned {
+		if err := o.lifecycle(user.raw.ID, "deactivate"); err != nil {
+			return err
+		}
+	}
+	_, err = o.call(http.MethodDelete, "/api/v1/users/"+url.PathEscape(user.raw.ID), nil, nil, nil)
+	return err
+}
+
+// ActivateUser activates staged and deprovisioned users and unsuspends
+// suspended ones, without sending the activation email.
+func (o *okta) ActivateUser(extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(o); err != nil {
+		return err
+	}
+	user, err := o.getUser(extID.GetEntryID())
+	if err != nil {
+		return err
+	}
+	switch user.raw.Status {
+	case oktaStatusActive:
+		return nil
+	case oktaStatusSuspended:
+		return o.lifecycle(user.raw.ID, "unsuspend")
+	default:
+		return o.lifecycle(user.raw.ID, "activate")
+	}
+}
+
+func (o *okta) DeactivateUser(extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(o); err != nil {
+		return err
+	}
+	user, err := o.getUser(extID.GetEntryID())
+	if err != nil {
+		return err
+	}
+	if user.raw.Status == oktaStatusDeprovisioned {
+		return nil
+	}
+	return o.lifecycle(user.raw.ID, "deactivate")
+}
+
+func (o *okta) lifecycle(userID, operation string) error {
+	_, err := o.call(http.MethodPost, "/api/v1/users/"+url.PathEscape(userID)+"/lifecycle/"+operation, url.Values{"sendEmail": {"false"}}, nil, nil)
+	return err
+}
+
+func (o *okta) LookupEntryByExternalIdentity(extID ExternalIdentity) (Entry, error) {
+	switch extID.GetEntryType() {
+	case EntryTypeUser:
+		return o.LookupEntryUserByExternalIdentity(extID)
+	case EntryTypeDept:
+		return o.LookupEntryDepartmentByExternalIdentity(extID)
+	default:
+		return nil, errors.New("unsupported entry type")
+	}
+}
+
+// LookupEntryUserByExternalIdentity searches the extID attribute, internal
+// extIDs are looked up by id.
+func (o *okta) LookupEntryUserByExternalIdentity(extID ExternalIdentity) (UserEntryExtIDStoreable, error) {
+	if extID.CheckIfInternal(o) == nil {
+		return o.getUser(extID.GetEntryID())
+	}
+	search := fmt.Sprintf("profile.%s eq %s", o.config.ExtIDAttribute, searchString(string(extID)))
+	raws, err := listAll[oktaUserRaw](o, "/api/v1/users", url.Values{"search": {search}})
+	if err != nil {
+		return nil, err
+	}
+	if len(raws) != 1 {
+		return nil, fmt.Errorf("%d okta users linked to %s", len(raws), extID)
+	}
+	return &oktaUser{okta: o, raw: &raws[0]}, nil
+}
+
+func (o *okta) LookupEntryDepartmentByExternalIdentity(extID ExternalIdentity) (DepartmentEntryExtIDStoreable, error) {
+	if extID.CheckIfInternal(o) == nil {
+		if extID.GetEntryID() == oktaRootID {
+			return nil, fmt.Errorf("%w: okta root department cannot store extIDs", ErrNotSupported)
+		}
+		return o.getGroup(extID.GetEntryID())
+	}
+	search := fmt.Sprintf("profile.%s eq %s", o.config.ExtIDAttribute, searchString(string(extID)))
+	raws, err := listAll[oktaGroupRaw](o, "/api/v1/groups", url.Values{"search": {search}})
+	if err != nil {
+		return nil, err
+	}
+	if len(raws) != 1 {
+		return nil, fmt.Errorf("%d okta groups linked to %s", len(raws), extID)
+	}
+	return &oktaGroup{okta: o, raw: &raws[0]}, nil
+}
+
+type oktaUser struct {
+	*okta
+	raw *oktaUserRaw
+}
+
+func (u *oktaUser) GetTarget() Target {
+	return u.okta
+}
+
+func (u oktaUser) GetID() string {
+	return u.raw.ID
+}
+
+func (u oktaUser) GetName() string {
+	if name := profileString(u.raw.Profile, "displayName"); name != "" {
+		return name
+	}
+	if name := strings.TrimSpace(profileString(u.raw.Profile, "firstName") + " " + profileString(u.raw.Profile, "lastName")); name != "" {
+		return name
+	}
+	return profileString(u.raw.Profile, "login")
+}
+
+func (u oktaUser) GetEmail() string {
+	return profileString(u.raw.Profile, "email")
+}
+
+// GetEmails adds the login when it is an address of its own.
+func (u oktaUser) GetEmails() []string {
+	emails := []string{u.GetEmail()}
+	if login := profileString(u.raw.Profile, "login"); strings.Contains(login, "@") {
+		emails = append(emails, login)
+	}
+	return lo.Uniq(lo.Compact(emails))
+}
+
+func (u oktaUser) GetPhone() string {
+	return profileString(u.raw.Profile, "mobilePhone")
+}
+
+func (u oktaUser) GetPhones() []string {
+	return lo.Uniq(lo.Compact([]string{u.GetPhone(), profileString(u.raw.Profile, "primaryPhone")}))
+}
+
+// GetStatus is the Okta lifecycle status, like ACTIVE or SUSPENDED.
+func (u oktaUser) GetStatus() string {
+	return u.raw.Status
+}
+
+func (u oktaUser) GetExternalIdentities() ExternalIdentities {
+	return ExternalIdentitiesFromStringList(profileStrings(u.raw.Profile, u.config.ExtIDAttribute))
+}
+
+func (u *oktaUser) SetExternalIdentities(extIDs ExternalIdentities) error {
+	profile := map[string]any{u.config.ExtIDAttribute: lo.Uniq(extIDs.StringList())}
+	updated := new(oktaUserRaw)
+	if _, err := u.call(http.MethodPost, "/api/v1/users/"+url.PathEscape(u.raw.ID), nil, oktaUserRaw{Profile: profile}, updated); err != nil {
+		return err
+	}
+	u.raw = updated
+	return nil
+}
+
+// oktaGroup is an Okta group, raw is nil for the synthetic root.
+type oktaGroup struct {
+	*okta
+	raw *oktaGroupRaw
+}
+
+func (g *oktaGroup) GetTarget() Target {
+	return g.okta
+}
+
+func (g oktaGroup) GetID() string {
+	if g.raw == nil {
+		return oktaRootID
+	}
+	return g.raw.ID
+}
+
+func (g oktaGroup) GetName() string {
+	if g.raw == nil {
+		return g.config.Slug
+	}
+	return profileString(g.raw.Profile, "name")
+}
+
+func (g oktaGroup) GetDescription() string {
+	if g.raw == nil {
+		return ""
+	}
+	return profileString(g.raw.Profile, "description")
+}
+
+// GetChildDepartments lists every group under the root, groups have no
+// children of their own.
+func (g oktaGroup) GetChildDepartments() (departments []DepartmentableEntry) {
+	if g.raw != nil {
+		return departments
+	}
+	raws, err := listAll[oktaGroupRaw](g.okta, "/api/v1/groups", nil)
+	if err != nil {
+		g.logger.WithError(err).Error("list okta groups failed")
+		return departments
+	}
+	for i := range raws {
+		departments = append(departments, &oktaGroup{okta: g.okta, raw: &raws[i]})
+	}
+	return departments
+}
+
+func (g oktaGroup) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	if g.raw != nil {
+		return nil, fmt.Errorf("%w: okta groups are flat, create %s under the root", ErrNotSupported, department.GetName())
+	}
+	profile := map[string]any{
+		"name":        department.GetName(),
+		"description": department.GetDescription(),
+	}
+	if entry, ok := department.(DepartmentableEntry); ok {
+		if extID := ExternalIdentityOfEntry(entry); extID.CheckIfInternal(g.okta) != nil {
+			profile[g.config.ExtIDAttribute] = []string{string(extID)}
+		}
+	}
+	created := new(oktaGroupRaw)
+	if _, err := g.call(http.MethodPost, "/api/v1/groups", nil, oktaGroupRaw{Profile: profile}, created); err != nil {
+		return nil, err
+	}
+	return &oktaGroup{okta: g.okta, raw: created}, nil
+}
+
+// GetUsers returns the members of the group, the synthetic root has none
+// of its own.
+func (g oktaGroup) GetUsers() (users []UserableEntry, err error) {
+	if g.raw == nil {
+		return nil, nil
+	}
+	raws, err := listAll[oktaUserRaw](g.okta, "/api/v1/groups/"+url.PathEscape(g.raw.ID)+"/users", nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range raws {
+		users = append(users, &oktaUser{okta: g.okta, raw: &raws[i]})
+	}
+	return users, nil
+}
+
+// GetRules names the active group rules assigning users to the group.
+func (g oktaGroup) GetRules() ([]string, error) {
+	if g.raw == nil {
+		return nil, nil
+	}
+	return g.activeRulesOf(g.raw.ID)
+}
+
+// AddToDepartment ignores the role, Okta group members have none.
+func (g oktaGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if err := g.checkMembershipWritable(extID); err != nil {
+		return err
+	}
+	_, err := g.call(http.MethodPut, g.memberPath(extID), nil, nil, nil)
+	return err
+}
+
+// RemoveFromDepartment refuses groups fed by an active group rule, Okta
+// would add the user back on the next evaluation.
+func (g oktaGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if err := g.checkMembershipWritable(extID); err != nil {
+		return err
+	}
+	rules, err := g.activeRulesOf(g.raw.ID)
+	if err != nil {
+		return err
+	}
+	if len(rules) != 0 {
+		return fmt.Errorf("%w: okta group %s is managed by group rules %s", ErrNotSupported, g.GetName(), strings.Join(rules, ", "))
+	}
+	_, err = g.call(http.MethodDelete, g.memberPath(extID), nil, nil, nil)
+	if isOktaStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (g oktaGroup) checkMembershipWritable(extID ExternalIdentity) error {
+	if g.raw == nil {
+		return fmt.Errorf("%w: okta root department has no members", ErrNotSupported)
+	}
+	if g.raw.Type != "" && g.raw.Type != oktaGroupTypeOkta {
+		return fmt.Errorf("%w: okta %s group %s is managed outside okta", ErrNotSupported, g.raw.Type, g.GetName())
+	}
+	return extID.CheckIfInternal(g.okta)
+}
+
+func (g oktaGroup) memberPath(extID ExternalIdentity) string {
+	return "/api/v1/groups/" + url.PathEscape(g.raw.ID) + "/users/" + url.PathEscape(extID.GetEntryID())
+}
+
+func (g oktaGroup) GetExternalIdentities() ExternalIdentities {
+	if g.raw == nil {
+		return nil
+	}
+	return ExternalIdentitiesFromStringList(profileStrings(g.raw.Profile, g.config.ExtIDAttribute))
+}
+
+// SetExternalIdentities replaces the whole profile, the group API has no
+// partial update.
+func (g *oktaGroup) SetExternalIdentities(extIDs ExternalIdentities) error {
+	if g.raw == nil {
+		return fmt.Errorf("%w: okta root department cannot store extIDs", ErrNotSupported)
+	}
+	profile := copyProfile(g.raw.Profile)
+	profile[g.config.ExtIDAttribute] = lo.Uniq(extIDs.StringList())
+	updated := new(oktaGroupRaw)
+	if _, err := g.call(http.MethodPut, "/api/v1/groups/"+url.PathEscape(g.raw.ID), nil, oktaGroupRaw{Profile: profile}, updated); err != nil {
+		return err
+	}
+	g.raw = updated
+	return nil
+}
@@ -0,0 +1,218 @@
+package okta
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+// oktaStub answers the management API from a few fixed users and groups.
+// Every request is logged as "METHOD path?query".
+type oktaStub struct {
+	mu       sync.Mutex
+	requests []string
+	arrived  []time.Time
+	// resetIn makes the first response of a bucket say it is spent and
+	// resets that long after.
+	resetIn time.Duration
+	users   []oktaUserRaw
+	members map[string][]string
+}
+
+func newOktaStub() *oktaStub {
+	stub := &oktaStub{members: map[string][]string{"g1": {"00u1", "00u2"}, "g2": {"00u3"}}}
+	for i, name := range []string{"Ada Lovelace", "Grace Hopper", "Alan Turing", "Edsger Dijkstra", "Barbara Liskov"} {
+		login := strings.ToLower(strings.Fields(name)[1]) + "@example.com"
+		first, last := splitName(name)
+		stub.users = append(stub.users, oktaUserRaw{ID: "00u" + strconv.Itoa(i+1), Status: oktaStatusActive, Profile: map[string]any{
+			"login": login, "email": login, "firstName": first, "lastName": last,
+		}})
+	}
+	return stub
+}
+
+func (s *oktaStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request := r.Method + " " + r.URL.Path
+	if r.URL.RawQuery != "" {
+		request += "?" + r.URL.RawQuery
+	}
+	s.requests = append(s.requests, request)
+	s.arrived = append(s.arrived, time.Now())
+	if r.Header.Get("Authorization") != "SSWS test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.resetIn > 0 {
+		w.Header().Set("X-Rate-Limit-Remaining", "0")
+		w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(s.resetIn).Unix(), 10))
+		s.resetIn = 0
+	}
+	query := r.URL.Query()
+	switch path := strings.TrimPrefix(r.URL.Path, "/api/v1/"); {
+	case path == "users" && query.Get("search") != "":
+		email := strings.Trim(strings.SplitN(query.Get("search"), " ", 4)[2], `"`)
+		s.reply(w, lo.Filter(s.users, func(user oktaUserRaw, _ int) bool { return user.Profile["email"] == email }))
+	case path == "users":
+		// cursors are the id of the last user of the page before, like Okta
+		after := lo.IndexOf(lo.Map(s.users, func(user oktaUserRaw, _ int) string { return user.ID }), query.Get("after")) + 1
+		page := lo.Subset(s.users, after, 2)
+		if after+len(page) < len(s.users) {
+			self := "http://" + r.Host + r.URL.RequestURI()
+			next := "http://" + r.Host + "/api/v1/users?after=" + page[len(page)-1].ID + "&limit=2"
+			w.Header().Set("Link", "<"+self+`>; rel="self", <`+next+`>; rel="next"`)
+		}
+		s.reply(w, page)
+	case path == "groups":
+		s.reply(w, []oktaGroupRaw{
+			{ID: "g1", Type: oktaGroupTypeOkta, Profile: map[string]any{"name": "Engineering"}},
+			{ID: "g2", Type: oktaGroupTypeOkta, Profile: map[string]any{"name": "Sales"}},
+			{ID: "g3", Type: "APP_GROUP", Profile: map[string]any{"name": "Synced from AD"}},
+		})
+	case path == "groups/rules":
+		rule := oktaGroupRule{Name: "sales by department", Status: oktaStatusActive}
+		rule.Actions.AssignUserToGroups.GroupIDs = []string{"g2"}
+		s.reply(w, []oktaGroupRule{rule})
+	case strings.HasPrefix(path, "users/") && r.Method == http.MethodGet:
+		user, _ := lo.Find(s.users, func(user oktaUserRaw) bool { return user.ID == strings.TrimPrefix(path, "users/") })
+		s.reply(w, user)
+	case strings.HasPrefix(path, "groups/") && r.Method == http.MethodDelete:
+		parts := strings.Split(path, "/")
+		if !lo.Contains(s.members[parts[1]], parts[3]) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errorCode":"E0000007","errorSummary":"Not found: Resource not found: ` + parts[3] + ` (User)"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *oktaStub) reply(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// writes are the requests that are not reads.
+func (s *oktaStub) writes() []string {
+	return lo.Reject(s.requests, func(request string, _ int) bool { return strings.HasPrefix(request, "GET ") })
+}
+
+func newStubbedOkta(t *testing.T, stub *oktaStub) *okta {
+	t.Helper()
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	o := &okta{logger: Log}
+	_, err := o.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"okta","Slug":"corp","OrgURL":"`+server.URL+`/","Token":"test-token","PageSize":2}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOktaFollowsNextLinksVerbatim(t *testing.T) {
+	stub := newOktaStub()
+	o := newStubbedOkta(t, stub)
+	users, err := o.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := lo.Map(users, func(user UserableEntry, _ int) string { return user.GetName() })
+	if strings.Join(names, ", ") != "Ada Lovelace, Grace Hopper, Alan Turing, Edsger Dijkstra, Barbara Liskov" {
+		t.Errorf("got users %v", names)
+	}
+	// limit goes on the first page only, the next links carry the cursor
+	want := []string{"GET /api/v1/users?limit=2", "GET /api/v1/users?after=00u2&limit=2", "GET /api/v1/users?after=00u4&limit=2"}
+	if strings.Join(stub.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests %q, want %q", stub.requests, want)
+	}
+}
+
+func TestOktaWaitsForSpentRateLimitToReset(t *testing.T) {
+	stub := newOktaStub()
+	stub.resetIn = time.Second
+	o := newStubbedOkta(t, stub)
+	if _, err := o.GetAllUsers(); err != nil {
+		t.Fatal(err)
+	}
+	reset := o.rateLimits[rateLimitBucket(http.MethodGet, "/api/v1/users")].reset
+	if stub.arrived[1].Before(reset) {
+		t.Errorf("second page asked at %v, before the reset at %v", stub.arrived[1], reset)
+	}
+	if rateLimitBucket(http.MethodGet, "/api/v1/users/00u1") == rateLimitBucket(http.MethodGet, "/api/v1/users") {
+		t.Error("single users share the bucket of the user list")
+	}
+}
+
+func TestOktaLookupUserQuotesSearch(t *testing.T) {
+	stub := newOktaStub()
+	o := newStubbedOkta(t, stub)
+	found, err := o.LookupUser(User{Email: "hopper@example.com"})
+	if err != nil || found == nil || found.GetID() != "00u2" {
+		t.Fatalf("lookup found %v, %v, want 00u2", found, err)
+	}
+	missing, err := o.LookupUser(User{Email: `o"brien@example.com`})
+	if err != nil || missing != nil {
+		t.Errorf("lookup of an unknown email found %v, %v, want nothing", missing, err)
+	}
+	if search := stub.requests[1]; !strings.Contains(search, `search=profile.email+eq+%22o%5C%22brien%40example.com%22`) {
+		t.Errorf("quote not escaped in %s", search)
+	}
+}
+
+func TestOktaMembershipRespectsRulesAndGroupTypes(t *testing.T) {
+	stub := newOktaStub()
+	o := newStubbedOkta(t, stub)
+	root, _ := o.GetRootDepartment()
+	groups := lo.KeyBy(root.GetChildDepartments(), func(group DepartmentableEntry) string { return group.GetID() })
+	extID := func(id string) ExternalIdentity { return ExternalIdentity("ei.user." + id + "@corp.okta") }
+	options := DepartmentModifyUserOptions{}
+
+	if err := groups["g1"].(DepartmentUserWriter).AddToDepartment(options, extID("00u5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := groups["g1"].(DepartmentUserWriter).RemoveFromDepartment(options, extID("00u2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := groups["g1"].(DepartmentUserWriter).RemoveFromDepartment(options, extID("00u4")); err != nil {
+		t.Errorf("removing a user who is no member returned %v", err)
+	}
+	if err := groups["g2"].(DepartmentUserWriter).RemoveFromDepartment(options, extID("00u3")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("removing from the rule fed g2 returned %v, want ErrNotSupported", err)
+	}
+	if err := groups["g3"].(DepartmentUserWriter).AddToDepartment(options, extID("00u5")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("adding to the app group g3 returned %v, want ErrNotSupported", err)
+	}
+	if err := root.(DepartmentUserWriter).AddToDepartment(options, extID("00u5")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("adding to the root returned %v, want ErrNotSupported", err)
+	}
+	want := []string{"PUT /api/v1/groups/g1/users/00u5", "DELETE /api/v1/groups/g1/users/00u2", "DELETE /api/v1/groups/g1/users/00u4"}
+	if got := stub.writes(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got writes %q, want %q", got, want)
+	}
+}
+
+func TestOktaDeleteUserDeactivatesFirst(t *testing.T) {
+	stub := newOktaStub()
+	o := newStubbedOkta(t, stub)
+	if err := o.DeleteUser("ei.user.00u3@corp.okta"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"POST /api/v1/users/00u3/lifecycle/deactivate?sendEmail=false", "DELETE /api/v1/users/00u3"}
+	if got := stub.writes(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got writes %q, want %q", got, want)
+	}
+}
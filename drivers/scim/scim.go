@@ -0,0 +1,530 @@
+package scim
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/org-tools/manager"
+	schema "github.com/org-tools/manager/scim"
+)
+
+const (
+	scimDefaultPageSize = 100
+	scimDefaultTimeout  = 30 * time.Second
+	// scimRootID is the synthetic root department, SCIM has no org root so
+	// groups without a parent hang under it.
+	scimRootID = "root"
+)
+
+// scimTarget talks SCIM 2.0 to a downstream app, Groups are departments
+// nested through the parent of the hierarchy extension when the server
+// keeps it, flat under the root otherwise.
+type scimTarget struct {
+	client *http.Client
+	config *scimConfig
+	logger Logger
+}
+
+func init() {
+	RegisterPlatform("scim", &scimTarget{})
+}
+
+type scimConfig struct {
+	Platform string
+	Slug     string
+	// BaseURL is the SCIM base, like https://api.example.com/scim/v2.
+	BaseURL            string
+	Token              string
+	Timeout            time.Duration
+	InsecureSkipVerify bool
+	PageSize           int
+	// RootName names the synthetic root department.
+	RootName string
+}
+
+func (s *scimTarget) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// SetHTTPClient replaces the client built from the config, for proxies,
+// custom transports or a stand-in server in tests.
+func (s *scimTarget) SetHTTPClient(client *http.Client) {
+	s.client = client
+}
+
+func (s *scimTarget) GetTarget() Target {
+	return s
+}
+
+func (s scimTarget) GetTargetSlug() string {
+	return s.config.Slug
+}
+
+func (s scimTarget) GetPlatform() string {
+	return s.config.Platform
+}
+
+func (s *scimTarget) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	if err := unmarshaler(&s.config); err != nil {
+		return nil, err
+	}
+	if s.config.BaseURL == "" {
+		return nil, errors.New("scim baseurl is required")
+	}
+	s.config.BaseURL = strings.TrimRight(s.config.BaseURL, "/")
+	if s.config.Timeout <= 0 {
+		s.config.Timeout = scimDefaultTimeout
+	}
+	if s.config.PageSize <= 0 {
+		s.config.PageSize = scimDefaultPageSize
+	}
+	if s.config.RootName == "" {
+		s.config.RootName = s.config.Slug
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if s.config.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		s.logger.Warn("scim tls verification disabled")
+	}
+	s.client = &http.Client{Transport: transport, Timeout: s.config.Timeout}
+	return s, nil
+}
+
+// do sends a SCIM request, errors keep the status and headers so the
+// retry decorator can classify them.
+func (s *scimTarget) do(method, path string, query url.Values, body, out any) error {
+	endpoint := s.config.BaseURL + path
+	if len(query) != 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", schema.ContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", schema.ContentType)
+	}
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	s.logger.WithField("method", method).WithField("path", path).WithField("status", resp.StatusCode).Debug("scim call")
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		httpErr := NewHTTPError(resp, raw)
+		var scimErr schema.Error
+		if json.Unmarshal(raw, &scimErr) == nil && scimErr.Detail != "" {
+			httpErr.Body = scimErr.Detail
+		}
+		return httpErr
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// listAll pages through a list endpoint with startIndex and count.
+func listAll[T any](s *scimTarget, path string, query url.Values) (resources []T, err error) {
+	if query == nil {
+		query = make(url.Values)
+	}
+	query.Set("count", strconv.Itoa(s.config.PageSize))
+	for startIndex := 1; ; {
+		query.Set("startIndex", strconv.Itoa(startIndex))
+		page := new(schema.ListResponse[T])
+		if err := s.do(http.MethodGet, path, query, nil, page); err != nil {
+			return nil, err
+		}
+		resources = append(resources, page.Resources...)
+		startIndex += len(page.Resources)
+		if len(page.Resources) == 0 || startIndex > page.TotalResults {
+			return resources, nil
+		}
+	}
+}
+
+func resourcePath(resource, id string) string {
+	return "/" + resource + "/" + url.PathEscape(id)
+}
+
+func (s *scimTarget) GetRootDepartment() (DepartmentableEntry, error) {
+	return &scimGroup{scimTarget: s, walk: new(scimWalk)}, nil
+}
+
+// scimWalk lists the groups and users once for all groups reached from one
+// root, SCIM can neither filter groups on their parent nor list the users
+// of a group. Listings that failed are tried again by the next caller.
+type scimWalk struct {
+	mu     sync.Mutex
+	groups []schema.Group
+	users  map[string]*schema.User
+}
+
+func (w *scimWalk) listGroups(s *scimTarget) ([]schema.Group, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.groups == nil {
+		groups, err := listAll[schema.Group](s, "/Groups", url.Values{"excludedAttributes": {"members"}})
+		if err != nil {
+			return nil, err
+		}
+		w.groups = append(make([]schema.Group, 0, len(groups)), groups...)
+	}
+	return w.groups, nil
+}
+
+// addGroup keeps groups created during the walk in its listing.
+func (w *scimWalk) addGroup(group schema.Group) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.groups != nil {
+		w.groups = append(w.groups, group)
+	}
+}
+
+func (w *scimWalk) listUsers(s *scimTarget) (map[string]*schema.User, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.users == nil {
+		users, err := listAll[schema.User](s, "/Users", nil)
+		if err != nil {
+			return nil, err
+		}
+		w.users = make(map[string]*schema.User, len(users))
+		for i := range users {
+			w.users[users[i].ID] = &users[i]
+		}
+	}
+	return w.users, nil
+}
+
+func (s *scimTarget) GetAllUsers() (users []UserableEntry, err error) {
+	scimUsers, err := listAll[schema.User](s, "/Users", nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range scimUsers {
+		users = append(users, &scimUser{scimTarget: s, raw: &scimUsers[i]})
+	}
+	return users, nil
+}
+
+func (s *scimTarget) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	return s.lookupSCIMUserByInternalExternalIdentity(internalExtID)
+}
+
+func (s *scimTarget) lookupSCIMUserByInternalExternalIdentity(internalExtID ExternalIdentity) (*scimUser, error) {
+	user := new(schema.User)
+	if err := s.do(http.MethodGet, resourcePath("Users", internalExtID.GetEntryID()), nil, nil, user); err != nil {
+		return nil, err
+	}
+	return &scimUser{scimTarget: s, raw: user}, nil
+}
+
+func (s *scimTarget) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	if internalExtID.GetEntryID() == scimRootID {
+		return s.GetRootDepartment()
+	}
+	group := new(schema.Group)
+	err := s.do(http.MethodGet, resourcePath("Groups", internalExtID.GetEntryID()), nil, nil, group)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.Status == http.StatusNotFound {
+		return nil, NotFound(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &scimGroup{scimTarget: s, raw: group, walk: new(scimWalk)}, nil
+}
+
+// CreateUser sets externalId to the extID of user when it comes from
+// another target, so the downstream app can tell where it came from.
+func (s *scimTarget) CreateUser(user Userable) (UserableEntry, error) {
+	resource := schema.User{
+		Schemas:     []string{schema.SchemaUser},
+		UserName:    user.GetEmail(),
+		DisplayName: user.GetName(),
+		Name:        &schema.Name{Formatted: user.GetName()},
+	}
+	if resource.UserName == "" {
+		resource.UserName = user.GetName()
+	}
+	for _, email := range GetUserableEmails(user) {
+		if email != "" {
+			resource.Emails = append(resource.Emails, schema.MultiValued{Value: email, Type: "work", Primary: email == user.GetEmail()})
+		}
+	}
+	for _, phone := range GetUserablePhones(user) {
+		if phone != "" {
+			resource.PhoneNumbers = append(resource.PhoneNumbers, schema.MultiValued{Value: phone, Type: "work", Primary: phone == user.GetPhone()})
+		}
+	}
+	if entry, ok := user.(UserableEntry); ok {
+		resource.ExternalID = string(ExternalIdentityOfEntry(entry))
+	}
+	created := new(schema.User)
+	if err := s.do(http.MethodPost, "/Users", nil, resource, created); err != nil {
+		return nil, err
+	}
+	return &scimUser{scimTarget: s, raw: created}, nil
+}
+
+// LookupUser matches userName or emails against the email of user, then
+// the name, it returns nil without error when nobody matches.
+func (s *scimTarget) LookupUser(user Userable) (UserableEntry, error) {
+	var filters []string
+	if email := user.GetEmail(); email != "" {
+		filters = append(filters, fmt.Sprintf("userName eq %s", filterString(email)),
+			fmt.Sprintf("emails.value eq %s", filterString(email)))
+	}
+	if name := user.GetName(); name != "" {
+		filters = append(filters, fmt.Sprintf("userName eq %s", filterString(name)))
+	}
+	for _, filter := range filters {
+		users, err := listAll[schema.User](s, "/Users", url.Values{"filter": {filter}})
+		if err != nil {
+			return nil, err
+		}
+		switch len(users) {
+		case 0:
+			continue
+		case 1:
+			return &scimUser{scimTarget: s, raw: &users[0]}, nil
+		default:
+			return nil, fmt.Errorf("%d users matched %s", len(users), filter)
+		}
+	}
+	return nil, nil
+}
+
+func filterString(value string) string {
+	raw, _ := json.Marshal(value)
+	return string(raw)
+}
+
+type scimUser struct {
+	*scimTarget
+	raw *schema.User
+}
+
+func (u *scimUser) GetTarget() Target {
+	return u.scimTarget
+}
+
+func (u scimUser) GetID() string {
+	return u.raw.ID
+}
+
+func (u scimUser) GetName() string {
+	return u.raw.GetName()
+}
+
+// GetEmail falls back to userName, which most apps set to the email.
+func (u scimUser) GetEmail() string {
+	if email := u.raw.GetEmail(); email != "" {
+		return email
+	}
+	if strings.Contains(u.raw.UserName, "@") {
+		return u.raw.UserName
+	}
+	return ""
+}
+
+func (u scimUser) GetEmails() []string {
+	if emails := u.raw.GetEmails(); len(emails) != 0 {
+		return emails
+	}
+	if email := u.GetEmail(); email != "" {
+		return []string{email}
+	}
+	return nil
+}
+
+func (u scimUser) GetPhone() string {
+	return u.raw.GetPhone()
+}
+
+func (u scimUser) GetPhones() []string {
+	return u.raw.GetPhones()
+}
+
+// scimGroup is a SCIM Group, raw is nil for the synthetic root. Groups
+// reached from one root share its walk.
+type scimGroup struct {
+	*scimTarget
+	raw  *schema.Group
+	walk *scimWalk
+}
+
+func (g *scimGroup) GetTarget() Target {
+	return g.scimTarget
+}
+
+func (g scimGroup) GetID() string {
+	if g.raw == nil {
+		return scimRootID
+	}
+	return g.raw.ID
+}
+
+func (g scimGroup) GetName() string {
+	if g.raw == nil {
+		return g.config.RootName
+	}
+	return g.raw.DisplayName
+}
+
+func (g scimGroup) GetDescription() string {
+	if g.raw == nil {
+		return ""
+	}
+	return g.raw.GetDescription()
+}
+
+func (g scimGroup) parentID() string {
+	if g.raw == nil || g.raw.Hierarchy == nil || g.raw.Hierarchy.Parent == nil || g.raw.Hierarchy.Parent.Value == "" {
+		return scimRootID
+	}
+	return g.raw.Hierarchy.Parent.Value
+}
+
+// GetChildDepartments picks the children out of the groups of the walk,
+// groups whose parent is unknown are treated as top level.
+func (g scimGroup) GetChildDepartments() (departments []DepartmentableEntry) {
+	groups, err := g.walk.listGroups(g.scimTarget)
+	if err != nil {
+		g.logger.WithError(err).Error("list groups failed")
+		return departments
+	}
+	ids := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		ids[group.ID] = true
+	}
+	for i := range groups {
+		child := scimGroup{scimTarget: g.scimTarget, raw: &groups[i], walk: g.walk}
+		parentID := child.parentID()
+		if !ids[parentID] {
+			parentID = scimRootID
+		}
+		if parentID == g.GetID() {
+			departments = append(departments, &child)
+		}
+	}
+	return departments
+}
+
+func (g scimGroup) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	resource := schema.Group{
+		Schemas:     []string{schema.SchemaGroup},
+		DisplayName: department.GetName(),
+	}
+	if g.raw != nil || department.GetDescription() != "" {
+		resource.Schemas = append(resource.Schemas, schema.SchemaGroupHierarchy)
+		resource.Hierarchy = &schema.GroupHierarchy{Description: department.GetDescription()}
+		if g.raw != nil {
+			resource.Hierarchy.Parent = &schema.MultiValued{Value: g.raw.ID}
+		}
+	}
+	created := new(schema.Group)
+	if err := g.do(http.MethodPost, "/Groups", nil, resource, created); err != nil {
+		return nil, err
+	}
+	g.walk.addGroup(*created)
+	return &scimGroup{scimTarget: g.scimTarget, raw: created, walk: g.walk}, nil
+}
+
+// GetUsers reads the members of the group and resolves them against the
+// users of the walk, members that are groups are skipped. Users created
+// after the walk listed them are read one by one.
+func (g scimGroup) GetUsers() (users []UserableEntry, err error) {
+	if g.raw == nil {
+		return nil, nil
+	}
+	group := new(schema.Group)
+	if err := g.do(http.MethodGet, resourcePath("Groups", g.raw.ID), nil, nil, group); err != nil {
+		return nil, err
+	}
+	if len(group.Members) == 0 {
+		return nil, nil
+	}
+	byID, err := g.walk.listUsers(g.scimTarget)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range group.Members {
+		if strings.EqualFold(member.Type, "Group") {
+			continue
+		}
+		if user, ok := byID[member.Value]; ok {
+			users = append(users, &scimUser{scimTarget: g.scimTarget, raw: user})
+			continue
+		}
+		user := new(schema.User)
+		err := g.do(http.MethodGet, resourcePath("Users", member.Value), nil, nil, user)
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.Status == http.StatusNotFound {
+			// a group member of a server leaving out the type
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &scimUser{scimTarget: g.scimTarget, raw: user})
+	}
+	return users, nil
+}
+
+// AddToDepartment ignores the role, SCIM groups have none.
+func (g scimGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if g.raw == nil {
+		return errors.New("cannot add user to the synthetic root")
+	}
+	if err := extID.CheckIfInternal(g.scimTarget); err != nil {
+		return err
+	}
+	value, _ := json.Marshal([]schema.MultiValued{{Value: extID.GetEntryID(), Type: "User"}})
+	return g.patch(schema.PatchOperation{Op: "add", Path: "members", Value: value})
+}
+
+func (g scimGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if g.raw == nil {
+		return errors.New("cannot remove user from the synthetic root")
+	}
+	if err := extID.CheckIfInternal(g.scimTarget); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("members[value eq %s]", filterString(extID.GetEntryID()))
+	return g.patch(schema.PatchOperation{Op: "remove", Path: path})
+}
+
+func (g scimGroup) patch(operations ...schema.PatchOperation) error {
+	body := schema.PatchRequest{Schemas: []string{schema.SchemaPatchOp}, Operations: operations}
+	return g.do(http.MethodPatch, resourcePath("Groups", g.raw.ID), nil, body, nil)
+}
@@ -0,0 +1,305 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/org-tools/manager"
+	schema "github.com/org-tools/manager/scim"
+	"github.com/samber/lo"
+)
+
+// downstreamApp plays a SCIM app that keeps no hierarchy extension and
+// caps every page at maxPage resources whatever count asks for, as many
+// apps do. Filters are answered from the filters map.
+type downstreamApp struct {
+	mu      sync.Mutex
+	maxPage int
+	users   []schema.User
+	groups  []schema.Group
+	filters map[string][]schema.User
+	gets    []string
+	patches []string
+}
+
+func (a *downstreamApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w.Header().Set("Content-Type", schema.ContentType)
+	query := r.URL.Query()
+	if r.Method == http.MethodGet {
+		a.gets = append(a.gets, r.URL.Path+" "+query.Get("startIndex")+" "+query.Get("filter"))
+	}
+	if r.Method == http.MethodPatch {
+		raw, _ := io.ReadAll(r.Body)
+		a.patches = append(a.patches, r.URL.Path+" "+string(raw))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	reply := func(status int, body any) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+	switch {
+	case r.Method == http.MethodPost:
+		reply(http.StatusConflict, schema.NewError(http.StatusConflict, "uniqueness", "userName taken"))
+	case r.URL.Path == "/Users" && query.Get("filter") != "":
+		found := a.filters[query.Get("filter")]
+		reply(http.StatusOK, schema.ListResponse[schema.User]{TotalResults: len(found), Resources: found})
+	case r.URL.Path == "/Users":
+		reply(http.StatusOK, page(a.users, query.Get("startIndex"), a.maxPage))
+	case r.URL.Path == "/Groups":
+		reply(http.StatusOK, page(a.groups, query.Get("startIndex"), a.maxPage))
+	case strings.HasPrefix(r.URL.Path, "/Groups/"):
+		if group, ok := lo.Find(a.groups, func(group schema.Group) bool { return "/Groups/"+group.ID == r.URL.Path }); ok {
+			reply(http.StatusOK, group)
+		} else {
+			reply(http.StatusNotFound, schema.NewError(http.StatusNotFound, "", "group not found"))
+		}
+	case strings.HasPrefix(r.URL.Path, "/Users/"):
+		if user, ok := lo.Find(a.users, func(user schema.User) bool { return "/Users/"+user.ID == r.URL.Path }); ok {
+			reply(http.StatusOK, user)
+		} else {
+			reply(http.StatusNotFound, schema.NewError(http.StatusNotFound, "", "user not found"))
+		}
+	}
+}
+
+// page answers startIndex with at most max resources, totalResults says
+// how many there are.
+func page[T any](resources []T, startIndex string, max int) schema.ListResponse[T] {
+	start, _ := strconv.Atoi(startIndex)
+	return schema.ListResponse[T]{TotalResults: len(resources), StartIndex: start, Resources: lo.Subset(resources, start-1, uint(max))}
+}
+
+func appUser(id, userName string) schema.User {
+	return schema.User{ID: id, UserName: userName, Name: &schema.Name{GivenName: strings.ToUpper(id[:1]) + id[1:], FamilyName: "App"}}
+}
+
+func newDownstreamApp() *downstreamApp {
+	app := &downstreamApp{maxPage: 1, filters: make(map[string][]schema.User)}
+	app.users = []schema.User{appUser("ada", "ada@example.com"), appUser("grace", "grace"), appUser("alan", "alan@example.com")}
+	app.users[1].Emails = []schema.MultiValued{{Value: "grace@home.example"}, {Value: "grace@example.com", Primary: true}}
+	app.groups = []schema.Group{
+		{ID: "eng", DisplayName: "Engineering", Members: []schema.MultiValued{{Value: "ada"}, {Value: "admins", Type: "Group"}, {Value: "gone"}}},
+		{ID: "admins", DisplayName: "Admins", Members: []schema.MultiValued{{Value: "grace", Type: "User"}}},
+	}
+	return app
+}
+
+func connectTo(t *testing.T, handler http.Handler) *scimTarget {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	s := &scimTarget{logger: Log}
+	_, err := s.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"scim","Slug":"app","BaseURL":"`+server.URL+`/","PageSize":50}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSCIMAdvancesStartIndexByWhatServerReturned(t *testing.T) {
+	app := newDownstreamApp()
+	s := connectTo(t, app)
+	users, err := s.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || strings.Join(app.gets, ",") != "/Users 1 ,/Users 2 ,/Users 3 " {
+		t.Errorf("got %d users from %q, want 3 pages of one", len(users), app.gets)
+	}
+	grace := users[1]
+	if grace.GetName() != "Grace App" || grace.GetEmail() != "grace@example.com" {
+		t.Errorf("grace reads as %s <%s>", grace.GetName(), grace.GetEmail())
+	}
+	if ada := users[0]; ada.GetEmail() != "ada@example.com" {
+		t.Errorf("ada without emails reads as <%s>, want her userName", ada.GetEmail())
+	}
+}
+
+func TestSCIMFlatAppGroupsHangUnderRoot(t *testing.T) {
+	app := newDownstreamApp()
+	app.groups = append(app.groups, schema.Group{ID: "oncall", DisplayName: "On call", Hierarchy: &schema.GroupHierarchy{Parent: &schema.MultiValued{Value: "eng"}}},
+		schema.Group{ID: "orphan", DisplayName: "Orphan", Hierarchy: &schema.GroupHierarchy{Parent: &schema.MultiValued{Value: "deleted"}}})
+	s := connectTo(t, app)
+	root, _ := s.GetRootDepartment()
+	tree := make(map[string][]string)
+	var walk func(department DepartmentableEntry)
+	walk = func(department DepartmentableEntry) {
+		for _, child := range department.GetChildDepartments() {
+			tree[department.GetID()] = append(tree[department.GetID()], child.GetID())
+			walk(child)
+		}
+	}
+	walk(root)
+	// a parent the app does not know leaves the group at the top
+	if got := fmt.Sprint(tree); got != "map[eng:[oncall] root:[eng admins orphan]]" {
+		t.Errorf("got tree %s", got)
+	}
+	if root.GetName() != "app" {
+		t.Errorf("root is named %q, want the slug", root.GetName())
+	}
+}
+
+func TestSCIMGroupMembersSkipGroupsAndVanishedUsers(t *testing.T) {
+	s := connectTo(t, newDownstreamApp())
+	root, _ := s.GetRootDepartment()
+	eng := root.GetChildDepartments()[0]
+	users, err := eng.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].GetID() != "ada" {
+		t.Errorf("eng has %v, want ada only", lo.Map(users, func(user UserableEntry, _ int) string { return user.GetID() }))
+	}
+}
+
+func TestSCIMLookupUserFallsBackToUserNameOfName(t *testing.T) {
+	app := newDownstreamApp()
+	app.filters[`userName eq "Grace"`] = app.users[1:2]
+	app.filters[`emails.value eq "twins@example.com"`] = app.users[:2]
+	s := connectTo(t, app)
+	found, err := s.LookupUser(User{Name: "Grace", Email: `grace"@example.com`})
+	if err != nil || found == nil || found.GetID() != "grace" {
+		t.Fatalf("lookup found %v, %v, want grace by name", found, err)
+	}
+	want := []string{`/Users 1 userName eq "grace\"@example.com"`, `/Users 1 emails.value eq "grace\"@example.com"`, `/Users 1 userName eq "Grace"`}
+	if strings.Join(app.gets, "\n") != strings.Join(want, "\n") {
+		t.Errorf("filtered %q, want %q", app.gets, want)
+	}
+	if _, err := s.LookupUser(User{Email: "twins@example.com"}); err == nil {
+		t.Error("lookup matching two users returned no error")
+	}
+}
+
+func TestSCIMErrorsKeepStatusAndDetail(t *testing.T) {
+	s := connectTo(t, newDownstreamApp())
+	_, err := s.CreateUser(User{Name: "Ada", Email: "ada@example.com"})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode() != http.StatusConflict || httpErr.Body != "userName taken" {
+		t.Errorf("create returned %v, want a 409 carrying the SCIM detail", err)
+	}
+	if retry, _ := ClassifyError(err); retry {
+		t.Error("a uniqueness conflict is classified as retryable")
+	}
+}
+
+func TestSCIMMembershipPatches(t *testing.T) {
+	app := newDownstreamApp()
+	s := connectTo(t, app)
+	root, _ := s.GetRootDepartment()
+	admins := root.GetChildDepartments()[1].(DepartmentUserWriter)
+	if err := admins.AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.alan@app.scim"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admins.RemoveFromDepartment(DepartmentModifyUserOptions{}, `ei.user.o"brien@app.scim`); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`/Groups/admins {"schemas":["` + schema.SchemaPatchOp + `"],"Operations":[{"op":"add","path":"members","value":[{"value":"alan","type":"User"}]}]}`,
+		`/Groups/admins {"schemas":["` + schema.SchemaPatchOp + `"],"Operations":[{"op":"remove","path":"members[value eq \"o\\\"brien\"]"}]}`,
+	}
+	if strings.Join(app.patches, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got patches\n%s\nwant\n%s", strings.Join(app.patches, "\n"), strings.Join(want, "\n"))
+	}
+	if err := root.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.alan@app.scim"); err == nil {
+		t.Error("added a user to the synthetic root")
+	}
+	if err := admins.AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.alan@other.scim"); err == nil {
+		t.Error("added the user of another target")
+	}
+}
+
+func TestSCIMWalkListsGroupsAndUsersOnce(t *testing.T) {
+	app := newDownstreamApp()
+	app.maxPage = 10
+	// alan joined admins after the walk listed the users
+	app.groups[1].Members = append(app.groups[1].Members, schema.MultiValued{Value: "alan"})
+	alan := app.users[2]
+	app.users = app.users[:2]
+	s := connectTo(t, app)
+	root, _ := s.GetRootDepartment()
+	members := make(map[string]int)
+	for _, group := range root.GetChildDepartments() {
+		if group.GetID() == "admins" {
+			app.mu.Lock()
+			app.users = append(app.users, alan)
+			app.mu.Unlock()
+		}
+		users, err := group.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[group.GetID()] = len(users)
+	}
+	if members["eng"] != 1 || members["admins"] != 2 {
+		t.Errorf("got member counts %v, want eng 1 and admins 2", members)
+	}
+	lists := make(map[string]int)
+	for _, get := range app.gets {
+		lists[strings.Fields(get)[0]]++
+	}
+	if lists["/Groups"] != 1 || lists["/Users"] != 1 {
+		t.Errorf("walk listed groups %d and users %d times, want once each", lists["/Groups"], lists["/Users"])
+	}
+	if lists["/Users/alan"] != 1 || lists["/Users/gone"] != 1 {
+		t.Errorf("walk read %v, want the late joiner and the vanished member one by one", lists)
+	}
+}
+
+// TestSCIMAgainstOwnServer pairs the driver with the SCIM server of this
+// repo, which keeps the hierarchy extension.
+func TestSCIMAgainstOwnServer(t *testing.T) {
+	local, err := InitTarget("local", func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"local","Slug":"hub","FileDSN":"`+t.TempDir()+`/hub.db"}`), v)
+	}, Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := schema.NewServer(local, schema.ServerOptions{Slug: "test", Logger: Log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := connectTo(t, server)
+	user, err := s.CreateUser(User{Name: "Ada Lovelace", Email: "ada@example.com", Phone: "+44 20 7946 0000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := s.GetRootDepartment()
+	ops, err := root.CreateChildDepartment(namedDepartment("ops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oncall, err := ops.CreateChildDepartment(namedDepartment("oncall"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := oncall.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, ExternalIdentityOfUser(s, user)); err != nil {
+		t.Fatal(err)
+	}
+	root, _ = s.GetRootDepartment()
+	all, err := RecursionGetAllUsersIncludeChildDepartments(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].GetPhone() != "+44 20 7946 0000" {
+		t.Errorf("walk found %d users, want ada in the nested oncall", len(all))
+	}
+}
+
+func namedDepartment(name string) Departmentable {
+	department := NewDepartment()
+	department.Name = name
+	return department
+}
@@ -0,0 +1,423 @@
+package slack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// slackRootID is the synthetic root department, the workspace, user
+	// groups are flat and all hang under it.
+	slackRootID = "root"
+	slackBotID  = "USLACKBOT"
+)
+
+// slackWorkspace reads the members of a workspace and keeps its user
+// groups, which are departments under a synthetic root.
+type slackWorkspace struct {
+	client *slack.Client
+	config *slackConfig
+	logger Logger
+
+	// membersMu serializes membership updates, Slack only replaces the
+	// whole member list of a user group.
+	membersMu sync.Mutex
+}
+
+func init() {
+	RegisterPlatform("slack", &slackWorkspace{})
+}
+
+type slackConfig struct {
+	Platform string
+	Slug     string
+	// Token is a bot or user token with users:read, users:read.email and
+	// usergroups:read, plus usergroups:write to change groups.
+	Token string
+	// APIURL replaces https://slack.com/api/, for a stand-in in tests.
+	APIURL string
+	// SkipGuests leaves single and multi channel guests out.
+	SkipGuests bool
+}
+
+func (s *slackWorkspace) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+func (s *slackWorkspace) GetTarget() Target {
+	return s
+}
+
+func (s *slackWorkspace) GetTargetSlug() string {
+	return s.config.Slug
+}
+
+func (s *slackWorkspace) GetPlatform() string {
+	return s.config.Platform
+}
+
+func (s *slackWorkspace) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	if err := unmarshaler(&s.config); err != nil {
+		return nil, err
+	}
+	if s.config.Token == "" {
+		return nil, errors.New("slack token is required")
+	}
+	s.SetHTTPClient(http.DefaultClient)
+	return s, nil
+}
+
+// SetHTTPClient replaces the client talking to the Web API.
+func (s *slackWorkspace) SetHTTPClient(client *http.Client) {
+	options := []slack.Option{slack.OptionHTTPClient(client)}
+	if s.config.APIURL != "" {
+		options = append(options, slack.OptionAPIURL(strings.TrimRight(s.config.APIURL, "/")+"/"))
+	}
+	s.client = slack.New(s.config.Token, options...)
+}
+
+// ClassifyError retries rate limits after the time Slack asks for, and the
+// server errors slack-go reports as retryable.
+func (s *slackWorkspace) ClassifyError(err error) (bool, time.Duration) {
+	var rateLimited *slack.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		return true, rateLimited.RetryAfter
+	}
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable(), 0
+	}
+	return ClassifyError(err)
+}
+
+func isSlackError(err error, codes ...string) bool {
+	var slackErr slack.SlackErrorResponse
+	return errors.As(err, &slackErr) && lo.Contains(codes, slackErr.Err)
+}
+
+// skipUser leaves out bots, Slackbot, deactivated members and optionally
+// guests, none of them are people of the organization.
+func (s *slackWorkspace) skipUser(user *slack.User) bool {
+	if user.IsBot || user.Deleted || user.ID == slackBotID {
+		return true
+	}
+	return s.config.SkipGuests && (user.IsRestricted || user.IsUltraRestricted)
+}
+
+func (s *slackWorkspace) GetRootDepartment() (DepartmentableEntry, error) {
+	return &slackUserGroup{slackWorkspace: s, members: new(slackMembers)}, nil
+}
+
+// slackMembers lists the workspace members once for all user groups of a
+// walk, user groups only know the ids of their members.
+type slackMembers struct {
+	mu    sync.Mutex
+	users map[string]*slackUser
+}
+
+// get lists the members on first use, a failed listing is tried again by
+// the next caller.
+func (m *slackMembers) get(s *slackWorkspace) (map[string]*slackUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.users == nil {
+		users, err := s.listUsers()
+		if err != nil {
+			return nil, err
+		}
+		m.users = users
+	}
+	return m.users, nil
+}
+
+// GetAllUsers pages through users.list.
+func (s *slackWorkspace) GetAllUsers() (users []UserableEntry, err error) {
+	all, err := s.listUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s *slackWorkspace) listUsers() (users map[string]*slackUser, err error) {
+	users = make(map[string]*slackUser)
+	ctx := context.Background()
+	page := s.client.GetUsersPaginated()
+	for {
+		if page, err = page.Next(ctx); err != nil {
+			break
+		}
+		for i := range page.Users {
+			if !s.skipUser(&page.Users[i]) {
+				users[page.Users[i].ID] = &slackUser{slackWorkspace: s, raw: &page.Users[i]}
+			}
+		}
+	}
+	if err = page.Failure(err); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *slackWorkspace) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	user, err := s.client.GetUserInfo(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	return &slackUser{slackWorkspace: s, raw: user}, nil
+}
+
+func (s *slackWorkspace) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	if internalExtID.GetEntryID() == slackRootID {
+		return s.GetRootDepartment()
+	}
+	return s.getUserGroup(internalExtID.GetEntryID())
+}
+
+// getUserGroup finds a user group by id, Slack has no call for a single
+// one so disabled groups are listed too.
+func (s *slackWorkspace) getUserGroup(id string) (*slackUserGroup, error) {
+	groups, err := s.client.GetUserGroups(slack.GetUserGroupsOptionIncludeDisabled(true), slack.GetUserGroupsOptionIncludeUsers(true))
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if groups[i].ID == id {
+			return &slackUserGroup{slackWorkspace: s, raw: &groups[i], members: new(slackMembers)}, nil
+		}
+	}
+	return nil, NotFound(fmt.Errorf("slack user group %s not found", id))
+}
+
+// LookupUser matches users.lookupByEmail, it returns nil without error
+// when nobody matches.
+func (s *slackWorkspace) LookupUser(user Userable) (UserableEntry, error) {
+	for _, email := range lo.Compact(GetUserableEmails(user)) {
+		found, err := s.client.GetUserByEmail(email)
+		if isSlackError(err, "users_not_found") {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &slackUser{slackWorkspace: s, raw: found}, nil
+	}
+	return nil, nil
+}
+
+// CreateUser is not possible with the Web API, people join a workspace by
+// invitation or through SCIM on Business+ plans.
+func (s *slackWorkspace) CreateUser(user Userable) (UserableEntry, error) {
+	return nil, fmt.Errorf("%w: slack users join by invitation, invite %s", ErrNotSupported, user.GetEmail())
+}
+
+type slackUser struct {
+	*slackWorkspace
+	raw *slack.User
+}
+
+func (u *slackUser) GetTarget() Target {
+	return u.slackWorkspace
+}
+
+func (u slackUser) GetID() string {
+	return u.raw.ID
+}
+
+func (u slackUser) GetName() string {
+	return lo.Ternary(u.raw.RealName != "", u.raw.RealName, u.raw.Name)
+}
+
+func (u slackUser) GetEmail() string {
+	return u.raw.Profile.Email
+}
+
+func (u slackUser) GetPhone() string {
+	return u.raw.Profile.Phone
+}
+
+// slackUserGroup is a user group, raw is nil for the synthetic root. The
+// groups listed under one root share its members.
+type slackUserGroup struct {
+	*slackWorkspace
+	raw     *slack.UserGroup
+	members *slackMembers
+}
+
+func (g *slackUserGroup) GetTarget() Target {
+	return g.slackWorkspace
+}
+
+func (g slackUserGroup) GetID() string {
+	if g.raw == nil {
+		return slackRootID
+	}
+	return g.raw.ID
+}
+
+func (g slackUserGroup) GetName() string {
+	if g.raw == nil {
+		return g.config.Slug
+	}
+	return g.raw.Name
+}
+
+func (g slackUserGroup) GetDescription() string {
+	if g.raw == nil {
+		return ""
+	}
+	return g.raw.Description
+}
+
+// GetChildDepartments lists the user groups under the root, disabled ones
+// included as they are only empty, creating them again fails on their
+// handle. User groups have no children of their own.
+func (g slackUserGroup) GetChildDepartments() (departments []DepartmentableEntry) {
+	if g.raw != nil {
+		return departments
+	}
+	groups, err := g.client.GetUserGroups(slack.GetUserGroupsOptionIncludeDisabled(true))
+	if err != nil {
+		g.logger.WithError(err).Error("list slack user groups failed")
+		return departments
+	}
+	for i := range groups {
+		departments = append(departments, &slackUserGroup{slackWorkspace: g.slackWorkspace, raw: &groups[i], members: g.members})
+	}
+	return departments
+}
+
+var slackHandleInvalid = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// CreateChildDepartment derives the mention handle from the name, it must
+// be unique among user groups, channels and members.
+func (g slackUserGroup) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	if g.raw != nil {
+		return nil, fmt.Errorf("%w: slack user groups are flat, create %s under the root", ErrNotSupported, department.GetName())
+	}
+	handle := strings.Trim(slackHandleInvalid.ReplaceAllString(strings.ToLower(department.GetName()), "-"), "-")
+	if handle == "" {
+		return nil, fmt.Errorf("cannot derive a slack handle from %q", department.GetName())
+	}
+	created, err := g.client.CreateUserGroup(slack.UserGroup{
+		Name:        department.GetName(),
+		Handle:      handle,
+		Description: department.GetDescription(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &slackUserGroup{slackWorkspace: g.slackWorkspace, raw: &created, members: g.members}, nil
+}
+
+// GetUsers returns the members of the group, the synthetic root and
+// disabled groups have none. Members who joined after the workspace was
+// listed are looked up one by one.
+func (g slackUserGroup) GetUsers() (users []UserableEntry, err error) {
+	if g.raw == nil || g.disabled() {
+		return nil, nil
+	}
+	memberIDs, err := g.client.GetUserGroupMembers(g.raw.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(memberIDs) == 0 {
+		return nil, nil
+	}
+	all, err := g.members.get(g.slackWorkspace)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range memberIDs {
+		user, ok := all[id]
+		if !ok {
+			raw, err := g.client.GetUserInfo(id)
+			if err != nil {
+				return nil, err
+			}
+			if g.skipUser(raw) {
+				continue
+			}
+			user = &slackUser{slackWorkspace: g.slackWorkspace, raw: raw}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// AddToDepartment ignores the role, user group members have none. A group
+// disabled for losing its last member is enabled again.
+func (g slackUserGroup) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return g.updateMembers(extID, func(members []string, userID string) []string {
+		return lo.Uniq(append(members, userID))
+	})
+}
+
+// RemoveFromDepartment disables the group instead of removing its last
+// member, Slack does not keep empty user groups.
+func (g slackUserGroup) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return g.updateMembers(extID, func(members []string, userID string) []string {
+		return lo.Without(members, userID)
+	})
+}
+
+// disabled groups keep their last member list, which no longer counts.
+func (g slackUserGroup) disabled() bool {
+	return g.raw.DateDelete != 0
+}
+
+// updateMembers reads the current members of the group alone, raw tracks
+// whether it is disabled as the groups it came from were listed with it.
+func (g slackUserGroup) updateMembers(extID ExternalIdentity, update func(members []string, userID string) []string) error {
+	if g.raw == nil {
+		return fmt.Errorf("%w: slack workspace members are managed by invitation", ErrNotSupported)
+	}
+	if err := extID.CheckIfInternal(g.slackWorkspace); err != nil {
+		return err
+	}
+	g.membersMu.Lock()
+	defer g.membersMu.Unlock()
+	disabled := g.disabled()
+	var before []string
+	if !disabled {
+		var err error
+		if before, err = g.client.GetUserGroupMembers(g.raw.ID); err != nil {
+			return err
+		}
+	}
+	members := update(before, extID.GetEntryID())
+	if len(members) == 0 {
+		if disabled {
+			return nil
+		}
+		if _, err := g.client.DisableUserGroup(g.raw.ID); err != nil {
+			return err
+		}
+		g.raw.DateDelete = slack.JSONTime(time.Now().Unix())
+		return nil
+	}
+	if disabled {
+		if _, err := g.client.EnableUserGroup(g.raw.ID); err != nil {
+			return err
+		}
+		g.raw.DateDelete = 0
+	}
+	if !disabled && len(members) == len(before) && len(lo.Intersect(members, before)) == len(members) {
+		return nil
+	}
+	_, err := g.client.UpdateUserGroupMembers(g.raw.ID, strings.Join(members, ","))
+	return err
+}
@@ -0,0 +1,311 @@
+package slack
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+// slackAPI answers Web API methods with the handler registered for them,
+// the calls are logged as "method key=value" without the token.
+type slackAPI struct {
+	mu       sync.Mutex
+	calls    []string
+	handlers map[string]func(form url.Values) map[string]any
+}
+
+func (a *slackAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_ = r.ParseForm()
+	r.Form.Del("token")
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+	a.calls = append(a.calls, strings.TrimSpace(method+" "+strings.ReplaceAll(r.Form.Encode(), "&", " ")))
+	handler, ok := a.handlers[method]
+	if !ok {
+		handler = func(url.Values) map[string]any { return map[string]any{"ok": false, "error": "unknown_method"} }
+	}
+	reply := handler(r.Form)
+	if retryAfter, ok := reply["retry_after"]; ok {
+		w.Header().Set("Retry-After", retryAfter.(string))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if _, ok := reply["ok"]; !ok {
+		reply["ok"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+func (a *slackAPI) called(method string) (calls []string) {
+	return lo.Filter(a.calls, func(call string, _ int) bool { return strings.HasPrefix(call, method+" ") || call == method })
+}
+
+func slackMember(id, name string, flags ...string) map[string]any {
+	member := map[string]any{"id": id, "real_name": name, "profile": map[string]any{"email": strings.ToLower(strings.Fields(name)[0]) + "@example.com"}}
+	for _, flag := range flags {
+		member[flag] = true
+	}
+	return member
+}
+
+// userGroups keeps the user groups of the workspace, usergroups.list
+// leaves out disabled ones unless asked for them like Slack does.
+type userGroups struct {
+	members  map[string][]string
+	disabled map[string]bool
+}
+
+func (g *userGroups) register(api *slackAPI) {
+	api.handlers["usergroups.list"] = func(form url.Values) map[string]any {
+		var groups []any
+		for _, id := range []string{"S1", "S2", "S3"} {
+			if g.disabled[id] && form.Get("include_disabled") != "true" {
+				continue
+			}
+			group := map[string]any{"id": id, "name": "group " + id, "date_delete": lo.Ternary(g.disabled[id], 1700000000, 0)}
+			if form.Get("include_users") == "true" {
+				group["users"] = g.members[id]
+			}
+			groups = append(groups, group)
+		}
+		return map[string]any{"usergroups": groups}
+	}
+	api.handlers["usergroups.users.list"] = func(form url.Values) map[string]any {
+		return map[string]any{"users": g.members[form.Get("usergroup")]}
+	}
+	api.handlers["usergroups.users.update"] = func(form url.Values) map[string]any {
+		g.members[form.Get("usergroup")] = strings.Split(form.Get("users"), ",")
+		return map[string]any{"usergroup": map[string]any{"id": form.Get("usergroup")}}
+	}
+	for _, method := range []string{"usergroups.disable", "usergroups.enable"} {
+		method := method
+		api.handlers[method] = func(form url.Values) map[string]any {
+			g.disabled[form.Get("usergroup")] = method == "usergroups.disable"
+			return map[string]any{"usergroup": map[string]any{"id": form.Get("usergroup")}}
+		}
+	}
+}
+
+func newSlackAPIWorkspace(t *testing.T, api *slackAPI, config string) *slackWorkspace {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	s := &slackWorkspace{logger: Log}
+	_, err := s.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"slack","Slug":"ws","Token":"xoxb-test","APIURL":"`+server.URL+`/api"`+config+`}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSlackLeavesOutBotsDeactivatedAndGuests(t *testing.T) {
+	api := &slackAPI{handlers: map[string]func(url.Values) map[string]any{
+		"users.list": func(form url.Values) map[string]any {
+			if form.Get("cursor") == "" {
+				return map[string]any{
+					"members":           []any{slackMember("U1", "Ada Lovelace"), slackMember("B1", "Deploy Bot", "is_bot"), slackMember(slackBotID, "Slackbot")},
+					"response_metadata": map[string]any{"next_cursor": "dXNlcjpVMg=="},
+				}
+			}
+			return map[string]any{"members": []any{slackMember("U2", "Grace Hopper", "deleted"), slackMember("U3", "Alan Turing", "is_restricted"), slackMember("U4", "Edsger Dijkstra", "is_ultra_restricted")}}
+		},
+	}}
+	for config, want := range map[string]string{"": "U1,U3,U4", `,"SkipGuests":true`: "U1"} {
+		users, err := newSlackAPIWorkspace(t, api, config).GetAllUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := lo.Map(users, func(user UserableEntry, _ int) string { return user.GetID() })
+		sort.Strings(ids)
+		if got := strings.Join(ids, ","); got != want {
+			t.Errorf("config %q listed %s, want %s", config, got, want)
+		}
+	}
+	if pages := api.called("users.list"); len(pages) != 4 || !strings.Contains(pages[1], "cursor=dXNlcjpVMg%3D%3D") {
+		t.Errorf("listed %q, want the second page by its cursor", pages)
+	}
+}
+
+type aliasedUser struct {
+	User
+	emails []string
+}
+
+func (u aliasedUser) GetEmails() []string {
+	return u.emails
+}
+
+func TestSlackLookupUserTriesEveryEmail(t *testing.T) {
+	api := &slackAPI{handlers: map[string]func(url.Values) map[string]any{
+		"users.lookupByEmail": func(form url.Values) map[string]any {
+			switch form.Get("email") {
+			case "grace@example.com":
+				return map[string]any{"user": slackMember("U2", "Grace Hopper")}
+			case "broken@example.com":
+				return map[string]any{"ok": false, "error": "account_inactive"}
+			}
+			return map[string]any{"ok": false, "error": "users_not_found"}
+		},
+	}}
+	s := newSlackAPIWorkspace(t, api, "")
+	found, err := s.LookupUser(aliasedUser{User{Email: "g.hopper@example.com"}, []string{"ghopper@navy.mil", "grace@example.com"}})
+	if err != nil || found == nil || found.GetID() != "U2" {
+		t.Fatalf("lookup found %v, %v, want U2 by its last email", found, err)
+	}
+	if missing, err := s.LookupUser(User{Email: "nobody@example.com"}); missing != nil || err != nil {
+		t.Errorf("lookup of an unknown email found %v, %v, want nothing", missing, err)
+	}
+	if _, err := s.LookupUser(User{Email: "broken@example.com"}); !isSlackError(err, "account_inactive") {
+		t.Errorf("lookup returned %v, want the account_inactive error", err)
+	}
+}
+
+func TestSlackRetriesRateLimitsAfterRetryAfter(t *testing.T) {
+	api := &slackAPI{handlers: map[string]func(url.Values) map[string]any{
+		"users.info": func(url.Values) map[string]any { return map[string]any{"retry_after": "7"} },
+	}}
+	s := newSlackAPIWorkspace(t, api, "")
+	_, err := s.LookupEntryUserByInternalExternalIdentity("ei.user.U1@ws.slack")
+	retry, after := s.ClassifyError(err)
+	if !retry || after != 7*time.Second {
+		t.Errorf("classified %v as retry %v after %v, want a retry after 7s", err, retry, after)
+	}
+}
+
+func groupNamed(name string) Departmentable {
+	department := NewDepartment()
+	department.Name = name
+	return department
+}
+
+func TestSlackCreateChildDepartmentDerivesHandle(t *testing.T) {
+	api := &slackAPI{handlers: map[string]func(url.Values) map[string]any{
+		"usergroups.create": func(form url.Values) map[string]any {
+			return map[string]any{"usergroup": map[string]any{"id": "S9", "name": form.Get("name"), "handle": form.Get("handle")}}
+		},
+	}}
+	s := newSlackAPIWorkspace(t, api, "")
+	root, _ := s.GetRootDepartment()
+	created, err := root.CreateChildDepartment(groupNamed("R&D: Platform Team!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := api.called("usergroups.create"); created.GetID() != "S9" || !strings.Contains(calls[0], "handle=r-d-platform-team ") {
+		t.Errorf("created %s with %q, want handle r-d-platform-team", created.GetID(), calls)
+	}
+	if _, err := root.CreateChildDepartment(groupNamed("研发")); err == nil {
+		t.Error("created a group whose name has no handle characters")
+	}
+	if _, err := created.CreateChildDepartment(groupNamed("nested")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("nesting a user group returned %v, want ErrNotSupported", err)
+	}
+}
+
+func TestSlackDisablesGroupInsteadOfEmptyingIt(t *testing.T) {
+	api := &slackAPI{handlers: make(map[string]func(url.Values) map[string]any)}
+	groups := &userGroups{members: map[string][]string{"S2": {"U2"}, "S3": {"U9"}}, disabled: map[string]bool{"S3": true}}
+	groups.register(api)
+	s := newSlackAPIWorkspace(t, api, "")
+	group := func(id string) DepartmentUserWriter {
+		found, err := s.LookupEntryDepartmentByInternalExternalIdentity(ExternalIdentity("ei.dept." + id + "@ws.slack"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found.(DepartmentUserWriter)
+	}
+	user := func(id string) ExternalIdentity { return ExternalIdentity("ei.user." + id + "@ws.slack") }
+
+	for _, step := range []error{
+		group("S2").AddToDepartment(DepartmentModifyUserOptions{}, user("U1")),
+		group("S2").AddToDepartment(DepartmentModifyUserOptions{}, user("U1")),
+		group("S2").RemoveFromDepartment(DepartmentModifyUserOptions{}, user("U2")),
+		group("S2").RemoveFromDepartment(DepartmentModifyUserOptions{}, user("U1")),
+		group("S3").AddToDepartment(DepartmentModifyUserOptions{}, user("U2")),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+	writes := lo.Reject(api.calls, func(call string, _ int) bool { return strings.Contains(call, ".list") })
+	want := []string{
+		"usergroups.users.update usergroup=S2 users=U2%2CU1",
+		"usergroups.users.update usergroup=S2 users=U1",
+		"usergroups.disable usergroup=S2",
+		"usergroups.enable usergroup=S3",
+		"usergroups.users.update usergroup=S3 users=U2",
+	}
+	if strings.Join(writes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got writes %q, want %q", writes, want)
+	}
+	root, _ := s.GetRootDepartment()
+	if err := root.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, user("U1")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("adding to the workspace returned %v, want ErrNotSupported", err)
+	}
+}
+
+func TestSlackWalkSharesOneMemberListing(t *testing.T) {
+	api := &slackAPI{handlers: map[string]func(url.Values) map[string]any{
+		"users.list": func(url.Values) map[string]any {
+			return map[string]any{"members": []any{slackMember("U1", "Ada Lovelace"), slackMember("U2", "Grace Hopper")}}
+		},
+		"users.info": func(form url.Values) map[string]any {
+			return map[string]any{"user": slackMember(form.Get("user"), lo.Ternary(form.Get("user") == "B7", "Standup Bot", "Alan Turing"), lo.Ternary(form.Get("user") == "B7", "is_bot", "has_2fa"))}
+		},
+	}}
+	groups := &userGroups{members: map[string][]string{"S1": {"U1", "U3", "B7"}, "S2": {"U2"}, "S3": {"U1"}}, disabled: map[string]bool{"S3": true}}
+	groups.register(api)
+	s := newSlackAPIWorkspace(t, api, "")
+	root, _ := s.GetRootDepartment()
+	members := make(map[string]string)
+	for _, group := range root.GetChildDepartments() {
+		users, err := group.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[group.GetID()] = strings.Join(lo.Map(users, func(user UserableEntry, _ int) string { return user.GetID() }), ",")
+	}
+	// S3 is disabled but listed, creating it again would fail on its handle
+	if want := map[string]string{"S1": "U1,U3", "S2": "U2", "S3": ""}; !reflect.DeepEqual(members, want) {
+		t.Errorf("walk found members %v, want %v", members, want)
+	}
+	if listed, looked := len(api.called("users.list")), api.called("users.info"); listed != 1 || len(looked) != 2 {
+		t.Errorf("listed users %d times and looked up %q, want one listing and the two late joiners", listed, looked)
+	}
+}
+
+func TestSlackGroupRemembersItsDisabling(t *testing.T) {
+	api := &slackAPI{handlers: make(map[string]func(url.Values) map[string]any)}
+	groups := &userGroups{members: map[string][]string{"S2": {"U2"}}, disabled: map[string]bool{}}
+	groups.register(api)
+	s := newSlackAPIWorkspace(t, api, "")
+	root, _ := s.GetRootDepartment()
+	s2, _ := lo.Find(root.GetChildDepartments(), func(group DepartmentableEntry) bool { return group.GetID() == "S2" })
+	if err := s2.(DepartmentUserWriter).RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.U2@ws.slack"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{}, "ei.user.U1@ws.slack"); err != nil {
+		t.Fatal(err)
+	}
+	// the group listed at the start of the walk knows it was disabled since
+	if got := api.called("usergroups.enable"); len(got) != 1 || groups.members["S2"][0] != "U1" {
+		t.Errorf("enabled %q and left members %v, want S2 enabled with U1", got, groups.members["S2"])
+	}
+	if listed := len(api.called("usergroups.list")); listed != 1 {
+		t.Errorf("listed user groups %d times, want once for the walk", listed)
+	}
+}
@@ -0,0 +1,698 @@
+package wecom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	wecomDefaultBaseURL = "https://qyapi.weixin.qq.com"
+	wecomDefaultRootID  = 1
+	// wecomListIDLimit is the largest page of user/list_id.
+	wecomListIDLimit = 10000
+
+	wecomErrCodeBusy          = -1
+	wecomErrCodeInvalidToken  = 40014
+	wecomErrCodeTokenExpired  = 42001
+	wecomErrCodeFreqLimit     = 45009
+	wecomErrCodeUserNotFound  = 46004
+	wecomErrCodeUserIDMissing = 60111
+	wecomErrCodeEmailNotFound = 60155
+	wecomErrCodeDeptNotFound  = 60123
+)
+
+type weCom struct {
+	client *http.Client
+	config *weComConfig
+	logger Logger
+
+	tokenMu        sync.Mutex
+	token          string
+	tokenExpiresAt time.Time
+}
+
+func init() {
+	RegisterPlatform("wecom", &weCom{})
+}
+
+func (w *weCom) SetLogger(logger Logger) {
+	w.logger = logger
+}
+
+func (w *weCom) GetTarget() Target {
+	return w
+}
+
+func (w *weCom) GetTargetSlug() string {
+	return w.config.Slug
+}
+
+func (w *weCom) GetPlatform() string {
+	return w.config.Platform
+}
+
+type weComConfig struct {
+	Platform   string
+	Slug       string
+	CorpID     string
+	CorpSecret string
+	// BaseURL is the API host, qyapi.weixin.qq.com when empty.
+	BaseURL         string
+	RootDeptID      int
+	TraverseWorkers int
+	Timeout         time.Duration
+}
+
+func (w *weCom) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
+	err := unmarshaler(&w.config)
+	if err != nil {
+		return nil, err
+	}
+	if w.config.CorpID == "" || w.config.CorpSecret == "" {
+		return nil, errors.New("wecom corpid and corpsecret are required")
+	}
+	if w.config.BaseURL == "" {
+		w.config.BaseURL = wecomDefaultBaseURL
+	}
+	if w.config.RootDeptID == 0 {
+		w.config.RootDeptID = wecomDefaultRootID
+	}
+	if w.config.Timeout <= 0 {
+		w.config.Timeout = 30 * time.Second
+	}
+	w.client = &http.Client{Timeout: w.config.Timeout}
+	return w, nil
+}
+
+// SetHTTPClient replaces the client talking to BaseURL.
+func (w *weCom) SetHTTPClient(client *http.Client) {
+	w.client = client
+}
+
+// weComError is a non-zero errcode, WeCom answers 200 for failures too.
+type weComError struct {
+	Code    int    `json:"errcode"`
+	Message string `json:"errmsg"`
+}
+
+func (e *weComError) Error() string {
+	return fmt.Sprintf("wecom errcode %d: %s", e.Code, e.Message)
+}
+
+func isWeComErrorCode(err error, codes ...int) bool {
+	var wecomErr *weComError
+	if !errors.As(err, &wecomErr) {
+		return false
+	}
+	for _, code := range codes {
+		if wecomErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *weCom) ClassifyError(err error) (bool, time.Duration) {
+	if isWeComErrorCode(err, wecomErrCodeBusy, wecomErrCodeFreqLimit) {
+		return true, time.Second
+	}
+	return ClassifyError(err)
+}
+
+// accessToken returns the cached token, fetched again a few minutes before
+// it expires as WeCom limits gettoken calls.
+func (w *weCom) accessToken() (string, error) {
+	w.tokenMu.Lock()
+	defer w.tokenMu.Unlock()
+	if w.token != "" && time.Now().Before(w.tokenExpiresAt) {
+		return w.token, nil
+	}
+	var resp struct {
+		weComError
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	query := url.Values{"corpid": {w.config.CorpID}, "corpsecret": {w.config.CorpSecret}}
+	if err := w.send(http.MethodGet, "/cgi-bin/gettoken", query, nil, &resp); err != nil {
+		return "", err
+	}
+	if resp.Code != 0 {
+		return "", &resp.weComError
+	}
+	w.token = resp.AccessToken
+	w.tokenExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - 5*time.Minute)
+	return w.token, nil
+}
+
+func (w *weCom) invalidateToken(token string) {
+	w.tokenMu.Lock()
+	defer w.tokenMu.Unlock()
+	if w.token == token {
+		w.token = ""
+	}
+}
+
+// call sends an API request with the access token, renewing the token once
+// when WeCom rejects it. out must embed weComError.
+func (w *weCom) call(method, path string, query url.Values, body any, out interface{ errorCode() *weComError }) error {
+	for attempt := 0; ; attempt++ {
+		token, err := w.accessToken()
+		if err != nil {
+			return err
+		}
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("access_token", token)
+		if err := w.send(method, path, query, body, out); err != nil {
+			return err
+		}
+		wecomErr := out.errorCode()
+		if wecomErr.Code == 0 {
+			return nil
+		}
+		if attempt == 0 && (wecomErr.Code == wecomErrCodeInvalidToken || wecomErr.Code == wecomErrCodeTokenExpired) {
+			w.invalidateToken(token)
+			*wecomErr = weComError{}
+			continue
+		}
+		return &weComError{Code: wecomErr.Code, Message: wecomErr.Message}
+	}
+}
+
+func (e *weComError) errorCode() *weComError {
+	return e
+}
+
+func (w *weCom) send(method, path string, query url.Values, body any, out any) error {
+	var reader *bytes.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), method, w.config.BaseURL+path+"?"+query.Encode(), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NewHTTPError(resp, nil)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type weComDeptRaw struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	NameEn   string   `json:"name_en,omitempty"`
+	ParentID int      `json:"parentid"`
+	Order    int      `json:"order,omitempty"`
+	Leaders  []string `json:"department_leader,omitempty"`
+}
+
+type weComUserRaw struct {
+	UserID         string `json:"userid"`
+	Name           string `json:"name,omitempty"`
+	Mobile         string `json:"mobile,omitempty"`
+	Email          string `json:"email,omitempty"`
+	BizMail        string `json:"biz_mail,omitempty"`
+	Department     []int  `json:"department,omitempty"`
+	IsLeaderInDept []int  `json:"is_leader_in_dept,omitempty"`
+	Status         int    `json:"status,omitempty"`
+}
+
+func (w *weCom) getDepartment(id int) (*weComDeptRaw, error) {
+	var resp struct {
+		weComError
+		Department weComDeptRaw `json:"department"`
+	}
+	if err := w.call(http.MethodGet, "/cgi-bin/department/get", url.Values{"id": {strconv.Itoa(id)}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Department, nil
+}
+
+func (w *weCom) getUser(userID string) (*weComUserRaw, error) {
+	var resp struct {
+		weComError
+		weComUserRaw
+	}
+	if err := w.call(http.MethodGet, "/cgi-bin/user/get", url.Values{"userid": {userID}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.weComUserRaw, nil
+}
+
+func (w *weCom) GetRootDepartment() (DepartmentableEntry, error) {
+	raw, err := w.getDepartment(w.config.RootDeptID)
+	if err != nil {
+		return nil, err
+	}
+	return &weComDept{weCom: w, raw: raw, walk: new(weComWalk)}, nil
+}
+
+// weComWalk lists the members of every department once for all departments
+// reached from one root, user/list_id pages through the whole company and
+// only has user IDs. Users read for their details are kept for the other
+// departments they are in. A listing that failed is tried again by the next
+// caller.
+type weComWalk struct {
+	mu      sync.Mutex
+	members map[int][]string
+	users   map[string]*weComUserRaw
+}
+
+func (walk *weComWalk) listMembers(w *weCom, deptID int) ([]string, error) {
+	walk.mu.Lock()
+	defer walk.mu.Unlock()
+	if walk.members == nil {
+		members := make(map[int][]string)
+		body := map[string]any{"limit": wecomListIDLimit}
+		for {
+			var resp struct {
+				weComError
+				NextCursor string `json:"next_cursor"`
+				DeptUser   []struct {
+					UserID     string `json:"userid"`
+					Department int    `json:"department"`
+				} `json:"dept_user"`
+			}
+			if err := w.call(http.MethodPost, "/cgi-bin/user/list_id", nil, body, &resp); err != nil {
+				return nil, err
+			}
+			for _, member := range resp.DeptUser {
+				members[member.Department] = append(members[member.Department], member.UserID)
+			}
+			if resp.NextCursor == "" {
+				break
+			}
+			body["cursor"] = resp.NextCursor
+		}
+		walk.members = members
+	}
+	return walk.members[deptID], nil
+}
+
+// getUser reads the user unless the walk has it, concurrent departments may
+// read the same user twice.
+func (walk *weComWalk) getUser(w *weCom, userID string) (*weComUserRaw, error) {
+	walk.mu.Lock()
+	raw, ok := walk.users[userID]
+	walk.mu.Unlock()
+	if ok {
+		return raw, nil
+	}
+	raw, err := w.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	walk.mu.Lock()
+	defer walk.mu.Unlock()
+	if walk.users == nil {
+		walk.users = make(map[string]*weComUserRaw)
+	}
+	walk.users[userID] = raw
+	return raw, nil
+}
+
+// updated keeps the listing in step with a membership written during the
+// walk.
+func (walk *weComWalk) updated(raw *weComUserRaw, deptID int) {
+	walk.mu.Lock()
+	defer walk.mu.Unlock()
+	delete(walk.users, raw.UserID)
+	if walk.members == nil {
+		return
+	}
+	members := lo.Without(walk.members[deptID], raw.UserID)
+	if lo.Contains(raw.Department, deptID) {
+		members = append(members, raw.UserID)
+	}
+	walk.members[deptID] = members
+}
+
+func (w *weCom) GetAllUsers() (users []UserableEntry, err error) {
+	return w.GetAllUsersContext(context.Background())
+}
+
+func (w *weCom) GetAllUsersContext(ctx context.Context) (users []UserableEntry, err error) {
+	rootDepartment, err := w.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	return ConcurrentGetAllUsersIncludeChildDepartments(ctx, rootDepartment, w.GetTraverseOptions())
+}
+
+func (w *weCom) GetTraverseOptions() TraverseOptions {
+	return TraverseOptions{Workers: w.config.TraverseWorkers}
+}
+
+func (w *weCom) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
+	deptID, err := strconv.Atoi(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	raw, err := w.getDepartment(deptID)
+	if isWeComErrorCode(err, wecomErrCodeDeptNotFound) {
+		return nil, NotFound(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &weComDept{weCom: w, raw: raw, walk: new(weComWalk)}, nil
+}
+
+func (w *weCom) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (UserableEntry, error) {
+	raw, err := w.getUser(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, err
+	}
+	return &weComUser{weCom: w, raw: raw}, nil
+}
+
+// LookupUser matches the mobile, then the email, nil without error when
+// nobody matches.
+func (w *weCom) LookupUser(user Userable) (UserableEntry, error) {
+	var resp struct {
+		weComError
+		UserID string `json:"userid"`
+	}
+	var err error
+	if mobile := user.GetPhone(); mobile != "" {
+		err = w.call(http.MethodPost, "/cgi-bin/user/getuserid", nil, map[string]string{"mobile": mobile}, &resp)
+		if err != nil && !isWeComErrorCode(err, wecomErrCodeUserNotFound, wecomErrCodeUserIDMissing) {
+			return nil, err
+		}
+	}
+	if resp.UserID == "" && user.GetEmail() != "" {
+		err = w.call(http.MethodPost, "/cgi-bin/user/get_userid_by_email", nil, map[string]string{"email": user.GetEmail()}, &resp)
+		if err != nil && !isWeComErrorCode(err, wecomErrCodeUserNotFound, wecomErrCodeUserIDMissing, wecomErrCodeEmailNotFound) {
+			return nil, err
+		}
+	}
+	if resp.UserID == "" {
+		return nil, nil
+	}
+	raw, err := w.getUser(resp.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &weComUser{weCom: w, raw: raw}, nil
+}
+
+// weComUserIDInvalid leaves out . and @ too, WeCom allows them but they
+// would break the external identity of the user.
+var weComUserIDInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// CreateUser puts the user in the root department, the userid is the
+// nickname of the email as WeCom requires the caller to pick one.
+func (w *weCom) CreateUser(user Userable) (UserableEntry, error) {
+	userID := weComUserIDInvalid.ReplaceAllString(GetUserableMailNickname(user), "")
+	if userID == "" {
+		userID = "u" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	if len(userID) > 64 {
+		userID = userID[:64]
+	}
+	raw := &weComUserRaw{
+		UserID:     userID,
+		Name:       user.GetName(),
+		Mobile:     user.GetPhone(),
+		Email:      user.GetEmail(),
+		Department: []int{w.config.RootDeptID},
+	}
+	var resp weComError
+	if err := w.call(http.MethodPost, "/cgi-bin/user/create", nil, raw, &resp); err != nil {
+		return nil, fmt.Errorf("create wecom user error: %w", err)
+	}
+	return &weComUser{weCom: w, raw: raw}, nil
+}
+
+func (w *weCom) UpdateUser(extID ExternalIdentity, options Userable) (UserableEntry, error) {
+	if err := extID.CheckIfInternal(w); err != nil {
+		return nil, err
+	}
+	update := map[string]string{"userid": extID.GetEntryID()}
+	if name := options.GetName(); name != "" {
+		update["name"] = name
+	}
+	if mobile := options.GetPhone(); mobile != "" {
+		update["mobile"] = mobile
+	}
+	if email := options.GetEmail(); email != "" {
+		update["email"] = email
+	}
+	var resp weComError
+	if err := w.call(http.MethodPost, "/cgi-bin/user/update", nil, update, &resp); err != nil {
+		return nil, err
+	}
+	return w.LookupEntryUserByInternalExternalIdentity(extID)
+}
+
+func (w *weCom) DeleteUser(extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(w); err != nil {
+		return err
+	}
+	var resp weComError
+	return w.call(http.MethodGet, "/cgi-bin/user/delete", url.Values{"userid": {extID.GetEntryID()}}, nil, &resp)
+}
+
+// weComDept is a department, departments reached from one root share its
+// walk.
+type weComDept struct {
+	*weCom
+	raw  *weComDeptRaw
+	walk *weComWalk
+}
+
+func (d *weComDept) GetTarget() Target {
+	return d.weCom
+}
+
+func (d weComDept) GetID() string {
+	return strconv.Itoa(d.raw.ID)
+}
+
+func (d weComDept) GetName() string {
+	return d.raw.Name
+}
+
+func (d weComDept) GetDescription() string {
+	return ""
+}
+
+// GetChildDepartments reads department/list, which returns the whole
+// subtree, and keeps the direct children.
+func (d weComDept) GetChildDepartments() (departments []DepartmentableEntry) {
+	var resp struct {
+		weComError
+		Department []weComDeptRaw `json:"department"`
+	}
+	if err := d.call(http.MethodGet, "/cgi-bin/department/list", url.Values{"id": {d.GetID()}}, nil, &resp); err != nil {
+		d.logger.WithError(err).Error("list wecom departments failed")
+		return departments
+	}
+	for i := range resp.Department {
+		if resp.Department[i].ParentID == d.raw.ID && resp.Department[i].ID != d.raw.ID {
+			departments = append(departments, &weComDept{weCom: d.weCom, raw: &resp.Department[i], walk: d.walk})
+		}
+	}
+	return departments
+}
+
+func (d weComDept) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
+	var resp struct {
+		weComError
+		ID int `json:"id"`
+	}
+	err := d.call(http.MethodPost, "/cgi-bin/department/create", nil, weComDeptRaw{
+		Name:     department.GetName(),
+		ParentID: d.raw.ID,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("create wecom department error: %w", err)
+	}
+	raw, err := d.getDepartment(resp.ID)
+	if err != nil {
+		return nil, fmt.Errorf("get wecom department detail error: %w", err)
+	}
+	return &weComDept{weCom: d.weCom, raw: raw, walk: d.walk}, nil
+}
+
+// GetUsers reads the direct members out of the user/list_id listing of the
+// walk, then their details one by one, user/list no longer returns members
+// to apps created since August 2022.
+func (d weComDept) GetUsers() (users []UserableEntry, err error) {
+	userIDs, err := d.walk.listMembers(d.weCom, d.raw.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, userID := range userIDs {
+		raw, err := d.walk.getUser(d.weCom, userID)
+		if isWeComErrorCode(err, wecomErrCodeUserNotFound) {
+			// deleted since the listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		role := DepartmentUserRoleMember
+		if raw.isLeaderIn(d.raw.ID) || lo.Contains(d.raw.Leaders, raw.UserID) {
+			role = DepartmentUserRoleAdmin
+		}
+		users = append(users, &weComMember{
+			weComUser: &weComUser{weCom: d.weCom, raw: raw},
+			role:      role,
+		})
+	}
+	return users, nil
+}
+
+func (u *weComUserRaw) isLeaderIn(deptID int) bool {
+	for i, id := range u.Department {
+		if id == deptID && i < len(u.IsLeaderInDept) {
+			return u.IsLeaderInDept[i] == 1
+		}
+	}
+	return false
+}
+
+// AddToDepartment adds the department to the departments of the user,
+// admins become leaders of it.
+func (d weComDept) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return d.updateMembership(extID, func(raw *weComUserRaw) {
+		leader := 0
+		if options.Role == DepartmentUserRoleAdmin {
+			leader = 1
+		}
+		for i, id := range raw.Department {
+			if id == d.raw.ID {
+				raw.IsLeaderInDept[i] = leader
+				return
+			}
+		}
+		raw.Department = append(raw.Department, d.raw.ID)
+		raw.IsLeaderInDept = append(raw.IsLeaderInDept, leader)
+	})
+}
+
+func (d weComDept) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	return d.updateMembership(extID, func(raw *weComUserRaw) {
+		var (
+			departments []int
+			leaders     []int
+		)
+		for i, id := range raw.Department {
+			if id != d.raw.ID {
+				departments = append(departments, id)
+				leaders = append(leaders, raw.IsLeaderInDept[i])
+			}
+		}
+		raw.Department, raw.IsLeaderInDept = departments, leaders
+	})
+}
+
+func (d weComDept) updateMembership(extID ExternalIdentity, modify func(raw *weComUserRaw)) error {
+	if err := extID.CheckIfInternal(d.weCom); err != nil {
+		return err
+	}
+	raw, err := d.getUser(extID.GetEntryID())
+	if err != nil {
+		return fmt.Errorf("error finding user %s: %s", extID, err)
+	}
+	// is_leader_in_dept is parallel to department, pad it when missing
+	for len(raw.IsLeaderInDept) < len(raw.Department) {
+		raw.IsLeaderInDept = append(raw.IsLeaderInDept, 0)
+	}
+	modify(raw)
+	if len(raw.Department) == 0 {
+		return fmt.Errorf("wecom user %s must stay in at least one department", raw.UserID)
+	}
+	var resp weComError
+	err = d.call(http.MethodPost, "/cgi-bin/user/update", nil, map[string]any{
+		"userid":            raw.UserID,
+		"department":        raw.Department,
+		"is_leader_in_dept": raw.IsLeaderInDept,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	d.walk.updated(raw, d.raw.ID)
+	return nil
+}
+
+type weComUser struct {
+	*weCom
+	raw *weComUserRaw
+}
+
+func (u *weComUser) GetTarget() Target {
+	return u.weCom
+}
+
+func (u weComUser) GetID() string {
+	return u.raw.UserID
+}
+
+func (u weComUser) GetName() string {
+	if u.raw.Name != "" {
+		return u.raw.Name
+	}
+	return u.raw.UserID
+}
+
+// GetEmail prefers the corporate mailbox over the personal email.
+func (u weComUser) GetEmail() string {
+	if u.raw.BizMail != "" {
+		return u.raw.BizMail
+	}
+	return u.raw.Email
+}
+
+func (u weComUser) GetEmails() (emails []string) {
+	for _, email := range []string{u.raw.BizMail, u.raw.Email} {
+		if email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+func (u weComUser) GetPhone() string {
+	return u.raw.Mobile
+}
+
+// weComMember is a user listed by a department, leaders have the admin
+// role.
+type weComMember struct {
+	*weComUser
+	role DepartmentUserRole
+}
+
+func (m *weComMember) GetRole() DepartmentUserRole {
+	return m.role
+}
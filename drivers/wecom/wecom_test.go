@@ -0,0 +1,256 @@
+package wecom
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+// corp answers the WeCom API from a few departments and users. Tokens are
+// "token-1", "token-2"... and expire when revoked is set, WeCom signals
+// errors with an errcode in a 200 response.
+type corp struct {
+	mu       sync.Mutex
+	issued   int
+	revoked  bool
+	answers  map[string]func(query map[string]string, body map[string]any) map[string]any
+	requests []string
+}
+
+func (c *corp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	query := make(map[string]string)
+	for key := range r.URL.Query() {
+		query[key] = r.URL.Query().Get(key)
+	}
+	var body map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	var reply map[string]any
+	switch {
+	case r.URL.Path == "/cgi-bin/gettoken" && query["corpid"] == "ww1" && query["corpsecret"] == "s3cret":
+		c.issued++
+		c.revoked = false
+		reply = map[string]any{"errcode": 0, "access_token": "token-" + strconv.Itoa(c.issued), "expires_in": 7200}
+	case query["access_token"] != "token-"+strconv.Itoa(c.issued) || c.revoked:
+		reply = map[string]any{"errcode": wecomErrCodeTokenExpired, "errmsg": "access_token expired"}
+	case c.answers[r.URL.Path] != nil:
+		reply = c.answers[r.URL.Path](query, body)
+	default:
+		reply = map[string]any{"errcode": 0, "errmsg": "ok"}
+	}
+	if r.URL.Path != "/cgi-bin/gettoken" {
+		raw, _ := json.Marshal(body)
+		c.requests = append(c.requests, r.URL.Path+" "+lo.Ternary(body != nil, string(raw), query["userid"]+query["id"]))
+	}
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+func errcode(code int) map[string]any {
+	return map[string]any{"errcode": code, "errmsg": "failed"}
+}
+
+func connectCorp(t *testing.T, c *corp) *weCom {
+	t.Helper()
+	server := httptest.NewServer(c)
+	t.Cleanup(server.Close)
+	w := &weCom{logger: Log}
+	_, err := w.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"wecom","Slug":"corp","CorpID":"ww1","CorpSecret":"s3cret","BaseURL":"`+server.URL+`"}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func userAnswer(users map[string]map[string]any) func(query map[string]string, body map[string]any) map[string]any {
+	return func(query map[string]string, body map[string]any) map[string]any {
+		user, ok := users[query["userid"]]
+		if !ok {
+			return errcode(wecomErrCodeUserNotFound)
+		}
+		return lo.Assign(map[string]any{"errcode": 0, "userid": query["userid"]}, user)
+	}
+}
+
+func TestWeComCachesTokenAndRenewsItOnce(t *testing.T) {
+	c := &corp{answers: map[string]func(map[string]string, map[string]any) map[string]any{
+		"/cgi-bin/user/get": userAnswer(map[string]map[string]any{"ada": {"name": "Ada", "biz_mail": "ada@corp.example", "email": "ada@home.example"}}),
+	}}
+	w := connectCorp(t, c)
+	for i := 0; i < 2; i++ {
+		if _, err := w.LookupEntryUserByInternalExternalIdentity("ei.user.ada@corp.wecom"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.issued != 1 {
+		t.Errorf("fetched %d tokens for two calls, want the first one cached", c.issued)
+	}
+	c.revoked = true
+	user, err := w.LookupEntryUserByInternalExternalIdentity("ei.user.ada@corp.wecom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.issued != 2 || user.GetEmail() != "ada@corp.example" {
+		t.Errorf("fetched %d tokens and read %s, want one renewal and the corporate mailbox", c.issued, user.GetEmail())
+	}
+	// a token rejected right after its renewal is not renewed forever
+	c.answers["/cgi-bin/user/get"] = func(map[string]string, map[string]any) map[string]any { return errcode(wecomErrCodeInvalidToken) }
+	if _, err := w.LookupEntryUserByInternalExternalIdentity("ei.user.ada@corp.wecom"); !isWeComErrorCode(err, wecomErrCodeInvalidToken) || c.issued != 3 {
+		t.Errorf("got %v after %d tokens, want 40014 after a single renewal", err, c.issued)
+	}
+}
+
+func TestWeComLookupUserTriesMobileThenEmail(t *testing.T) {
+	c := &corp{answers: map[string]func(map[string]string, map[string]any) map[string]any{
+		"/cgi-bin/user/getuserid": func(map[string]string, map[string]any) map[string]any { return errcode(wecomErrCodeUserNotFound) },
+		"/cgi-bin/user/get_userid_by_email": func(_ map[string]string, body map[string]any) map[string]any {
+			switch body["email"] {
+			case "ada@corp.example":
+				return map[string]any{"errcode": 0, "userid": "ada"}
+			case "locked@corp.example":
+				return errcode(60020)
+			}
+			return errcode(wecomErrCodeEmailNotFound)
+		},
+		"/cgi-bin/user/get": userAnswer(map[string]map[string]any{"ada": {"name": "Ada"}}),
+	}}
+	w := connectCorp(t, c)
+	found, err := w.LookupUser(User{Email: "ada@corp.example", Phone: "13800000001"})
+	if err != nil || found == nil || found.GetID() != "ada" {
+		t.Fatalf("lookup found %v, %v, want ada by email", found, err)
+	}
+	want := []string{`/cgi-bin/user/getuserid {"mobile":"13800000001"}`, `/cgi-bin/user/get_userid_by_email {"email":"ada@corp.example"}`, "/cgi-bin/user/get ada"}
+	if strings.Join(c.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests %q, want %q", c.requests, want)
+	}
+	if missing, err := w.LookupUser(User{Email: "grace@corp.example"}); missing != nil || err != nil {
+		t.Errorf("lookup of an unknown email found %v, %v, want nothing", missing, err)
+	}
+	if _, err := w.LookupUser(User{Email: "locked@corp.example"}); !isWeComErrorCode(err, 60020) {
+		t.Errorf("lookup returned %v, want errcode 60020", err)
+	}
+}
+
+func TestWeComClassifiesBusyAndFrequencyLimit(t *testing.T) {
+	w := &weCom{}
+	for code, want := range map[int]bool{wecomErrCodeBusy: true, wecomErrCodeFreqLimit: true, wecomErrCodeUserNotFound: false, 60020: false} {
+		retry, after := w.ClassifyError(&weComError{Code: code})
+		if retry != want || (retry && after != time.Second) {
+			t.Errorf("errcode %d classified as retry %v after %v, want %v", code, retry, after, want)
+		}
+	}
+}
+
+func TestWeComCreateUserDerivesUserID(t *testing.T) {
+	c := new(corp)
+	w := connectCorp(t, c)
+	for email, userID := range map[string]string{
+		"ada.lovelace+hr@corp.example":   "adalovelacehr",
+		strings.Repeat("x", 70) + "@a.b": strings.Repeat("x", 64),
+	} {
+		created, err := w.CreateUser(User{Name: "Ada", Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.GetID() != userID {
+			t.Errorf("created %s for %s, want %s", created.GetID(), email, userID)
+		}
+	}
+	if !strings.Contains(c.requests[0], `"department":[1]`) {
+		t.Errorf("created %s, want it in the root department", c.requests[0])
+	}
+	created, err := w.CreateUser(User{Name: "李雷"})
+	if err != nil || !strings.HasPrefix(created.GetID(), "u") {
+		t.Errorf("created %v, %v for a name without userid characters", created, err)
+	}
+}
+
+func TestWeComMembershipKeepsLeaderFlagsParallel(t *testing.T) {
+	c := &corp{answers: map[string]func(map[string]string, map[string]any) map[string]any{
+		"/cgi-bin/department/get": func(query map[string]string, _ map[string]any) map[string]any {
+			return map[string]any{"errcode": 0, "department": map[string]any{"id": 3, "name": "sre", "parentid": 2}}
+		},
+		// is_leader_in_dept is left out for apps without the field permission
+		"/cgi-bin/user/get": userAnswer(map[string]map[string]any{
+			"ada":   {"department": []int{1, 2}},
+			"grace": {"department": []int{3}, "is_leader_in_dept": []int{1}},
+		}),
+	}}
+	w := connectCorp(t, c)
+	sre, err := w.LookupEntryDepartmentByInternalExternalIdentity("ei.dept.3@corp.wecom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sre.(DepartmentUserWriter).AddToDepartment(DepartmentModifyUserOptions{Role: DepartmentUserRoleAdmin}, "ei.user.ada@corp.wecom"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sre.(DepartmentUserWriter).RemoveFromDepartment(DepartmentModifyUserOptions{}, "ei.user.grace@corp.wecom"); err == nil {
+		t.Error("removed grace from her only department")
+	}
+	updates := lo.Filter(c.requests, func(request string, _ int) bool { return strings.HasPrefix(request, "/cgi-bin/user/update ") })
+	if want := `/cgi-bin/user/update {"department":[1,2,3],"is_leader_in_dept":[0,0,1],"userid":"ada"}`; len(updates) != 1 || updates[0] != want {
+		t.Errorf("got updates %q, want %s", updates, want)
+	}
+}
+
+func TestWeComWalkPagesListIDOnce(t *testing.T) {
+	c := &corp{answers: map[string]func(map[string]string, map[string]any) map[string]any{
+		"/cgi-bin/department/get": func(map[string]string, map[string]any) map[string]any {
+			return map[string]any{"errcode": 0, "department": map[string]any{"id": 1, "name": "corp"}}
+		},
+		"/cgi-bin/department/list": func(query map[string]string, _ map[string]any) map[string]any {
+			if query["id"] != "1" {
+				return map[string]any{"errcode": 0, "department": []any{map[string]any{"id": 2, "name": "eng", "parentid": 1, "department_leader": []string{"grace"}}}}
+			}
+			return map[string]any{"errcode": 0, "department": []any{
+				map[string]any{"id": 1, "name": "corp"},
+				map[string]any{"id": 2, "name": "eng", "parentid": 1, "department_leader": []string{"grace"}},
+			}}
+		},
+		"/cgi-bin/user/list_id": func(_ map[string]string, body map[string]any) map[string]any {
+			if body["cursor"] == nil {
+				return map[string]any{"errcode": 0, "next_cursor": "c2", "dept_user": []any{
+					map[string]any{"userid": "ada", "department": 1}, map[string]any{"userid": "ada", "department": 2},
+				}}
+			}
+			return map[string]any{"errcode": 0, "dept_user": []any{
+				map[string]any{"userid": "grace", "department": 2}, map[string]any{"userid": "gone", "department": 2},
+			}}
+		},
+		"/cgi-bin/user/get": userAnswer(map[string]map[string]any{
+			"ada":   {"department": []int{1, 2}, "is_leader_in_dept": []int{1, 0}},
+			"grace": {"department": []int{2}},
+		}),
+	}}
+	w := connectCorp(t, c)
+	root, _ := w.GetRootDepartment()
+	var members []string
+	for _, department := range append([]DepartmentableEntry{root}, root.GetChildDepartments()...) {
+		users, err := department.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range users {
+			members = append(members, department.GetName()+"/"+user.GetID()+":"+user.(UserableWithRole).GetRole().String())
+		}
+	}
+	admin, member := DepartmentUserRoleAdmin.String(), DepartmentUserRoleMember.String()
+	if want := []string{"corp/ada:" + admin, "eng/ada:" + member, "eng/grace:" + admin}; strings.Join(members, " ") != strings.Join(want, " ") {
+		t.Errorf("got members %v, want %v", members, want)
+	}
+	reads := lo.Filter(c.requests, func(request string, _ int) bool { return !strings.HasPrefix(request, "/cgi-bin/department/") })
+	want := []string{`/cgi-bin/user/list_id {"limit":10000}`, `/cgi-bin/user/list_id {"cursor":"c2","limit":10000}`, "/cgi-bin/user/get ada", "/cgi-bin/user/get grace", "/cgi-bin/user/get gone"}
+	if strings.Join(reads, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got reads %q, want the two list_id pages once and each user read once", reads)
+	}
+}
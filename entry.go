@@ -60,6 +60,11 @@ func (i ExternalIdentities) StringList() (list []string) {
 
 const InvalidExternalIdentity ExternalIdentity = ""
 
+// ClientLinkPlatform is the platform of links naming a client which pushed
+// the entry, like the externalId a SCIM client assigned, instead of a
+// target. It is never a registered platform, link walkers skip it.
+const ClientLinkPlatform = "client"
+
 func (id ExternalIdentity) GetEntryType() EntryType {
 	return EntryType(strings.Split(string(id), ".")[1])
 }
@@ -116,12 +121,11 @@ type Entry interface {
 	GetPlatform() string
 }
 
+// Uniq keeps the first entry of every ID in the order they were given.
 func Uniq[T Entry](list []T) []T {
-	m := make(map[string]T)
-	for _, v := range list {
-		m[v.GetID()] = v
-	}
-	return lo.Values(m)
+	return lo.UniqBy(list, func(v T) string {
+		return v.GetID()
+	})
 }
 
 func ExternalIdentityOfEntry(entry Entry) ExternalIdentity {
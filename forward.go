@@ -0,0 +1,216 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// EmailForward forwards an enterprise address to a mailbox elsewhere, Name
+// tells people reading the rules who it is for.
+type EmailForward struct {
+	Address     string
+	Destination string
+	Name        string
+}
+
+// TargetWithEmailForwarding keeps forwards of its enterprise email domains,
+// it only lists and changes the forwards it created itself.
+type TargetWithEmailForwarding interface {
+	TargetWithEnterpriseEmail
+	GetEmailForwards() ([]EmailForward, error)
+	// SetEmailForward creates the forward of the address or updates it.
+	SetEmailForward(forward EmailForward) error
+	// DeleteEmailForward does nothing when the address has no forward.
+	DeleteEmailForward(address string) error
+}
+
+// TargetWithEmailForwardingBulk sets and deletes many forwards per call,
+// errors line up with the forwards passed in. ReconcileEmailForwards
+// prefers it, what the writes check is then listed once per run.
+type TargetWithEmailForwardingBulk interface {
+	TargetWithEmailForwarding
+	SetEmailForwards(forwards []EmailForward) []error
+	DeleteEmailForwards(addresses []string) []error
+}
+
+func emailDomainIn(email string, domains []string) bool {
+	_, domain, found := strings.Cut(email, "@")
+	return found && lo.ContainsBy(domains, func(d string) bool { return strings.EqualFold(d, domain) })
+}
+
+// EmailForwardsOfUser forwards every address of user under domains to its
+// primary email, users whose primary email is under domains get none.
+func EmailForwardsOfUser(domains []string, user Userable) (forwards []EmailForward) {
+	destination := user.GetEmail()
+	if destination == "" || emailDomainIn(destination, domains) {
+		return nil
+	}
+	for _, email := range lo.Compact(GetUserableEmails(user)) {
+		if emailDomainIn(email, domains) {
+			forwards = append(forwards, EmailForward{Address: strings.ToLower(email), Destination: destination, Name: user.GetName()})
+		}
+	}
+	return forwards
+}
+
+type EmailForwardResult struct {
+	Users     int
+	Forwards  int
+	Created   int
+	Updated   int
+	Deleted   int
+	Unchanged int
+	Errors    []error
+}
+
+// DefaultMaxEmailForwardDeleteRatio is the share of the current forwards a
+// reconcile deletes at most, unless its options say otherwise.
+var DefaultMaxEmailForwardDeleteRatio = 0.1
+
+type ReconcileEmailForwardsOptions struct {
+	// DryRun only counts what would change.
+	DryRun bool
+	// MaxDeleteRatio caps the deletions to this share of the current
+	// forwards, at least one, as a center silently missing a subtree looks
+	// just like its users being offboarded. Zero is
+	// DefaultMaxEmailForwardDeleteRatio, 1 lifts the cap.
+	MaxDeleteRatio float64
+}
+
+// ReconcileEmailForwards forwards the enterprise addresses of every user of
+// center and deletes the forwards of addresses no user has anymore. Nothing
+// is written when the walk of center fails or more forwards would be deleted
+// than options allow.
+func ReconcileEmailForwards(ctx context.Context, center Target, target Target, options ReconcileEmailForwardsOptions) (result EmailForwardResult, err error) {
+	forwarding, ok := As[TargetWithEmailForwarding](target)
+	if !ok {
+		return result, notSupported(target, "email forwarding")
+	}
+	domains := forwarding.GetEnterpriseEmailDomains()
+	if len(domains) == 0 {
+		return result, errors.New("no enterprise email domains to forward")
+	}
+	// users of the branches that did load are returned next to the error,
+	// reconciling them would delete the forwards of everyone else
+	users, err := GetAllUsersContext(ctx, center)
+	if err != nil {
+		return result, fmt.Errorf("list users of center: %w", err)
+	}
+	users = Uniq(users)
+	result.Users = len(users)
+	var current []EmailForward
+	err = Do(target, Call{Operation: "get_email_forwards"}, func() (err error) {
+		current, err = forwarding.GetEmailForwards()
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+	// an empty center is far more likely broken than everyone offboarded
+	if len(users) == 0 && len(current) != 0 {
+		return result, errors.New("center has no users, refusing to delete every forward")
+	}
+	currentByAddress := lo.KeyBy(current, func(forward EmailForward) string { return strings.ToLower(forward.Address) })
+	desired := make(map[string]bool)
+	var sets []EmailForward
+	for _, user := range users {
+		for _, forward := range EmailForwardsOfUser(domains, user) {
+			if desired[forward.Address] {
+				result.Errors = append(result.Errors, fmt.Errorf("address %s is used by more than one user, kept for the first", forward.Address))
+				continue
+			}
+			desired[forward.Address] = true
+			result.Forwards++
+			existing, found := currentByAddress[forward.Address]
+			if found && strings.EqualFold(existing.Destination, forward.Destination) && existing.Name == forward.Name {
+				result.Unchanged++
+				continue
+			}
+			sets = append(sets, forward)
+		}
+	}
+	deletes := lo.Filter(lo.Keys(currentByAddress), func(address string, _ int) bool { return !desired[address] })
+	sort.Strings(deletes)
+
+	ratio := options.MaxDeleteRatio
+	if ratio <= 0 {
+		ratio = DefaultMaxEmailForwardDeleteRatio
+	}
+	if maxDeletes := lo.Max([]int{1, int(ratio * float64(len(current)))}); len(deletes) > maxDeletes {
+		err := fmt.Errorf("%d of %d forwards would be deleted, more than the %d allowed, check the users of center or raise the ratio",
+			len(deletes), len(current), maxDeletes)
+		if !options.DryRun {
+			return result, err
+		}
+		result.Errors = append(result.Errors, err)
+	}
+
+	setErrs, deleteErrs := make([]error, len(sets)), make([]error, len(deletes))
+	if !options.DryRun {
+		setErrs, deleteErrs = writeEmailForwards(target, forwarding, sets, deletes)
+	}
+	for i, forward := range sets {
+		if setErrs[i] != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("set forward of %s: %w", forward.Address, setErrs[i]))
+			continue
+		}
+		if _, found := currentByAddress[forward.Address]; found {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+	}
+	for i, address := range deletes {
+		if deleteErrs[i] != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("delete forward of %s: %w", address, deleteErrs[i]))
+			continue
+		}
+		result.Deleted++
+	}
+	return result, nil
+}
+
+// writeEmailForwards sets and then deletes forwards, in bulk when target is
+// a TargetWithEmailForwardingBulk. The bulk calls are not retried as a
+// whole, like the bulk calls of SyncUsers.
+func writeEmailForwards(target Target, forwarding TargetWithEmailForwarding, sets []EmailForward, deletes []string) (setErrs, deleteErrs []error) {
+	bulk, ok := As[TargetWithEmailForwardingBulk](target)
+	if !ok {
+		setErrs = lo.Map(sets, func(forward EmailForward, _ int) error {
+			return Do(target, Call{Operation: "set_email_forward", Write: true, Idempotent: true}, func() error {
+				return forwarding.SetEmailForward(forward)
+			})
+		})
+		deleteErrs = lo.Map(deletes, func(address string, _ int) error {
+			return Do(target, Call{Operation: "delete_email_forward", Write: true, Idempotent: true}, func() error {
+				return forwarding.DeleteEmailForward(address)
+			})
+		})
+		return setErrs, deleteErrs
+	}
+	setErrs, deleteErrs = make([]error, len(sets)), make([]error, len(deletes))
+	if len(sets) != 0 {
+		err := Do(target, Call{Operation: "set_email_forwards", Write: true}, func() error {
+			setErrs = bulk.SetEmailForwards(sets)
+			return nil
+		})
+		if err != nil {
+			setErrs = lo.Map(setErrs, func(error, int) error { return err })
+		}
+	}
+	if len(deletes) != 0 {
+		err := Do(target, Call{Operation: "delete_email_forwards", Write: true}, func() error {
+			deleteErrs = bulk.DeleteEmailForwards(deletes)
+			return nil
+		})
+		if err != nil {
+			deleteErrs = lo.Map(deleteErrs, func(error, int) error { return err })
+		}
+	}
+	return setErrs, deleteErrs
+}
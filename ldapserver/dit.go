@@ -0,0 +1,218 @@
+package ldapserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/org-tools/manager"
+)
+
+// entry is an ldap.Entry with its parsed DN, parsed once per snapshot
+// rather than once per search.
+type entry struct {
+	*ldap.Entry
+	dn *ldap.DN
+}
+
+// dit is a snapshot of a target laid out as
+//
+//	{base}
+//	├── ou=people     uid={user id}, inetOrgPerson with memberOf
+//	└── ou=groups     cn={root dept}, nested cn={dept} following GetChildDepartments
+//
+// Departments are groupOfNames listing their direct members. Siblings of the
+// same name are cn={dept} ({dept id}) instead, so each has a DN of its own.
+type dit struct {
+	entries []entry
+}
+
+func (s *Server) peopleDN() string {
+	return "ou=people," + s.options.BaseDN
+}
+
+func (s *Server) groupsDN() string {
+	return "ou=groups," + s.options.BaseDN
+}
+
+func (s *Server) userDN(id string) string {
+	return "uid=" + ldap.EscapeDN(id) + "," + s.peopleDN()
+}
+
+func buildDIT(s *Server) (*dit, error) {
+	root, err := s.target.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.target.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	memberOf := make(map[string][]string)
+	var groups []*ldap.Entry
+	var walk func(department manager.DepartmentableEntry, cn, parentDN string) error
+	walk = func(department manager.DepartmentableEntry, cn, parentDN string) error {
+		dn := "cn=" + ldap.EscapeDN(cn) + "," + parentDN
+		members, err := department.GetUsers()
+		if err != nil {
+			return manager.BranchError{Department: department, Err: err}
+		}
+		var memberDNs []string
+		for _, member := range manager.Uniq(members) {
+			memberDNs = append(memberDNs, s.userDN(member.GetID()))
+			memberOf[member.GetID()] = append(memberOf[member.GetID()], dn)
+		}
+		attributes := map[string][]string{
+			"objectClass": {"top", "groupOfNames"},
+			"cn":          uniqStrings([]string{cn, department.GetName()}),
+			"ou":          {department.GetName()},
+			"entryUUID":   {department.GetID()},
+			"member":      memberDNs,
+		}
+		if description := department.GetDescription(); description != "" {
+			attributes["description"] = []string{description}
+		}
+		groups = append(groups, newEntry(dn, attributes))
+		children := department.GetChildDepartments()
+		named := make(map[string]int, len(children))
+		for _, child := range children {
+			named[strings.ToLower(child.GetName())]++
+		}
+		for _, child := range children {
+			cn := child.GetName()
+			if named[strings.ToLower(cn)] > 1 {
+				cn = fmt.Sprintf("%s (%s)", cn, child.GetID())
+			}
+			if err := walk(child, cn, dn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root, root.GetName(), s.groupsDN()); err != nil {
+		return nil, err
+	}
+
+	d := new(dit)
+	base := strings.SplitN(s.options.BaseDN, ",", 2)[0]
+	baseType, baseValue, _ := strings.Cut(base, "=")
+	baseClass := "domain"
+	if strings.EqualFold(baseType, "o") {
+		baseClass = "organization"
+	} else if strings.EqualFold(baseType, "ou") {
+		baseClass = "organizationalUnit"
+	}
+	if err := d.add(ldap.NewEntry(s.options.BaseDN, map[string][]string{
+		"objectClass": {"top", baseClass},
+		baseType:      {baseValue},
+	})); err != nil {
+		return nil, err
+	}
+	for _, dn := range []string{s.peopleDN(), s.groupsDN()} {
+		name := strings.TrimPrefix(strings.SplitN(dn, ",", 2)[0], "ou=")
+		if err := d.add(ldap.NewEntry(dn, map[string][]string{"objectClass": {"top", "organizationalUnit"}, "ou": {name}})); err != nil {
+			return nil, err
+		}
+	}
+	for _, user := range manager.Uniq(users) {
+		if err := d.add(s.userEntry(user, memberOf[user.GetID()])); err != nil {
+			return nil, err
+		}
+	}
+	for _, group := range groups {
+		if err := d.add(group); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (s *Server) userEntry(user manager.UserableEntry, memberOf []string) *ldap.Entry {
+	name := user.GetName()
+	attributes := map[string][]string{
+		"objectClass":     {"top", "person", "organizationalPerson", "inetOrgPerson"},
+		"uid":             {user.GetID()},
+		"entryUUID":       {user.GetID()},
+		"cn":              {name},
+		"sn":              {name},
+		"displayName":     {name},
+		"mail":            sortedWithFirst(user.GetEmail(), manager.GetUserableEmails(user)),
+		"telephoneNumber": sortedWithFirst(user.GetPhone(), manager.GetUserablePhones(user)),
+		"memberOf":        memberOf,
+	}
+	if email := user.GetEmail(); email != "" {
+		attributes["userPrincipalName"] = []string{email}
+	}
+	return newEntry(s.userDN(user.GetID()), attributes)
+}
+
+// newEntry leaves out attributes without values, LDAP has no empty ones.
+func newEntry(dn string, attributes map[string][]string) *ldap.Entry {
+	for key, values := range attributes {
+		if len(values) == 0 {
+			delete(attributes, key)
+		}
+	}
+	return ldap.NewEntry(dn, attributes)
+}
+
+// sortedWithFirst returns values with first leading, the rest sorted, as
+// clients reading a single value take the first one.
+func sortedWithFirst(first string, values []string) (sorted []string) {
+	for _, value := range values {
+		if value != "" && value != first {
+			sorted = append(sorted, value)
+		}
+	}
+	sort.Strings(sorted)
+	sorted = uniqStrings(sorted)
+	if first != "" {
+		sorted = append([]string{first}, sorted...)
+	}
+	return sorted
+}
+
+func uniqStrings(sorted []string) []string {
+	uniq := sorted[:0]
+	for i, value := range sorted {
+		if i == 0 || value != sorted[i-1] {
+			uniq = append(uniq, value)
+		}
+	}
+	return uniq
+}
+
+func (d *dit) add(e *ldap.Entry) error {
+	dn, err := ldap.ParseDN(e.DN)
+	if err != nil {
+		return fmt.Errorf("invalid dn %s: %w", e.DN, err)
+	}
+	d.entries = append(d.entries, entry{Entry: e, dn: dn})
+	return nil
+}
+
+func (d *dit) find(dn *ldap.DN) (entry, bool) {
+	for _, e := range d.entries {
+		if e.dn.EqualFold(dn) {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
+// inScope tells if e is within scope of base, RFC 4511 4.5.1.2.
+func inScope(e entry, base *ldap.DN, scope int) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return e.dn.EqualFold(base)
+	case ldap.ScopeSingleLevel:
+		return len(e.dn.RDNs) == len(base.RDNs)+1 && base.AncestorOfFold(e.dn)
+	case ldap.ScopeWholeSubtree:
+		return e.dn.EqualFold(base) || base.AncestorOfFold(e.dn)
+	case ldap.ScopeChildren:
+		return base.AncestorOfFold(e.dn)
+	}
+	return false
+}
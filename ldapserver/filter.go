@@ -0,0 +1,116 @@
+package ldapserver
+
+import (
+	"fmt"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// matchFilter evaluates a search filter as sent on the wire, values are
+// compared case-insensitively like the caseIgnoreMatch of the attributes
+// we serve.
+func matchFilter(filter *ber.Packet, e entry) (bool, error) {
+	if filter.ClassType != ber.ClassContext {
+		return false, fmt.Errorf("invalid filter class %d", filter.ClassType)
+	}
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			matched, err := matchFilter(child, e)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		return true, nil
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			matched, err := matchFilter(child, e)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	case ldap.FilterNot:
+		if len(filter.Children) != 1 {
+			return false, fmt.Errorf("invalid not filter")
+		}
+		matched, err := matchFilter(filter.Children[0], e)
+		return !matched, err
+	case ldap.FilterPresent:
+		return len(attributeValues(e, packetString(filter))) != 0, nil
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false, fmt.Errorf("invalid %s filter", ldap.FilterMap[uint64(filter.Tag)])
+		}
+		expected := strings.ToLower(packetString(filter.Children[1]))
+		for _, value := range attributeValues(e, packetString(filter.Children[0])) {
+			value = strings.ToLower(value)
+			switch {
+			case filter.Tag == ldap.FilterGreaterOrEqual && value >= expected,
+				filter.Tag == ldap.FilterLessOrEqual && value <= expected,
+				(filter.Tag == ldap.FilterEqualityMatch || filter.Tag == ldap.FilterApproxMatch) && value == expected:
+				return true, nil
+			}
+		}
+		return false, nil
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false, fmt.Errorf("invalid substrings filter")
+		}
+		for _, value := range attributeValues(e, packetString(filter.Children[0])) {
+			if matchSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unsupported filter %s", ldap.FilterMap[uint64(filter.Tag)])
+}
+
+func matchSubstrings(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		sub := strings.ToLower(packetString(part))
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, sub) {
+				return false
+			}
+			value = value[len(sub):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, sub)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(sub):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, sub) {
+				return false
+			}
+			value = ""
+		}
+	}
+	return true
+}
+
+// attributeValues reads an attribute case-insensitively, the DN is served
+// as the virtual entryDN.
+func attributeValues(e entry, name string) []string {
+	if strings.EqualFold(name, "entryDN") {
+		return []string{e.DN}
+	}
+	return e.GetEqualFoldAttributeValues(name)
+}
+
+// packetString reads universal strings and the context-specific ones
+// asn1-ber leaves undecoded.
+func packetString(p *ber.Packet) string {
+	if value, ok := p.Value.(string); ok {
+		return value
+	}
+	if p.Data != nil {
+		return p.Data.String()
+	}
+	return ""
+}
@@ -0,0 +1,448 @@
+// Package ldapserver serves a target read-only over LDAPv3 for apps that
+// only know LDAP bind and search.
+package ldapserver
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/org-tools/manager"
+)
+
+const (
+	defaultSnapshotTTL    = time.Minute
+	defaultMaxConnections = 256
+	idleTimeout           = 5 * time.Minute
+	// requestTimeout bounds reading the rest of a request once it started
+	// and writing each response, idleTimeout only bounds the wait for it.
+	requestTimeout = 30 * time.Second
+	maxRequestSize = 1 << 20
+	// maxRequestDepth bounds the nesting of a request, filters nest the most.
+	maxRequestDepth = 64
+)
+
+// Account is an application allowed to bind, like Jenkins binding as
+// cn=jenkins,ou=apps,dc=example,dc=com.
+type Account struct {
+	DN       string
+	Password string
+}
+
+type Options struct {
+	// BaseDN is the suffix of the served tree, like dc=example,dc=com.
+	BaseDN   string
+	Accounts []Account
+	// AllowAnonymous lets clients search without binding.
+	AllowAnonymous bool
+	// SnapshotTTL is how long a snapshot of the target serves searches.
+	SnapshotTTL time.Duration
+	// MaxConnections is how many clients are served at once, connections
+	// beyond it are closed right away.
+	MaxConnections int
+	Logger         manager.Logger
+}
+
+type Server struct {
+	target  manager.Target
+	options Options
+	logger  manager.Logger
+
+	conns chan struct{}
+
+	mu         sync.Mutex
+	snapshot   *dit
+	snapshotAt time.Time
+}
+
+func NewServer(target manager.Target, options Options) (*Server, error) {
+	base, err := ldap.ParseDN(options.BaseDN)
+	if err != nil || len(base.RDNs) == 0 {
+		return nil, fmt.Errorf("invalid base dn %q", options.BaseDN)
+	}
+	options.BaseDN = base.String()
+	for _, account := range options.Accounts {
+		if _, err := ldap.ParseDN(account.DN); err != nil || account.Password == "" {
+			return nil, fmt.Errorf("invalid account %q, dn and password are required", account.DN)
+		}
+	}
+	if len(options.Accounts) == 0 && !options.AllowAnonymous {
+		return nil, errors.New("no accounts to bind with and anonymous search is not allowed")
+	}
+	if options.SnapshotTTL <= 0 {
+		options.SnapshotTTL = defaultSnapshotTTL
+	}
+	if options.MaxConnections <= 0 {
+		options.MaxConnections = defaultMaxConnections
+	}
+	if options.Logger == nil {
+		options.Logger = manager.Log
+	}
+	return &Server{
+		target:  target,
+		options: options,
+		logger:  options.Logger,
+		conns:   make(chan struct{}, options.MaxConnections),
+	}, nil
+}
+
+// Serve accepts connections until listener fails, wrap listener with
+// tls.NewListener for LDAPS.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		select {
+		case s.conns <- struct{}{}:
+		default:
+			s.logger.WithField("remote", conn.RemoteAddr().String()).Warn("too many ldap connections, closed")
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-s.conns }()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+func (s *Server) currentSnapshot() (*dit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshot != nil && time.Since(s.snapshotAt) < s.options.SnapshotTTL {
+		return s.snapshot, nil
+	}
+	snapshot, err := buildDIT(s)
+	if err != nil {
+		return nil, err
+	}
+	s.snapshot, s.snapshotAt = snapshot, time.Now()
+	return snapshot, nil
+}
+
+type session struct {
+	conn   net.Conn
+	logger manager.Logger
+	bound  string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	sess := &session{conn: conn, logger: s.logger.WithField("remote", conn.RemoteAddr().String())}
+	reader := bufio.NewReader(conn)
+	for {
+		packet, err := readRequest(conn, reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				sess.logger.WithError(err).Debug("ldap connection closed")
+			}
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		messageID, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			err = s.handleBind(sess, messageID, op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationSearchRequest:
+			err = s.handleSearch(sess, messageID, op)
+		case ldap.ApplicationAbandonRequest:
+			continue
+		case ldap.ApplicationExtendedRequest:
+			err = sess.write(messageID, result(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError, "extended operations are not supported"))
+		case ldap.ApplicationModifyRequest, ldap.ApplicationAddRequest, ldap.ApplicationDelRequest,
+			ldap.ApplicationModifyDNRequest, ldap.ApplicationCompareRequest:
+			err = sess.write(messageID, result(op.Tag+1, ldap.LDAPResultUnwillingToPerform, "the directory is read-only"))
+		default:
+			sess.logger.WithField("operation", op.Tag).Debug("unknown ldap operation")
+			return
+		}
+		if err != nil {
+			sess.logger.WithError(err).Debug("ldap write failed")
+			return
+		}
+	}
+}
+
+func (s *Server) handleBind(sess *session, messageID int64, op *ber.Packet) error {
+	reply := func(code uint16, message string) error {
+		return sess.write(messageID, result(ldap.ApplicationBindResponse, code, message))
+	}
+	if len(op.Children) != 3 {
+		return reply(ldap.LDAPResultProtocolError, "invalid bind request")
+	}
+	if version, _ := op.Children[0].Value.(int64); version != 3 {
+		return reply(ldap.LDAPResultProtocolError, "only LDAPv3 is supported")
+	}
+	name := packetString(op.Children[1])
+	auth := op.Children[2]
+	if auth.ClassType != ber.ClassContext || auth.Tag != 0 {
+		return reply(ldap.LDAPResultAuthMethodNotSupported, "only simple bind is supported")
+	}
+	password := packetString(auth)
+	sess.bound = ""
+	if name == "" && password == "" {
+		if !s.options.AllowAnonymous {
+			return reply(ldap.LDAPResultInappropriateAuthentication, "anonymous bind is not allowed")
+		}
+		return reply(ldap.LDAPResultSuccess, "")
+	}
+	if dn, err := ldap.ParseDN(name); err == nil {
+		for _, account := range s.options.Accounts {
+			accountDN, _ := ldap.ParseDN(account.DN)
+			if dn.EqualFold(accountDN) && subtle.ConstantTimeCompare([]byte(password), []byte(account.Password)) == 1 {
+				sess.bound = account.DN
+				sess.logger.WithField("dn", account.DN).Info("ldap bind")
+				return reply(ldap.LDAPResultSuccess, "")
+			}
+		}
+	}
+	sess.logger.WithField("dn", name).Warn("ldap bind failed")
+	return reply(ldap.LDAPResultInvalidCredentials, "invalid credentials")
+}
+
+func (s *Server) handleSearch(sess *session, messageID int64, op *ber.Packet) error {
+	done := func(code uint16, message string) error {
+		return sess.write(messageID, result(ldap.ApplicationSearchResultDone, code, message))
+	}
+	if sess.bound == "" && !s.options.AllowAnonymous {
+		return done(ldap.LDAPResultInsufficientAccessRights, "bind first")
+	}
+	if len(op.Children) != 8 {
+		return done(ldap.LDAPResultProtocolError, "invalid search request")
+	}
+	baseDN := packetString(op.Children[0])
+	scope, _ := op.Children[1].Value.(int64)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	typesOnly, _ := op.Children[5].Value.(bool)
+	filter := op.Children[6]
+	var attributes []string
+	for _, attribute := range op.Children[7].Children {
+		attributes = append(attributes, packetString(attribute))
+	}
+	if filterString, err := ldap.DecompileFilter(filter); err == nil {
+		sess.logger.WithField("base", baseDN).WithField("scope", scope).WithField("filter", filterString).Debug("ldap search")
+	}
+
+	if baseDN == "" && scope == ldap.ScopeBaseObject {
+		if err := sess.write(messageID, entryPacket(s.rootDSE(), attributes, typesOnly)); err != nil {
+			return err
+		}
+		return done(ldap.LDAPResultSuccess, "")
+	}
+	base, err := ldap.ParseDN(baseDN)
+	if err != nil {
+		return done(ldap.LDAPResultInvalidDNSyntax, err.Error())
+	}
+	snapshot, err := s.currentSnapshot()
+	if err != nil {
+		sess.logger.WithError(err).Error("ldap snapshot failed")
+		return done(ldap.LDAPResultOther, "directory unavailable")
+	}
+	if _, ok := snapshot.find(base); !ok {
+		return done(ldap.LDAPResultNoSuchObject, "")
+	}
+	sent := int64(0)
+	for _, e := range snapshot.entries {
+		if !inScope(e, base, int(scope)) {
+			continue
+		}
+		matched, err := matchFilter(filter, e)
+		if err != nil {
+			return done(ldap.LDAPResultUnwillingToPerform, err.Error())
+		}
+		if !matched {
+			continue
+		}
+		if sizeLimit > 0 && sent == sizeLimit {
+			return done(ldap.LDAPResultSizeLimitExceeded, "")
+		}
+		if err := sess.write(messageID, entryPacket(e.Entry, attributes, typesOnly)); err != nil {
+			return err
+		}
+		sent++
+	}
+	return done(ldap.LDAPResultSuccess, "")
+}
+
+func (s *Server) rootDSE() *ldap.Entry {
+	return ldap.NewEntry("", map[string][]string{
+		"objectClass":          {"top"},
+		"namingContexts":       {s.options.BaseDN},
+		"supportedLDAPVersion": {"3"},
+		"vendorName":           {"org-tools"},
+	})
+}
+
+// selectAttributes applies the attribute list of a search, empty or *
+// means all, 1.1 means none.
+func selectAttributes(e *ldap.Entry, requested []string) []*ldap.EntryAttribute {
+	all := len(requested) == 0
+	for _, name := range requested {
+		if name == "*" {
+			all = true
+		}
+	}
+	if all {
+		return e.Attributes
+	}
+	var selected []*ldap.EntryAttribute
+	for _, name := range requested {
+		if strings.EqualFold(name, "entryDN") {
+			selected = append(selected, ldap.NewEntryAttribute("entryDN", []string{e.DN}))
+			continue
+		}
+		for _, attribute := range e.Attributes {
+			if strings.EqualFold(attribute.Name, name) {
+				selected = append(selected, attribute)
+			}
+		}
+	}
+	return selected
+}
+
+func entryPacket(e *ldap.Entry, requested []string, typesOnly bool) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "Object Name"))
+	attributes := ber.NewSequence("Attributes")
+	for _, attribute := range selectAttributes(e, requested) {
+		partial := ber.NewSequence("Partial Attribute")
+		partial.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		if !typesOnly {
+			for _, value := range attribute.Values {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+		}
+		partial.AppendChild(values)
+		attributes.AppendChild(partial)
+	}
+	op.AppendChild(attributes)
+	return op
+}
+
+func result(tag ber.Tag, code uint16, message string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	return op
+}
+
+func (sess *session) write(messageID int64, op *ber.Packet) error {
+	message := ber.NewSequence("LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	message.AppendChild(op)
+	_ = sess.conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	_, err := sess.conn.Write(message.Bytes())
+	return err
+}
+
+// readRequest reads one LDAPMessage of at most maxRequestSize bytes. ber
+// allocates whatever length a packet claims before reading it, so the
+// lengths are checked against the bytes actually read before decoding.
+func readRequest(conn net.Conn, reader *bufio.Reader) (*ber.Packet, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	if _, err := reader.Peek(1); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	header, err := reader.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 0x30 {
+		return nil, errors.New("request is not an LDAPMessage")
+	}
+	if header[1] > 0x80 {
+		if header, err = reader.Peek(2 + int(header[1]&0x7f)); err != nil {
+			return nil, err
+		}
+	}
+	headerLen, contentLen, err := berHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if headerLen+contentLen > maxRequestSize {
+		return nil, fmt.Errorf("request of %d bytes is larger than %d", headerLen+contentLen, maxRequestSize)
+	}
+	data := make([]byte, headerLen+contentLen)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	if err := checkLengths(data, 0); err != nil {
+		return nil, err
+	}
+	return ber.DecodePacketErr(data)
+}
+
+// berHeader parses the identifier and definite length at the start of data,
+// LDAP forbids indefinite lengths.
+func berHeader(data []byte) (headerLen, contentLen int, err error) {
+	i := 1
+	if len(data) != 0 && data[0]&0x1f == 0x1f {
+		for i < len(data) && data[i]&0x80 != 0 {
+			i++
+		}
+		i++
+	}
+	if i >= len(data) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	length := data[i]
+	i++
+	switch {
+	case length < 0x80:
+		return i, int(length), nil
+	case length == 0x80:
+		return 0, 0, errors.New("indefinite length is not allowed")
+	}
+	n := int(length & 0x7f)
+	if n > 4 || i+n > len(data) {
+		return 0, 0, fmt.Errorf("invalid length of %d bytes", n)
+	}
+	for _, b := range data[i : i+n] {
+		contentLen = contentLen<<8 | int(b)
+	}
+	return i + n, contentLen, nil
+}
+
+// checkLengths makes sure every element of data fits in its parent.
+func checkLengths(data []byte, depth int) error {
+	if depth > maxRequestDepth {
+		return errors.New("request nested too deep")
+	}
+	for len(data) != 0 {
+		headerLen, contentLen, err := berHeader(data)
+		if err != nil {
+			return err
+		}
+		if contentLen > len(data)-headerLen {
+			return fmt.Errorf("element of %d bytes overruns its parent", contentLen)
+		}
+		if data[0]&0x20 != 0 {
+			if err := checkLengths(data[headerLen:headerLen+contentLen], depth+1); err != nil {
+				return err
+			}
+		}
+		data = data[headerLen+contentLen:]
+	}
+	return nil
+}
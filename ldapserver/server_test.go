@@ -0,0 +1,539 @@
+package ldapserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/org-tools/manager"
+)
+
+const (
+	baseDN   = "dc=example,dc=com"
+	appDN    = "cn=jenkins,ou=apps,dc=example,dc=com"
+	password = "change-me"
+)
+
+// openDirectory fills a local target with
+//
+//	root
+//	├── Eng      ann, bob
+//	│   └── Infra  ann
+//	└── Sales    cid
+func openDirectory(t *testing.T) manager.Target {
+	t.Helper()
+	dsn := t.TempDir() + "/hub.db"
+	local, err := manager.InitTarget("local", func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"local","Slug":"hub","FileDSN":"`+dsn+`"}`), v)
+	}, manager.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make(map[string]manager.UserableEntry)
+	for _, user := range []manager.User{
+		{Name: "Ann Lee", Email: "ann@example.com", Phone: "+1 555 0100"},
+		{Name: "Bob Jones", Email: "bob@example.com"},
+		{Name: "Cid Moss", Email: "cid@example.com"},
+	} {
+		created, err := local.(manager.UserWriteable).CreateUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[strings.Fields(user.Name)[0]] = created
+	}
+	root, err := local.GetRootDepartment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(parent manager.DepartmentableEntry, name, description string, members ...string) manager.DepartmentableEntry {
+		department := manager.NewDepartment()
+		department.Name, department.Description = name, description
+		created, err := parent.CreateChildDepartment(department)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, member := range members {
+			extID := manager.ExternalIdentityOfUser(local, users[member])
+			if err := created.(manager.DepartmentUserWriter).AddToDepartment(manager.DepartmentModifyUserOptions{}, extID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return created
+	}
+	eng := create(root, "Eng", "builds things", "Ann", "Bob")
+	create(eng, "Infra", "", "Ann")
+	create(root, "Sales", "", "Cid")
+	return local
+}
+
+func serve(t *testing.T, options Options) string {
+	t.Helper()
+	if options.BaseDN == "" {
+		options.BaseDN = baseDN
+	}
+	if options.Accounts == nil {
+		options.Accounts = []Account{{DN: appDN, Password: password}}
+	}
+	server, err := NewServer(openDirectory(t), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *ldap.Conn {
+	t.Helper()
+	conn, err := ldap.DialURL("ldap://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func bound(t *testing.T, addr string) *ldap.Conn {
+	t.Helper()
+	conn := dial(t, addr)
+	if err := conn.Bind(appDN, password); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func resultCode(err error) uint16 {
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		return ldapErr.ResultCode
+	}
+	return 0
+}
+
+func TestNewServerChecksOptions(t *testing.T) {
+	for _, options := range []Options{
+		{BaseDN: "", Accounts: []Account{{DN: appDN, Password: password}}},
+		{BaseDN: "not a dn", AllowAnonymous: true},
+		{BaseDN: baseDN, Accounts: []Account{{DN: appDN}}},
+		{BaseDN: baseDN, Accounts: []Account{{DN: "=", Password: password}}},
+		{BaseDN: baseDN},
+	} {
+		if _, err := NewServer(nil, options); err == nil {
+			t.Errorf("%+v was taken", options)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	addr := serve(t, Options{})
+	for _, tc := range []struct {
+		dn, password string
+		code         uint16
+	}{
+		{appDN, password, ldap.LDAPResultSuccess},
+		// DNs compare case- and space-insensitively
+		{"CN=Jenkins, OU=apps, DC=example, DC=com", password, ldap.LDAPResultSuccess},
+		{appDN, "wrong", ldap.LDAPResultInvalidCredentials},
+		{appDN, password + "x", ldap.LDAPResultInvalidCredentials},
+		{"cn=other,ou=apps,dc=example,dc=com", password, ldap.LDAPResultInvalidCredentials},
+		{"not a dn", password, ldap.LDAPResultInvalidCredentials},
+	} {
+		err := dial(t, addr).Bind(tc.dn, tc.password)
+		if code := resultCode(err); code != tc.code {
+			t.Errorf("bind %s %s: %v, want code %d", tc.dn, tc.password, err, tc.code)
+		}
+	}
+	conn := dial(t, addr)
+	if err := conn.UnauthenticatedBind(""); resultCode(err) != ldap.LDAPResultInappropriateAuthentication {
+		t.Errorf("anonymous bind: %v", err)
+	}
+	if _, err := conn.Search(ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", nil, nil)); resultCode(err) != ldap.LDAPResultInsufficientAccessRights {
+		t.Errorf("search without bind: %v", err)
+	}
+	// a failed bind drops the one before
+	if err := conn.Bind(appDN, password); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Bind(appDN, "wrong")
+	if _, err := conn.Search(ldap.NewSearchRequest(baseDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", nil, nil)); resultCode(err) != ldap.LDAPResultInsufficientAccessRights {
+		t.Errorf("search after a failed bind: %v", err)
+	}
+}
+
+func TestAnonymousSearch(t *testing.T) {
+	addr := serve(t, Options{AllowAnonymous: true, Accounts: []Account{}})
+	conn := dial(t, addr)
+	if err := conn.UnauthenticatedBind(""); err != nil {
+		t.Fatal(err)
+	}
+	found, err := conn.Search(ldap.NewSearchRequest(baseDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", nil, nil))
+	if err != nil || len(found.Entries) != 1 {
+		t.Fatalf("%v %v", found, err)
+	}
+}
+
+// TestSearchFilters round-trips filters through the BER the client encodes
+// and the server decodes, matching them on the users.
+func TestSearchFilters(t *testing.T) {
+	conn := bound(t, serve(t, Options{}))
+	for _, tc := range []struct {
+		filter string
+		want   string
+	}{
+		{"(objectClass=inetOrgPerson)", "ann bob cid"},
+		{"(OBJECTCLASS=INETORGPERSON)", "ann bob cid"},
+		{"(mail=ann@example.com)", "ann"},
+		{"(mail~=ANN@example.com)", "ann"},
+		{"(userPrincipalName=Bob@Example.com)", "bob"},
+		{"(telephoneNumber=*)", "ann"},
+		{"(!(telephoneNumber=*))", "bob cid"},
+		{"(mail=a*)", "ann"},
+		{"(mail=*@example.com)", "ann bob cid"},
+		{"(mail=*ob*)", "bob"},
+		{"(cn=b*j*s)", "bob"},
+		{"(cn=a*n*n*e)", "ann"},
+		// parts match in order
+		{"(cn=*lee*ann*)", ""},
+		{"(mail>=bob)", "bob cid"},
+		{"(mail<=bob)", "ann"},
+		{"(&(objectClass=person)(|(mail=ann*)(mail=cid*)))", "ann cid"},
+		{"(&(objectClass=person)(!(mail=ann*)))", "bob cid"},
+		{"(|(mail=nobody*)(cn=nobody))", ""},
+		{"(memberOf=cn=Infra,cn=Eng,cn=root,ou=groups,dc=example,dc=com)", "ann"},
+		{"(memberOf=CN=Eng,CN=root,ou=groups,dc=example,dc=com)", "ann bob"},
+		{"(entryDN=*ou=people,dc=example,dc=com)", "ann bob cid"},
+		{"(nonexistent=*)", ""},
+	} {
+		found, err := conn.Search(ldap.NewSearchRequest("ou=people,"+baseDN, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+			tc.filter, []string{"mail"}, nil))
+		if err != nil {
+			t.Errorf("%s: %v", tc.filter, err)
+			continue
+		}
+		var got []string
+		for _, e := range found.Entries {
+			got = append(got, strings.TrimSuffix(e.GetAttributeValue("mail"), "@example.com"))
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s found %v, want %s", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestSearchScopesAndAttributes(t *testing.T) {
+	conn := bound(t, serve(t, Options{}))
+	groups := "ou=groups," + baseDN
+	eng := "cn=Eng,cn=root," + groups
+	for _, tc := range []struct {
+		base  string
+		scope int
+		want  string
+	}{
+		{baseDN, ldap.ScopeBaseObject, baseDN},
+		{baseDN, ldap.ScopeSingleLevel, "ou=people," + baseDN + " " + groups},
+		{groups, ldap.ScopeWholeSubtree, groups + " cn=root," + groups + " " + eng + " cn=Infra," + eng + " cn=Sales,cn=root," + groups},
+		{eng, ldap.ScopeChildren, "cn=Infra," + eng},
+		{"CN=ENG,CN=ROOT,OU=GROUPS,DC=EXAMPLE,DC=COM", ldap.ScopeBaseObject, eng},
+	} {
+		found, err := conn.Search(ldap.NewSearchRequest(tc.base, tc.scope, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)", []string{"1.1"}, nil))
+		if err != nil {
+			t.Errorf("%s %d: %v", tc.base, tc.scope, err)
+			continue
+		}
+		var got []string
+		for _, e := range found.Entries {
+			got = append(got, e.DN)
+			if len(e.Attributes) != 0 {
+				t.Errorf("%s: 1.1 returned %d attributes", e.DN, len(e.Attributes))
+			}
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s %d found %v, want %s", tc.base, tc.scope, got, tc.want)
+		}
+	}
+
+	found, err := conn.Search(ldap.NewSearchRequest(eng, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=groupOfNames)", []string{"CN", "description", "member", "entryDN"}, nil))
+	if err != nil || len(found.Entries) != 1 {
+		t.Fatalf("%v %v", found, err)
+	}
+	group := found.Entries[0]
+	if group.GetAttributeValue("cn") != "Eng" || group.GetAttributeValue("description") != "builds things" ||
+		len(group.GetAttributeValues("member")) != 2 || group.GetAttributeValue("entryDN") != eng {
+		group.PrettyPrint(2)
+		t.Error("unexpected Eng entry")
+	}
+	if group.GetAttributeValue("objectClass") != "" {
+		t.Error("returned attributes which were not requested")
+	}
+
+	found, err = conn.Search(ldap.NewSearchRequest(eng, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, true,
+		"(objectClass=*)", []string{"*"}, nil))
+	if err != nil || len(found.Entries) != 1 {
+		t.Fatalf("%v %v", found, err)
+	}
+	for _, attribute := range found.Entries[0].Attributes {
+		if len(attribute.Values) != 0 {
+			t.Errorf("typesOnly returned values of %s", attribute.Name)
+		}
+	}
+
+	found, err = conn.Search(ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"namingContexts", "supportedLDAPVersion"}, nil))
+	if err != nil || len(found.Entries) != 1 || found.Entries[0].GetAttributeValue("namingContexts") != baseDN ||
+		found.Entries[0].GetAttributeValue("supportedLDAPVersion") != "3" {
+		t.Errorf("root DSE: %v %v", found, err)
+	}
+}
+
+func TestSearchErrors(t *testing.T) {
+	conn := bound(t, serve(t, Options{}))
+	for _, tc := range []struct {
+		base   string
+		filter string
+		size   int
+		code   uint16
+	}{
+		{"ou=nowhere," + baseDN, "(objectClass=*)", 0, ldap.LDAPResultNoSuchObject},
+		{"dc=other,dc=com", "(objectClass=*)", 0, ldap.LDAPResultNoSuchObject},
+		{"=broken", "(objectClass=*)", 0, ldap.LDAPResultInvalidDNSyntax},
+		{baseDN, "(objectClass=*)", 2, ldap.LDAPResultSizeLimitExceeded},
+		{baseDN, "(cn:caseExactMatch:=Eng)", 0, ldap.LDAPResultUnwillingToPerform},
+	} {
+		_, err := conn.Search(ldap.NewSearchRequest(tc.base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, tc.size, 0, false,
+			tc.filter, nil, nil))
+		if code := resultCode(err); code != tc.code {
+			t.Errorf("%s %s: %v, want code %d", tc.base, tc.filter, err, tc.code)
+		}
+	}
+}
+
+func TestWritesAreRefused(t *testing.T) {
+	conn := bound(t, serve(t, Options{}))
+	people := "ou=people," + baseDN
+	for name, err := range map[string]error{
+		"add":    conn.Add(ldap.NewAddRequest("uid=x,"+people, nil)),
+		"delete": conn.Del(ldap.NewDelRequest("uid=x,"+people, nil)),
+		"modify": conn.Modify(ldap.NewModifyRequest("uid=x,"+people, nil)),
+		"modrdn": conn.ModifyDN(ldap.NewModifyDNRequest("uid=x,"+people, "uid=y", true, "")),
+	} {
+		if code := resultCode(err); code != ldap.LDAPResultUnwillingToPerform {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := conn.Compare("uid=x,"+people, "cn", "x"); resultCode(err) != ldap.LDAPResultUnwillingToPerform {
+		t.Errorf("compare: %v", err)
+	}
+	if _, err := conn.WhoAmI(nil); resultCode(err) != ldap.LDAPResultProtocolError {
+		t.Errorf("extended: %v", err)
+	}
+	// the connection still serves searches
+	if _, err := conn.Search(ldap.NewSearchRequest(baseDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", nil, nil)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBERHeader(t *testing.T) {
+	for _, length := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000, maxRequestSize} {
+		packet := ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, strings.Repeat("x", length), "")
+		data := packet.Bytes()
+		headerLen, contentLen, err := berHeader(data)
+		if err != nil || contentLen != length || headerLen+contentLen != len(data) {
+			t.Errorf("%d bytes: header %d content %d %v", length, headerLen, contentLen, err)
+		}
+		if err := checkLengths(data, 0); err != nil {
+			t.Errorf("%d bytes: %v", length, err)
+		}
+	}
+	for _, data := range [][]byte{
+		{},
+		{0x04},
+		{0x1f},
+		{0x1f, 0x81},
+		{0x04, 0x80},
+		{0x04, 0x85, 1, 2, 3, 4, 5},
+		{0x04, 0x82, 1},
+	} {
+		if _, _, err := berHeader(data); err == nil {
+			t.Errorf("% x was taken", data)
+		}
+	}
+	for _, data := range [][]byte{
+		{0x04, 0x02, 'x'},
+		{0x30, 0x03, 0x04, 0x05, 'x'},
+		{0x30, 0x02, 0x04},
+		{0x30, 0x80, 0x00, 0x00},
+		bytes.Repeat([]byte{0x30, 0x02}, maxRequestDepth+2),
+	} {
+		if err := checkLengths(data, 0); err == nil {
+			t.Errorf("% x was taken", data)
+		}
+	}
+}
+
+// TestReadRequestRoundTrip reads back what the client library writes.
+func TestReadRequestRoundTrip(t *testing.T) {
+	for _, filter := range []string{
+		"(objectClass=*)",
+		"(&(mail=a*b*c)(|(cn>=x)(cn<=y))(!(uid~=z)))",
+		"(cn=" + strings.Repeat("x", 300) + ")",
+		strings.Repeat("(!", maxRequestDepth/2-4) + "(cn=x)" + strings.Repeat(")", maxRequestDepth/2-4),
+	} {
+		compiled, err := ldap.CompileFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		search := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+		search.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, baseDN, "Base DN"))
+		search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 2, "Scope"))
+		search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "Deref Aliases"))
+		search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 5, "Size Limit"))
+		search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+		search.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Types Only"))
+		search.AppendChild(compiled)
+		search.AppendChild(ber.NewSequence("Attributes"))
+		message := ber.NewSequence("LDAP Message")
+		message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 42, "Message ID"))
+		message.AppendChild(search)
+
+		client, server := net.Pipe()
+		go func() {
+			client.Write(message.Bytes())
+			client.Close()
+		}()
+		packet, err := readRequest(server, bufio.NewReader(server))
+		server.Close()
+		if err != nil {
+			t.Errorf("%.40s: %v", filter, err)
+			continue
+		}
+		if id, _ := packet.Children[0].Value.(int64); id != 42 {
+			t.Errorf("%.40s: message id %v", filter, packet.Children[0].Value)
+		}
+		op := packet.Children[1]
+		if op.Tag != ldap.ApplicationSearchRequest || len(op.Children) != 8 || packetString(op.Children[0]) != baseDN ||
+			op.Children[3].Value != int64(5) || op.Children[5].Value != true {
+			t.Errorf("%.40s: read %s", filter, ber.DescribePacket(op))
+		}
+		if decompiled, err := ldap.DecompileFilter(op.Children[6]); err != nil || decompiled != filter {
+			t.Errorf("%.40s: decompiled %.40s %v", filter, decompiled, err)
+		}
+	}
+}
+
+// TestMalformedRequests sends requests no client should, the server must
+// answer or hang up without panicking and keep serving others.
+func TestMalformedRequests(t *testing.T) {
+	addr := serve(t, Options{AllowAnonymous: true})
+	message := func(id int64, op *ber.Packet) []byte {
+		packet := ber.NewSequence("LDAP Message")
+		packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+		if op != nil {
+			packet.AppendChild(op)
+		}
+		return packet.Bytes()
+	}
+	op := func(tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+		packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+		for _, child := range children {
+			packet.AppendChild(child)
+		}
+		return packet
+	}
+	str := func(s string) *ber.Packet {
+		return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+	}
+	integer := func(i int64) *ber.Packet {
+		return ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, i, "")
+	}
+	filter := func(tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+		packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, tag, nil, "")
+		for _, child := range children {
+			packet.AppendChild(child)
+		}
+		return packet
+	}
+	search := func(f *ber.Packet) []byte {
+		return message(1, op(ldap.ApplicationSearchRequest, str(baseDN), integer(2), integer(0), integer(0), integer(0),
+			ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, ""), f, ber.NewSequence("")))
+	}
+	for name, data := range map[string][]byte{
+		"not a sequence":        {0x04, 0x01, 'x'},
+		"indefinite length":     {0x30, 0x80, 0x02, 0x01, 0x01, 0x00, 0x00},
+		"huge length":           {0x30, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		"length of 5 bytes":     {0x30, 0x85, 0, 0, 0, 0, 1},
+		"child overruns":        {0x30, 0x05, 0x02, 0x09, 0x01, 0x60, 0x00},
+		"too deep":              append([]byte{0x30, 0x82, 0x01, 0x00}, bytes.Repeat([]byte{0x30, 0x7e}, 128)...),
+		"truncated":             {0x30, 0x10, 0x02, 0x01},
+		"empty message":         {0x30, 0x00},
+		"no operation":          message(1, nil),
+		"string message id":     {0x30, 0x05, 0x04, 0x01, 'x', 0x42, 0x00},
+		"empty integer":         {0x30, 0x04, 0x02, 0x00, 0x42, 0x00},
+		"unknown operation":     message(1, op(30)),
+		"bind without children": message(1, op(ldap.ApplicationBindRequest)),
+		"bind of ldapv2":        message(1, op(ldap.ApplicationBindRequest, integer(2), str(""), str(""))),
+		"bind with sasl": message(1, op(ldap.ApplicationBindRequest, integer(3), str(appDN),
+			ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, ""))),
+		"bind with a string version": message(1, op(ldap.ApplicationBindRequest, str("3"), str(""), str(""))),
+		"search without children":    message(1, op(ldap.ApplicationSearchRequest)),
+		"search of wrong types": message(1, op(ldap.ApplicationSearchRequest, integer(1), str("x"), str("x"), str("x"),
+			str("x"), str("x"), str("x"), str("x"))),
+		"universal filter":          search(str("x")),
+		"equality without a value":  search(filter(ldap.FilterEqualityMatch, str("cn"))),
+		"not of two":                search(filter(ldap.FilterNot, filter(ldap.FilterPresent), filter(ldap.FilterPresent))),
+		"empty not":                 search(filter(ldap.FilterNot)),
+		"substrings without parts":  search(filter(ldap.FilterSubstrings, str("cn"))),
+		"substrings of strings":     search(filter(ldap.FilterSubstrings, str("cn"), str("x"))),
+		"extensible match":          search(filter(ldap.FilterExtensibleMatch)),
+		"unknown filter":            search(filter(12)),
+		"and of garbage":            search(filter(ldap.FilterAnd, str("x"), integer(1))),
+		"or of garbage":             search(filter(ldap.FilterOr, integer(1))),
+		"bad base dn":               message(1, op(ldap.ApplicationSearchRequest, str("=,="), integer(2), integer(0), integer(0), integer(0), ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, ""), filter(ldap.FilterPresent), ber.NewSequence(""))),
+		"write without children":    message(1, op(ldap.ApplicationDelRequest)),
+		"extended without children": message(1, op(ldap.ApplicationExtendedRequest)),
+		"abandon then garbage":      append(message(1, op(ldap.ApplicationAbandonRequest)), 0xff, 0xff),
+	} {
+		func() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(data); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Errorf("%s: the server did not hang up: %v", name, err)
+			}
+		}()
+	}
+	// a panic would have taken the test binary down, the server still serves
+	conn := dial(t, addr)
+	if _, err := conn.Search(ldap.NewSearchRequest(baseDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", nil, nil)); err != nil {
+		t.Error(err)
+	}
+}
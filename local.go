@@ -3,21 +3,26 @@ package manager
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/samber/lo"
 	"gorm.io/datatypes"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 type local struct {
 	db     *gorm.DB
 	config *localConfig
+	logger Logger
 }
 
-func init() {
-	RegisterPlatform("local", &local{})
+func (l *local) SetLogger(logger Logger) {
+	l.logger = logger
 }
 
 func (l *local) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error) {
@@ -28,8 +33,13 @@ func (l *local) InitFormUnmarshaler(unmarshaler func(any) error) (Target, error)
 	if l.config.RootDepartmentUUID == uuid.Nil {
 		l.config.RootDepartmentUUID = localDefaultRootDepartmentUUID
 	}
-	l.db, err = gorm.Open(sqlite.Open(l.config.FileDSN), &gorm.Config{})
-	l.db.AutoMigrate(&localUser{}, &localDepartment{})
+	l.db, err = gorm.Open(sqlite.Open(l.config.FileDSN), &gorm.Config{
+		Logger: gormlogger.New(gormLogWriter{l.logger}, gormlogger.Config{
+			SlowThreshold: 200 * time.Millisecond,
+			LogLevel:      gormlogger.Info,
+		}),
+	})
+	l.db.AutoMigrate(&localUser{}, &localDepartment{}, &localDeltaToken{})
 	return l, err
 }
 
@@ -42,8 +52,21 @@ type localConfig struct {
 
 var localDefaultRootDepartmentUUID = uuid.NameSpaceDNS
 
+// gormLogWriter sends SQL traces to the target logger at debug level.
+type gormLogWriter struct {
+	logger Logger
+}
+
+func (w gormLogWriter) Printf(format string, args ...any) {
+	if w.logger == nil {
+		return
+	}
+	w.logger.Debugf(format, args...)
+}
+
 func (l local) CreateUser(user Userable) (UserableEntry, error) {
 	newUser := &localUser{
+		local:  &l,
 		Name:   user.GetName(),
 		Names:  jsonMap(GetUserableNames(user)),
 		Phone:  user.GetPhone(),
@@ -62,8 +85,18 @@ func (l local) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalI
 }
 
 func (l local) lookupLocalUserByInternalExternalIdentity(internalExtID ExternalIdentity) (user *localUser, err error) {
-	err = l.db.Where(&localUser{ID: uuid.MustParse(internalExtID.GetEntryID())}).Find(&user).Error
-	return user, err
+	id, err := uuid.Parse(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, fmt.Errorf("user %s not found", internalExtID)
+	}
+	req := l.db.Where(&localUser{ID: id}).Find(&user)
+	if req.Error == nil && req.RowsAffected == 0 {
+		return nil, fmt.Errorf("user %s not found", internalExtID)
+	}
+	if user != nil {
+		user.local = &l
+	}
+	return user, req.Error
 }
 
 func (l local) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (DepartmentableEntry, error) {
@@ -71,27 +104,215 @@ func (l local) LookupEntryDepartmentByInternalExternalIdentity(internalExtID Ext
 }
 
 func (l local) lookupLocalDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (dept *localDepartment, err error) {
-	err = l.db.Where(&localDepartment{ID: uuid.MustParse(internalExtID.GetEntryID())}).Find(&dept).Error
-	return dept, err
+	id, err := uuid.Parse(internalExtID.GetEntryID())
+	if err != nil {
+		return nil, NotFound(fmt.Errorf("department %s not found", internalExtID))
+	}
+	req := l.db.Where(&localDepartment{ID: id}).Find(&dept)
+	if req.Error == nil && req.RowsAffected == 0 {
+		return nil, NotFound(fmt.Errorf("department %s not found", internalExtID))
+	}
+	if dept != nil {
+		dept.local = &l
+	}
+	return dept, req.Error
 }
 
 func (l *local) LookupUser(user Userable) (UserableEntry, error) {
 	result := &localUser{local: l}
-	req := l.db.Debug().
-		Where(datatypes.JSONQuery("names").HasKey(user.GetName()))
+	req := l.db.Where("JSON_EXTRACT(names, ?) IS NOT NULL", jsonKeyPath(user.GetName()))
 	if email := user.GetEmail(); email != "" {
-		req = req.Or(datatypes.JSONQuery("emails").HasKey(user.GetEmail()))
+		req = req.Or("JSON_EXTRACT(emails, ?) IS NOT NULL", jsonKeyPath(email))
 	}
 	if phone := user.GetPhone(); phone != "" {
-		req = req.Or(datatypes.JSONQuery("phones").HasKey(user.GetPhone()))
+		req = req.Or("JSON_EXTRACT(phones, ?) IS NOT NULL", jsonKeyPath(phone))
 	}
 	req = req.Find(&result)
 	if req.RowsAffected > 1 {
 		return nil, errors.New("muli users matched")
 	}
+	if req.RowsAffected == 0 {
+		return nil, req.Error
+	}
 	return result, req.Error
 }
 
+func (l *local) UpsertUser(user Userable) (UserableEntry, bool, error) {
+	existing, err := l.lookupLocalUserByContact(user)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing == nil {
+		created, err := l.CreateUser(user)
+		return created, true, err
+	}
+	if name := user.GetName(); name != "" {
+		existing.Name = name
+	}
+	if email := user.GetEmail(); email != "" {
+		existing.Email = email
+	}
+	if phone := user.GetPhone(); phone != "" {
+		existing.Phone = phone
+	}
+	existing.Names = jsonMap(existing.GetNames(), GetUserableNames(user)...)
+	existing.Emails = jsonMap(existing.GetEmails(), GetUserableEmails(user)...)
+	existing.Phones = jsonMap(existing.GetPhones(), GetUserablePhones(user)...)
+	return existing, false, existing.Save()
+}
+
+func (l *local) UpdateUser(extID ExternalIdentity, options Userable) (UserableEntry, error) {
+	if err := extID.CheckIfInternal(l); err != nil {
+		return nil, err
+	}
+	user, err := l.lookupLocalUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return nil, err
+	}
+	user.Name = options.GetName()
+	user.Email = options.GetEmail()
+	user.Phone = options.GetPhone()
+	user.Names = jsonMap(user.GetNames(), GetUserableNames(options)...)
+	user.Emails = jsonMap(GetUserableEmails(options))
+	user.Phones = jsonMap(GetUserablePhones(options))
+	return user, user.Save()
+}
+
+func (l *local) DeleteUser(extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(l); err != nil {
+		return err
+	}
+	user, err := l.lookupLocalUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return err
+	}
+	return l.db.Delete(user).Error
+}
+
+func (l *local) ActivateUser(extID ExternalIdentity) error {
+	return l.setUserInactive(extID, false)
+}
+
+func (l *local) DeactivateUser(extID ExternalIdentity) error {
+	return l.setUserInactive(extID, true)
+}
+
+func (l *local) setUserInactive(extID ExternalIdentity, inactive bool) error {
+	if err := extID.CheckIfInternal(l); err != nil {
+		return err
+	}
+	user, err := l.lookupLocalUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return err
+	}
+	return l.db.Model(user).Update("inactive", inactive).Error
+}
+
+// UpdateDepartment refuses to move a department under itself or its
+// descendants, and the root department cannot be moved.
+func (l *local) UpdateDepartment(extID ExternalIdentity, department Departmentable, parent ExternalIdentity) (DepartmentableEntry, error) {
+	if err := extID.CheckIfInternal(l); err != nil {
+		return nil, err
+	}
+	dept, err := l.lookupLocalDepartmentByInternalExternalIdentity(extID)
+	if err != nil {
+		return nil, err
+	}
+	dept.Name = department.GetName()
+	dept.Description = department.GetDescription()
+	if parent != InvalidExternalIdentity {
+		if err := parent.CheckIfInternal(l); err != nil {
+			return nil, err
+		}
+		if dept.ID == l.config.RootDepartmentUUID {
+			return nil, errors.New("root department cannot be moved")
+		}
+		newParent, err := l.lookupLocalDepartmentByInternalExternalIdentity(parent)
+		if err != nil {
+			return nil, err
+		}
+		for ancestor := newParent; ancestor.ID != l.config.RootDepartmentUUID; {
+			if ancestor.ID == dept.ID {
+				return nil, fmt.Errorf("cannot move department %s under itself", dept.Name)
+			}
+			next := new(localDepartment)
+			if err := l.db.Where("id = ?", ancestor.ParentID).First(next).Error; err != nil {
+				return nil, err
+			}
+			ancestor = next
+		}
+		dept.ParentID = newParent.ID
+	}
+	return dept, l.db.Save(dept).Error
+}
+
+// DeleteDepartment only deletes departments without children, members
+// are removed from it first.
+func (l *local) DeleteDepartment(extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(l); err != nil {
+		return err
+	}
+	dept, err := l.lookupLocalDepartmentByInternalExternalIdentity(extID)
+	if err != nil {
+		return err
+	}
+	if dept.ID == l.config.RootDepartmentUUID {
+		return errors.New("root department cannot be deleted")
+	}
+	if len(dept.GetChildDepartments()) != 0 {
+		return fmt.Errorf("department %s has child departments", dept.Name)
+	}
+	return l.db.Transaction(func(tx *gorm.DB) error {
+		users := make([]localUser, 0)
+		err := tx.Where("JSON_EXTRACT(departemts, ?) IS NOT NULL", jsonKeyPath(dept.ID.String())).Find(&users).Error
+		if err != nil {
+			return err
+		}
+		for i := range users {
+			delete(users[i].Departemts, dept.ID.String())
+			if err := tx.Save(&users[i]).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(dept).Error
+	})
+}
+
+// lookupLocalUserByContact matches on emails and phones only, names are too
+// ambiguous to decide that two rows are the same person.
+func (l *local) lookupLocalUserByContact(user Userable) (*localUser, error) {
+	emails := lo.Compact(GetUserableEmails(user))
+	phones := lo.Compact(GetUserablePhones(user))
+	if len(emails) == 0 && len(phones) == 0 {
+		return nil, nil
+	}
+	// keys are quoted by hand, HasKey would split emails on their dots
+	req := l.db.Where("1 = 0")
+	for _, email := range emails {
+		req = req.Or("JSON_EXTRACT(emails, ?) IS NOT NULL", jsonKeyPath(email))
+	}
+	for _, phone := range phones {
+		req = req.Or("JSON_EXTRACT(phones, ?) IS NOT NULL", jsonKeyPath(phone))
+	}
+	matched := make([]localUser, 0)
+	if err := req.Find(&matched).Error; err != nil {
+		return nil, err
+	}
+	switch len(matched) {
+	case 0:
+		return nil, nil
+	case 1:
+		matched[0].local = l
+		return &matched[0], nil
+	default:
+		return nil, errors.New("muli users matched")
+	}
+}
+
+func jsonKeyPath(key string) string {
+	return `$."` + strings.ReplaceAll(key, `"`, `\"`) + `"`
+}
+
 func (l *local) GetTarget() Target {
 	return l
 }
@@ -117,13 +338,13 @@ func (l *local) GetRootDepartment() (DepartmentableEntry, error) {
 
 func (l *local) GetAllUsers() (users []UserableEntry, err error) {
 	localUsers := make([]localUser, 0)
-	err = l.db.Model(&localUser{}).Find(&localUser{}).Error
+	err = l.db.Model(&localUser{}).Find(&localUsers).Error
 	if err != nil {
 		return nil, err
 	}
-	for _, v := range localUsers {
-		v.local = l
-		users = append(users, &v)
+	for i := range localUsers {
+		localUsers[i].local = l
+		users = append(users, &localUsers[i])
 	}
 	return users, err
 }
@@ -132,14 +353,48 @@ func (l *local) LookupEntryByExternalIdentity(extID ExternalIdentity) (Entry, er
 	return nil, nil
 }
 
+// LookupEntryUserByExternalIdentity finds the user extID is linked to, or
+// the user itself when extID is internal.
 func (l *local) LookupEntryUserByExternalIdentity(extID ExternalIdentity) (UserEntryExtIDStoreable, error) {
-	user := &localUser{local: l}
-	return user, l.db.Where(&localUser{ID: uuid.MustParse(extID.GetEntryID())}).Find(&user).Error
+	if extID.CheckIfInternal(l) == nil {
+		return l.lookupLocalUserByInternalExternalIdentity(extID)
+	}
+	users := make([]localUser, 0)
+	if err := l.db.Where("JSON_EXTRACT(ext_ids, ?) IS NOT NULL", jsonKeyPath(string(extID))).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, fmt.Errorf("no user linked to %s", extID)
+	case 1:
+		users[0].local = l
+		return &users[0], nil
+	default:
+		return nil, fmt.Errorf("%d users linked to %s", len(users), extID)
+	}
 }
 
+// LookupEntryDepartmentByExternalIdentity finds the department extID is
+// linked to, or the department itself when extID is internal.
 func (l *local) LookupEntryDepartmentByExternalIdentity(extID ExternalIdentity) (DepartmentEntryExtIDStoreable, error) {
-	dept := &localDepartment{local: l}
-	return dept, l.db.Where(&localDepartment{ID: uuid.MustParse(extID.GetEntryID())}).Find(&dept).Error
+	if extID.CheckIfInternal(l) == nil {
+		return l.lookupLocalDepartmentByInternalExternalIdentity(extID)
+	}
+	depts := make([]localDepartment, 0)
+	err := l.db.Where("EXISTS (SELECT 1 FROM JSON_EACH(local_departments.ext_ids) WHERE JSON_EACH.value = ?)", string(extID)).
+		Find(&depts).Error
+	if err != nil {
+		return nil, err
+	}
+	switch len(depts) {
+	case 0:
+		return nil, fmt.Errorf("no department linked to %s", extID)
+	case 1:
+		depts[0].local = l
+		return &depts[0], nil
+	default:
+		return nil, fmt.Errorf("%d departments linked to %s", len(depts), extID)
+	}
 }
 
 type localUser struct {
@@ -154,6 +409,9 @@ type localUser struct {
 	Emails     datatypes.JSONMap
 	ExtIDs     datatypes.JSONMap
 	Departemts datatypes.JSONMap
+	// Inactive users were deactivated by a SCIM client, local has no
+	// sign-in to turn off so it is only kept.
+	Inactive bool
 }
 
 func (u *localUser) BeforeCreate(_ *gorm.DB) error {
@@ -163,6 +421,10 @@ func (u *localUser) BeforeCreate(_ *gorm.DB) error {
 	return nil
 }
 
+func (u localUser) IsActive() bool {
+	return !u.Inactive
+}
+
 func (u localUser) GetID() string {
 	return u.ID.String()
 }
@@ -282,18 +544,19 @@ func (d localDepartment) GetDescription() string {
 func (d localDepartment) GetChildDepartments() (departments []DepartmentableEntry) {
 	localDepartments := make([]localDepartment, 0)
 	d.db.Where(&localDepartment{ParentID: d.ID}).Find(&localDepartments)
-	for _, v := range localDepartments {
-		v.local = d.local
-		departments = append(departments, &v)
+	for i := range localDepartments {
+		localDepartments[i].local = d.local
+		departments = append(departments, &localDepartments[i])
 	}
 	return departments
 }
 
 func (d localDepartment) CreateChildDepartment(department Departmentable) (DepartmentableEntry, error) {
 	newDepartment := &localDepartment{
-		local:    d.local,
-		Name:     department.GetName(),
-		ParentID: d.ID,
+		local:       d.local,
+		Name:        department.GetName(),
+		Description: department.GetDescription(),
+		ParentID:    d.ID,
 	}
 	return newDepartment, d.db.Create(&newDepartment).Error
 }
@@ -304,13 +567,61 @@ func (d localDepartment) GetUsers() (users []UserableEntry, err error) {
 	if err != nil {
 		return
 	}
-	for _, v := range localUsers {
-		v.local = d.local
-		users = append(users, &v)
+	for i := range localUsers {
+		localUsers[i].local = d.local
+		users = append(users, &localMember{
+			localUser: &localUsers[i],
+			role:      localUsers[i].departmentRole(d.ID),
+		})
 	}
 	return
 }
 
+// localMember is a user listed by a department, carrying its role there.
+type localMember struct {
+	*localUser
+	role DepartmentUserRole
+}
+
+func (m *localMember) GetRole() DepartmentUserRole {
+	return m.role
+}
+
+func (u localUser) departmentRole(departmentID uuid.UUID) DepartmentUserRole {
+	// roles come back from JSON as float64
+	if role, ok := u.Departemts[departmentID.String()].(float64); ok {
+		return DepartmentUserRole(role)
+	}
+	return DepartmentUserRoleMember
+}
+
+func (d localDepartment) AddToDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(d.local); err != nil {
+		return err
+	}
+	user, err := d.lookupLocalUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return err
+	}
+	if user.Departemts == nil {
+		user.Departemts = make(datatypes.JSONMap)
+	}
+	user.Departemts[d.ID.String()] = options.Role
+	return d.db.Save(user).Error
+}
+
+func (d localDepartment) RemoveFromDepartment(options DepartmentModifyUserOptions, extID ExternalIdentity) error {
+	if err := extID.CheckIfInternal(d.local); err != nil {
+		return err
+	}
+	user, err := d.lookupLocalUserByInternalExternalIdentity(extID)
+	if err != nil {
+		return err
+	}
+	delete(user.Departemts, d.ID.String())
+	return d.db.Save(user).Error
+}
+
 func (d localDepartment) GetExternalIdentities() (extIDs ExternalIdentities) {
 	_ = json.Unmarshal(d.ExtIDs, &extIDs)
 	return extIDs
@@ -324,6 +635,27 @@ func (d *localDepartment) SetExternalIdentities(extIDs ExternalIdentities) (err
 	return d.db.Save(d).Error
 }
 
+// localDeltaToken keeps the change tracking token of another target, Key
+// is the target key.
+type localDeltaToken struct {
+	Key       string `gorm:"primaryKey"`
+	Token     string
+	UpdatedAt time.Time
+}
+
+func (l *local) GetDeltaToken(key string) (string, error) {
+	var token localDeltaToken
+	err := l.db.Where("key = ?", key).Limit(1).Find(&token).Error
+	return token.Token, err
+}
+
+func (l *local) SetDeltaToken(key, token string) error {
+	if token == "" {
+		return l.db.Delete(&localDeltaToken{Key: key}).Error
+	}
+	return l.db.Save(&localDeltaToken{Key: key, Token: token}).Error
+}
+
 func JSON(in any) (bytes datatypes.JSON) {
 	bytes, _ = json.Marshal(in)
 	return bytes
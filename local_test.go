@@ -0,0 +1,103 @@
+package manager
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func openTestLocal(t *testing.T) *local {
+	t.Helper()
+	return openTestLocalAs(t, "hub")
+}
+
+func openTestLocalAs(t *testing.T, slug string) *local {
+	t.Helper()
+	dsn := t.TempDir() + "/" + slug + ".db"
+	l := new(local)
+	_, err := l.InitFormUnmarshaler(func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"local","Slug":"`+slug+`","FileDSN":"`+dsn+`"}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func named(name string) Departmentable {
+	department := NewDepartment()
+	department.Name = name
+	return department
+}
+
+// tree creates the departments of paths below the root of l, parents
+// first, and returns them by name.
+func tree(t *testing.T, l *local, paths ...string) map[string]DepartmentableEntry {
+	t.Helper()
+	root, _ := l.GetRootDepartment()
+	departments := map[string]DepartmentableEntry{"": root}
+	for _, path := range paths {
+		names := SplitDepartmentPath(path)
+		parent := departments[strings.Join(names[:len(names)-1], "/")]
+		created, err := parent.CreateChildDepartment(named(names[len(names)-1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		departments[path] = created
+	}
+	return departments
+}
+
+func parentOf(t *testing.T, l *local, department DepartmentableEntry) string {
+	t.Helper()
+	dept, err := l.lookupLocalDepartmentByInternalExternalIdentity(ExternalIdentityOfDepartment(l, department))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dept.ParentID.String()
+}
+
+func TestLocalUpdateDepartmentMovesUnderNestedParent(t *testing.T) {
+	l := openTestLocal(t)
+	departments := tree(t, l, "eng", "eng/platform", "eng/platform/infra", "sales")
+	infra := departments["eng/platform/infra"]
+	before := parentOf(t, l, infra)
+	sales := ExternalIdentityOfDepartment(l, departments["sales"])
+	moved, err := l.UpdateDepartment(sales, named("sales ops"), ExternalIdentityOfDepartment(l, infra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.GetName() != "sales ops" || parentOf(t, l, moved) != infra.GetID() {
+		t.Errorf("moved to %s named %q, want under infra", parentOf(t, l, moved), moved.GetName())
+	}
+	// walking the ancestors of the new parent leaves the parent as it was
+	if after := parentOf(t, l, infra); after != before {
+		t.Errorf("infra moved from %s to %s", before, after)
+	}
+	if infra.GetName() != "infra" {
+		t.Errorf("infra was renamed to %q", infra.GetName())
+	}
+}
+
+func TestLocalUpdateDepartmentRefusesCycles(t *testing.T) {
+	l := openTestLocal(t)
+	departments := tree(t, l, "eng", "eng/platform", "eng/platform/infra")
+	eng := ExternalIdentityOfDepartment(l, departments["eng"])
+	root := ExternalIdentityOfDepartment(l, departments[""])
+	for _, under := range []string{"eng", "eng/platform", "eng/platform/infra"} {
+		parent := ExternalIdentityOfDepartment(l, departments[under])
+		if _, err := l.UpdateDepartment(eng, named("eng"), parent); err == nil {
+			t.Errorf("moved eng under %s", under)
+		}
+	}
+	if parentOf(t, l, departments["eng"]) != departments[""].GetID() {
+		t.Error("a refused move changed the parent of eng")
+	}
+	if _, err := l.UpdateDepartment(root, named("root"), eng); err == nil {
+		t.Error("moved the root department")
+	}
+	// keeping the parent skips the walk
+	if _, err := l.UpdateDepartment(eng, named("engineering"), InvalidExternalIdentity); err != nil {
+		t.Error(err)
+	}
+}
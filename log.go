@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is what platforms receive at init, already carrying the fields of
+// the target being initialized.
+type Logger = logrus.FieldLogger
+
+// LoggerSetter is implemented by platforms that want a logger before
+// InitFormUnmarshaler runs.
+type LoggerSetter interface {
+	SetLogger(logger Logger)
+}
+
+var Log = newLogger()
+
+func newLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetFormatter(&redactingFormatter{Formatter: &logrus.TextFormatter{}})
+	return logger
+}
+
+// ConfigureLogging applies --log-level and --log-format, format is text or json.
+func ConfigureLogging(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Log.SetLevel(lvl)
+	switch format {
+	case "", "text":
+		Log.SetFormatter(&redactingFormatter{Formatter: &logrus.TextFormatter{}})
+	case "json":
+		Log.SetFormatter(&redactingFormatter{Formatter: &logrus.JSONFormatter{}})
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+	return nil
+}
+
+var (
+	secretFieldKeys = []string{"secret", "token", "password", "pem", "apikey", "api_key", "credential"}
+	emailFieldKeys  = []string{"email", "mail"}
+	phoneFieldKeys  = []string{"phone", "mobile"}
+	tokenPattern    = regexp.MustCompile(`\S+`)
+	emailPattern    = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+	phonePattern    = regexp.MustCompile(`\+\d{6,}(\d{4})|\b1[3-9]\d{5}(\d{4})\b`)
+)
+
+// redactingFormatter drops secrets and masks emails and phones before the
+// wrapped formatter renders an entry, so shipped logs carry no credentials or PII.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		redacted.Data[key] = redactField(key, value)
+	}
+	redacted.Message = redactString(entry.Message)
+	return f.Formatter.Format(&redacted)
+}
+
+func redactField(key string, value any) any {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	lowerKey := strings.ToLower(key)
+	for _, secret := range secretFieldKeys {
+		if strings.Contains(lowerKey, secret) {
+			return "[REDACTED]"
+		}
+	}
+	str, ok := value.(string)
+	if !ok {
+		return value
+	}
+	for _, phone := range phoneFieldKeys {
+		if strings.Contains(lowerKey, phone) {
+			return maskPhone(str)
+		}
+	}
+	for _, email := range emailFieldKeys {
+		if strings.Contains(lowerKey, email) {
+			return emailPattern.ReplaceAllString(str, "$1***@$2")
+		}
+	}
+	return redactString(str)
+}
+
+// redactString masks emails and phone numbers in free text but keeps
+// external identities, which look like emails and are what logs are searched by.
+func redactString(str string) string {
+	return tokenPattern.ReplaceAllStringFunc(str, func(token string) string {
+		if ExternalIdentity(strings.Trim(token, `"',;:()[]{}`)).Valid() {
+			return token
+		}
+		token = emailPattern.ReplaceAllString(token, "$1***@$2")
+		return phonePattern.ReplaceAllString(token, "***$1$2")
+	})
+}
+
+func maskPhone(phone string) string {
+	if len(phone) <= 4 {
+		return "***"
+	}
+	return "***" + phone[len(phone)-4:]
+}
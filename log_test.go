@@ -0,0 +1,108 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logged renders one entry through the redacting formatter as JSON.
+func logged(t *testing.T, fields logrus.Fields, msg string) map[string]any {
+	t.Helper()
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&redactingFormatter{Formatter: &logrus.JSONFormatter{}})
+	logger.WithFields(fields).Info(msg)
+	var entry map[string]any
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("%s: %v", out.String(), err)
+	}
+	return entry
+}
+
+func TestRedactingFormatterFields(t *testing.T) {
+	for _, tc := range []struct {
+		key   string
+		value any
+		want  any
+	}{
+		{"token", "abc", "[REDACTED]"},
+		{"AppSecret", "abc", "[REDACTED]"},
+		{"bind_password", "abc", "[REDACTED]"},
+		{"PrivateKeyPEM", "-----BEGIN", "[REDACTED]"},
+		{"ApiKey", 42, "[REDACTED]"},
+		{"credentials", errors.New("user:pass"), "[REDACTED]"},
+		{"email", "ann.lee@example.com", "a***@example.com"},
+		{"Emails", "ann@example.com, bob@example.org", "a***@example.com, b***@example.org"},
+		{"phone", "+1 555 0100", "***0100"},
+		{"mobile", "123", "***"},
+		{"name", "Ann Lee", "Ann Lee"},
+		{"count", float64(3), float64(3)},
+		{"detail", "mail ann@example.com or call +8613800138000", "mail a***@example.com or call ***8000"},
+		{"error", errors.New("no user ann@example.com"), "no user a***@example.com"},
+		{"extID", "ei.user.1@hub.local", "ei.user.1@hub.local"},
+	} {
+		if got := logged(t, logrus.Fields{tc.key: tc.value}, "")[tc.key]; got != tc.want {
+			t.Errorf("%s=%v: got %v, want %v", tc.key, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestRedactingFormatterMessage(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want string
+	}{
+		{"synced ann@example.com", "synced a***@example.com"},
+		{"linked (ei.user.1@hub.local) to ei.user.2@main.feishu,", "linked (ei.user.1@hub.local) to ei.user.2@main.feishu,"},
+		{"call 13800138000 or +4930123456789", "call ***8000 or ***6789"},
+		{"user 12345 has 13 groups", "user 12345 has 13 groups"},
+	} {
+		if got := logged(t, nil, tc.msg)["msg"]; got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestRedactingFormatterKeepsTheEntry(t *testing.T) {
+	entry := logrus.NewEntry(logrus.New()).WithField("token", "abc")
+	entry.Message = "ann@example.com"
+	formatter := &redactingFormatter{Formatter: &logrus.TextFormatter{DisableColors: true}}
+	out, err := formatter.Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "abc") || strings.Contains(string(out), "ann@") {
+		t.Errorf("rendered %s", out)
+	}
+	if entry.Data["token"] != "abc" || entry.Message != "ann@example.com" {
+		t.Errorf("the entry was changed to %v %q", entry.Data, entry.Message)
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	level, formatter := Log.Level, Log.Formatter
+	defer func() { Log.SetLevel(level); Log.SetFormatter(formatter) }()
+	if err := ConfigureLogging("debug", "json"); err != nil {
+		t.Fatal(err)
+	}
+	if Log.Level != logrus.DebugLevel {
+		t.Errorf("level is %s", Log.Level)
+	}
+	if redacting, ok := Log.Formatter.(*redactingFormatter); !ok {
+		t.Errorf("formatter %T does not redact", Log.Formatter)
+	} else if _, ok := redacting.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Errorf("formatter renders with %T", redacting.Formatter)
+	}
+	if err := ConfigureLogging("loud", "text"); err == nil {
+		t.Error("accepted level loud")
+	}
+	if err := ConfigureLogging("info", "xml"); err == nil {
+		t.Error("accepted format xml")
+	}
+}
@@ -1,5 +1,10 @@
 package manager
 
+import (
+	"fmt"
+	"strings"
+)
+
 type DepartmentUserRole uint
 
 const (
@@ -14,3 +19,26 @@ const (
 	DepartmentUserActionAdd
 	DepartmentUserActionDelete
 )
+
+func (r DepartmentUserRole) String() string {
+	switch r {
+	case DepartmentUserRoleMember:
+		return "member"
+	case DepartmentUserRoleAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("role(%d)", uint(r))
+	}
+}
+
+// ParseDepartmentUserRole reads member or admin, empty means member.
+func ParseDepartmentUserRole(raw string) (DepartmentUserRole, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", "member":
+		return DepartmentUserRoleMember, nil
+	case "admin":
+		return DepartmentUserRoleAdmin, nil
+	default:
+		return DepartmentUserRoleMember, fmt.Errorf("invalid role %q, should be member or admin", raw)
+	}
+}
@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Observer receives every API call made through decorated targets and the
+// number of entries they returned, the monitor daemon turns them into metrics.
+type Observer interface {
+	ObserveCall(target Target, operation string, duration time.Duration, err error)
+	ObserveEntries(target Target, entryType EntryType, count int)
+}
+
+var (
+	observersMu sync.RWMutex
+	observers   []Observer
+)
+
+func RegisterObserver(observer Observer) {
+	observersMu.Lock()
+	defer observersMu.Unlock()
+	observers = append(observers, observer)
+}
+
+func observeCall(target Target, operation string, duration time.Duration, err error) {
+	observersMu.RLock()
+	defer observersMu.RUnlock()
+	for _, observer := range observers {
+		observer.ObserveCall(target, operation, duration, err)
+	}
+}
+
+func observeEntries(target Target, entryType EntryType, count int) {
+	observersMu.RLock()
+	defer observersMu.RUnlock()
+	for _, observer := range observers {
+		observer.ObserveEntries(target, entryType, count)
+	}
+}
+
+// ErrorType buckets errors into a small set usable as a metric label.
+func ErrorType(err error) string {
+	if err == nil {
+		return ""
+	}
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, ErrNotSupported):
+		return "not_supported"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	var statusErr StatusCodeError
+	if errors.As(err, &statusErr) {
+		switch status := statusErr.StatusCode(); {
+		case status == 429:
+			return "rate_limited"
+		case status >= 500:
+			return "server"
+		case status >= 400:
+			return "client"
+		}
+	}
+	var afterErr RetryAfterError
+	if errors.As(err, &afterErr) {
+		return "rate_limited"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	return "other"
+}
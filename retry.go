@@ -0,0 +1,370 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RetryConfig struct {
+	Disabled         bool
+	MaxAttempts      int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts:      5,
+	BaseDelay:        500 * time.Millisecond,
+	MaxDelay:         30 * time.Second,
+	BreakerThreshold: 10,
+	BreakerCooldown:  time.Minute,
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.Disabled {
+		c.MaxAttempts = 1
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultRetryConfig.MaxAttempts
+	}
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = DefaultRetryConfig.BaseDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = DefaultRetryConfig.MaxDelay
+	}
+	if c.BreakerThreshold <= 0 {
+		c.BreakerThreshold = DefaultRetryConfig.BreakerThreshold
+	}
+	if c.BreakerCooldown <= 0 {
+		c.BreakerCooldown = DefaultRetryConfig.BreakerCooldown
+	}
+	return c
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// ErrorClassifier lets a platform tell the retry decorator which of its SDK
+// errors are transient and how long the remote side asked us to wait.
+type ErrorClassifier interface {
+	ClassifyError(err error) (retryable bool, retryAfter time.Duration)
+}
+
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+type StatusCodeError interface {
+	error
+	StatusCode() int
+}
+
+// HTTPError is returned by drivers talking plain HTTP so the status and
+// rate-limit headers reach the retry decorator.
+type HTTPError struct {
+	Status int
+	Header http.Header
+	Body   string
+}
+
+func NewHTTPError(resp *http.Response, body []byte) *HTTPError {
+	return &HTTPError{Status: resp.StatusCode, Header: resp.Header, Body: string(body)}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("http status %d", e.Status)
+	}
+	return fmt.Sprintf("http status %d: %s", e.Status, e.Body)
+}
+
+func (e *HTTPError) StatusCode() int {
+	return e.Status
+}
+
+func (e *HTTPError) RetryAfter() time.Duration {
+	return RetryAfterFromHeader(e.Header)
+}
+
+func IsRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RetryAfterFromHeader understands Retry-After in both its forms and the
+// reset headers used by GitHub, Okta and Feishu once the quota is spent.
+func RetryAfterFromHeader(header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	if v := header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			return time.Until(at)
+		}
+	}
+	for _, prefix := range []string{"X-RateLimit", "X-Rate-Limit"} {
+		if header.Get(prefix+"-Remaining") != "0" {
+			continue
+		}
+		if reset, err := strconv.ParseInt(header.Get(prefix+"-Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0))
+		}
+	}
+	if v := header.Get("X-Ogw-Ratelimit-Reset"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// ClassifyError is the fallback used when a target has no ErrorClassifier.
+func ClassifyError(err error) (retryable bool, retryAfter time.Duration) {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrNotSupported) {
+		return false, 0
+	}
+	var afterErr RetryAfterError
+	if errors.As(err, &afterErr) {
+		retryAfter = afterErr.RetryAfter()
+	}
+	var statusErr StatusCodeError
+	if errors.As(err, &statusErr) {
+		return IsRetryableStatus(statusErr.StatusCode()), retryAfter
+	}
+	if retryAfter > 0 {
+		return true, retryAfter
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	return errors.Is(err, context.DeadlineExceeded), 0
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+func (b *circuitBreaker) record(transientFailure bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !transientFailure {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.failures = 0
+	}
+}
+
+type retryTarget struct {
+	Target
+	config  RetryConfig
+	breaker *circuitBreaker
+}
+
+// WithRetry wraps target so transient failures are retried with jittered
+// exponential backoff, and a run of them opens a per-target circuit breaker.
+// A disabled config still wraps target so calls keep reaching observers.
+func WithRetry(target Target, config RetryConfig) Target {
+	config = config.withDefaults()
+	retryTarget := &retryTarget{Target: target, config: config}
+	if !config.Disabled {
+		retryTarget.breaker = &circuitBreaker{
+			threshold: config.BreakerThreshold,
+			cooldown:  config.BreakerCooldown,
+		}
+	}
+	return retryTarget
+}
+
+func (t *retryTarget) Unwrap() any {
+	return t.Target
+}
+
+func (t *retryTarget) GetTarget() Target {
+	return t
+}
+
+func (t *retryTarget) classify(err error) (bool, time.Duration) {
+	if classifier, ok := As[ErrorClassifier](t.Target); ok {
+		return classifier.ClassifyError(err)
+	}
+	return ClassifyError(err)
+}
+
+func (t *retryTarget) backoff(attempt int) time.Duration {
+	ceiling := t.config.BaseDelay << attempt
+	if ceiling <= 0 || ceiling > t.config.MaxDelay {
+		ceiling = t.config.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// do runs fn until it succeeds or fails permanently. Calls that are not
+// idempotent are only retried when the remote side explicitly throttled them.
+func (t *retryTarget) do(operation string, idempotent bool, fn func() error) (err error) {
+	for attempt := 0; attempt < t.config.MaxAttempts; attempt++ {
+		if err = t.breaker.allow(); err != nil {
+			err = fmt.Errorf("%s: %w", TargetKey(t), err)
+			observeCall(t, operation, 0, err)
+			return err
+		}
+		start := time.Now()
+		err = fn()
+		observeCall(t, operation, time.Since(start), err)
+		retryable, retryAfter := t.classify(err)
+		t.breaker.record(retryable)
+		if !retryable || (!idempotent && retryAfter <= 0) {
+			return err
+		}
+		if retryAfter > t.config.MaxDelay || attempt == t.config.MaxAttempts-1 {
+			return err
+		}
+		delay := t.backoff(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter + delay/4
+		}
+		time.Sleep(delay)
+	}
+	return err
+}
+
+func (t *retryTarget) wrapDepartment(department DepartmentableEntry) DepartmentableEntry {
+	if department == nil {
+		return nil
+	}
+	return &retryDepartment{DepartmentableEntry: department, target: t}
+}
+
+func (t *retryTarget) GetRootDepartment() (department DepartmentableEntry, err error) {
+	err = t.do("get_root_department", true, func() (err error) {
+		department, err = t.Target.GetRootDepartment()
+		return err
+	})
+	return t.wrapDepartment(department), err
+}
+
+func (t *retryTarget) GetAllUsers() ([]UserableEntry, error) {
+	return t.GetAllUsersContext(context.Background())
+}
+
+// GetAllUsersContext walks the departments itself for targets that walk them
+// anyway, so a failing department is retried alone instead of the walk.
+func (t *retryTarget) GetAllUsersContext(ctx context.Context) (users []UserableEntry, err error) {
+	if walker, ok := As[TargetWithTraversal](t.Target); ok {
+		root, err := t.GetRootDepartment()
+		if err != nil {
+			return nil, err
+		}
+		return ConcurrentGetAllUsersIncludeChildDepartments(ctx, root, walker.GetTraverseOptions())
+	}
+	err = t.do("get_all_users", true, func() (err error) {
+		users, err = GetAllUsersContext(ctx, t.Target)
+		return err
+	})
+	observeEntries(t, EntryTypeUser, len(users))
+	return users, err
+}
+
+func (t *retryTarget) LookupEntryUserByInternalExternalIdentity(internalExtID ExternalIdentity) (user UserableEntry, err error) {
+	err = t.do("lookup_user", true, func() (err error) {
+		user, err = t.Target.LookupEntryUserByInternalExternalIdentity(internalExtID)
+		return err
+	})
+	return user, err
+}
+
+func (t *retryTarget) LookupEntryDepartmentByInternalExternalIdentity(internalExtID ExternalIdentity) (department DepartmentableEntry, err error) {
+	err = t.do("lookup_department", true, func() (err error) {
+		department, err = t.Target.LookupEntryDepartmentByInternalExternalIdentity(internalExtID)
+		return err
+	})
+	return t.wrapDepartment(department), err
+}
+
+// Around retries calls on optional interfaces like the methods of target,
+// writes that are not idempotent only when they were throttled.
+func (t *retryTarget) Around(call Call, fn func() error) error {
+	return t.do(call.Operation, !call.Write || call.Idempotent, fn)
+}
+
+type retryDepartment struct {
+	DepartmentableEntry
+	target *retryTarget
+}
+
+func (d *retryDepartment) Unwrap() any {
+	return d.DepartmentableEntry
+}
+
+func (d *retryDepartment) GetTarget() Target {
+	return d.target
+}
+
+func (d *retryDepartment) GetChildDepartments() (departments []DepartmentableEntry) {
+	for _, child := range d.DepartmentableEntry.GetChildDepartments() {
+		departments = append(departments, d.target.wrapDepartment(child))
+	}
+	observeEntries(d.target, EntryTypeDept, len(departments))
+	return departments
+}
+
+func (d *retryDepartment) CreateChildDepartment(departmentable Departmentable) (department DepartmentableEntry, err error) {
+	err = d.target.do("create_department", false, func() (err error) {
+		department, err = d.DepartmentableEntry.CreateChildDepartment(departmentable)
+		return err
+	})
+	return d.target.wrapDepartment(department), err
+}
+
+func (d *retryDepartment) GetUsers() (users []UserableEntry, err error) {
+	err = d.target.do("get_users", true, func() (err error) {
+		users, err = d.DepartmentableEntry.GetUsers()
+		return err
+	})
+	observeEntries(d.target, EntryTypeUser, len(users))
+	return users, err
+}
+
+func (d *retryDepartment) Around(call Call, fn func() error) error {
+	return d.target.Around(call, fn)
+}
@@ -0,0 +1,194 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// throttledError asks to be retried after a delay without a status code.
+type throttledError time.Duration
+
+func (e throttledError) Error() string             { return "throttled" }
+func (e throttledError) RetryAfter() time.Duration { return time.Duration(e) }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func status(code int) error {
+	return &HTTPError{Status: code}
+}
+
+var fastRetry = RetryConfig{MaxAttempts: 4, BaseDelay: time.Microsecond, MaxDelay: time.Millisecond, BreakerThreshold: 100}
+
+// failing returns a call failing with errs in turn, then succeeding, and
+// the number of times it ran.
+func failing(errs ...error) (func() error, *int) {
+	calls := new(int)
+	return func() error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+		return nil
+	}, calls
+}
+
+func TestRetryRetriesTransientFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		call  Call
+		errs  []error
+		calls int
+		fails bool
+	}{
+		{"success", Call{}, nil, 1, false},
+		{"transient statuses", Call{}, []error{status(503), status(429), status(502)}, 4, false},
+		{"up to MaxAttempts", Call{}, []error{status(500), status(500), status(500), status(500), status(500)}, 4, true},
+		{"permanent status", Call{}, []error{status(400)}, 1, true},
+		{"not found", Call{}, []error{status(404)}, 1, true},
+		{"timeout", Call{}, []error{timeoutError{}}, 2, false},
+		{"deadline", Call{}, []error{context.DeadlineExceeded}, 2, false},
+		{"canceled", Call{}, []error{context.Canceled}, 1, true},
+		{"not supported", Call{}, []error{fmt.Errorf("x: %w", ErrNotSupported)}, 1, true},
+		{"plain error", Call{}, []error{errors.New("bad input")}, 1, true},
+		{"idempotent write", Call{Write: true, Idempotent: true}, []error{status(503)}, 2, false},
+		{"write without throttling", Call{Write: true}, []error{status(503)}, 1, true},
+		{"throttled write", Call{Write: true}, []error{throttledError(time.Microsecond)}, 2, false},
+		{"throttled longer than MaxDelay", Call{}, []error{throttledError(time.Hour)}, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := WithRetry(openTestLocal(t), fastRetry)
+			fn, calls := failing(tc.errs...)
+			err := Do(target, tc.call, fn)
+			if *calls != tc.calls || (err != nil) != tc.fails {
+				t.Errorf("ran %d times with %v, want %d times failing %v", *calls, err, tc.calls, tc.fails)
+			}
+		})
+	}
+}
+
+func TestRetryDisabledRunsOnce(t *testing.T) {
+	config := fastRetry
+	config.Disabled = true
+	target := WithRetry(openTestLocal(t), config)
+	fn, calls := failing(status(503))
+	if err := Do(target, Call{}, fn); err == nil || *calls != 1 {
+		t.Errorf("ran %d times with %v, want once failing", *calls, err)
+	}
+}
+
+// classifyingTarget takes every error for transient.
+type classifyingTarget struct {
+	*local
+}
+
+func (classifyingTarget) ClassifyError(err error) (bool, time.Duration) {
+	return err != nil, 0
+}
+
+func TestRetryPrefersTheClassifierOfTheTarget(t *testing.T) {
+	target := WithRetry(classifyingTarget{openTestLocal(t)}, fastRetry)
+	fn, calls := failing(errors.New("driver specific"))
+	if err := Do(target, Call{}, fn); err != nil || *calls != 2 {
+		t.Errorf("ran %d times with %v, want the driver error retried", *calls, err)
+	}
+}
+
+func TestRetryBreakerOpensAfterARunOfFailures(t *testing.T) {
+	config := fastRetry
+	config.MaxAttempts, config.BreakerThreshold, config.BreakerCooldown = 1, 3, time.Hour
+	target := WithRetry(openTestLocal(t), config)
+
+	// a success in between starts the run again
+	fn, calls := failing(status(503), status(503), nil, status(503), status(503))
+	for i := 0; i < 5; i++ {
+		_ = Do(target, Call{}, fn)
+	}
+	// permanent failures do not count
+	_ = Do(target, Call{}, func() error { return status(400) })
+	if err := Do(target, Call{}, fn); err != nil || *calls != 6 {
+		t.Fatalf("ran %d times with %v, want the breaker closed", *calls, err)
+	}
+
+	fn, calls = failing(status(503), status(503), status(503))
+	for i := 0; i < 3; i++ {
+		_ = Do(target, Call{}, fn)
+	}
+	err := Do(target, Call{}, fn)
+	if !errors.Is(err, ErrCircuitOpen) || *calls != 3 {
+		t.Errorf("ran %d times with %v, want the breaker open", *calls, err)
+	}
+	if _, err := target.GetRootDepartment(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got %v from the target, want the breaker open", err)
+	}
+}
+
+func TestRetryBreakerClosesAfterCooldown(t *testing.T) {
+	config := fastRetry
+	config.MaxAttempts, config.BreakerThreshold, config.BreakerCooldown = 1, 1, 10*time.Millisecond
+	target := WithRetry(openTestLocal(t), config)
+	_ = Do(target, Call{}, func() error { return status(503) })
+	if err := Do(target, Call{}, func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want the breaker open", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := Do(target, Call{}, func() error { return nil }); err != nil {
+		t.Errorf("got %v after the cooldown", err)
+	}
+}
+
+func TestRetryBackoffStaysUnderItsCeiling(t *testing.T) {
+	target := WithRetry(openTestLocal(t), RetryConfig{BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond}).(*retryTarget)
+	for attempt, ceiling := range map[int]time.Duration{
+		0:   time.Millisecond,
+		3:   8 * time.Millisecond,
+		6:   50 * time.Millisecond,
+		100: 50 * time.Millisecond,
+	} {
+		for i := 0; i < 200; i++ {
+			if delay := target.backoff(attempt); delay < 0 || delay > ceiling {
+				t.Fatalf("attempt %d waited %s, want at most %s", attempt, delay, ceiling)
+			}
+		}
+	}
+}
+
+func TestRetryAfterFromHeader(t *testing.T) {
+	in := func(d time.Duration) string { return strconv.FormatInt(time.Now().Add(d).Unix(), 10) }
+	for _, tc := range []struct {
+		header http.Header
+		min    time.Duration
+		max    time.Duration
+	}{
+		{nil, 0, 0},
+		{http.Header{"Retry-After": {"7"}}, 7 * time.Second, 7 * time.Second},
+		{http.Header{"Retry-After": {time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)}}, 28 * time.Second, 30 * time.Second},
+		{http.Header{"Retry-After": {"soon"}}, 0, 0},
+		{http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {in(time.Minute)}}, 58 * time.Second, time.Minute},
+		{http.Header{"X-Ratelimit-Remaining": {"12"}, "X-Ratelimit-Reset": {in(time.Minute)}}, 0, 0},
+		{http.Header{"X-Rate-Limit-Remaining": {"0"}, "X-Rate-Limit-Reset": {in(time.Minute)}}, 58 * time.Second, time.Minute},
+		{http.Header{"X-Ogw-Ratelimit-Reset": {"3"}}, 3 * time.Second, 3 * time.Second},
+	} {
+		if got := RetryAfterFromHeader(tc.header); got < tc.min || got > tc.max {
+			t.Errorf("%v: got %s, want between %s and %s", tc.header, got, tc.min, tc.max)
+		}
+	}
+}
+
+func TestHTTPErrorCarriesRetryAfter(t *testing.T) {
+	err := fmt.Errorf("call: %w", &HTTPError{Status: 429, Header: http.Header{"Retry-After": {"2"}}})
+	if retryable, after := ClassifyError(err); !retryable || after != 2*time.Second {
+		t.Errorf("got %v %s, want retryable after 2s", retryable, after)
+	}
+}
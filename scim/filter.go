@@ -0,0 +1,439 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Filter is a parsed SCIM filter of RFC 7644 3.4.2.2, matched against a
+// resource decoded into a generic JSON map.
+type Filter interface {
+	Match(resource map[string]any) bool
+}
+
+// AttrPath is an attribute path like emails.value, urn is set for
+// extension attributes only, core schema prefixes are dropped.
+type AttrPath struct {
+	URN  string
+	Attr string
+	Sub  string
+}
+
+func (p AttrPath) String() string {
+	path := p.Attr
+	if p.Sub != "" {
+		path += "." + p.Sub
+	}
+	if p.URN != "" {
+		path = p.URN + ":" + path
+	}
+	return path
+}
+
+func ParseAttrPath(raw string) (AttrPath, error) {
+	var path AttrPath
+	if strings.HasPrefix(strings.ToLower(raw), "urn:") {
+		i := strings.LastIndex(raw, ":")
+		path.URN, raw = raw[:i], raw[i+1:]
+		if strings.EqualFold(path.URN, SchemaUser) || strings.EqualFold(path.URN, SchemaGroup) {
+			path.URN = ""
+		}
+	}
+	path.Attr, path.Sub, _ = strings.Cut(raw, ".")
+	if path.Attr == "" || strings.Contains(path.Sub, ".") {
+		return path, NewError(http.StatusBadRequest, "invalidPath", "invalid attribute path %q", raw)
+	}
+	return path, nil
+}
+
+// values returns the values of the attribute in resource, multi-valued
+// complex attributes without a sub-attribute give their value sub-attribute.
+func (p AttrPath) values(resource map[string]any) (values []any) {
+	object := resource
+	if p.URN != "" {
+		extension, _ := lookup(resource, p.URN).(map[string]any)
+		object = extension
+	}
+	value := lookup(object, p.Attr)
+	sub := p.Sub
+	if list, ok := value.([]any); ok {
+		if sub == "" {
+			sub = "value"
+		}
+		for _, item := range list {
+			if complex, ok := item.(map[string]any); ok {
+				values = appendValue(values, lookup(complex, sub))
+			} else {
+				values = appendValue(values, item)
+			}
+		}
+		return values
+	}
+	if complex, ok := value.(map[string]any); ok && sub != "" {
+		return appendValue(values, lookup(complex, sub))
+	}
+	return appendValue(values, value)
+}
+
+func appendValue(values []any, value any) []any {
+	if value == nil {
+		return values
+	}
+	return append(values, value)
+}
+
+// lookup reads key case-insensitively, attribute names are case-insensitive.
+func lookup(object map[string]any, key string) any {
+	if value, ok := object[key]; ok {
+		return value
+	}
+	for k, value := range object {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
+	return nil
+}
+
+func lookupKey(object map[string]any, key string) string {
+	for k := range object {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+	}
+	return key
+}
+
+type logicalFilter struct {
+	and         bool
+	left, right Filter
+}
+
+func (f logicalFilter) Match(resource map[string]any) bool {
+	if f.and {
+		return f.left.Match(resource) && f.right.Match(resource)
+	}
+	return f.left.Match(resource) || f.right.Match(resource)
+}
+
+type notFilter struct {
+	inner Filter
+}
+
+func (f notFilter) Match(resource map[string]any) bool {
+	return !f.inner.Match(resource)
+}
+
+type presentFilter struct {
+	path AttrPath
+}
+
+func (f presentFilter) Match(resource map[string]any) bool {
+	for _, value := range f.path.values(resource) {
+		if str, ok := value.(string); !ok || str != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// valuePathFilter matches when an element of a multi-valued attribute
+// matches, like emails[type eq "work" and value co "@example.com"].
+type valuePathFilter struct {
+	path   AttrPath
+	filter Filter
+}
+
+func (f valuePathFilter) Match(resource map[string]any) bool {
+	return len(f.elements(resource)) != 0
+}
+
+func (f valuePathFilter) elements(resource map[string]any) (indexes []int) {
+	object := resource
+	if f.path.URN != "" {
+		object, _ = lookup(resource, f.path.URN).(map[string]any)
+	}
+	list, _ := lookup(object, f.path.Attr).([]any)
+	for i, item := range list {
+		if complex, ok := item.(map[string]any); ok && f.filter.Match(complex) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+type compareFilter struct {
+	path  AttrPath
+	op    string
+	value any
+}
+
+func (f compareFilter) Match(resource map[string]any) bool {
+	values := f.path.values(resource)
+	if f.op == "ne" {
+		return !compareFilter{path: f.path, op: "eq", value: f.value}.Match(resource)
+	}
+	if f.value == nil && f.op == "eq" {
+		return len(values) == 0
+	}
+	for _, value := range values {
+		if compare(value, f.op, f.value, strings.EqualFold(f.path.Attr, "externalId") || strings.EqualFold(f.path.Attr, "id")) {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(actual any, op string, expected any, caseExact bool) bool {
+	switch expected := expected.(type) {
+	case string:
+		actual, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		if !caseExact {
+			actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+		}
+		switch op {
+		case "eq":
+			return actual == expected
+		case "co":
+			return strings.Contains(actual, expected)
+		case "sw":
+			return strings.HasPrefix(actual, expected)
+		case "ew":
+			return strings.HasSuffix(actual, expected)
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	case float64:
+		actual, ok := actual.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return actual == expected
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	case bool:
+		actual, ok := actual.(bool)
+		return ok && op == "eq" && actual == expected
+	}
+	return false
+}
+
+// ParseFilter parses filters like userName eq "bjensen" and emails[type eq "work"].
+func ParseFilter(raw string) (Filter, error) {
+	tokens, err := tokenizeFilter(raw)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	filter, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos != len(parser.tokens) {
+		return nil, invalidFilter("unexpected %q", parser.tokens[parser.pos].text)
+	}
+	return filter, nil
+}
+
+func invalidFilter(format string, args ...any) *Error {
+	return NewError(http.StatusBadRequest, "invalidFilter", format, args...)
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeFilter(raw string) (tokens []filterToken, err error) {
+	for i := 0; i < len(raw); {
+		c := raw[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(raw) && raw[end] != '"'; end++ {
+				if raw[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(raw) {
+				return nil, invalidFilter("unterminated string in %q", raw)
+			}
+			var str string
+			if err := json.Unmarshal([]byte(raw[i:end+1]), &str); err != nil {
+				return nil, invalidFilter("invalid string %s", raw[i:end+1])
+			}
+			tokens = append(tokens, filterToken{text: str, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(raw) && !unicode.IsSpace(rune(raw[end])) && !strings.ContainsRune("()[]\"", rune(raw[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: raw[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *filterParser) keyword(word string) bool {
+	token, ok := p.peek()
+	if ok && !token.quoted && strings.EqualFold(token.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(text string) error {
+	if !p.keyword(text) {
+		return invalidFilter("expected %q", text)
+	}
+	return nil
+}
+
+func (p *filterParser) or() (Filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalFilter{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (Filter, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalFilter{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) not() (Filter, error) {
+	if p.keyword("not") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{inner: inner}, p.expect(")")
+	}
+	return p.primary()
+}
+
+func (p *filterParser) primary() (Filter, error) {
+	if p.keyword("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	token, ok := p.peek()
+	if !ok || token.quoted {
+		return nil, invalidFilter("expected attribute path")
+	}
+	p.pos++
+	path, err := ParseAttrPath(token.text)
+	if err != nil {
+		return nil, invalidFilter("%s", err.(*Error).Detail)
+	}
+	if p.keyword("[") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return valuePathFilter{path: path, filter: inner}, p.expect("]")
+	}
+	opToken, ok := p.peek()
+	if !ok {
+		return nil, invalidFilter("expected operator after %s", path)
+	}
+	p.pos++
+	op := strings.ToLower(opToken.text)
+	switch op {
+	case "pr":
+		return presentFilter{path: path}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, invalidFilter("unknown operator %q", opToken.text)
+	}
+	valueToken, ok := p.peek()
+	if !ok {
+		return nil, invalidFilter("expected value after %s %s", path, op)
+	}
+	p.pos++
+	value, err := filterValue(valueToken)
+	if err != nil {
+		return nil, err
+	}
+	return compareFilter{path: path, op: op, value: value}, nil
+}
+
+func filterValue(token filterToken) (any, error) {
+	if token.quoted {
+		return token.text, nil
+	}
+	var value any
+	if err := json.Unmarshal([]byte(token.text), &value); err != nil {
+		return nil, invalidFilter("invalid value %q", token.text)
+	}
+	switch value.(type) {
+	case nil, bool, float64:
+		return value, nil
+	default:
+		return nil, invalidFilter("invalid value %q", token.text)
+	}
+}
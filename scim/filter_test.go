@@ -0,0 +1,144 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+const filterUser = `{
+	"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+	"id": "Ab1",
+	"externalId": "X-7",
+	"userName": "Bjensen@Example.com",
+	"active": true,
+	"name": {"formatted": "Barbara Jensen"},
+	"emails": [
+		{"value": "bjensen@example.com", "type": "work", "primary": true},
+		{"value": "babs@home.example.org", "type": "home"}
+	],
+	"phoneNumbers": [{"value": "+1 555 0100", "type": "work"}],
+	"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group": {"description": "", "level": 3}
+}`
+
+func TestParseFilterMatches(t *testing.T) {
+	var resource map[string]any
+	if err := json.Unmarshal([]byte(filterUser), &resource); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "bjensen@example.com"`, true},
+		{`USERNAME EQ "BJENSEN@EXAMPLE.COM"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "bjensen@example.com"`, true},
+		{`userName ne "bjensen@example.com"`, false},
+		{`userName ne "ann@example.com"`, true},
+		{`userName co "jensen"`, true},
+		{`userName sw "bj"`, true},
+		{`userName ew ".com"`, true},
+		{`userName gt "a"`, true},
+		{`userName ge "bjensen@example.com"`, true},
+		{`userName lt "b"`, false},
+		{`userName le "c"`, true},
+		// id and externalId are case exact
+		{`externalId eq "X-7"`, true},
+		{`externalId eq "x-7"`, false},
+		{`id eq "ab1"`, false},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`active eq "true"`, false},
+		{`nickName eq null`, true},
+		{`userName eq null`, false},
+		{`name.formatted sw "Barbara"`, true},
+		{`emails.value eq "babs@home.example.org"`, true},
+		{`emails eq "bjensen@example.com"`, true},
+		{`emails.type eq "other"`, false},
+		{`phoneNumbers pr`, true},
+		{`nickName pr`, false},
+		{`urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group:description pr`, false},
+		{`urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group:level ge 3`, true},
+		{`urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group:level lt 3`, false},
+		{`emails[type eq "work" and value co "@example.com"]`, true},
+		{`emails[type eq "home" and value co "@example.com"]`, false},
+		{`emails[type eq "home" or primary eq true]`, true},
+		{`emails[not (primary eq true)]`, true},
+		{`not (userName eq "bjensen@example.com")`, false},
+		{`userName eq "ann" or active eq true`, true},
+		{`userName eq "ann" or active eq true and externalId eq "Y"`, false},
+		{`(userName eq "ann" or active eq true) and externalId eq "X-7"`, true},
+		{`userName eq "bjensen@example.com" and (emails.type eq "home" or nickName pr)`, true},
+		{`userName eq "quote \" in \\ it"`, false},
+	} {
+		filter, err := ParseFilter(tc.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tc.filter, err)
+			continue
+		}
+		if got := filter.Match(resource); got != tc.match {
+			t.Errorf("%s matched %v, want %v", tc.filter, got, tc.match)
+		}
+	}
+}
+
+func TestParseFilterRejectsMalformed(t *testing.T) {
+	for _, raw := range []string{
+		``,
+		`   `,
+		`userName`,
+		`userName eq`,
+		`userName xx "a"`,
+		`userName eq bjensen`,
+		`userName eq "unterminated`,
+		`userName eq "escaped at the end\"`,
+		`userName eq "a" and`,
+		`userName eq "a" or or`,
+		`userName eq "a" extra`,
+		`(userName eq "a"`,
+		`userName eq "a")`,
+		`not userName eq "a"`,
+		`not (userName eq "a"`,
+		`emails[type eq "work"`,
+		`emails[]`,
+		`emails[type eq "work"]]`,
+		`"userName" eq "a"`,
+		`. eq "a"`,
+		`name.given.first eq "a"`,
+		`urn: eq "a"`,
+		`urn:ietf:params:scim:schemas:core:2.0:User: pr`,
+		`userName eq {"a":1}`,
+		`userName eq [1]`,
+		`[`,
+		`]`,
+		`((((`,
+	} {
+		_, err := ParseFilter(raw)
+		var scimErr *Error
+		if !errors.As(err, &scimErr) || scimErr.StatusCode() != http.StatusBadRequest || scimErr.ScimType != "invalidFilter" {
+			t.Errorf("%q: got %v, want an invalidFilter error", raw, err)
+		}
+	}
+}
+
+func TestParseAttrPath(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want AttrPath
+	}{
+		{"userName", AttrPath{Attr: "userName"}},
+		{"name.givenName", AttrPath{Attr: "name", Sub: "givenName"}},
+		{"urn:ietf:params:scim:schemas:core:2.0:User:emails.value", AttrPath{Attr: "emails", Sub: "value"}},
+		{"URN:IETF:PARAMS:SCIM:SCHEMAS:CORE:2.0:GROUP:members", AttrPath{Attr: "members"}},
+		{SchemaGroupHierarchy + ":parent.value", AttrPath{URN: SchemaGroupHierarchy, Attr: "parent", Sub: "value"}},
+	} {
+		got, err := ParseAttrPath(tc.raw)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %+v %v, want %+v", tc.raw, got, err, tc.want)
+		}
+		if again, _ := ParseAttrPath(got.String()); again != got {
+			t.Errorf("%s: %s parses as %+v", tc.raw, got, again)
+		}
+	}
+}
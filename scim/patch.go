@@ -0,0 +1,307 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// patchPath is a PATCH path of RFC 7644 3.5.2, an attribute path optionally
+// followed by a value filter and a sub-attribute: members[value eq "1"].display.
+type patchPath struct {
+	attr   AttrPath
+	filter Filter
+	sub    string
+}
+
+func parsePatchPath(raw string) (path patchPath, err error) {
+	attrPart, rest, hasFilter := strings.Cut(raw, "[")
+	if path.attr, err = ParseAttrPath(attrPart); err != nil {
+		return path, err
+	}
+	if !hasFilter {
+		return path, nil
+	}
+	filterPart, sub, ok := strings.Cut(rest, "]")
+	if !ok || path.attr.Sub != "" {
+		return path, NewError(http.StatusBadRequest, "invalidPath", "invalid path %q", raw)
+	}
+	if path.filter, err = ParseFilter(filterPart); err != nil {
+		return path, err
+	}
+	if sub != "" {
+		if !strings.HasPrefix(sub, ".") {
+			return path, NewError(http.StatusBadRequest, "invalidPath", "invalid path %q", raw)
+		}
+		path.sub = sub[1:]
+	}
+	return path, nil
+}
+
+// ApplyPatch applies operations to a resource decoded into a generic JSON
+// map, the caller then decodes it back and saves it as a full replace.
+func ApplyPatch(resource map[string]any, operations []PatchOperation) error {
+	for _, operation := range operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return NewError(http.StatusBadRequest, "invalidSyntax", "unknown op %q", operation.Op)
+		}
+		var value any
+		if len(operation.Value) != 0 {
+			if err := json.Unmarshal(operation.Value, &value); err != nil {
+				return NewError(http.StatusBadRequest, "invalidValue", "invalid value of %s %s", operation.Op, operation.Path)
+			}
+		}
+		if operation.Path != "" {
+			path, err := parsePatchPath(operation.Path)
+			if err != nil {
+				return err
+			}
+			if err := applyAt(resource, path, op, value); err != nil {
+				return err
+			}
+			continue
+		}
+		// without a path the value is an object of attributes to add or replace
+		object, ok := value.(map[string]any)
+		if op == "remove" || !ok {
+			return NewError(http.StatusBadRequest, "noTarget", "%s without path needs an object value", operation.Op)
+		}
+		for key, value := range object {
+			if extension, ok := value.(map[string]any); ok && strings.HasPrefix(strings.ToLower(key), "urn:") {
+				for attr, value := range extension {
+					path, err := parsePatchPath(key + ":" + attr)
+					if err != nil {
+						return err
+					}
+					if err := applyAt(resource, path, op, value); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			path, err := parsePatchPath(key)
+			if err != nil {
+				return err
+			}
+			if err := applyAt(resource, path, op, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyAt(resource map[string]any, path patchPath, op string, value any) error {
+	container := resource
+	if path.attr.URN != "" {
+		key := lookupKey(resource, path.attr.URN)
+		extension, ok := resource[key].(map[string]any)
+		if !ok {
+			if op == "remove" {
+				return nil
+			}
+			extension = make(map[string]any)
+			resource[key] = extension
+		}
+		container = extension
+	}
+	key := lookupKey(container, path.attr.Attr)
+	if path.filter != nil {
+		return applyToElements(container, key, path, op, value)
+	}
+	if path.attr.Sub != "" {
+		return applyToSub(container, key, path.attr.Sub, op, value)
+	}
+	switch op {
+	case "add":
+		list, isList := container[key].([]any)
+		if !isList {
+			container[key] = value
+			return nil
+		}
+		if values, ok := value.([]any); ok {
+			container[key] = appendUniq(list, values...)
+		} else {
+			container[key] = appendUniq(list, value)
+		}
+	case "replace":
+		container[key] = value
+	case "remove":
+		list, isList := container[key].([]any)
+		// Azure AD removes members by path members with the values to remove
+		if values, ok := value.([]any); ok && isList {
+			container[key] = removeValues(list, values)
+			return nil
+		}
+		delete(container, key)
+	}
+	return nil
+}
+
+func applyToSub(container map[string]any, key, sub string, op string, value any) error {
+	if list, ok := container[key].([]any); ok {
+		for _, item := range list {
+			if complex, ok := item.(map[string]any); ok {
+				setOrRemove(complex, sub, op, value)
+			}
+		}
+		return nil
+	}
+	complex, ok := container[key].(map[string]any)
+	if !ok {
+		if op == "remove" {
+			return nil
+		}
+		complex = make(map[string]any)
+		container[key] = complex
+	}
+	setOrRemove(complex, sub, op, value)
+	return nil
+}
+
+func setOrRemove(object map[string]any, key string, op string, value any) {
+	key = lookupKey(object, key)
+	if op == "remove" {
+		delete(object, key)
+		return
+	}
+	object[key] = value
+}
+
+func applyToElements(container map[string]any, key string, path patchPath, op string, value any) error {
+	list, _ := container[key].([]any)
+	indexes := valuePathFilter{path: AttrPath{Attr: key}, filter: path.filter}.elements(container)
+	if len(indexes) == 0 {
+		if op == "remove" {
+			return nil
+		}
+		// IdPs replace emails[type eq "work"].value on users without one
+		element, ok := elementOfFilter(path.filter)
+		if !ok {
+			return NewError(http.StatusBadRequest, "noTarget", "no %s matches the filter", key)
+		}
+		if path.sub != "" {
+			element[path.sub] = value
+		} else if object, ok := value.(map[string]any); ok {
+			for k, v := range object {
+				element[k] = v
+			}
+		}
+		container[key] = append(list, element)
+		return nil
+	}
+	if op == "remove" && path.sub == "" {
+		kept := make([]any, 0, len(list))
+		for i, item := range list {
+			if !containsIndex(indexes, i) {
+				kept = append(kept, item)
+			}
+		}
+		container[key] = kept
+		return nil
+	}
+	for _, i := range indexes {
+		element := list[i].(map[string]any)
+		if path.sub != "" {
+			setOrRemove(element, path.sub, op, value)
+			continue
+		}
+		object, ok := value.(map[string]any)
+		if !ok {
+			return NewError(http.StatusBadRequest, "invalidValue", "%s of %s needs an object value", op, key)
+		}
+		if op == "replace" {
+			list[i] = object
+			continue
+		}
+		for k, v := range object {
+			element[lookupKey(element, k)] = v
+		}
+	}
+	return nil
+}
+
+// elementOfFilter builds the element a filter of eq comparisons selects.
+func elementOfFilter(filter Filter) (map[string]any, bool) {
+	switch filter := filter.(type) {
+	case compareFilter:
+		if filter.op != "eq" || filter.path.Sub != "" || filter.path.URN != "" {
+			return nil, false
+		}
+		return map[string]any{filter.path.Attr: filter.value}, true
+	case logicalFilter:
+		if !filter.and {
+			return nil, false
+		}
+		left, ok := elementOfFilter(filter.left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := elementOfFilter(filter.right)
+		if !ok {
+			return nil, false
+		}
+		for k, v := range right {
+			left[k] = v
+		}
+		return left, true
+	}
+	return nil, false
+}
+
+func containsIndex(indexes []int, i int) bool {
+	for _, index := range indexes {
+		if index == i {
+			return true
+		}
+	}
+	return false
+}
+
+// elementValue identifies an element of a multi-valued attribute by its
+// value sub-attribute, simple elements by themselves.
+func elementValue(item any) any {
+	if complex, ok := item.(map[string]any); ok {
+		return lookup(complex, "value")
+	}
+	return item
+}
+
+func sameValue(a, b any) bool {
+	return a != nil && b != nil && reflect.DeepEqual(a, b)
+}
+
+func appendUniq(list []any, values ...any) []any {
+	for _, value := range values {
+		duplicated := false
+		for _, item := range list {
+			if sameValue(elementValue(item), elementValue(value)) {
+				duplicated = true
+				break
+			}
+		}
+		if !duplicated {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func removeValues(list []any, values []any) []any {
+	kept := make([]any, 0, len(list))
+	for _, item := range list {
+		removed := false
+		for _, value := range values {
+			if sameValue(elementValue(item), elementValue(value)) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
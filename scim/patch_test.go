@@ -0,0 +1,279 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const patchGroup = `{
+	"displayName": "Eng",
+	"emails": [
+		{"value": "a@example.com", "type": "work", "primary": true},
+		{"value": "b@example.com", "type": "home"}
+	],
+	"members": [{"value": "1"}, {"value": "2", "display": "Bob"}],
+	"name": {"givenName": "Barbara"},
+	"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group": {"parent": {"value": "p1"}}
+}`
+
+func decodeJSON(t *testing.T, raw string) map[string]any {
+	t.Helper()
+	var object map[string]any
+	if err := json.Unmarshal([]byte(raw), &object); err != nil {
+		t.Fatalf("%s: %v", raw, err)
+	}
+	return object
+}
+
+func TestApplyPatch(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		operations string
+		// want lists the keys changed, compared against patchGroup patched by them
+		want string
+	}{
+		{
+			"add attribute",
+			`[{"op":"add","path":"displayName","value":"Platform"}]`,
+			`{"displayName":"Platform"}`,
+		},
+		{
+			"op is case-insensitive",
+			`[{"op":"Replace","path":"displayName","value":"Platform"}]`,
+			`{"displayName":"Platform"}`,
+		},
+		{
+			"path is case-insensitive",
+			`[{"op":"replace","path":"DISPLAYNAME","value":"Platform"}]`,
+			`{"displayName":"Platform"}`,
+		},
+		{
+			"core schema urn is dropped",
+			`[{"op":"replace","path":"urn:ietf:params:scim:schemas:core:2.0:Group:displayName","value":"Platform"}]`,
+			`{"displayName":"Platform"}`,
+		},
+		{
+			"add appends to lists without duplicates",
+			`[{"op":"add","path":"members","value":[{"value":"2"},{"value":"3"}]}]`,
+			`{"members":[{"value":"1"},{"value":"2","display":"Bob"},{"value":"3"}]}`,
+		},
+		{
+			"add a single element",
+			`[{"op":"add","path":"members","value":{"value":"3"}}]`,
+			`{"members":[{"value":"1"},{"value":"2","display":"Bob"},{"value":"3"}]}`,
+		},
+		{
+			"replace a list",
+			`[{"op":"replace","path":"members","value":[{"value":"3"}]}]`,
+			`{"members":[{"value":"3"}]}`,
+		},
+		{
+			"remove attribute",
+			`[{"op":"remove","path":"members"}]`,
+			`{"members":null}`,
+		},
+		{
+			"remove listed values",
+			`[{"op":"remove","path":"members","value":[{"value":"1"}]}]`,
+			`{"members":[{"value":"2","display":"Bob"}]}`,
+		},
+		{
+			"remove a missing attribute",
+			`[{"op":"remove","path":"nickName"}]`,
+			`{}`,
+		},
+		{
+			"remove by filter",
+			`[{"op":"remove","path":"members[value eq \"2\"]"}]`,
+			`{"members":[{"value":"1"}]}`,
+		},
+		{
+			"remove by filter matching nothing",
+			`[{"op":"remove","path":"members[value eq \"9\"]"}]`,
+			`{}`,
+		},
+		{
+			"replace sub-attribute of filtered elements",
+			`[{"op":"replace","path":"emails[type eq \"work\"].value","value":"c@example.com"}]`,
+			`{"emails":[{"value":"c@example.com","type":"work","primary":true},{"value":"b@example.com","type":"home"}]}`,
+		},
+		{
+			"remove sub-attribute of filtered elements",
+			`[{"op":"remove","path":"members[value eq \"2\"].display"}]`,
+			`{"members":[{"value":"1"},{"value":"2"}]}`,
+		},
+		{
+			"replace filtered elements",
+			`[{"op":"replace","path":"emails[type eq \"home\"]","value":{"value":"d@example.com"}}]`,
+			`{"emails":[{"value":"a@example.com","type":"work","primary":true},{"value":"d@example.com"}]}`,
+		},
+		{
+			"add merges into filtered elements",
+			`[{"op":"add","path":"emails[type eq \"home\"]","value":{"display":"Home"}}]`,
+			`{"emails":[{"value":"a@example.com","type":"work","primary":true},{"value":"b@example.com","type":"home","display":"Home"}]}`,
+		},
+		{
+			"filter matching nothing adds the element it selects",
+			`[{"op":"replace","path":"emails[type eq \"other\"].value","value":"e@example.com"}]`,
+			`{"emails":[{"value":"a@example.com","type":"work","primary":true},{"value":"b@example.com","type":"home"},{"type":"other","value":"e@example.com"}]}`,
+		},
+		{
+			"filter of ands adds the element it selects",
+			`[{"op":"add","path":"emails[type eq \"other\" and primary eq false]","value":{"value":"e@example.com"}}]`,
+			`{"emails":[{"value":"a@example.com","type":"work","primary":true},{"value":"b@example.com","type":"home"},{"type":"other","primary":false,"value":"e@example.com"}]}`,
+		},
+		{
+			"sub-attribute of a complex attribute",
+			`[{"op":"replace","path":"name.familyName","value":"Jensen"}]`,
+			`{"name":{"givenName":"Barbara","familyName":"Jensen"}}`,
+		},
+		{
+			"sub-attribute of a missing complex attribute",
+			`[{"op":"add","path":"nickname.value","value":"babs"}]`,
+			`{"nickname":{"value":"babs"}}`,
+		},
+		{
+			"remove sub-attribute",
+			`[{"op":"remove","path":"name.givenName"}]`,
+			`{"name":{}}`,
+		},
+		{
+			"sub-attribute of every element",
+			`[{"op":"remove","path":"emails.type"}]`,
+			`{"emails":[{"value":"a@example.com","primary":true},{"value":"b@example.com"}]}`,
+		},
+		{
+			"extension attribute",
+			`[{"op":"replace","path":"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group:parent.value","value":"p2"}]`,
+			`{"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":{"parent":{"value":"p2"}}}`,
+		},
+		{
+			"missing extension",
+			`[{"op":"add","path":"urn:example:ext:2.0:Group:level","value":2}]`,
+			`{"urn:example:ext:2.0:Group":{"level":2}}`,
+		},
+		{
+			"remove from a missing extension",
+			`[{"op":"remove","path":"urn:example:ext:2.0:Group:level"}]`,
+			`{}`,
+		},
+		{
+			"no path replaces the attributes of the value",
+			`[{"op":"replace","value":{"displayName":"Platform","name.givenName":"Babs"}}]`,
+			`{"displayName":"Platform","name":{"givenName":"Babs"}}`,
+		},
+		{
+			"no path with an extension object",
+			`[{"op":"replace","value":{"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":{"description":"d"}}}]`,
+			`{"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":{"parent":{"value":"p1"},"description":"d"}}`,
+		},
+		{
+			"no path adds to lists",
+			`[{"op":"add","value":{"members":[{"value":"3"}]}}]`,
+			`{"members":[{"value":"1"},{"value":"2","display":"Bob"},{"value":"3"}]}`,
+		},
+		{
+			"operations apply in order",
+			`[{"op":"remove","path":"members"},{"op":"add","path":"members","value":[{"value":"4"}]}]`,
+			`{"members":[{"value":"4"}]}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var operations []PatchOperation
+			if err := json.Unmarshal([]byte(tc.operations), &operations); err != nil {
+				t.Fatal(err)
+			}
+			resource := decodeJSON(t, patchGroup)
+			if err := ApplyPatch(resource, operations); err != nil {
+				t.Fatal(err)
+			}
+			want := decodeJSON(t, patchGroup)
+			for key, value := range decodeJSON(t, tc.want) {
+				if value == nil {
+					delete(want, key)
+				} else {
+					want[key] = value
+				}
+			}
+			if !reflect.DeepEqual(resource, want) {
+				got, _ := json.Marshal(resource)
+				t.Errorf("got %s", got)
+			}
+		})
+	}
+}
+
+func TestApplyPatchRejectsMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		operations string
+		scimType   string
+	}{
+		{`[{"op":"move","path":"displayName","value":"x"}]`, "invalidSyntax"},
+		{`[{"op":"","path":"displayName"}]`, "invalidSyntax"},
+		{`[{"op":"replace"}]`, "noTarget"},
+		{`[{"op":"replace","value":"Platform"}]`, "noTarget"},
+		{`[{"op":"replace","value":[{"displayName":"Platform"}]}]`, "noTarget"},
+		{`[{"op":"remove","value":{"displayName":"Platform"}}]`, "noTarget"},
+		{`[{"op":"replace","path":"","value":null}]`, "noTarget"},
+		{`[{"op":"replace","path":"name.given.first","value":"x"}]`, "invalidPath"},
+		{`[{"op":"replace","path":".","value":"x"}]`, "invalidPath"},
+		{`[{"op":"replace","path":"[type eq \"work\"]","value":"x"}]`, "invalidPath"},
+		{`[{"op":"replace","path":"emails[type eq \"work\"","value":"x"}]`, "invalidPath"},
+		{`[{"op":"replace","path":"emails.value[type eq \"work\"]","value":"x"}]`, "invalidPath"},
+		{`[{"op":"replace","path":"emails[type eq \"work\"]value","value":"x"}]`, "invalidPath"},
+		{`[{"op":"replace","path":"emails[type eq]","value":"x"}]`, "invalidFilter"},
+		{`[{"op":"replace","path":"emails[]","value":"x"}]`, "invalidFilter"},
+		{`[{"op":"replace","path":"emails[type eq \"home\"]","value":"x"}]`, "invalidValue"},
+		{`[{"op":"replace","path":"emails[type eq \"other\" or display pr].value","value":"x"}]`, "noTarget"},
+		{`[{"op":"add","path":"emails[type co \"other\"]","value":{}}]`, "noTarget"},
+		{`[{"op":"add","value":{"a.b.c":1}}]`, "invalidPath"},
+		{`[{"op":"add","value":{"urn:example:ext:2.0:Group":{"a.b.c":1}}}]`, "invalidPath"},
+	} {
+		var operations []PatchOperation
+		if err := json.Unmarshal([]byte(tc.operations), &operations); err != nil {
+			t.Fatal(err)
+		}
+		err := ApplyPatch(decodeJSON(t, patchGroup), operations)
+		var scimErr *Error
+		if !errors.As(err, &scimErr) || scimErr.StatusCode() != http.StatusBadRequest || scimErr.ScimType != tc.scimType {
+			t.Errorf("%s: got %v, want %s", tc.operations, err, tc.scimType)
+		}
+	}
+}
+
+// TestApplyPatchOnOddShapes patches values of types the path does not
+// expect, which must fail or apply but never panic.
+func TestApplyPatchOnOddShapes(t *testing.T) {
+	resources := []string{
+		`{}`,
+		`{"members":"1","emails":{"value":"a"},"name":[1,2]}`,
+		`{"members":[1,"2",null,[3]],"emails":[null],"name":null}`,
+		`{"urn:example:ext:2.0:Group":"flat","members":[{"value":null}]}`,
+	}
+	paths := []string{
+		"members", "members.value", `members[value eq "1"]`, `members[value eq "1"].display`,
+		"emails.value", `emails[type eq "work"].value`, "name.givenName",
+		"urn:example:ext:2.0:Group:level", "urn:example:ext:2.0:Group:members.value",
+	}
+	values := []string{``, `null`, `1`, `"x"`, `[1,{"value":"1"}]`, `{"value":"1"}`}
+	for _, raw := range resources {
+		for _, path := range paths {
+			for _, value := range values {
+				for _, op := range []string{"add", "replace", "remove"} {
+					operations := []PatchOperation{{Op: op, Path: path, Value: json.RawMessage(value)}}
+					func() {
+						defer func() {
+							if r := recover(); r != nil {
+								t.Errorf("%s %s %s on %s panicked: %v", op, path, value, raw, r)
+							}
+						}()
+						_ = ApplyPatch(decodeJSON(t, raw), operations)
+					}()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package scim
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/org-tools/manager"
+)
+
+// ExternalIdentityPlatform is the platform of the links externalId values
+// are stored as, ei.{type}.{base64url externalId}@{slug}.client, the
+// slug naming the SCIM client which assigned them. It is not the platform
+// of the scim driver, so drift does not take them for dangling links.
+const ExternalIdentityPlatform = manager.ClientLinkPlatform
+
+func externalIdentity(entryType manager.EntryType, slug, externalID string) manager.ExternalIdentity {
+	return manager.ExternalIdentity(fmt.Sprintf("ei.%s.%s@%s.%s",
+		entryType, base64.RawURLEncoding.EncodeToString([]byte(externalID)), slug, ExternalIdentityPlatform))
+}
+
+func isExternalIdentityOf(extID manager.ExternalIdentity, slug string) bool {
+	return extID.Valid() && extID.GetPlatform() == ExternalIdentityPlatform && extID.GetTargetSlug() == slug
+}
+
+// externalIDOf reads the externalId the client of slug assigned to entry.
+func externalIDOf(entry any, slug string) string {
+	storeable, ok := manager.As[manager.EntryExtIDStoreable](entry)
+	if !ok {
+		return ""
+	}
+	for _, extID := range storeable.GetExternalIdentities() {
+		if !isExternalIdentityOf(extID, slug) {
+			continue
+		}
+		if raw, err := base64.RawURLEncoding.DecodeString(extID.GetEntryID()); err == nil {
+			return string(raw)
+		}
+	}
+	return ""
+}
+
+// setExternalID replaces the link of the client of slug on entry, links of
+// other clients and targets are kept.
+func setExternalID(entry any, entryType manager.EntryType, slug, externalID string) error {
+	if externalIDOf(entry, slug) == externalID {
+		return nil
+	}
+	storeable, ok := manager.As[manager.EntryExtIDStoreable](entry)
+	if !ok {
+		return NewError(http.StatusBadRequest, "invalidValue", "target cannot store externalId")
+	}
+	extIDs := make(manager.ExternalIdentities, 0)
+	for _, extID := range storeable.GetExternalIdentities() {
+		if !isExternalIdentityOf(extID, slug) {
+			extIDs = append(extIDs, extID)
+		}
+	}
+	if externalID != "" {
+		extIDs = append(extIDs, externalIdentity(entryType, slug, externalID))
+	}
+	return manager.Do(entry, manager.Call{Operation: "set_external_identities", Write: true, Idempotent: true}, func() error {
+		return storeable.SetExternalIdentities(extIDs)
+	})
+}
+
+// userNameOf maps a user to a userName, which local has no field for: the
+// primary email, then the name.
+func userNameOf(user manager.Userable) string {
+	if email := user.GetEmail(); email != "" {
+		return email
+	}
+	return user.GetName()
+}
+
+// isActive is false for users a UserActivator turned off.
+func isActive(user manager.Userable) bool {
+	if withActive, ok := manager.As[manager.UserableWithActive](user); ok {
+		return withActive.IsActive()
+	}
+	return true
+}
+
+func (s *Server) userResource(user manager.UserableEntry) User {
+	active := isActive(user)
+	resource := User{
+		Schemas:      []string{SchemaUser},
+		ID:           user.GetID(),
+		ExternalID:   externalIDOf(user, s.options.Slug),
+		UserName:     userNameOf(user),
+		DisplayName:  user.GetName(),
+		Active:       &active,
+		Emails:       multiValuedOf(user.GetEmail(), manager.GetUserableEmails(user)),
+		PhoneNumbers: multiValuedOf(user.GetPhone(), manager.GetUserablePhones(user)),
+		Meta:         &Meta{ResourceType: "User", Location: s.location("Users", user.GetID())},
+	}
+	if name := user.GetName(); name != "" {
+		resource.Name = &Name{Formatted: name}
+	}
+	return resource
+}
+
+// multiValuedOf lists primary first and the others sorted, local keeps
+// emails and phones in maps without an order.
+func multiValuedOf(primary string, all []string) (list []MultiValued) {
+	others := make([]string, 0, len(all))
+	for _, value := range all {
+		if value != "" && value != primary {
+			others = append(others, value)
+		}
+	}
+	sort.Strings(others)
+	if primary != "" {
+		list = append(list, MultiValued{Value: primary, Type: "work", Primary: true})
+	}
+	for _, value := range others {
+		if len(list) != 0 && list[len(list)-1].Value == value {
+			continue
+		}
+		list = append(list, MultiValued{Value: value, Type: "work"})
+	}
+	return list
+}
+
+// normalizeUser checks a user sent by a client, a userName looking like an
+// email becomes its email when none is given.
+func normalizeUser(user *User) error {
+	user.UserName = strings.TrimSpace(user.UserName)
+	if user.UserName == "" {
+		return NewError(http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+	if len(user.Emails) == 0 && strings.Contains(user.UserName, "@") {
+		user.Emails = []MultiValued{{Value: user.UserName, Type: "work", Primary: true}}
+	}
+	return nil
+}
+
+// groupNode is a department with its parent, nil for the root, as SCIM
+// groups carry their parent but departments only know their children.
+type groupNode struct {
+	department manager.DepartmentableEntry
+	parent     manager.DepartmentableEntry
+}
+
+func (s *Server) groupTree() (nodes []groupNode, err error) {
+	root, err := s.target.GetRootDepartment()
+	if err != nil {
+		return nil, err
+	}
+	var walk func(department, parent manager.DepartmentableEntry)
+	walk = func(department, parent manager.DepartmentableEntry) {
+		nodes = append(nodes, groupNode{department: department, parent: parent})
+		for _, child := range department.GetChildDepartments() {
+			walk(child, department)
+		}
+	}
+	walk(root, nil)
+	return nodes, nil
+}
+
+func findGroupNode(nodes []groupNode, id string) (groupNode, bool) {
+	for _, node := range nodes {
+		if node.department.GetID() == id {
+			return node, true
+		}
+	}
+	return groupNode{}, false
+}
+
+// isDescendant tells if id is department or under it.
+func isDescendant(nodes []groupNode, id string, department manager.DepartmentableEntry) bool {
+	for id != "" {
+		if id == department.GetID() {
+			return true
+		}
+		node, ok := findGroupNode(nodes, id)
+		if !ok || node.parent == nil {
+			return false
+		}
+		id = node.parent.GetID()
+	}
+	return false
+}
+
+func (s *Server) groupResource(node groupNode, withMembers bool) (Group, error) {
+	department := node.department
+	resource := Group{
+		Schemas:     []string{SchemaGroup, SchemaGroupHierarchy},
+		ID:          department.GetID(),
+		ExternalID:  externalIDOf(department, s.options.Slug),
+		DisplayName: department.GetName(),
+		Hierarchy:   &GroupHierarchy{Description: department.GetDescription()},
+		Meta:        &Meta{ResourceType: "Group", Location: s.location("Groups", department.GetID())},
+	}
+	if node.parent != nil {
+		resource.Hierarchy.Parent = &MultiValued{
+			Value:   node.parent.GetID(),
+			Display: node.parent.GetName(),
+			Ref:     s.location("Groups", node.parent.GetID()),
+		}
+	}
+	if !withMembers {
+		return resource, nil
+	}
+	users, err := department.GetUsers()
+	if err != nil {
+		return resource, err
+	}
+	for _, user := range manager.Uniq(users) {
+		resource.Members = append(resource.Members, MultiValued{
+			Value:   user.GetID(),
+			Type:    "User",
+			Display: user.GetName(),
+			Ref:     s.location("Users", user.GetID()),
+		})
+	}
+	for _, child := range department.GetChildDepartments() {
+		resource.Members = append(resource.Members, MultiValued{
+			Value:   child.GetID(),
+			Type:    "Group",
+			Display: child.GetName(),
+			Ref:     s.location("Groups", child.GetID()),
+		})
+	}
+	return resource, nil
+}
+
+func (s *Server) location(resource, id string) string {
+	return strings.TrimRight(s.options.BaseURL, "/") + "/" + resource + "/" + id
+}
+
+// toMap and fromMap convert resources to the generic maps filters and
+// PATCH operations work on.
+func toMap(resource any) (map[string]any, error) {
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	object := make(map[string]any)
+	return object, json.Unmarshal(raw, &object)
+}
+
+func fromMap(object map[string]any, resource any) error {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, resource); err != nil {
+		return NewError(http.StatusBadRequest, "invalidValue", "%s", err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Package scim holds the SCIM 2.0 resources, filters and PATCH operations
+// shared by the SCIM server over local and the scim platform driver.
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	// SchemaGroupHierarchy is our extension carrying the parent group and
+	// description, SCIM groups are flat otherwise.
+	SchemaGroupHierarchy = "urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group"
+
+	ContentType = "application/scim+json"
+)
+
+type Meta struct {
+	ResourceType string `json:"resourceType,omitempty"`
+	Location     string `json:"location,omitempty"`
+}
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+}
+
+// MultiValued is an entry of emails, phoneNumbers, members and the like.
+type MultiValued struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type User struct {
+	Schemas      []string      `json:"schemas"`
+	ID           string        `json:"id,omitempty"`
+	ExternalID   string        `json:"externalId,omitempty"`
+	UserName     string        `json:"userName"`
+	Name         *Name         `json:"name,omitempty"`
+	DisplayName  string        `json:"displayName,omitempty"`
+	Active       *bool         `json:"active,omitempty"`
+	Emails       []MultiValued `json:"emails,omitempty"`
+	PhoneNumbers []MultiValued `json:"phoneNumbers,omitempty"`
+	Meta         *Meta         `json:"meta,omitempty"`
+}
+
+// GetName prefers displayName, then the formatted or given and family
+// names, then userName.
+func (u User) GetName() string {
+	switch {
+	case u.DisplayName != "":
+		return u.DisplayName
+	case u.Name != nil && u.Name.Formatted != "":
+		return u.Name.Formatted
+	case u.Name != nil && (u.Name.GivenName != "" || u.Name.FamilyName != ""):
+		if u.Name.GivenName == "" || u.Name.FamilyName == "" {
+			return u.Name.GivenName + u.Name.FamilyName
+		}
+		return u.Name.GivenName + " " + u.Name.FamilyName
+	default:
+		return u.UserName
+	}
+}
+
+func (u User) GetEmail() string {
+	return primaryValue(u.Emails)
+}
+
+func (u User) GetEmails() []string {
+	return values(u.Emails)
+}
+
+func (u User) GetPhone() string {
+	return primaryValue(u.PhoneNumbers)
+}
+
+func (u User) GetPhones() []string {
+	return values(u.PhoneNumbers)
+}
+
+type GroupHierarchy struct {
+	Parent      *MultiValued `json:"parent,omitempty"`
+	Description string       `json:"description,omitempty"`
+}
+
+type Group struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	DisplayName string          `json:"displayName"`
+	Members     []MultiValued   `json:"members,omitempty"`
+	Hierarchy   *GroupHierarchy `json:"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group,omitempty"`
+	Meta        *Meta           `json:"meta,omitempty"`
+}
+
+func (g Group) GetName() string {
+	return g.DisplayName
+}
+
+func (g Group) GetDescription() string {
+	if g.Hierarchy == nil {
+		return ""
+	}
+	return g.Hierarchy.Description
+}
+
+type ListResponse[T any] struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []T      `json:"Resources"`
+}
+
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// Error is both the SCIM error response and a Go error, scimType is one of
+// the error types of RFC 7644 3.12.
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func NewError(status int, scimType, format string, args ...any) *Error {
+	return &Error{
+		Schemas:  []string{SchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	if e.ScimType != "" {
+		return fmt.Sprintf("scim %s %s: %s", e.Status, e.ScimType, e.Detail)
+	}
+	return fmt.Sprintf("scim %s: %s", e.Status, e.Detail)
+}
+
+func (e *Error) StatusCode() int {
+	status, _ := strconv.Atoi(e.Status)
+	return status
+}
+
+func primaryValue(list []MultiValued) string {
+	for _, item := range list {
+		if item.Primary {
+			return item.Value
+		}
+	}
+	if len(list) != 0 {
+		return list[0].Value
+	}
+	return ""
+}
+
+func values(list []MultiValued) (values []string) {
+	for _, item := range list {
+		if item.Value != "" {
+			values = append(values, item.Value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,776 @@
+package scim
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/org-tools/manager"
+	"github.com/samber/lo"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 200
+	maxBodySize     = 1 << 20
+)
+
+type ServerOptions struct {
+	// Slug names the SCIM client, its externalId values are stored as
+	// links of ExternalIdentityPlatform with this slug.
+	Slug string
+	// Token is the bearer token clients must send, empty disables auth.
+	Token string
+	// BaseURL prefixes meta.location, like https://hub.example.com/scim/v2.
+	BaseURL string
+	Logger  manager.Logger
+}
+
+// Server serves /Users and /Groups of RFC 7644 over a target, departments
+// being groups whose parent lives in the SchemaGroupHierarchy extension.
+// Mount it under the base path with http.StripPrefix.
+type Server struct {
+	target manager.Target
+	center manager.EntryCenter
+	writer manager.UserWriteable
+	users  manager.UserEditor
+	depts  manager.DepartmentEditor
+	// activator maps active, targets without one only take active users
+	activator manager.UserActivator
+	options   ServerOptions
+	logger    manager.Logger
+
+	// writes are serialized, checks like userName uniqueness run before them
+	mu sync.Mutex
+}
+
+func NewServer(target manager.Target, options ServerOptions) (*Server, error) {
+	s := &Server{target: target, options: options, logger: options.Logger}
+	var ok bool
+	if s.center, ok = manager.As[manager.EntryCenter](target); !ok {
+		return nil, fmt.Errorf("target %s is not an EntryCenter", manager.TargetKey(target))
+	}
+	if s.writer, ok = manager.As[manager.UserWriteable](target); !ok {
+		return nil, fmt.Errorf("target %s cannot create users", manager.TargetKey(target))
+	}
+	if s.users, ok = manager.As[manager.UserEditor](target); !ok {
+		return nil, fmt.Errorf("target %s cannot edit users", manager.TargetKey(target))
+	}
+	if s.depts, ok = manager.As[manager.DepartmentEditor](target); !ok {
+		return nil, fmt.Errorf("target %s cannot edit departments", manager.TargetKey(target))
+	}
+	s.activator, _ = manager.As[manager.UserActivator](target)
+	if options.Slug == "" || strings.ContainsAny(options.Slug, ".@") {
+		return nil, fmt.Errorf("invalid client slug %q", options.Slug)
+	}
+	if s.logger == nil {
+		s.logger = manager.Log
+	}
+	return s, nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.serve(recorder, r)
+	s.logger.WithField("method", r.Method).WithField("path", r.URL.Path).WithField("status", recorder.status).
+		Info("scim request")
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		writeError(w, NewError(http.StatusUnauthorized, "", "invalid bearer token"))
+		return
+	}
+	resource, id, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+	// ids end up inside extIDs, which split on dots and @
+	if strings.ContainsAny(id, "/.@") {
+		writeError(w, NewError(http.StatusNotFound, "", "%s not found", r.URL.Path))
+		return
+	}
+	switch {
+	case resource == "Users":
+		s.serveUsers(w, r, id)
+	case resource == "Groups":
+		s.serveGroups(w, r, id)
+	case r.Method != http.MethodGet:
+		writeError(w, NewError(http.StatusMethodNotAllowed, "", "%s not allowed", r.Method))
+	case resource == "ServiceProviderConfig" && id == "":
+		writeJSON(w, http.StatusOK, serviceProviderConfig)
+	case resource == "ResourceTypes":
+		serveStatic(w, id, resourceTypes)
+	case resource == "Schemas":
+		serveStatic(w, id, schemas)
+	default:
+		writeError(w, NewError(http.StatusNotFound, "", "%s not found", r.URL.Path))
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.options.Token == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.options.Token)) == 1
+}
+
+func (s *Server) serveUsers(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		result any
+		status = http.StatusOK
+		err    error
+	)
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		result, err = s.listUsers(r)
+	case id == "" && r.Method == http.MethodPost:
+		var user User
+		if err = decodeBody(w, r, &user); err == nil {
+			result, err = s.createUser(user)
+			status = http.StatusCreated
+		}
+	case id != "" && r.Method == http.MethodGet:
+		var entry manager.UserableEntry
+		if entry, err = s.lookupUser(id); err == nil {
+			result = s.userResource(entry)
+		}
+	case id != "" && r.Method == http.MethodPut:
+		var user User
+		if err = decodeBody(w, r, &user); err == nil {
+			result, err = s.replaceUser(id, user)
+		}
+	case id != "" && r.Method == http.MethodPatch:
+		var patch PatchRequest
+		if err = decodeBody(w, r, &patch); err == nil {
+			result, err = s.patchUser(id, patch)
+		}
+	case id != "" && r.Method == http.MethodDelete:
+		err = s.deleteUser(id)
+		status = http.StatusNoContent
+	default:
+		err = NewError(http.StatusMethodNotAllowed, "", "%s not allowed", r.Method)
+	}
+	writeResult(w, status, result, err)
+}
+
+func (s *Server) serveGroups(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		result any
+		status = http.StatusOK
+		err    error
+	)
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		result, err = s.listGroups(r)
+	case id == "" && r.Method == http.MethodPost:
+		var group Group
+		if err = decodeBody(w, r, &group); err == nil {
+			result, err = s.saveGroup("", group)
+			status = http.StatusCreated
+		}
+	case id != "" && r.Method == http.MethodGet:
+		result, err = s.getGroup(id, !excludesMembers(r))
+	case id != "" && r.Method == http.MethodPut:
+		var group Group
+		if err = decodeBody(w, r, &group); err == nil {
+			result, err = s.saveGroup(id, group)
+		}
+	case id != "" && r.Method == http.MethodPatch:
+		var patch PatchRequest
+		if err = decodeBody(w, r, &patch); err == nil {
+			result, err = s.patchGroup(id, patch)
+		}
+	case id != "" && r.Method == http.MethodDelete:
+		err = s.deleteGroup(id)
+		status = http.StatusNoContent
+	default:
+		err = NewError(http.StatusMethodNotAllowed, "", "%s not allowed", r.Method)
+	}
+	writeResult(w, status, result, err)
+}
+
+func (s *Server) internalExtID(entryType manager.EntryType, id string) manager.ExternalIdentity {
+	return manager.ExternalIdentity(fmt.Sprintf("ei.%s.%s@%s.%s",
+		entryType, id, s.target.GetTargetSlug(), s.target.GetPlatform()))
+}
+
+func (s *Server) lookupUser(id string) (manager.UserableEntry, error) {
+	user, err := s.target.LookupEntryUserByInternalExternalIdentity(s.internalExtID(manager.EntryTypeUser, id))
+	if err != nil || user == nil {
+		return nil, NewError(http.StatusNotFound, "", "User %s not found", id)
+	}
+	return user, nil
+}
+
+func (s *Server) listUsers(r *http.Request) (*ListResponse[User], error) {
+	filter, err := queryFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	var users []manager.UserableEntry
+	if externalID, ok := externalIDFilter(filter); ok {
+		// served by the EntryCenter, IdPs look users up this way before every push
+		if user, err := s.center.LookupEntryUserByExternalIdentity(
+			externalIdentity(manager.EntryTypeUser, s.options.Slug, externalID)); err == nil {
+			users = append(users, user)
+		}
+	} else if users, err = s.target.GetAllUsers(); err != nil {
+		return nil, err
+	}
+	resources := make([]User, 0, len(users))
+	for _, user := range users {
+		resource := s.userResource(user)
+		matched, err := matches(filter, resource)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			resources = append(resources, resource)
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].ID < resources[j].ID })
+	return paginate(r, resources)
+}
+
+func (s *Server) createUser(user User) (User, error) {
+	if err := s.normalizeUser(&user); err != nil {
+		return user, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkUserUniqueness("", user); err != nil {
+		return user, err
+	}
+	var entry manager.UserableEntry
+	err := manager.Do(s.target, manager.Call{Operation: "create_user", Write: true}, func() (err error) {
+		entry, err = s.writer.CreateUser(user)
+		return err
+	})
+	if err != nil {
+		return user, err
+	}
+	if err := setExternalID(entry, manager.EntryTypeUser, s.options.Slug, user.ExternalID); err != nil {
+		return user, err
+	}
+	return s.setActive(entry, user)
+}
+
+// normalizeUser is normalizeUser refusing to deactivate users on targets
+// which cannot.
+func (s *Server) normalizeUser(user *User) error {
+	if user.Active != nil && !*user.Active && s.activator == nil {
+		return NewError(http.StatusBadRequest, "invalidValue",
+			"target %s cannot deactivate users, delete them instead", manager.TargetKey(s.target))
+	}
+	return normalizeUser(user)
+}
+
+// setActive (de)activates entry when active of user differs from it and
+// serves the user as saved.
+func (s *Server) setActive(entry manager.UserableEntry, user User) (User, error) {
+	if user.Active == nil || s.activator == nil || isActive(entry) == *user.Active {
+		return s.userResource(entry), nil
+	}
+	extID := s.internalExtID(manager.EntryTypeUser, entry.GetID())
+	call, set := manager.Call{Operation: "deactivate_user", Write: true, Idempotent: true}, s.activator.DeactivateUser
+	if *user.Active {
+		call, set = manager.Call{Operation: "activate_user", Write: true, Idempotent: true}, s.activator.ActivateUser
+	}
+	if err := manager.Do(s.target, call, func() error { return set(extID) }); err != nil {
+		return user, err
+	}
+	entry, err := s.lookupUser(entry.GetID())
+	if err != nil {
+		return user, err
+	}
+	return s.userResource(entry), nil
+}
+
+// checkUserUniqueness keeps userName and externalId unique, id is the user
+// being replaced, if any. userName is looked up as the email or the name it
+// is kept as, as given and lowercased, listing every user on each create
+// made bulk pushes quadratic.
+func (s *Server) checkUserUniqueness(id string, user User) error {
+	if user.ExternalID != "" {
+		existing, err := s.center.LookupEntryUserByExternalIdentity(
+			externalIdentity(manager.EntryTypeUser, s.options.Slug, user.ExternalID))
+		if err == nil && existing.GetID() != id {
+			return NewError(http.StatusConflict, "uniqueness", "externalId %s is taken", user.ExternalID)
+		}
+	}
+	for _, userName := range lo.Uniq([]string{user.UserName, strings.ToLower(user.UserName)}) {
+		probe := manager.User{Name: userName}
+		if strings.Contains(userName, "@") {
+			probe = manager.User{Email: userName}
+		}
+		var existing manager.UserableEntry
+		err := manager.Do(s.target, manager.Call{Operation: "lookup_user"}, func() (err error) {
+			existing, err = s.writer.LookupUser(probe)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.GetID() != id && strings.EqualFold(userNameOf(existing), user.UserName) {
+			return NewError(http.StatusConflict, "uniqueness", "userName %s is taken", user.UserName)
+		}
+	}
+	return nil
+}
+
+func (s *Server) replaceUser(id string, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replaceUserLocked(id, user)
+}
+
+// replaceUserLocked is replaceUser for callers already holding s.mu.
+func (s *Server) replaceUserLocked(id string, user User) (User, error) {
+	if err := s.normalizeUser(&user); err != nil {
+		return user, err
+	}
+	if _, err := s.lookupUser(id); err != nil {
+		return user, err
+	}
+	if err := s.checkUserUniqueness(id, user); err != nil {
+		return user, err
+	}
+	var entry manager.UserableEntry
+	err := manager.Do(s.target, manager.Call{Operation: "update_user", Write: true, Idempotent: true}, func() (err error) {
+		entry, err = s.users.UpdateUser(s.internalExtID(manager.EntryTypeUser, id), user)
+		return err
+	})
+	if err != nil {
+		return user, err
+	}
+	if err := setExternalID(entry, manager.EntryTypeUser, s.options.Slug, user.ExternalID); err != nil {
+		return user, err
+	}
+	return s.setActive(entry, user)
+}
+
+// patchUser holds s.mu from reading the user to saving it, so concurrent
+// patches of the same user both apply.
+func (s *Server) patchUser(id string, patch PatchRequest) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.lookupUser(id)
+	if err != nil {
+		return User{}, err
+	}
+	object, err := toMap(s.userResource(entry))
+	if err != nil {
+		return User{}, err
+	}
+	if err := ApplyPatch(object, patch.Operations); err != nil {
+		return User{}, err
+	}
+	var user User
+	if err := fromMap(object, &user); err != nil {
+		return user, err
+	}
+	if user.ID != id {
+		return user, NewError(http.StatusBadRequest, "mutability", "id is read-only")
+	}
+	return s.replaceUserLocked(id, user)
+}
+
+func (s *Server) deleteUser(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.lookupUser(id); err != nil {
+		return err
+	}
+	return manager.Do(s.target, manager.Call{Operation: "delete_user", Write: true}, func() error {
+		return s.users.DeleteUser(s.internalExtID(manager.EntryTypeUser, id))
+	})
+}
+
+func (s *Server) listGroups(r *http.Request) (*ListResponse[Group], error) {
+	filter, err := queryFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := s.groupTree()
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]Group, 0, len(nodes))
+	for _, node := range nodes {
+		resource, err := s.groupResource(node, !excludesMembers(r))
+		if err != nil {
+			return nil, err
+		}
+		matched, err := matches(filter, resource)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			resources = append(resources, resource)
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].ID < resources[j].ID })
+	return paginate(r, resources)
+}
+
+func (s *Server) getGroup(id string, withMembers bool) (Group, error) {
+	nodes, err := s.groupTree()
+	if err != nil {
+		return Group{}, err
+	}
+	node, ok := findGroupNode(nodes, id)
+	if !ok {
+		return Group{}, NewError(http.StatusNotFound, "", "Group %s not found", id)
+	}
+	return s.groupResource(node, withMembers)
+}
+
+// saveGroup creates the group when id is empty or replaces it. A missing
+// parent keeps the current one, or is the root for new groups. Child groups
+// are listed as members but moved by setting their parent.
+func (s *Server) saveGroup(id string, group Group) (Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveGroupLocked(id, group)
+}
+
+// saveGroupLocked is saveGroup for callers already holding s.mu.
+func (s *Server) saveGroupLocked(id string, group Group) (Group, error) {
+	group.DisplayName = strings.TrimSpace(group.DisplayName)
+	if group.DisplayName == "" {
+		return group, NewError(http.StatusBadRequest, "invalidValue", "displayName is required")
+	}
+	nodes, err := s.groupTree()
+	if err != nil {
+		return group, err
+	}
+	var current groupNode
+	if id != "" {
+		var ok bool
+		if current, ok = findGroupNode(nodes, id); !ok {
+			return group, NewError(http.StatusNotFound, "", "Group %s not found", id)
+		}
+	}
+
+	parent := current.parent
+	if id == "" {
+		parent = nodes[0].department
+	}
+	if group.Hierarchy != nil && group.Hierarchy.Parent != nil && group.Hierarchy.Parent.Value != "" {
+		node, ok := findGroupNode(nodes, group.Hierarchy.Parent.Value)
+		if !ok {
+			return group, NewError(http.StatusBadRequest, "invalidValue", "parent group %s not found", group.Hierarchy.Parent.Value)
+		}
+		if current.department != nil && current.parent == nil {
+			return group, NewError(http.StatusBadRequest, "mutability", "the root group cannot be moved")
+		}
+		if current.department != nil && isDescendant(nodes, node.department.GetID(), current.department) {
+			return group, NewError(http.StatusBadRequest, "invalidValue", "group cannot be moved under itself")
+		}
+		parent = node.department
+	}
+	if parent != nil {
+		for _, sibling := range parent.GetChildDepartments() {
+			if sibling.GetID() != id && strings.EqualFold(sibling.GetName(), group.DisplayName) {
+				return group, NewError(http.StatusConflict, "uniqueness", "group %s already exists under %s", group.DisplayName, parent.GetName())
+			}
+		}
+	}
+	if group.ExternalID != "" {
+		existing, err := s.center.LookupEntryDepartmentByExternalIdentity(
+			externalIdentity(manager.EntryTypeDept, s.options.Slug, group.ExternalID))
+		if err == nil && existing.GetID() != id {
+			return group, NewError(http.StatusConflict, "uniqueness", "externalId %s is taken", group.ExternalID)
+		}
+	}
+	userIDs, err := s.memberUserIDs(nodes, current, group.Members)
+	if err != nil {
+		return group, err
+	}
+
+	var department manager.DepartmentableEntry
+	if id == "" {
+		department, err = parent.CreateChildDepartment(group)
+	} else {
+		var parentExtID manager.ExternalIdentity
+		if parent != nil && (current.parent == nil || parent.GetID() != current.parent.GetID()) {
+			parentExtID = s.internalExtID(manager.EntryTypeDept, parent.GetID())
+		}
+		err = manager.Do(s.target, manager.Call{Operation: "update_department", Write: true, Idempotent: true}, func() (err error) {
+			department, err = s.depts.UpdateDepartment(s.internalExtID(manager.EntryTypeDept, id), group, parentExtID)
+			return err
+		})
+	}
+	if err != nil {
+		return group, err
+	}
+	if err := setExternalID(department, manager.EntryTypeDept, s.options.Slug, group.ExternalID); err != nil {
+		return group, err
+	}
+	if err := s.syncMembers(department, userIDs); err != nil {
+		return group, err
+	}
+	return s.groupResource(groupNode{department: department, parent: parent}, true)
+}
+
+// memberUserIDs returns the users among members, rejecting groups other
+// than the current children of the group.
+func (s *Server) memberUserIDs(nodes []groupNode, current groupNode, members []MultiValued) (ids []string, err error) {
+	for _, member := range members {
+		if member.Type == "" || strings.EqualFold(member.Type, "User") {
+			if _, err := s.lookupUser(member.Value); err == nil {
+				ids = append(ids, member.Value)
+				continue
+			}
+			if member.Type != "" {
+				return nil, NewError(http.StatusBadRequest, "invalidValue", "member User %s not found", member.Value)
+			}
+		}
+		node, ok := findGroupNode(nodes, member.Value)
+		if !ok {
+			return nil, NewError(http.StatusBadRequest, "invalidValue", "member %s not found", member.Value)
+		}
+		if current.department == nil || node.parent == nil || node.parent.GetID() != current.department.GetID() {
+			return nil, NewError(http.StatusBadRequest, "invalidValue",
+				"group %s cannot be added as a member, set its parent instead", member.Value)
+		}
+	}
+	return ids, nil
+}
+
+// syncMembers adds and removes users to match ids, roles of users staying
+// in the department are kept.
+func (s *Server) syncMembers(department manager.DepartmentableEntry, ids []string) error {
+	writer, ok := manager.As[manager.DepartmentUserWriter](department)
+	if !ok {
+		return errors.New("department cannot change its members")
+	}
+	users, err := department.GetUsers()
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		desired[id] = true
+	}
+	current := make(map[string]bool, len(users))
+	for _, user := range users {
+		current[user.GetID()] = true
+		if !desired[user.GetID()] {
+			extID := s.internalExtID(manager.EntryTypeUser, user.GetID())
+			err := manager.Do(department, manager.Call{Operation: "remove_from_department", Write: true, Idempotent: true}, func() error {
+				return writer.RemoveFromDepartment(manager.DepartmentModifyUserOptions{}, extID)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range ids {
+		if current[id] {
+			continue
+		}
+		current[id] = true
+		options := manager.DepartmentModifyUserOptions{Role: manager.DepartmentUserRoleMember}
+		extID := s.internalExtID(manager.EntryTypeUser, id)
+		err := manager.Do(department, manager.Call{Operation: "add_to_department", Write: true, Idempotent: true}, func() error {
+			return writer.AddToDepartment(options, extID)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchGroup holds s.mu from reading the group to saving it, like patchUser.
+func (s *Server) patchGroup(id string, patch PatchRequest) (Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.getGroup(id, true)
+	if err != nil {
+		return current, err
+	}
+	object, err := toMap(current)
+	if err != nil {
+		return current, err
+	}
+	if err := ApplyPatch(object, patch.Operations); err != nil {
+		return current, err
+	}
+	var group Group
+	if err := fromMap(object, &group); err != nil {
+		return group, err
+	}
+	if group.ID != id {
+		return group, NewError(http.StatusBadRequest, "mutability", "id is read-only")
+	}
+	return s.saveGroupLocked(id, group)
+}
+
+func (s *Server) deleteGroup(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes, err := s.groupTree()
+	if err != nil {
+		return err
+	}
+	node, ok := findGroupNode(nodes, id)
+	switch {
+	case !ok:
+		return NewError(http.StatusNotFound, "", "Group %s not found", id)
+	case node.parent == nil:
+		return NewError(http.StatusBadRequest, "mutability", "the root group cannot be deleted")
+	case len(node.department.GetChildDepartments()) != 0:
+		return NewError(http.StatusBadRequest, "mutability", "group %s has child groups, delete or move them first", id)
+	}
+	return manager.Do(s.target, manager.Call{Operation: "delete_department", Write: true}, func() error {
+		return s.depts.DeleteDepartment(s.internalExtID(manager.EntryTypeDept, id))
+	})
+}
+
+func queryFilter(r *http.Request) (Filter, error) {
+	raw := r.URL.Query().Get("filter")
+	if raw == "" {
+		return nil, nil
+	}
+	return ParseFilter(raw)
+}
+
+// externalIDFilter tells if filter is externalId eq "...".
+func externalIDFilter(filter Filter) (string, bool) {
+	compare, ok := filter.(compareFilter)
+	if !ok || compare.op != "eq" || compare.path.URN != "" || compare.path.Sub != "" ||
+		!strings.EqualFold(compare.path.Attr, "externalId") {
+		return "", false
+	}
+	value, ok := compare.value.(string)
+	return value, ok
+}
+
+func matches(filter Filter, resource any) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	object, err := toMap(resource)
+	if err != nil {
+		return false, err
+	}
+	return filter.Match(object), nil
+}
+
+func excludesMembers(r *http.Request) bool {
+	for _, attr := range strings.Split(r.URL.Query().Get("excludedAttributes"), ",") {
+		if strings.EqualFold(strings.TrimSpace(attr), "members") {
+			return true
+		}
+	}
+	return false
+}
+
+// paginate applies the 1-based startIndex and count of RFC 7644 3.4.2.4.
+func paginate[T any](r *http.Request, resources []T) (*ListResponse[T], error) {
+	query := r.URL.Query()
+	startIndex, count := 1, defaultPageSize
+	if raw := query.Get("startIndex"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, NewError(http.StatusBadRequest, "invalidValue", "invalid startIndex %q", raw)
+		}
+		if value > 1 {
+			startIndex = value
+		}
+	}
+	if raw := query.Get("count"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, NewError(http.StatusBadRequest, "invalidValue", "invalid count %q", raw)
+		}
+		count = value
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > maxPageSize {
+		count = maxPageSize
+	}
+	page := make([]T, 0, count)
+	for i := startIndex - 1; i < len(resources) && len(page) < count; i++ {
+		page = append(page, resources[i])
+	}
+	return &ListResponse[T]{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}, nil
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v); err != nil {
+		return NewError(http.StatusBadRequest, "invalidSyntax", "invalid request body: %s", err)
+	}
+	return nil
+}
+
+func writeResult(w http.ResponseWriter, status int, result any, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	if status == http.StatusCreated {
+		if meta := locationOf(result); meta != "" {
+			w.Header().Set("Location", meta)
+		}
+	}
+	writeJSON(w, status, result)
+}
+
+func locationOf(result any) string {
+	switch resource := result.(type) {
+	case User:
+		return resource.Meta.Location
+	case Group:
+		return resource.Meta.Location
+	}
+	return ""
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var scimErr *Error
+	if !errors.As(err, &scimErr) {
+		scimErr = NewError(http.StatusInternalServerError, "", "%s", err)
+	}
+	writeJSON(w, scimErr.StatusCode(), scimErr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
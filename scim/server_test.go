@@ -0,0 +1,373 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/org-tools/manager"
+)
+
+func openLocal(t *testing.T) manager.Target {
+	t.Helper()
+	dsn := t.TempDir() + "/hub.db"
+	local, err := manager.InitTarget("local", func(v any) error {
+		return json.Unmarshal([]byte(`{"Platform":"local","Slug":"hub","FileDSN":"`+dsn+`"}`), v)
+	}, manager.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local
+}
+
+func newTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	return newTestServerWith(t, ServerOptions{Slug: "idp", BaseURL: "/scim/v2"})
+}
+
+func newTestServerWith(t *testing.T, options ServerOptions) http.Handler {
+	t.Helper()
+	server, err := NewServer(openLocal(t), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// call sends body to h and decodes the answer into a map, nil for empty ones.
+func call(t *testing.T, h http.Handler, method, path, body string) (int, map[string]any) {
+	t.Helper()
+	return callAs(t, h, "", method, path, body)
+}
+
+func callAs(t *testing.T, h http.Handler, token, method, path, body string) (int, map[string]any) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/scim+json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.Len() == 0 {
+		return w.Code, nil
+	}
+	var answer map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("%s %s answered %q: %v", method, path, w.Body.String(), err)
+	}
+	return w.Code, answer
+}
+
+func TestServerDeactivatesUsers(t *testing.T) {
+	h := newTestServer(t)
+	status, created := call(t, h, http.MethodPost, "/Users", `{"userName":"ann@example.com","active":false}`)
+	if status != http.StatusCreated || created["active"] != false {
+		t.Fatalf("created %d %v, want an inactive user", status, created)
+	}
+	id := created["id"].(string)
+	if _, got := call(t, h, http.MethodGet, "/Users/"+id, ""); got["active"] != false {
+		t.Errorf("served active=%v after creating it inactive", got["active"])
+	}
+	for _, tc := range []struct {
+		method, body string
+		active       bool
+	}{
+		{http.MethodPatch, `{"Operations":[{"op":"replace","path":"active","value":true}]}`, true},
+		{http.MethodPatch, `{"Operations":[{"op":"replace","value":{"active":false}}]}`, false},
+		{http.MethodPut, `{"userName":"ann@example.com","active":true}`, true},
+		{http.MethodPut, `{"userName":"ann@example.com","active":false}`, false},
+		// leaving active out keeps it
+		{http.MethodPut, `{"userName":"ann@example.com","displayName":"Ann"}`, false},
+	} {
+		status, got := call(t, h, tc.method, "/Users/"+id, tc.body)
+		if status != http.StatusOK || got["active"] != tc.active {
+			t.Errorf("%s %s: %d active=%v, want %v", tc.method, tc.body, status, got["active"], tc.active)
+		}
+		if _, got := call(t, h, http.MethodGet, "/Users/"+id, ""); got["active"] != tc.active {
+			t.Errorf("%s %s: served active=%v, want %v", tc.method, tc.body, got["active"], tc.active)
+		}
+	}
+}
+
+func TestServerAuthorizesBearerTokens(t *testing.T) {
+	h := newTestServerWith(t, ServerOptions{Slug: "idp", Token: "s3cret"})
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"s3cret0", http.StatusUnauthorized},
+		{"s3cret", http.StatusOK},
+	} {
+		if status, _ := callAs(t, h, tc.token, http.MethodGet, "/Users", ""); status != tc.status {
+			t.Errorf("token %q: %d, want %d", tc.token, status, tc.status)
+		}
+	}
+}
+
+func TestNewServerChecksSlug(t *testing.T) {
+	for _, slug := range []string{"", "a.b", "a@b"} {
+		if _, err := NewServer(openLocal(t), ServerOptions{Slug: slug}); err == nil {
+			t.Errorf("slug %q was taken", slug)
+		}
+	}
+}
+
+// step is a request of a scenario, $name in its path and body is the id
+// saved by an earlier step.
+type step struct {
+	method, path, body string
+	status             int
+	// save keeps the id answered under this name
+	save string
+	// want are fields of the answer, dotted paths like meta.location index
+	// into objects and lists
+	want map[string]any
+}
+
+func runSteps(t *testing.T, h http.Handler, steps []step) {
+	t.Helper()
+	ids := make(map[string]string)
+	expand := func(s string) string {
+		for name, id := range ids {
+			s = strings.ReplaceAll(s, "$"+name, id)
+		}
+		return s
+	}
+	for i, step := range steps {
+		path, body := expand(step.path), expand(step.body)
+		status, answer := call(t, h, step.method, path, body)
+		if status != step.status {
+			t.Fatalf("step %d %s %s %s: %d %v, want %d", i, step.method, path, body, status, answer, step.status)
+		}
+		if step.save != "" {
+			ids[step.save], _ = answer["id"].(string)
+		}
+		for field, want := range step.want {
+			if want, ok := want.(string); ok {
+				if got := fieldOf(answer, field); got != expand(want) {
+					t.Errorf("step %d %s %s: %s is %v, want %v", i, step.method, path, field, got, expand(want))
+				}
+				continue
+			}
+			if got := fieldOf(answer, field); got != want {
+				t.Errorf("step %d %s %s: %s is %v, want %v", i, step.method, path, field, got, want)
+			}
+		}
+	}
+}
+
+func fieldOf(answer any, field string) any {
+	keys := strings.Split(field, ".")
+	for len(keys) != 0 {
+		switch value := answer.(type) {
+		case map[string]any:
+			// extension URNs have dots too, the longest key present wins
+			n := len(keys)
+			for ; n > 1; n-- {
+				if _, ok := value[strings.Join(keys[:n], ".")]; ok {
+					break
+				}
+			}
+			answer, keys = value[strings.Join(keys[:n], ".")], keys[n:]
+		case []any:
+			i, err := strconv.Atoi(keys[0])
+			if err != nil || i >= len(value) {
+				return nil
+			}
+			answer, keys = value[i], keys[1:]
+		default:
+			return nil
+		}
+	}
+	if list, ok := answer.([]any); ok {
+		return len(list)
+	}
+	return answer
+}
+
+func TestServerUsers(t *testing.T) {
+	runSteps(t, newTestServer(t), []step{
+		{method: "POST", path: "/Users", body: `{"userName":"ann@example.com","externalId":"A-1","displayName":"Ann"}`,
+			status: http.StatusCreated, save: "ann", want: map[string]any{
+				"userName": "ann@example.com", "externalId": "A-1", "displayName": "Ann", "active": true,
+				"emails.0.value": "ann@example.com", "emails.0.primary": true, "meta.location": "/scim/v2/Users/$ann",
+			}},
+		{method: "POST", path: "/Users", body: `{"userName":"bob","name":{"givenName":"Bob","familyName":"Jones"},
+			"phoneNumbers":[{"value":"+1 555 0100"}]}`,
+			status: http.StatusCreated, save: "bob", want: map[string]any{
+				"userName": "Bob Jones", "displayName": "Bob Jones", "phoneNumbers.0.value": "+1 555 0100",
+			}},
+		// userName and externalId stay unique, userName case-insensitively
+		{method: "POST", path: "/Users", body: `{"userName":"ANN@example.com"}`, status: http.StatusConflict,
+			want: map[string]any{"scimType": "uniqueness"}},
+		{method: "POST", path: "/Users", body: `{"userName":"cid@example.com","externalId":"A-1"}`, status: http.StatusConflict},
+		{method: "POST", path: "/Users", body: `{"userName":"  "}`, status: http.StatusBadRequest},
+		{method: "GET", path: "/Users/$ann", status: http.StatusOK, want: map[string]any{"id": "$ann", "name.formatted": "Ann"}},
+		{method: "GET", path: "/Users?filter=" + url.QueryEscape(`externalId eq "A-1"`), status: http.StatusOK,
+			want: map[string]any{"totalResults": 1.0, "Resources.0.id": "$ann"}},
+		{method: "GET", path: "/Users?filter=" + url.QueryEscape(`externalId eq "a-1"`), status: http.StatusOK,
+			want: map[string]any{"totalResults": 0.0}},
+		{method: "GET", path: "/Users?filter=" + url.QueryEscape(`emails[value ew "@example.com"]`), status: http.StatusOK,
+			want: map[string]any{"totalResults": 1.0, "Resources.0.id": "$ann"}},
+		{method: "GET", path: "/Users", status: http.StatusOK, want: map[string]any{"totalResults": 2.0, "Resources": 2}},
+		{method: "GET", path: "/Users?startIndex=2&count=5", status: http.StatusOK,
+			want: map[string]any{"totalResults": 2.0, "startIndex": 2.0, "itemsPerPage": 1.0}},
+		{method: "GET", path: "/Users?count=0", status: http.StatusOK, want: map[string]any{"itemsPerPage": 0.0}},
+		{method: "GET", path: "/Users?startIndex=9", status: http.StatusOK, want: map[string]any{"itemsPerPage": 0.0}},
+		{method: "PUT", path: "/Users/$bob", body: `{"userName":"bob@example.com","displayName":"Bobby","externalId":"B-1"}`,
+			status: http.StatusOK, want: map[string]any{"userName": "bob@example.com", "displayName": "Bobby", "externalId": "B-1"}},
+		{method: "PUT", path: "/Users/$bob", body: `{"userName":"ann@example.com"}`, status: http.StatusConflict},
+		{method: "PATCH", path: "/Users/$bob", body: `{"Operations":[
+			{"op":"replace","path":"displayName","value":"Robert"},
+			{"op":"add","path":"emails","value":[{"value":"rob@example.com","type":"home"}]},
+			{"op":"replace","path":"phoneNumbers[type eq \"work\"].value","value":"+1 555 0199"}]}`,
+			status: http.StatusOK, want: map[string]any{
+				"displayName": "Robert", "emails": 2, "emails.1.value": "rob@example.com", "phoneNumbers.0.value": "+1 555 0199",
+			}},
+		{method: "PATCH", path: "/Users/$bob", body: `{"Operations":[{"op":"remove","path":"externalId"}]}`,
+			status: http.StatusOK, want: map[string]any{"externalId": nil}},
+		{method: "PATCH", path: "/Users/$bob", body: `{"Operations":[{"op":"replace","path":"id","value":"other"}]}`,
+			status: http.StatusBadRequest, want: map[string]any{"scimType": "mutability"}},
+		{method: "DELETE", path: "/Users/$bob", status: http.StatusNoContent},
+		{method: "GET", path: "/Users/$bob", status: http.StatusNotFound},
+		{method: "DELETE", path: "/Users/$bob", status: http.StatusNotFound},
+		{method: "PUT", path: "/Users/$bob", body: `{"userName":"bob@example.com"}`, status: http.StatusNotFound},
+	})
+}
+
+func TestServerGroups(t *testing.T) {
+	runSteps(t, newTestServer(t), []step{
+		{method: "POST", path: "/Users", body: `{"userName":"ann@example.com"}`, status: http.StatusCreated, save: "ann"},
+		{method: "GET", path: "/Groups", status: http.StatusOK, save: "", want: map[string]any{"totalResults": 1.0}},
+		{method: "GET", path: "/Groups?filter=" + url.QueryEscape(`displayName eq "root"`), status: http.StatusOK,
+			want: map[string]any{"totalResults": 1.0}},
+		{method: "POST", path: "/Groups", body: `{"displayName":"Eng","externalId":"G-1","members":[{"value":"$ann"}],
+			"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":{"description":"builds"}}`,
+			status: http.StatusCreated, save: "eng", want: map[string]any{
+				"displayName": "Eng", "externalId": "G-1", "members": 1, "members.0.value": "$ann", "members.0.type": "User",
+				"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group.description": "builds",
+			}},
+		{method: "POST", path: "/Groups", body: `{"displayName":"eng"}`, status: http.StatusConflict},
+		{method: "POST", path: "/Groups", body: `{"displayName":"Ops","externalId":"G-1"}`, status: http.StatusConflict},
+		{method: "POST", path: "/Groups", body: `{"displayName":"Infra",
+			"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":{"parent":{"value":"$eng"}}}`,
+			status: http.StatusCreated, save: "infra", want: map[string]any{
+				"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group.parent.value": "$eng",
+			}},
+		{method: "GET", path: "/Groups/$eng", status: http.StatusOK, want: map[string]any{"members": 2, "members.1.type": "Group"}},
+		{method: "GET", path: "/Groups/$eng?excludedAttributes=members", status: http.StatusOK, want: map[string]any{"members": nil}},
+		// groups are moved by their parent, not added as members
+		{method: "POST", path: "/Groups", body: `{"displayName":"Ops","members":[{"value":"$infra","type":"Group"}]}`,
+			status: http.StatusBadRequest},
+		{method: "POST", path: "/Groups", body: `{"displayName":"Ops","members":[{"value":"nobody","type":"User"}]}`,
+			status: http.StatusBadRequest},
+		{method: "POST", path: "/Groups", body: `{"displayName":" "}`, status: http.StatusBadRequest},
+		{method: "POST", path: "/Groups", body: `{"displayName":"Ops",
+			"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":{"parent":{"value":"nowhere"}}}`,
+			status: http.StatusBadRequest},
+		{method: "PATCH", path: "/Groups/$eng", body: `{"Operations":[
+			{"op":"replace","path":"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group:parent.value","value":"$infra"}]}`,
+			status: http.StatusBadRequest},
+		{method: "PATCH", path: "/Groups/$eng", body: `{"Operations":[{"op":"remove","path":"members[value eq \"$ann\"]"}]}`,
+			status: http.StatusOK, want: map[string]any{"members": 1}},
+		{method: "PATCH", path: "/Groups/$eng", body: `{"Operations":[{"op":"add","path":"members","value":[{"value":"$ann"}]}]}`,
+			status: http.StatusOK, want: map[string]any{"members": 2}},
+		// Azure AD removes members by value
+		{method: "PATCH", path: "/Groups/$eng", body: `{"Operations":[{"op":"remove","path":"members","value":[{"value":"$ann"}]}]}`,
+			status: http.StatusOK, want: map[string]any{"members": 1}},
+		{method: "PATCH", path: "/Groups/$infra", body: `{"Operations":[{"op":"replace","value":{"displayName":"Platform",
+			"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":{"parent":{"value":""}}}}]}`,
+			status: http.StatusOK, want: map[string]any{
+				"displayName": "Platform",
+				"urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group.parent.value": "$eng",
+			}},
+		{method: "PUT", path: "/Groups/$eng", body: `{"displayName":"Engineering"}`, status: http.StatusOK,
+			want: map[string]any{"displayName": "Engineering", "members": 1}},
+		{method: "DELETE", path: "/Groups/$eng", status: http.StatusBadRequest},
+		{method: "DELETE", path: "/Groups/$infra", status: http.StatusNoContent},
+		{method: "DELETE", path: "/Groups/$eng", status: http.StatusNoContent},
+		{method: "GET", path: "/Groups/$eng", status: http.StatusNotFound},
+	})
+}
+
+func TestServerRejectsMalformedRequests(t *testing.T) {
+	h := newTestServer(t)
+	status, ann := call(t, h, http.MethodPost, "/Users", `{"userName":"ann@example.com"}`)
+	if status != http.StatusCreated {
+		t.Fatal(status, ann)
+	}
+	status, root := call(t, h, http.MethodGet, "/Groups?filter="+url.QueryEscape(`displayName eq "root"`), "")
+	if status != http.StatusOK {
+		t.Fatal(status, root)
+	}
+	user := "/Users/" + ann["id"].(string)
+	group := "/Groups/" + fieldOf(root, "Resources.0.id").(string)
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/Nothing", "", http.StatusNotFound},
+		{"GET", "/Users/a.b", "", http.StatusNotFound},
+		{"GET", "/Users/a@b", "", http.StatusNotFound},
+		{"GET", "/Users/a/b", "", http.StatusNotFound},
+		{"GET", "/Users/not-a-uuid", "", http.StatusNotFound},
+		{"POST", "/Schemas", "{}", http.StatusMethodNotAllowed},
+		{"POST", user, "{}", http.StatusMethodNotAllowed},
+		{"DELETE", "/Users", "", http.StatusMethodNotAllowed},
+		{"GET", "/Users?filter=" + url.QueryEscape(`userName eq`), "", http.StatusBadRequest},
+		{"GET", "/Groups?filter=" + url.QueryEscape(`(`), "", http.StatusBadRequest},
+		{"GET", "/Users?startIndex=x", "", http.StatusBadRequest},
+		{"GET", "/Users?count=x", "", http.StatusBadRequest},
+		{"GET", "/Users?count=-1&startIndex=-5", "", http.StatusOK},
+		{"POST", "/Users", "", http.StatusBadRequest},
+		{"POST", "/Users", "{", http.StatusBadRequest},
+		{"POST", "/Users", "[]", http.StatusBadRequest},
+		{"POST", "/Users", `{"userName":1}`, http.StatusBadRequest},
+		{"POST", "/Users", `{"userName":"x","active":"no"}`, http.StatusBadRequest},
+		{"POST", "/Users", `{"userName":"x","emails":"x@example.com"}`, http.StatusBadRequest},
+		{"POST", "/Users", `{"userName":"` + strings.Repeat("x", maxBodySize) + `"}`, http.StatusBadRequest},
+		{"PUT", user, `{"userName":null}`, http.StatusBadRequest},
+		{"PATCH", user, `{"Operations":{}}`, http.StatusBadRequest},
+		{"PATCH", user, `{"Operations":[{"op":"replace","path":"emails","value":"x"}]}`, http.StatusBadRequest},
+		{"PATCH", user, `{"Operations":[{"op":"replace","path":"active","value":"no"}]}`, http.StatusBadRequest},
+		{"PATCH", user, `{"Operations":[{"op":"replace","path":"userName","value":""}]}`, http.StatusBadRequest},
+		{"PATCH", user, `{"Operations":[{"op":"replace","path":"meta","value":1}]}`, http.StatusBadRequest},
+		{"PATCH", user, `{"Operations":[{"op":"add","path":"emails[type eq","value":"x"}]}`, http.StatusBadRequest},
+		{"POST", "/Groups", `{"displayName":"x","members":"all"}`, http.StatusBadRequest},
+		{"POST", "/Groups", `{"displayName":"x","urn:org-tools:params:scim:schemas:extension:hierarchy:2.0:Group":[]}`, http.StatusBadRequest},
+		{"PATCH", group, `{"Operations":[{"op":"replace","path":"members","value":[1]}]}`, http.StatusBadRequest},
+		{"PATCH", group, `{"Operations":[{"op":"remove","path":"displayName"}]}`, http.StatusBadRequest},
+		{"DELETE", group, "", http.StatusBadRequest},
+	} {
+		if status, answer := call(t, h, tc.method, tc.path, tc.body); status != tc.status {
+			t.Errorf("%s %s %.80s: %d %v, want %d", tc.method, tc.path, tc.body, status, answer, tc.status)
+		}
+	}
+}
+
+func TestServerServesStaticResources(t *testing.T) {
+	h := newTestServer(t)
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/ServiceProviderConfig", http.StatusOK},
+		{"/ResourceTypes", http.StatusOK},
+		{"/ResourceTypes/User", http.StatusOK},
+		{"/ResourceTypes/Nothing", http.StatusNotFound},
+		{"/Schemas", http.StatusOK},
+		{"/Schemas/" + SchemaUser, http.StatusNotFound},
+		{"/ServiceProviderConfig/x", http.StatusNotFound},
+	} {
+		if status, answer := call(t, h, http.MethodGet, tc.path, ""); status != tc.status {
+			t.Errorf("%s: %d %v, want %d", tc.path, status, answer, tc.status)
+		}
+	}
+}
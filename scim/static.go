@@ -0,0 +1,82 @@
+package scim
+
+import (
+	"net/http"
+)
+
+// serviceProviderConfig advertises what the server supports, RFC 7643 5.
+var serviceProviderConfig = map[string]any{
+	"schemas":        []string{SchemaServiceProviderConfig},
+	"patch":          map[string]any{"supported": true},
+	"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+	"filter":         map[string]any{"supported": true, "maxResults": maxPageSize},
+	"changePassword": map[string]any{"supported": false},
+	"sort":           map[string]any{"supported": false},
+	"etag":           map[string]any{"supported": false},
+	"authenticationSchemes": []map[string]any{{
+		"type":        "oauthbearertoken",
+		"name":        "Bearer Token",
+		"description": "Authentication with a static bearer token",
+	}},
+}
+
+type staticResource struct {
+	id       string
+	resource map[string]any
+}
+
+var resourceTypes = []staticResource{
+	{id: "User", resource: map[string]any{
+		"schemas":  []string{SchemaResourceType},
+		"id":       "User",
+		"name":     "User",
+		"endpoint": "/Users",
+		"schema":   SchemaUser,
+	}},
+	{id: "Group", resource: map[string]any{
+		"schemas":  []string{SchemaResourceType},
+		"id":       "Group",
+		"name":     "Group",
+		"endpoint": "/Groups",
+		"schema":   SchemaGroup,
+		"schemaExtensions": []map[string]any{{
+			"schema":   SchemaGroupHierarchy,
+			"required": false,
+		}},
+	}},
+}
+
+// schemas only names the schemas, attribute definitions are left out as
+// clients we met configure their mappings by hand anyway.
+var schemas = []staticResource{
+	{id: SchemaUser, resource: map[string]any{"id": SchemaUser, "name": "User"}},
+	{id: SchemaGroup, resource: map[string]any{"id": SchemaGroup, "name": "Group"}},
+	{id: SchemaGroupHierarchy, resource: map[string]any{
+		"id":          SchemaGroupHierarchy,
+		"name":        "GroupHierarchy",
+		"description": "Parent group and description of a group",
+	}},
+}
+
+func serveStatic(w http.ResponseWriter, id string, resources []staticResource) {
+	if id != "" {
+		for _, resource := range resources {
+			if resource.id == id {
+				writeJSON(w, http.StatusOK, resource.resource)
+				return
+			}
+		}
+		writeError(w, NewError(http.StatusNotFound, "", "%s not found", id))
+		return
+	}
+	list := &ListResponse[map[string]any]{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+	}
+	for _, resource := range resources {
+		list.Resources = append(list.Resources, resource.resource)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
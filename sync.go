@@ -0,0 +1,166 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/samber/lo"
+)
+
+type SyncResult struct {
+	Users   int
+	Uniq    int
+	Created int
+	Merged  int
+	Linked  int
+	Errors  []error
+}
+
+// SyncUsers creates every user of source missing in destination and merges
+// the ones destination can already find. A UserBulkWriteable destination is
+// synced in bulk and also gets the extID of each source user stored.
+func SyncUsers(ctx context.Context, source Target, destination Target) (result SyncResult, err error) {
+	writeable, ok := As[UserWriteable](destination)
+	if !ok {
+		return result, notSupported(destination, "write users")
+	}
+	users, err := GetAllUsersContext(ctx, source)
+	if err != nil {
+		return result, err
+	}
+	result.Users = len(users)
+	users = Uniq(users)
+	result.Uniq = len(users)
+	if bulk, ok := As[UserBulkWriteable](destination); ok {
+		syncUsersBulk(destination, bulk, users, &result)
+		return result, nil
+	}
+	for _, user := range users {
+		synced, err := syncUser(destination, writeable, user, &result)
+		if err != nil {
+			result.Errors = append(result.Errors, syncUserError(user, err))
+			continue
+		}
+		if storeable, ok := As[EntryExtIDStoreable](synced); ok &&
+			lo.Contains(storeable.GetExternalIdentities(), ExternalIdentityOfEntry(user)) {
+			result.Linked++
+		}
+	}
+	return result, nil
+}
+
+func syncUserError(user UserableEntry, err error) error {
+	return fmt.Errorf("sync user %s(%s): %w", user.GetName(), user.GetID(), err)
+}
+
+func syncUser(destination Target, writeable UserWriteable, user UserableEntry, result *SyncResult) (UserableEntry, error) {
+	var got UserableEntry
+	err := Do(destination, Call{Operation: "lookup_user"}, func() (err error) {
+		got, err = writeable.LookupUser(user)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if got == nil {
+		var created UserableEntry
+		err = Do(destination, Call{Operation: "create_user", Write: true}, func() (err error) {
+			created, err = writeable.CreateUser(user)
+			return err
+		})
+		if err == nil {
+			result.Created++
+		}
+		return created, err
+	}
+	return mergeUser(got, user, result)
+}
+
+func mergeUser(got UserableEntry, user UserableEntry, result *SyncResult) (UserableEntry, error) {
+	mergeable, ok := As[UserableCanMerge](got)
+	if !ok {
+		return got, nil
+	}
+	err := Do(got, Call{Operation: "merge_user", Write: true}, func() error {
+		return mergeable.Merge(user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Merged++
+	return got, nil
+}
+
+// syncUsersBulk looks up all users, creates the missing ones and then adds
+// the extID of the source user to every synced user lacking it.
+// The bulk calls are not retried as a whole, a failure of one user says
+// nothing about the others and drivers retry throttled parts themselves.
+func syncUsersBulk(destination Target, bulk UserBulkWriteable, users []UserableEntry, result *SyncResult) {
+	options := lo.Map(users, func(user UserableEntry, _ int) Userable { return user })
+	synced := make([]UserableEntry, len(users))
+	found, errs := bulk.LookupUsers(options)
+	var missing []int
+	for i, user := range users {
+		switch {
+		case errs[i] != nil:
+			result.Errors = append(result.Errors, syncUserError(user, errs[i]))
+		case found[i] == nil:
+			missing = append(missing, i)
+		default:
+			merged, err := mergeUser(found[i], user, result)
+			if err != nil {
+				result.Errors = append(result.Errors, syncUserError(user, err))
+				continue
+			}
+			synced[i] = merged
+		}
+	}
+	created, errs := make([]UserableEntry, len(missing)), make([]error, len(missing))
+	err := Do(destination, Call{Operation: "create_users", Write: true}, func() error {
+		created, errs = bulk.CreateUsers(lo.Map(missing, func(i int, _ int) Userable { return options[i] }))
+		return nil
+	})
+	if err != nil {
+		errs = lo.Map(errs, func(error, int) error { return err })
+	}
+	for j, i := range missing {
+		if errs[j] != nil {
+			result.Errors = append(result.Errors, syncUserError(users[i], errs[j]))
+			continue
+		}
+		synced[i] = created[j]
+		result.Created++
+	}
+	var unlinked []int
+	var toLink []UserableEntry
+	var extIDs []ExternalIdentities
+	for i, user := range synced {
+		storeable, ok := As[EntryExtIDStoreable](user)
+		if !ok {
+			continue
+		}
+		extID := ExternalIdentityOfEntry(users[i])
+		if lo.Contains(storeable.GetExternalIdentities(), extID) {
+			result.Linked++
+			continue
+		}
+		unlinked = append(unlinked, i)
+		toLink = append(toLink, user)
+		extIDs = append(extIDs, append(storeable.GetExternalIdentities(), extID))
+	}
+	errs = make([]error, len(toLink))
+	err = Do(destination, Call{Operation: "set_external_identities", Write: true}, func() error {
+		errs = bulk.SetExternalIdentitiesOf(toLink, extIDs)
+		return nil
+	})
+	if err != nil {
+		errs = lo.Map(errs, func(error, int) error { return err })
+	}
+	for k, err := range errs {
+		if err != nil {
+			result.Errors = append(result.Errors, syncUserError(users[unlinked[k]], err))
+			continue
+		}
+		result.Linked++
+	}
+}
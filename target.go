@@ -4,21 +4,37 @@ import (
 	"errors"
 	"fmt"
 	"path"
+	"reflect"
 )
 
 type Platform interface {
 	InitFormUnmarshaler(unmarshaler func(any) error) (Target, error)
 }
 
-var enabledPlatform = make(map[string]Platform)
+// local is built in, the drivers register themselves from their init funcs
+// before the root command loads the targets.
+var enabledPlatform = map[string]Platform{
+	"local": &local{},
+}
 
 func RegisterPlatform(name string, platform Platform) {
 	enabledPlatform[name] = platform
 }
 
-func InitTarget(platformKey string, unmarshaler func(any) error) (Target, error) {
+func InitTarget(platformKey string, unmarshaler func(any) error, logger Logger) (Target, error) {
 	if p, exist := enabledPlatform[platformKey]; exist {
+		// platforms are registered as zero values, every target of a
+		// platform gets its own copy so configs do not overwrite each other
+		if t := reflect.TypeOf(p); t.Kind() == reflect.Pointer {
+			p = reflect.New(t.Elem()).Interface().(Platform)
+		}
+		if setter, ok := p.(LoggerSetter); ok {
+			setter.SetLogger(logger)
+		}
 		target, err := p.InitFormUnmarshaler(unmarshaler)
+		if err != nil {
+			return nil, err
+		}
 		if target.GetPlatform() == "" || target.GetTargetSlug() == "" {
 			err = fmt.Errorf("Platform Or Slug of %s config not exist", path.Ext(platformKey))
 		}
@@ -67,7 +83,7 @@ func GetTargetByPlatformAndSlug(platform, slug string) (Target, error) {
 			return target, nil
 		}
 	}
-	return nil, errors.New("target not found")
+	return nil, NotFound(errors.New("target not found"))
 }
 
 type Config struct {
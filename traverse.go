@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var DefaultTraverseWorkers = 8
+
+type TraverseOptions struct {
+	Workers int
+}
+
+// TargetWithTraversal is a target whose GetAllUsers walks its departments,
+// decorators walk them on their own so every department call goes through
+// the decorator.
+type TargetWithTraversal interface {
+	GetTraverseOptions() TraverseOptions
+}
+
+// UserListerWithContext is a target whose user listing stops once ctx is
+// done, GetAllUsers is the same listing without a deadline.
+type UserListerWithContext interface {
+	GetAllUsersContext(ctx context.Context) ([]UserableEntry, error)
+}
+
+// GetAllUsersContext lists the users of target with ctx when it supports it.
+func GetAllUsersContext(ctx context.Context, target Target) ([]UserableEntry, error) {
+	if lister, ok := As[UserListerWithContext](target); ok {
+		return lister.GetAllUsersContext(ctx)
+	}
+	return target.GetAllUsers()
+}
+
+type BranchError struct {
+	Department DepartmentableEntry
+	Err        error
+}
+
+func (e BranchError) Error() string {
+	return fmt.Sprintf("department %s(%s): %s", e.Department.GetName(), e.Department.GetID(), e.Err)
+}
+
+func (e BranchError) Unwrap() error {
+	return e.Err
+}
+
+// TraverseError collects the failures of every branch, users from the
+// branches that did succeed are still returned next to it.
+type TraverseError []BranchError
+
+func (e TraverseError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, branchErr := range e {
+		msgs = append(msgs, branchErr.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type traverseResult struct {
+	path  []int
+	users []UserableEntry
+	err   *BranchError
+}
+
+// ConcurrentGetAllUsersIncludeChildDepartments returns the same users in the
+// same order as RecursionGetAllUsersIncludeChildDepartments, deduplicated,
+// while fetching up to options.Workers departments at once. A department
+// without a free worker is walked by the goroutine that found it, so the walk
+// never runs more than options.Workers goroutines. Once ctx is done every
+// department reached is reported as a BranchError of ctx.Err() instead of
+// being fetched, the children of those are never listed.
+func ConcurrentGetAllUsersIncludeChildDepartments(ctx context.Context, department DepartmentableEntry, options TraverseOptions) ([]UserableEntry, error) {
+	workers := options.Workers
+	if workers <= 0 {
+		workers = DefaultTraverseWorkers
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sem     = make(chan struct{}, workers-1)
+		results []traverseResult
+		visit   func(department DepartmentableEntry, path []int)
+	)
+	visit = func(department DepartmentableEntry, path []int) {
+		if err := ctx.Err(); err != nil {
+			mu.Lock()
+			results = append(results, traverseResult{path: path, err: &BranchError{Department: department, Err: err}})
+			mu.Unlock()
+			return
+		}
+		users, err := department.GetUsers()
+		children := department.GetChildDepartments()
+		result := traverseResult{path: path, users: users}
+		if err != nil {
+			result.err = &BranchError{Department: department, Err: err}
+		}
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+		for i, child := range children {
+			child, childPath := child, append(append(make([]int, 0, len(path)+1), path...), i)
+			select {
+			case sem <- struct{}{}:
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					visit(child, childPath)
+				}()
+			default:
+				visit(child, childPath)
+			}
+		}
+	}
+	visit(department, nil)
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return lessPath(results[i].path, results[j].path)
+	})
+	users := make([]UserableEntry, 0)
+	var errs TraverseError
+	for _, result := range results {
+		users = append(users, result.users...)
+		if result.err != nil {
+			errs = append(errs, *result.err)
+		}
+	}
+	users = Uniq(users)
+	if len(errs) != 0 {
+		return users, errs
+	}
+	return users, nil
+}
+
+func lessPath(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,196 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+type traverseUser struct{ id string }
+
+func (u traverseUser) GetID() string         { return u.id }
+func (u traverseUser) GetTarget() Target     { return nil }
+func (u traverseUser) GetTargetSlug() string { return "test" }
+func (u traverseUser) GetPlatform() string   { return "test" }
+func (u traverseUser) GetName() string       { return u.id }
+func (u traverseUser) GetEmail() string      { return "" }
+func (u traverseUser) GetPhone() string      { return "" }
+
+type traverseDepartment struct {
+	id       string
+	users    []string
+	children []*traverseDepartment
+	err      error
+	delay    time.Duration
+	onFetch  func()
+	fetched  *int32
+}
+
+func (d *traverseDepartment) GetID() string          { return d.id }
+func (d *traverseDepartment) GetTarget() Target      { return nil }
+func (d *traverseDepartment) GetTargetSlug() string  { return "test" }
+func (d *traverseDepartment) GetPlatform() string    { return "test" }
+func (d *traverseDepartment) GetName() string        { return d.id }
+func (d *traverseDepartment) GetDescription() string { return "" }
+
+func (d *traverseDepartment) GetChildDepartments() []DepartmentableEntry {
+	return lo.Map(d.children, func(child *traverseDepartment, _ int) DepartmentableEntry {
+		return child
+	})
+}
+
+func (d *traverseDepartment) CreateChildDepartment(Departmentable) (DepartmentableEntry, error) {
+	return nil, ErrNotSupported
+}
+
+func (d *traverseDepartment) GetUsers() ([]UserableEntry, error) {
+	if d.onFetch != nil {
+		d.onFetch()
+	}
+	if d.fetched != nil {
+		atomic.AddInt32(d.fetched, 1)
+	}
+	time.Sleep(d.delay)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return lo.Map(d.users, func(id string, _ int) UserableEntry {
+		return traverseUser{id: id}
+	}), nil
+}
+
+// wideTree builds a root with fanout children of fanout children each, the
+// users of every department are its own ID and the ID shared with its parent.
+func wideTree(fanout int, delay time.Duration) *traverseDepartment {
+	root := &traverseDepartment{id: "root", users: []string{"root", "shared"}, delay: delay}
+	for i := 0; i < fanout; i++ {
+		child := &traverseDepartment{id: fmt.Sprint("d", i), delay: delay}
+		child.users = []string{child.id, "shared"}
+		for j := 0; j < fanout; j++ {
+			grandchild := &traverseDepartment{id: fmt.Sprint(child.id, ".", j), delay: delay}
+			grandchild.users = []string{grandchild.id, child.id}
+			child.children = append(child.children, grandchild)
+		}
+		root.children = append(root.children, child)
+	}
+	return root
+}
+
+func userIDs(users []UserableEntry) []string {
+	return lo.Map(users, func(user UserableEntry, _ int) string {
+		return user.GetID()
+	})
+}
+
+func TestConcurrentGetAllUsersOrderAndDedup(t *testing.T) {
+	root := wideTree(5, time.Millisecond)
+	expected, err := RecursionGetAllUsersIncludeChildDepartments(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedIDs := userIDs(Uniq(expected))
+	for _, workers := range []int{1, 3, 32} {
+		users, err := ConcurrentGetAllUsersIncludeChildDepartments(context.Background(), root, TraverseOptions{Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := userIDs(users)
+		if fmt.Sprint(ids) != fmt.Sprint(expectedIDs) {
+			t.Errorf("workers %d: got %v, want %v", workers, ids, expectedIDs)
+		}
+		if len(lo.Uniq(ids)) != len(ids) {
+			t.Errorf("workers %d: duplicated users %v", workers, ids)
+		}
+	}
+}
+
+func TestConcurrentGetAllUsersBoundsWorkers(t *testing.T) {
+	root := wideTree(6, 2*time.Millisecond)
+	var (
+		running, peak int32
+		mu            sync.Mutex
+	)
+	var walk func(department *traverseDepartment)
+	walk = func(department *traverseDepartment) {
+		department.onFetch = func() {
+			now := atomic.AddInt32(&running, 1)
+			mu.Lock()
+			if now > peak {
+				peak = now
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}
+		for _, child := range department.children {
+			walk(child)
+		}
+	}
+	walk(root)
+	if _, err := ConcurrentGetAllUsersIncludeChildDepartments(context.Background(), root, TraverseOptions{Workers: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if peak > 3 {
+		t.Errorf("%d departments fetched at once, want at most 3", peak)
+	}
+}
+
+func TestConcurrentGetAllUsersAggregatesErrors(t *testing.T) {
+	root := wideTree(3, 0)
+	failFirst, failLast := errors.New("first failed"), errors.New("last failed")
+	root.children[2].err = failLast
+	root.children[0].children[1].err = failFirst
+
+	users, err := ConcurrentGetAllUsersIncludeChildDepartments(context.Background(), root, TraverseOptions{Workers: 4})
+	var traverseErr TraverseError
+	if !errors.As(err, &traverseErr) {
+		t.Fatalf("got %v, want a TraverseError", err)
+	}
+	if len(traverseErr) != 2 || traverseErr[0].Department.GetID() != "d0.1" || traverseErr[1].Department.GetID() != "d2" {
+		t.Fatalf("got %v, want the d0.1 and d2 failures in walk order", traverseErr)
+	}
+	if !errors.Is(traverseErr[0], failFirst) || !errors.Is(traverseErr[1], failLast) {
+		t.Errorf("branch errors do not unwrap to their causes: %v", traverseErr)
+	}
+	ids := userIDs(users)
+	for _, id := range []string{"root", "d0", "d0.0", "d1", "d2.0"} {
+		if !lo.Contains(ids, id) {
+			t.Errorf("users of the working branches lost, %s missing from %v", id, ids)
+		}
+	}
+}
+
+func TestConcurrentGetAllUsersStopsOnCanceledContext(t *testing.T) {
+	var fetched int32
+	root := wideTree(4, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	root.onFetch = cancel
+	var count func(department *traverseDepartment)
+	count = func(department *traverseDepartment) {
+		department.fetched = &fetched
+		for _, child := range department.children {
+			count(child)
+		}
+	}
+	count(root)
+
+	_, err := ConcurrentGetAllUsersIncludeChildDepartments(ctx, root, TraverseOptions{Workers: 2})
+	var traverseErr TraverseError
+	if !errors.As(err, &traverseErr) || len(traverseErr) != len(root.children) {
+		t.Fatalf("got %v, want context.Canceled for each child of the root", err)
+	}
+	for i, branchErr := range traverseErr {
+		if !errors.Is(branchErr, context.Canceled) || branchErr.Department != root.children[i] {
+			t.Errorf("got %v for child %d, want context.Canceled", branchErr, i)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("%d departments fetched after cancel, want only the root", fetched)
+	}
+}
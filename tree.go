@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"sort"
+)
+
+// TreeUser is a user as seen from one department of a TreeDepartment.
+type TreeUser struct {
+	ExtID ExternalIdentity `json:"extID" yaml:"extID"`
+	Name  string           `json:"name" yaml:"name"`
+	Email string           `json:"email,omitempty" yaml:"email,omitempty"`
+	Phone string           `json:"phone,omitempty" yaml:"phone,omitempty"`
+	Role  string           `json:"role,omitempty" yaml:"role,omitempty"`
+}
+
+// TreeDepartment is a plain snapshot of a department tree, children and
+// users are sorted so two snapshots of the same org compare equal.
+type TreeDepartment struct {
+	ExtID       ExternalIdentity  `json:"extID" yaml:"extID"`
+	Name        string            `json:"name" yaml:"name"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Users       []TreeUser        `json:"users,omitempty" yaml:"users,omitempty"`
+	Children    []*TreeDepartment `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+// SnapshotTree walks department with GetChildDepartments and GetUsers.
+func SnapshotTree(department DepartmentableEntry) (*TreeDepartment, error) {
+	node := &TreeDepartment{
+		ExtID:       ExternalIdentityOfEntry(department),
+		Name:        department.GetName(),
+		Description: department.GetDescription(),
+	}
+	users, err := department.GetUsers()
+	if err != nil {
+		return nil, BranchError{Department: department, Err: err}
+	}
+	for _, user := range Uniq(users) {
+		treeUser := TreeUser{
+			ExtID: ExternalIdentityOfEntry(user),
+			Name:  user.GetName(),
+			Email: user.GetEmail(),
+			Phone: user.GetPhone(),
+		}
+		if withRole, ok := user.(UserableWithRole); ok {
+			treeUser.Role = withRole.GetRole().String()
+		}
+		node.Users = append(node.Users, treeUser)
+	}
+	sort.Slice(node.Users, func(i, j int) bool {
+		if node.Users[i].Name != node.Users[j].Name {
+			return node.Users[i].Name < node.Users[j].Name
+		}
+		return node.Users[i].ExtID < node.Users[j].ExtID
+	})
+	for _, child := range department.GetChildDepartments() {
+		childNode, err := SnapshotTree(child)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, childNode)
+	}
+	sort.Slice(node.Children, func(i, j int) bool {
+		if node.Children[i].Name != node.Children[j].Name {
+			return node.Children[i].Name < node.Children[j].Name
+		}
+		return node.Children[i].ExtID < node.Children[j].ExtID
+	})
+	return node, nil
+}
+
+// Walk calls fn for node and all its descendants depth first, path holds
+// the names from the snapshot root down to the visited department.
+func (node *TreeDepartment) Walk(fn func(path []string, department *TreeDepartment)) {
+	node.walk(nil, fn)
+}
+
+func (node *TreeDepartment) walk(parent []string, fn func(path []string, department *TreeDepartment)) {
+	path := append(append(make([]string, 0, len(parent)+1), parent...), node.Name)
+	fn(path, node)
+	for _, child := range node.Children {
+		child.walk(path, fn)
+	}
+}
@@ -118,3 +118,44 @@ type UserWriteable interface {
 	CreateUser(options Userable) (UserableEntry, error)
 	LookupUser(options Userable) (UserableEntry, error)
 }
+
+// UserBulkWriteable looks up, creates and links many users per call,
+// results line up with the users passed in. SyncUsers prefers it.
+type UserBulkWriteable interface {
+	UserWriteable
+	// LookupUsers has nil entries, without error, for users not found.
+	LookupUsers(options []Userable) ([]UserableEntry, []error)
+	CreateUsers(options []Userable) ([]UserableEntry, []error)
+	SetExternalIdentitiesOf(users []UserableEntry, extIDs []ExternalIdentities) []error
+}
+
+// UserImporter updates the user matching options by email or phone, or
+// creates it, so importing the same list twice does not duplicate anyone.
+type UserImporter interface {
+	UpsertUser(options Userable) (user UserableEntry, created bool, err error)
+}
+
+// UserEditor replaces the fields of a user in place or deletes it, extID
+// should be internal to the target.
+type UserEditor interface {
+	UpdateUser(extID ExternalIdentity, options Userable) (UserableEntry, error)
+	DeleteUser(extID ExternalIdentity) error
+}
+
+var _ = []UserActivator{
+	&local{},
+}
+
+// UserActivator turns sign-in of a user on or off without deleting it,
+// extID should be internal to the target.
+type UserActivator interface {
+	ActivateUser(extID ExternalIdentity) error
+	DeactivateUser(extID ExternalIdentity) error
+}
+
+// UserableWithActive is a user of a UserActivator, IsActive is false while
+// it is turned off.
+type UserableWithActive interface {
+	Userable
+	IsActive() bool
+}
@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNotSupported = errors.New("not supported by target")
+
+// ErrNotFound matches, with errors.Is, the errors drivers return for
+// lookups of entries that do not exist, see NotFound.
+var ErrNotFound = errors.New("not found")
+
+type notFoundError struct {
+	err error
+}
+
+func (e notFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e notFoundError) Unwrap() error {
+	return e.err
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// NotFound marks err as the lookup of an entry that does not exist, telling
+// it apart from the target failing to answer.
+func NotFound(err error) error {
+	if err == nil {
+		return nil
+	}
+	return notFoundError{err: err}
+}
+
+// Unwrapper is implemented by decorators around targets and entries,
+// so callers can still discover what the wrapped value supports.
+type Unwrapper interface {
+	Unwrap() any
+}
+
+// As reports whether the innermost value behind v implements T and returns
+// the outermost value that does, so calls keep going through decorators.
+func As[T any](v any) (t T, ok bool) {
+	inner := v
+	for {
+		wrapper, isWrapper := inner.(Unwrapper)
+		if !isWrapper {
+			break
+		}
+		inner = wrapper.Unwrap()
+	}
+	if _, ok = inner.(T); !ok {
+		return t, false
+	}
+	if t, ok = v.(T); ok {
+		return t, ok
+	}
+	t, ok = inner.(T)
+	return t, ok
+}
+
+// Call describes a call made on an optional interface of a decorated value,
+// decorators retry it or drop what it outdates without implementing it.
+type Call struct {
+	Operation string
+	// Write calls change the directory, Idempotent ones may be repeated.
+	Write      bool
+	Idempotent bool
+}
+
+// Decorator is implemented by decorators around targets and entries,
+// Around runs fn with what the decorator adds to its own methods.
+type Decorator interface {
+	Unwrapper
+	Around(call Call, fn func() error) error
+}
+
+// Do runs fn, a call on an optional interface of v reached through As,
+// inside every decorator around v with the outermost one first.
+func Do(v any, call Call, fn func() error) error {
+	var decorators []Decorator
+	for inner := v; ; {
+		if decorator, ok := inner.(Decorator); ok {
+			decorators = append(decorators, decorator)
+		}
+		wrapper, ok := inner.(Unwrapper)
+		if !ok {
+			break
+		}
+		inner = wrapper.Unwrap()
+	}
+	for i := len(decorators) - 1; i >= 0; i-- {
+		decorator, next := decorators[i], fn
+		fn = func() error {
+			return decorator.Around(call, next)
+		}
+	}
+	return fn()
+}
+
+func notSupported(target Target, what string) error {
+	return fmt.Errorf("%s %s: %w", TargetKey(target), what, ErrNotSupported)
+}
+
+// bulkNotSupported is notSupported for each of n results of a bulk call.
+func bulkNotSupported(target Target, what string, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = notSupported(target, what)
+	}
+	return errs
+}